@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/cmdutils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// exportCmd represents the `export` command.
+// It is used to export images and charts to a bundle that can be carried to an air-gapped site.
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export images and charts to an OCI image layout bundle",
+	Long: `Pulls the images and charts of YAML files into a single OCI image layout, a directory or a tarball when the
+output ends with .tar, that can be carried to a site without access to the upstream registries.
+The charts are transformed for the target registry, and every artifact is tagged in the index of the layout with
+its reference in the target registry.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmdutils.Export(ctx, cmd)
+	},
+}
+
+// init initializes the `export` command and its flags.
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String("images", "", "Path to YAML file with list of container images")
+	_ = viper.BindPFlag("images", exportCmd.Flags().Lookup("images"))
+	exportCmd.Flags().String("charts", "", "Path to YAML file with list of Helm charts")
+	_ = viper.BindPFlag("charts", exportCmd.Flags().Lookup("charts"))
+	exportCmd.Flags().StringP("output", "o", "", "Path of the bundle, a directory or a tarball ending with .tar")
+	_ = viper.BindPFlag("output", exportCmd.Flags().Lookup("output"))
+	exportCmd.Flags().Bool("skip-chart-images", false, "Skip exporting the container images used by the Helm charts")
+	_ = viper.BindPFlag("skip_chart_images", exportCmd.Flags().Lookup("skip-chart-images"))
+	addDiscoveryFlags(exportCmd)
+	exportCmd.Flags().Bool("force", false, "Export the charts again even if they are up to date in the bundle")
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// sharedFlags maps the flags registered by several commands to their configuration key.
+// Viper binds a key to a single flag, so they are bound when a command runs instead of in init.
+var sharedFlags = map[string]string{
+	"lockfile":         "options.lockfile",
+	"locked":           "locked",
+	"discovery":        "options.discovery.mode",
+	"discovery-values": "options.discovery.values_files",
+	"force":            "force",
+}
+
+// addLockfileFlags registers the `--lockfile` and `--locked` flags of a command.
+func addLockfileFlags(cmd *cobra.Command, lockfileUsage, lockedUsage string) {
+	cmd.Flags().String("lockfile", "", lockfileUsage)
+	cmd.Flags().Bool("locked", false, lockedUsage)
+}
+
+// addDiscoveryFlags registers the `--discovery` and `--discovery-values` flags of a command.
+func addDiscoveryFlags(cmd *cobra.Command) {
+	cmd.Flags().String("discovery", "", "How the images of the charts are found: scan, render or both (default scan)")
+	cmd.Flags().StringSlice("discovery-values", nil, "Values files the charts are also rendered with, when they are rendered")
+}
+
+// bindSharedFlags binds the shared flags of the command being run to their configuration key.
+// It returns an error if a flag cannot be bound.
+func bindSharedFlags(cmd *cobra.Command) error {
+	for name, key := range sharedFlags {
+		if flag := cmd.Flags().Lookup(name); flag != nil {
+			if err := viper.BindPFlag(key, flag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
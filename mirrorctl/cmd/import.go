@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/cmdutils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// importCmd represents the `import` command.
+// It is used to push a bundle written by the `export` command to the target registry.
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import an OCI image layout bundle into the target registry",
+	Long: `Pushes every image and chart of a bundle written by the export command, a directory or a tarball, to the
+target registry. Charts exported for another images repository are retargeted to the one of the target registry,
+and the digests pushed are checked against the index of the bundle.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmdutils.Import(ctx, cmd)
+	},
+}
+
+// init initializes the `import` command and its flags.
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().String("bundle", "", "Path of the bundle, a directory or a tarball ending with .tar")
+	_ = viper.BindPFlag("bundle", importCmd.Flags().Lookup("bundle"))
+}
@@ -2,15 +2,28 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // mirrorCmd represents the mirror command, which is the parent of all mirror subcommands.
 var mirrorCmd = &cobra.Command{
 	Use:   "mirror",
-	Short: "Mirror artifacts to Google Artifact Registry",
-	Long:  `Mirror Helm charts and/or container images to Google Artifact Registry (GAR).`,
+	Short: "Mirror artifacts to an OCI registry",
+	Long:  `Mirror Helm charts and/or container images to an OCI registry such as Google Artifact Registry (GAR), Harbor, Nexus, Artifactory, ECR, ACR or registry:2.`,
 }
 
 func init() {
 	rootCmd.AddCommand(mirrorCmd)
+	mirrorCmd.PersistentFlags().Int("concurrency", 0, "Number of images mirrored at the same time (default 4)")
+	_ = viper.BindPFlag("options.concurrency", mirrorCmd.PersistentFlags().Lookup("concurrency"))
+	mirrorCmd.PersistentFlags().StringSlice("platforms", nil, "Platforms of the images to mirror, e.g. linux/amd64,linux/arm64 (default all)")
+	_ = viper.BindPFlag("options.platforms", mirrorCmd.PersistentFlags().Lookup("platforms"))
+	mirrorCmd.PersistentFlags().Bool("copy-referrers", false, "Copy the signatures, attestations and SBOMs attached to the images")
+	_ = viper.BindPFlag("options.referrers.enabled", mirrorCmd.PersistentFlags().Lookup("copy-referrers"))
+	mirrorCmd.PersistentFlags().StringSlice("referrer-artifact-types", nil, "Artifact types of the referrers to copy (default all)")
+	_ = viper.BindPFlag("options.referrers.artifact_types", mirrorCmd.PersistentFlags().Lookup("referrer-artifact-types"))
+	mirrorCmd.PersistentFlags().String("verification", "", "Signature verification policy of the images: require, warn or skip (default skip)")
+	_ = viper.BindPFlag("options.verification.policy", mirrorCmd.PersistentFlags().Lookup("verification"))
+	mirrorCmd.PersistentFlags().StringSlice("verification-keys", nil, "Paths to the PEM public keys that sign the images")
+	_ = viper.BindPFlag("options.verification.keys", mirrorCmd.PersistentFlags().Lookup("verification-keys"))
 }
@@ -9,11 +9,11 @@ import (
 )
 
 // mirrorChartsCmd represents the `mirror charts` command.
-// It is used to mirror a list of Helm charts to a Google Artifact Registry.
+// It is used to mirror a list of Helm charts to the target registry.
 var mirrorChartsCmd = &cobra.Command{
 	Use:   "charts",
-	Short: "Mirror Helm charts to GAR",
-	Long:  `Mirrors Helm charts specified in a YAML file to Google Artifact Registry.`,
+	Short: "Mirror Helm charts to the target registry",
+	Long:  `Mirrors Helm charts specified in a YAML file to the target OCI registry.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return cmdutils.MirrorCharts(ctx, cmd)
 	},
@@ -30,4 +30,24 @@ func init() {
 	if err := viper.BindPFlag("skip_image_mirroring", mirrorChartsCmd.Flags().Lookup("skip-image-mirroring")); err != nil {
 		log.Fatalf("Error binding flag: %v", err)
 	}
+	mirrorChartsCmd.Flags().Int("chart-concurrency", 0, "Number of charts mirrored at the same time (default 2)")
+	if err := viper.BindPFlag("options.chart_concurrency", mirrorChartsCmd.Flags().Lookup("chart-concurrency")); err != nil {
+		log.Fatalf("Error binding flag: %v", err)
+	}
+	mirrorChartsCmd.Flags().Bool("pin-digests", false, "Reference the images of the charts by the digest mirrored in values.yaml")
+	if err := viper.BindPFlag("options.pin_digests", mirrorChartsCmd.Flags().Lookup("pin-digests")); err != nil {
+		log.Fatalf("Error binding flag: %v", err)
+	}
+	mirrorChartsCmd.Flags().Bool("mirror-dependencies", false, "Mirror the dependencies declared in the Chart.yaml of the charts and point the charts to them")
+	if err := viper.BindPFlag("options.mirror_dependencies", mirrorChartsCmd.Flags().Lookup("mirror-dependencies")); err != nil {
+		log.Fatalf("Error binding flag: %v", err)
+	}
+	mirrorChartsCmd.Flags().Bool("attach-sbom", false, "Push the SBOM of each chart to the target registry as a referrer of the chart")
+	if err := viper.BindPFlag("options.sbom.attach", mirrorChartsCmd.Flags().Lookup("attach-sbom")); err != nil {
+		log.Fatalf("Error binding flag: %v", err)
+	}
+	addLockfileFlags(mirrorChartsCmd, "Path of the lockfile the chart versions resolved are written to (default mirrorctl.lock)",
+		"Mirror the chart versions of the lockfile and fail if their upstream digest changed")
+	addDiscoveryFlags(mirrorChartsCmd)
+	mirrorChartsCmd.Flags().Bool("force", false, "Push the charts again even if they are up to date in the target registry")
 }
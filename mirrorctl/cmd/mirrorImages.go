@@ -7,11 +7,11 @@ import (
 )
 
 // mirrorImagesCmd represents the `mirror images` command.
-// It is used to mirror a list of container images to a Google Artifact Registry.
+// It is used to mirror a list of container images to the target registry.
 var mirrorImagesCmd = &cobra.Command{
 	Use:   "images",
-	Short: "Mirror container images to GAR",
-	Long:  `Mirrors container images specified in a YAML file to Google Artifact Registry.`,
+	Short: "Mirror container images to the target registry",
+	Long:  `Mirrors container images specified in a YAML file to the target OCI registry.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return cmdutils.MirrorImages(ctx, cmd)
 	},
@@ -22,4 +22,6 @@ func init() {
 	mirrorCmd.AddCommand(mirrorImagesCmd)
 	mirrorImagesCmd.Flags().String("images", "", "Path to YAML file with list of container images")
 	_ = viper.BindPFlag("images", mirrorImagesCmd.Flags().Lookup("images"))
+	addLockfileFlags(mirrorImagesCmd, "Path of the lockfile the image tags resolved are written to (default mirrorctl.lock)",
+		"Mirror the image digests of the lockfile and fail if their upstream tags moved")
 }
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/cmdutils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// planCmd represents the `plan` command.
+// It is used to show what a mirror run would change in the target registry, without changing anything.
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what mirroring images and charts would change in the target registry",
+	Long: `Resolves the images and charts of YAML files upstream and inspects the target registry, then reports for each
+image tag and chart version whether it is new, up-to-date, tag-mutated (the target tag points to a different digest)
+or missing upstream. Nothing is copied.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmdutils.Plan(ctx, cmd)
+	},
+}
+
+// init initializes the `plan` command and its flags.
+func init() {
+	rootCmd.AddCommand(planCmd)
+
+	planCmd.Flags().String("images", "", "Path to YAML file with list of container images")
+	_ = viper.BindPFlag("images", planCmd.Flags().Lookup("images"))
+	planCmd.Flags().String("charts", "", "Path to YAML file with list of Helm charts")
+	_ = viper.BindPFlag("charts", planCmd.Flags().Lookup("charts"))
+	planCmd.Flags().String("format", "text", "Output format: text or json")
+	_ = viper.BindPFlag("format", planCmd.Flags().Lookup("format"))
+	planCmd.Flags().Bool("fail-on-changes", false, "Exit with an error if a mirror run would change the target registry")
+	_ = viper.BindPFlag("fail_on_changes", planCmd.Flags().Lookup("fail-on-changes"))
+}
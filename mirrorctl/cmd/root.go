@@ -22,12 +22,15 @@ var ctx *appcontext.AppContext
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "mirrorctl",
-	Short: "mirrorctl mirrors Helm charts and container images to Google Artifact Registry",
-	Long: `mirrorctl is a CLI tool that automates the mirroring of Helm charts and their container images into Google Artifact Registry (GAR). 
+	Short: "mirrorctl mirrors Helm charts and container images to OCI registries",
+	Long: `mirrorctl is a CLI tool that automates the mirroring of Helm charts and their container images into any OCI registry, such as Google Artifact Registry (GAR). 
 	It supports provenance tracking.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		var err error
 		viper.BindPFlags(cmd.Flags())
+		if err = bindSharedFlags(cmd); err != nil {
+			log.Fatal().Err(err).Msg("Failed to bind flags")
+		}
 		cfg, err = config.LoadConfig()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to load configuration")
@@ -63,6 +66,7 @@ func init() {
 	rootCmd.PersistentFlags().String("log-file", "", "If set, writes logs to the specified file path instead of the console.")
 	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Simulate actions without executing")
 	rootCmd.PersistentFlags().BoolVar(&keepTempDir, "keep-temp-dir", false, "Keep temporary directories for inspection")
+	rootCmd.PersistentFlags().String("target", "", "Name of the target registry to mirror to, when several are configured")
 	rootCmd.PersistentFlags().Bool("verbose", false, "Enable verbose output.")
 	rootCmd.PersistentFlags().Bool("quiet", false, "Suppress all output.")
 
@@ -75,6 +79,7 @@ func init() {
 	_ = viper.BindPFlag("log_file", rootCmd.PersistentFlags().Lookup("log-file"))
 	_ = viper.BindPFlag("dry_run", rootCmd.PersistentFlags().Lookup("dry-run"))
 	_ = viper.BindPFlag("options.keep_temp_dir", rootCmd.PersistentFlags().Lookup("keep-temp-dir"))
+	_ = viper.BindPFlag("target", rootCmd.PersistentFlags().Lookup("target"))
 	_ = viper.BindPFlag("verbose", rootCmd.PersistentFlags().Lookup("verbose"))
 	_ = viper.BindPFlag("quiet", rootCmd.PersistentFlags().Lookup("quiet"))
 }
@@ -26,4 +26,8 @@ func init() {
 
 	chartImagesCmd.Flags().String("output-dir", "", "Directory path to store the list of images per chart")
 	_ = viper.BindPFlag("output_dir", chartImagesCmd.Flags().Lookup("output-dir"))
+
+	chartImagesCmd.Flags().String("format", "native", "SBOM format: native, cyclonedx-json or spdx-json")
+	_ = viper.BindPFlag("format", chartImagesCmd.Flags().Lookup("format"))
+	addDiscoveryFlags(chartImagesCmd)
 }
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/cmdutils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// verifyCmd represents the `verify` command.
+// It is used to audit the target registry against the images and charts files after they were mirrored.
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify that the target registry has every image and chart of the input files",
+	Long: `Checks that every image tag and chart version (<version>-<suffix>) of YAML files is in the target registry,
+that the images have the digest of the source, or of the lockfile with --locked, and that the images referenced by
+the values of the mirrored charts are in the mirror. Prints a pass/fail report and exits with an error if a check failed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmdutils.Verify(ctx, cmd)
+	},
+}
+
+// init initializes the `verify` command and its flags.
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().String("images", "", "Path to YAML file with list of container images")
+	_ = viper.BindPFlag("images", verifyCmd.Flags().Lookup("images"))
+	verifyCmd.Flags().String("charts", "", "Path to YAML file with list of Helm charts")
+	_ = viper.BindPFlag("charts", verifyCmd.Flags().Lookup("charts"))
+	addLockfileFlags(verifyCmd, "Path of the lockfile (default mirrorctl.lock)",
+		"Expect the image digests and chart versions of the lockfile instead of resolving them upstream")
+	addDiscoveryFlags(verifyCmd)
+}
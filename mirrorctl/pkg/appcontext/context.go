@@ -1,13 +1,20 @@
 package appcontext
 
 import (
+	"sync"
+
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/credentials"
 )
 
 // AppContext holds shared application state, such as configuration and flags.
 type AppContext struct {
 	Config *config.Config // The application configuration.
 	DryRun bool           // A flag to simulate actions without executing them.
+
+	credentialsOnce  sync.Once
+	credentials      *credentials.Store
+	credentialsError error
 }
 
 // NewAppContext creates a new application context.
@@ -19,3 +26,12 @@ func NewAppContext(cfg *config.Config, dryRun bool) *AppContext {
 		DryRun: dryRun,
 	}
 }
+
+// Credentials returns the registry credential store built from the configuration.
+// The store is created on first use and shared afterwards, so tokens are fetched only once per run.
+func (c *AppContext) Credentials() (*credentials.Store, error) {
+	c.credentialsOnce.Do(func() {
+		c.credentials, c.credentialsError = credentials.NewStore(c.Config)
+	})
+	return c.credentials, c.credentialsError
+}
@@ -0,0 +1,256 @@
+// Package bundle reads and writes the OCI image layouts that charts and images are exported to, to be carried to
+// sites that cannot reach the upstream registries.
+// Each artifact of a bundle is tagged in the index of the layout with the reference it has in the target registry
+// it was exported for, e.g. `registry.example.com/mirror/images/busybox:1.36`, and annotated with its origin.
+// A bundle is a directory, or a tarball of that directory when its path ends with `.tar`.
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// Annotations of the artifacts in the index of a bundle.
+const (
+	AnnotationKind             = "mirrorctl/kind"              // KindImage or KindChart.
+	AnnotationName             = "mirrorctl/name"              // The name of the image or chart entry.
+	AnnotationSource           = "mirrorctl/source"            // The upstream image reference, or the chart repository.
+	AnnotationVersion          = "mirrorctl/version"           // The upstream version of a chart.
+	AnnotationSourceDigest     = "mirrorctl/source-digest"     // The digest of the upstream image, or chart archive.
+	AnnotationImagesRepository = "mirrorctl/images-repository" // The images repository the images of a chart were rewritten to.
+)
+
+// Kinds of the artifacts of a bundle.
+const (
+	KindImage = "image"
+	KindChart = "chart"
+)
+
+// Artifact is an image or a chart tagged in the index of a bundle, or another tag of the repository of an image,
+// such as a cosign signature, whose Kind is empty.
+// Reference is the reference of the artifact in the target registry the bundle was exported for, and Descriptor
+// the manifest or index it is tagged with.
+type Artifact struct {
+	Reference        string
+	Kind             string
+	Name             string
+	Source           string
+	Version          string
+	SourceDigest     string
+	ImagesRepository string
+	Descriptor       v1.Descriptor
+}
+
+// Repository returns the repository of the reference of an artifact, e.g. `registry.example.com/mirror/busybox`.
+func (a Artifact) Repository() string {
+	repository, _ := splitReference(a.Reference)
+	return repository
+}
+
+// Tag returns the tag or the digest of the reference of an artifact, e.g. `1.36`.
+func (a Artifact) Tag() string {
+	_, tag := splitReference(a.Reference)
+	return tag
+}
+
+// splitReference splits a reference into its repository and its tag or digest.
+func splitReference(reference string) (string, string) {
+	if repository, dgst, found := strings.Cut(reference, "@"); found {
+		return repository, dgst
+	}
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		return reference[:i], reference[i+1:]
+	}
+	return reference, ""
+}
+
+// Open opens a bundle for reading, a directory or a tarball.
+// It returns an error if the bundle is not an OCI image layout.
+func Open(ctx context.Context, path string) (*oci.ReadOnlyStore, error) {
+	var store *oci.ReadOnlyStore
+	var err error
+	if IsTarball(path) {
+		store, err = oci.NewFromTar(ctx, path)
+	} else {
+		store, err = oci.NewFromFS(ctx, os.DirFS(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// Artifacts lists the artifacts tagged in the index of a bundle, sorted by reference.
+// It returns an error if the index cannot be read.
+func Artifacts(ctx context.Context, store *oci.ReadOnlyStore) ([]Artifact, error) {
+	var references []string
+	err := store.Tags(ctx, "", func(tags []string) error {
+		references = append(references, tags...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the artifacts of the bundle: %w", err)
+	}
+	sort.Strings(references)
+
+	artifacts := make([]Artifact, 0, len(references))
+	for _, reference := range references {
+		desc, err := store.Resolve(ctx, reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s in the bundle: %w", reference, err)
+		}
+		artifacts = append(artifacts, Artifact{
+			Reference:        reference,
+			Kind:             desc.Annotations[AnnotationKind],
+			Name:             desc.Annotations[AnnotationName],
+			Source:           desc.Annotations[AnnotationSource],
+			Version:          desc.Annotations[AnnotationVersion],
+			SourceDigest:     desc.Annotations[AnnotationSourceDigest],
+			ImagesRepository: desc.Annotations[AnnotationImagesRepository],
+			Descriptor:       desc,
+		})
+	}
+	return artifacts, nil
+}
+
+// Writer writes a bundle: Store is the OCI image layout the artifacts are copied to, in the bundle directory or,
+// for a tarball, in a temporary directory archived when the writer is closed.
+type Writer struct {
+	Store     *oci.Store
+	dir       string
+	tarball   string
+	temporary bool // The directory is removed once the writer is closed or discarded.
+}
+
+// IsTarball returns true if a bundle path is a tarball rather than a directory.
+func IsTarball(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".tar")
+}
+
+// Create opens the bundle at a path for writing. The artifacts of an existing bundle directory are kept, so that
+// the images and charts already exported are skipped, while an existing tarball is replaced.
+// It returns an error if the OCI image layout cannot be created.
+func Create(path string) (*Writer, error) {
+	if !IsTarball(path) {
+		return newWriter(&Writer{dir: path})
+	}
+	dir, err := os.MkdirTemp("", "mirrorctl-bundle-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return newWriter(&Writer{dir: dir, tarball: path, temporary: true})
+}
+
+// CreateTemp opens a throwaway bundle in a temporary directory, removed once the writer is closed or discarded
+// without writing anything, e.g. for a dry-run that must leave the bundle exported to as it is.
+// It returns an error if the OCI image layout cannot be created.
+func CreateTemp() (*Writer, error) {
+	dir, err := os.MkdirTemp("", "mirrorctl-bundle-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return newWriter(&Writer{dir: dir, temporary: true})
+}
+
+// newWriter creates the OCI image layout of a writer in its directory.
+func newWriter(w *Writer) (*Writer, error) {
+	store, err := oci.New(w.dir)
+	if err != nil {
+		w.Discard()
+		return nil, fmt.Errorf("failed to create OCI image layout %s: %w", w.dir, err)
+	}
+	w.Store = store
+	return w, nil
+}
+
+// Close writes the tarball of a bundle, if it is one, and removes its temporary directory.
+// It returns an error if the tarball cannot be written.
+func (w *Writer) Close() error {
+	defer w.Discard()
+	if w.tarball == "" {
+		return nil
+	}
+	if err := writeTarball(w.dir, w.tarball); err != nil {
+		return fmt.Errorf("failed to write bundle %s: %w", w.tarball, err)
+	}
+	log.Info().Str("file", w.tarball).Msg("Bundle tarball written")
+	return nil
+}
+
+// Discard removes the temporary directory of a tarball or a throwaway bundle without writing the tarball, e.g. after
+// an error. It does nothing for a bundle directory, or once the writer is closed.
+func (w *Writer) Discard() {
+	if !w.temporary {
+		return
+	}
+	if err := os.RemoveAll(w.dir); err != nil {
+		log.Warn().Err(err).Str("path", w.dir).Msg("Failed to remove temporary bundle directory")
+	}
+}
+
+// Tag tags an artifact copied to the OCI image layout of a bundle with its reference in the target registry,
+// and records the annotations of the artifact in the index of the layout.
+// It returns an error if the artifact is not in the layout or the index cannot be written.
+func Tag(ctx context.Context, store *oci.Store, desc v1.Descriptor, reference string, annotations map[string]string) error {
+	tagged := desc
+	tagged.Annotations = make(map[string]string, len(desc.Annotations)+len(annotations))
+	maps.Copy(tagged.Annotations, desc.Annotations)
+	maps.Copy(tagged.Annotations, annotations)
+	return store.Tag(ctx, tagged, reference)
+}
+
+// writeTarball archives the files of a directory to a tarball, with paths relative to the directory.
+func writeTarball(dir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil || name == "." {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
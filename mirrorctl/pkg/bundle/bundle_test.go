@@ -0,0 +1,124 @@
+package bundle
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2"
+)
+
+func TestIsTarball(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "bundle.tar", expected: true},
+		{path: "/tmp/BUNDLE.TAR", expected: true},
+		{path: "bundle", expected: false},
+		{path: "bundle.tar.d", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsTarball(tt.path))
+		})
+	}
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "directory", path: "bundle"},
+		{name: "tarball", path: "bundle.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.path)
+			w, err := Create(path)
+			require.NoError(t, err)
+
+			desc, err := oras.PushBytes(context.Background(), w.Store, "application/vnd.oci.image.manifest.v1+json", []byte(`{"schemaVersion":2}`))
+			require.NoError(t, err)
+			require.NoError(t, Tag(context.Background(), w.Store, desc, "registry.example.com/mirror/app:1.0", map[string]string{AnnotationKind: KindImage}))
+			resolved, err := w.Store.Resolve(context.Background(), "registry.example.com/mirror/app:1.0")
+			require.NoError(t, err)
+			assert.Equal(t, KindImage, resolved.Annotations[AnnotationKind])
+			require.NoError(t, w.Close())
+
+			files := make(map[string]bool)
+			if IsTarball(path) {
+				f, err := os.Open(path)
+				require.NoError(t, err)
+				defer f.Close()
+				tr := tar.NewReader(f)
+				for {
+					header, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					require.NoError(t, err)
+					files[header.Name] = true
+				}
+				// The layout was written to a temporary directory, removed once the tarball is written
+				assert.NoDirExists(t, w.dir)
+			} else {
+				require.NoError(t, filepath.Walk(path, func(file string, _ os.FileInfo, err error) error {
+					name, _ := filepath.Rel(path, file)
+					files[filepath.ToSlash(name)] = true
+					return err
+				}))
+			}
+			assert.True(t, files["oci-layout"])
+			assert.True(t, files["index.json"])
+			assert.True(t, files["blobs/sha256/"+desc.Digest.Encoded()])
+
+			store, err := Open(context.Background(), path)
+			require.NoError(t, err)
+			artifacts, err := Artifacts(context.Background(), store)
+			require.NoError(t, err)
+			require.Len(t, artifacts, 1)
+			assert.Equal(t, "registry.example.com/mirror/app:1.0", artifacts[0].Reference)
+			assert.Equal(t, KindImage, artifacts[0].Kind)
+			assert.Equal(t, desc.Digest, artifacts[0].Descriptor.Digest)
+		})
+	}
+}
+
+func TestCreateTemp(t *testing.T) {
+	w, err := CreateTemp()
+	require.NoError(t, err)
+	_, err = oras.PushBytes(context.Background(), w.Store, "application/vnd.oci.image.manifest.v1+json", []byte(`{"schemaVersion":2}`))
+	require.NoError(t, err)
+	assert.DirExists(t, w.dir)
+
+	// The layout is thrown away, nothing is written
+	require.NoError(t, w.Close())
+	assert.NoDirExists(t, w.dir)
+}
+
+func TestArtifactReference(t *testing.T) {
+	tests := []struct {
+		reference          string
+		expectedRepository string
+		expectedTag        string
+	}{
+		{reference: "registry.example.com/mirror/app:1.0", expectedRepository: "registry.example.com/mirror/app", expectedTag: "1.0"},
+		{reference: "registry.example.com:5000/mirror/app:1.0", expectedRepository: "registry.example.com:5000/mirror/app", expectedTag: "1.0"},
+		{reference: "registry.example.com:5000/mirror/app", expectedRepository: "registry.example.com:5000/mirror/app", expectedTag: ""},
+		{reference: "registry.example.com/mirror/app@sha256:abc", expectedRepository: "registry.example.com/mirror/app", expectedTag: "sha256:abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			a := Artifact{Reference: tt.reference}
+			assert.Equal(t, tt.expectedRepository, a.Repository())
+			assert.Equal(t, tt.expectedTag, a.Tag())
+		})
+	}
+}
@@ -1,77 +1,388 @@
 package charts
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"sync"
 
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2/content/oci"
 )
 
-// MirrorHelmCharts mirrors a list of Helm charts to a Google Artifact Registry.
-// It takes an application context and the path to a file containing the list of charts to mirror.
+// UpToDateSuffix follows the charts that were up to date in the target registry, and were not pushed again,
+// in the lists of charts mirrored.
+const UpToDateSuffix = " (up to date)"
+
+// MirrorOptions holds the optional steps and the concurrency of the chart pipeline.
+type MirrorOptions struct {
+	// Concurrency is the number of charts mirrored at the same time, config.DefaultChartConcurrency if not set.
+	Concurrency int
+	// ScanImages, if set, lists the container images of a pulled chart before it is transformed.
+	ScanImages func(chartPath string) ([]types.Image, error)
+	// OnImages, if set, receives the images found by ScanImages as soon as each chart has been scanned.
+	// It is called from several goroutines at the same time.
+	OnImages func(chart types.Chart, images []types.Image)
+	// AwaitImages, if set, blocks until the images found by ScanImages have been mirrored and returns them,
+	// so that the values.yaml files of the chart reference them by the digest mirrored.
+	// It is called after OnImages, from several goroutines at the same time.
+	AwaitImages func(images []types.Image) []types.MirroredImage
+	// OnComputedImages, if set, receives the image references of the templates of a chart that are computed by
+	// template actions, and are not rewritten to the target registry.
+	// It is called from several goroutines at the same time.
+	OnComputedImages func(chart types.Chart, images []types.ComputedImage)
+	// SBOM, if set, returns the SBOM document of a pulled chart and of the images found by ScanImages, with its
+	// artifact type. The document is pushed to the target registry as a referrer of the chart manifest.
+	// It is called from several goroutines at the same time.
+	SBOM func(chart types.Chart, chartPath string, images []types.Image) ([]byte, string, error)
+	// ResolveVersions, if set, resolves the version of a chart entry to the concrete versions to mirror instead of
+	// the versions of the upstream repository, e.g. to the versions of a lockfile.
+	ResolveVersions func(entry types.Chart) ([]string, error)
+	// OnResolved, if set, receives the chart entries of the charts file with the concrete versions they resolved to,
+	// before any chart is mirrored.
+	OnResolved func(resolved []ResolvedChart)
+	// OnDependencies, if set, receives the dependencies resolved with options.mirror_dependencies, as chart entries
+	// of the version constraint of Chart.yaml with the concrete version it resolved to, once every chart has been
+	// mirrored. ResolveVersions also resolves the dependencies that have no Chart.lock.
+	OnDependencies func(resolved []ResolvedChart)
+	// OnPulled, if set, receives the digest of the archive of each chart pulled. An error fails the chart,
+	// e.g. when the digest differs from the one of a lockfile.
+	// It is called from several goroutines at the same time.
+	OnPulled func(chart types.Chart, digest string) error
+	// Force, if set, pushes the charts even if they are up to date in the target registry.
+	Force bool
+	// Layout, if set, is the OCI image layout of a bundle the charts are exported to instead of the target registry.
+	// Each chart is tagged in the layout with its reference in the target registry, see bundle.Tag.
+	Layout *oci.Store
+}
+
+// MirrorHelmCharts mirrors a list of Helm charts to the target registry.
+// It takes an application context, the path to a file containing the list of charts to mirror and the pipeline options.
+// The version of each entry, a semver constraint or `latest`, is first resolved to the concrete versions to mirror.
+// Each chart is pulled once, scanned for images, transformed, packaged and pushed,
+// with up to opts.Concurrency charts going through the pipeline at the same time.
+// With options.mirror_dependencies, the dependencies declared in the Chart.yaml of the charts are mirrored too,
+// recursively, each chart once, see mirrorChart.
 //
 // MirrorHelmCharts Returns:
-//  1. []string: List of successfully mirrored charts (Name:Version).
-//  2. []string: List of charts that failed to mirror (Name:Version).
+//  1. []string: List of successfully mirrored charts (Name:Version), in the order of the charts file, followed by
+//     the dependencies mirrored.
+//  2. []string: List of charts that failed to mirror (Name:Version), in the order of the charts file, followed by
+//     the dependencies that failed.
+//     Entries whose version could not be resolved are listed with their constraint.
 //  3. error: Any error encountered during the initial loading of the charts list.
-func MirrorHelmCharts(ctx *appcontext.AppContext, chartsFile string) ([]string, []string, error) {
+func MirrorHelmCharts(ctx *appcontext.AppContext, chartsFile string, opts MirrorOptions) ([]string, []string, error) {
 	chartsList, err := LoadChartsList(chartsFile)
 	if err != nil {
 		// Only return an error here if the failure prevents processing any chart
 		return nil, nil, err
 	}
 
+	resolved := resolveCharts(chartsList.Charts, versionResolver(ctx, opts))
+	if opts.OnResolved != nil {
+		opts.OnResolved(resolved)
+	}
+
+	var mirrorList []types.Chart
+	for _, r := range resolved {
+		mirrorList = append(mirrorList, r.Charts()...)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = config.DefaultChartConcurrency
+	}
+
+	// The charts of the file are mirrored first then, with options.mirror_dependencies, the dependencies they declare,
+	// one level of dependencies after the other. Each chart is mirrored once, whatever the charts depending on it.
+	jobs := make([]chartJob, 0, len(mirrorList))
+	mirrored := make(map[string]bool)
+	for _, ch := range mirrorList {
+		jobs = append(jobs, chartJob{chart: ch})
+		mirrored[dependencyKey(ch)] = true
+	}
+	var outcomes []chartOutcome
+	for level := jobs; len(level) > 0; {
+		levelOutcomes := mirrorCharts(ctx, level, opts, concurrency)
+		outcomes = append(outcomes, levelOutcomes...)
+		level = nextDependencies(level, levelOutcomes, mirrored)
+		jobs = append(jobs, level...)
+	}
+	if opts.OnDependencies != nil {
+		opts.OnDependencies(resolvedDependencies(outcomes))
+	}
+
 	// Initialize the lists to be returned
 	var successfulCharts []string
 	var failedCharts []string
+	addOutcome := func(ch types.Chart, outcome chartOutcome) {
+		// Format the chart identifier as "name:version" for the lists, followed by the retries if any
+		chartDetail := fmt.Sprintf("%s:%s%s", ch.Name, ch.Version, retry.Suffix(outcome.retries))
+		if outcome.upToDate {
+			chartDetail += UpToDateSuffix
+		}
 
-	for _, ch := range chartsList.Charts {
-		// Format the chart identifier as "name:version" for the lists
-		chartDetail := fmt.Sprintf("%s:%s", ch.Name, ch.Version)
-
-		if err := mirrorChart(ctx, ch); err != nil {
-			log.Error().Err(err).Str("chart", ch.Name).Msg("Failed to mirror chart")
+		if outcome.err != nil {
+			log.Error().Err(outcome.err).Str("chart", ch.Name).Int("retries", outcome.retries).Msg("Failed to mirror chart")
 			failedCharts = append(failedCharts, chartDetail) // Add to failed list
-			continue
+		} else {
+			successfulCharts = append(successfulCharts, chartDetail) // Add to successful list
 		}
+	}
 
-		successfulCharts = append(successfulCharts, chartDetail) // Add to successful list
+	// The mirrored charts follow the entries they were resolved from, and the dependencies follow them
+	i := 0
+	for _, r := range resolved {
+		if r.Err != nil {
+			log.Error().Err(r.Err).Str("chart", r.Entry.Name).Str("version", r.Entry.Version).Msg("Failed to resolve chart version")
+			failedCharts = append(failedCharts, fmt.Sprintf("%s:%s", r.Entry.Name, r.Entry.Version))
+			continue
+		}
+		for _, ch := range r.Charts() {
+			addOutcome(ch, outcomes[i])
+			i++
+		}
+	}
+	for ; i < len(jobs); i++ {
+		addOutcome(jobs[i].chart, outcomes[i])
 	}
 
 	// Return the two lists and a nil error (since processing the loop was successful)
 	return successfulCharts, failedCharts, nil
 }
 
-// mirrorChart mirrors a single Helm chart to a Google Artifact Registry.
-// It takes an application context and a Chart object as input.
-// It returns an error if the chart could not be mirrored.
-func mirrorChart(ctx *appcontext.AppContext, chart types.Chart) error {
+// chartJob is a chart to mirror, with the charts depending on it when it is mirrored as a dependency,
+// from the chart of the charts file to its parent.
+type chartJob struct {
+	chart   types.Chart
+	parents []types.Chart
+}
+
+// chartOutcome is the outcome of mirroring a chart: the number of registry operations retried, whether the chart
+// was up to date in the target registry, the error if it could not be mirrored, and the dependencies it declares
+// that were resolved.
+type chartOutcome struct {
+	retries      int
+	upToDate     bool
+	err          error
+	dependencies []Dependency
+}
+
+// mirrorCharts mirrors charts with up to concurrency charts going through the pipeline at the same time.
+// It returns the outcome of each chart, in the order of the charts.
+func mirrorCharts(ctx *appcontext.AppContext, jobs []chartJob, opts MirrorOptions, concurrency int) []chartOutcome {
+	// Each goroutine writes the outcome of a chart at the index of the chart, so the outcomes keep the order of the charts
+	outcomes := make([]chartOutcome, len(jobs))
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			outcomes[i] = mirrorChart(ctx, job.chart, opts)
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// nextDependencies returns the dependencies of the charts mirrored that have not been mirrored yet, and marks them
+// as mirrored. A dependency on one of the charts depending on it is a cycle: it is logged and not followed.
+func nextDependencies(jobs []chartJob, outcomes []chartOutcome, mirrored map[string]bool) []chartJob {
+	var next []chartJob
+	for i, job := range jobs {
+		chain := append(slices.Clone(job.parents), job.chart)
+		for _, dep := range outcomes[i].dependencies {
+			key := dependencyKey(dep.Chart)
+			if cycle := dependencyCycle(chain, key); cycle != nil {
+				log.Warn().Str("chart", job.chart.Name).Str("dependency", dep.Chart.Name).Strs("cycle", cycle).
+					Msg("Dependency cycle between charts, the dependency is mirrored once")
+				continue
+			}
+			if mirrored[key] {
+				log.Debug().Str("chart", job.chart.Name).Str("dependency", dep.Chart.Name).Str("version", dep.Chart.Version).
+					Msg("Dependency already mirrored")
+				continue
+			}
+			mirrored[key] = true
+			log.Info().Str("chart", job.chart.Name).Str("dependency", dep.Chart.Name).Str("version", dep.Chart.Version).
+				Msg("Mirroring chart dependency")
+			next = append(next, chartJob{chart: dep.Chart, parents: chain})
+		}
+	}
+	return next
+}
+
+// dependencyCycle returns the charts of a cycle, as `name:version`, if a dependency is one of the charts of a chain
+// of dependencies, or nil.
+func dependencyCycle(chain []types.Chart, key string) []string {
+	for i, ch := range chain {
+		if dependencyKey(ch) != key {
+			continue
+		}
+		cycle := make([]string, 0, len(chain)-i+1)
+		for _, c := range chain[i:] {
+			cycle = append(cycle, c.Name+":"+c.Version)
+		}
+		return append(cycle, ch.Name+":"+ch.Version)
+	}
+	return nil
+}
+
+// mirrorChart mirrors a single Helm chart to the target registry.
+// It takes an application context, a Chart object and the pipeline options as input.
+// The images of the chart are scanned from the pulled copy, before the chart is transformed.
+// A chart already in the target registry with the digest of the chart pulled is up to date: its images are still
+// scanned, but it is not pushed again, unless opts.Force is set, see checkMirroredChart. With options.pin_digests,
+// its images are also awaited, and it is pushed again if they were mirrored with other digests than the ones pinned.
+// With options.mirror_dependencies, the dependencies of its Chart.yaml are resolved, and the chart is pointed to the
+// charts mirrored for them.
+// It returns the outcome of the chart: the number of registry operations retried, whether it was up to date, the
+// dependencies resolved, to be mirrored once the chart has been mirrored, and an error if it could not be mirrored.
+func mirrorChart(ctx *appcontext.AppContext, chart types.Chart, opts MirrorOptions) chartOutcome {
 	log.Debug().Str("chart", chart.Name).Str("version", chart.Version).Msg("Mirroring chart")
 
 	tmpDir, err := helm.CreateTempDir(ctx)
 	if err != nil {
-		return err
+		return chartOutcome{err: err}
 	}
+	defer helm.RemoveTempDir(ctx, tmpDir)
 
-	srcChartPath, err := helm.PullChart(chart, tmpDir)
+	srcChartPath, archiveDigest, err := helm.PullChart(ctx, chart, tmpDir)
 	if err != nil {
-		return err
+		return chartOutcome{err: err}
+	}
+	if opts.OnPulled != nil {
+		if err := opts.OnPulled(chart, archiveDigest.String()); err != nil {
+			return chartOutcome{err: err}
+		}
+	}
+
+	var outcome chartOutcome
+	if !opts.Force {
+		outcome.upToDate, outcome.retries, err = checkMirroredChart(ctx, chart, archiveDigest.String(), nil, opts.Layout)
+		if err != nil {
+			outcome.err = err
+			return outcome
+		}
+	}
+
+	if ctx.Config.Options.MirrorDependencies {
+		var retries int
+		outcome.dependencies, retries, err = resolveDependencies(srcChartPath, versionResolver(ctx, opts))
+		outcome.retries += retries
+		if err != nil {
+			outcome.err = err
+			return outcome
+		}
+	}
+
+	var images []types.Image
+	var digests ImageDigests
+	scanned := false
+	if opts.ScanImages != nil {
+		images, err = opts.ScanImages(srcChartPath)
+		if err != nil {
+			// The chart can still be mirrored, only its images are missing
+			log.Error().Err(err).Str("chart", chart.Name).Msg("Failed to extract images from chart")
+		} else {
+			scanned = true
+			// The images of a chart up to date are still mirrored, in case a previous run failed to mirror some
+			if opts.OnImages != nil {
+				opts.OnImages(chart, images)
+			}
+			// The images of a chart up to date are awaited too, as the digests pinned in it may be stale
+			if opts.AwaitImages != nil && len(images) > 0 {
+				log.Debug().Str("chart", chart.Name).Int("images", len(images)).Msg("Waiting for the images of the chart to pin their digests")
+				mirrored := opts.AwaitImages(images)
+				digests = NewImageDigests(mirrored)
+				if len(digests) < len(images) {
+					log.Warn().Str("chart", chart.Name).Int("images", len(images)).Int("pinned", len(digests)).
+						Msg("Some images of the chart were not mirrored, they are not pinned by digest")
+				}
+			}
+		}
+	}
+	if outcome.upToDate && len(digests) > 0 && len(digests) == len(images) {
+		// A chart up to date is pushed again if its images were mirrored with other digests than the ones pinned.
+		// It keeps its pins when some images were not mirrored, e.g. in dry-run mode.
+		var retries int
+		outcome.upToDate, retries, err = checkMirroredChart(ctx, chart, archiveDigest.String(), digests, opts.Layout)
+		outcome.retries += retries
+		if err != nil {
+			outcome.err = err
+			return outcome
+		}
+	}
+	if outcome.upToDate {
+		log.Info().Str("chart", chart.Name).Str("version", chart.Version).Str("digest", archiveDigest.String()).
+			Msg("Chart already mirrored from the same upstream chart, skipping")
+		return outcome
 	}
 
-	dstChartPath, err := TransformHelmChart(ctx, chart, srcChartPath)
+	var sbom []byte
+	var sbomArtifactType string
+	if opts.SBOM != nil && scanned {
+		// The SBOM is built from the pulled chart, before it is transformed
+		sbom, sbomArtifactType, err = opts.SBOM(chart, srcChartPath, images)
+		if err != nil {
+			outcome.err = fmt.Errorf("failed to build the SBOM of the chart: %w", err)
+			return outcome
+		}
+	}
+
+	dstChartPath, computed, err := transformHelmChart(ctx, chart, archiveDigest.String(), srcChartPath, srcChartPath+"-transformed", digests, outcome.dependencies)
 	if err != nil {
-		return err
+		outcome.err = err
+		return outcome
+	}
+	if len(computed) > 0 {
+		log.Debug().Str("chart", chart.Name).Interface("images", computed).Msg("Image references computed in templates are not rewritten")
+		if opts.OnComputedImages != nil {
+			opts.OnComputedImages(chart, computed)
+		}
 	}
 
 	pkgChartPath, err := packageHelmChart(dstChartPath)
 	if err != nil {
-		return err
+		outcome.err = err
+		return outcome
 	}
 
-	if err := pushChart(ctx, pkgChartPath, chart.Name, chart.Version); err != nil {
-		return err
+	manifestDesc, pushRetries, err := pushChart(ctx, pkgChartPath, chart.Name, chart.Version, opts.Layout)
+	outcome.retries += pushRetries
+	if err != nil {
+		outcome.err = err
+		return outcome
+	}
+	if opts.Layout != nil && !ctx.DryRun {
+		if err := tagExportedChart(ctx, opts.Layout, chart, archiveDigest.String(), manifestDesc); err != nil {
+			outcome.err = err
+			return outcome
+		}
+	}
+
+	if sbom != nil {
+		if ctx.DryRun {
+			log.Info().Str("chart", chart.Name).Str("artifact_type", sbomArtifactType).
+				Msg("Running in dry-run mode: SBOM attachment to the chart skipped")
+		} else {
+			_, sbomRetries, err := pushSBOM(ctx, chart.Name, manifestDesc, sbom, sbomArtifactType, opts.Layout)
+			outcome.retries += sbomRetries
+			if err != nil {
+				outcome.err = fmt.Errorf("failed to attach the SBOM to the chart: %w", err)
+				return outcome
+			}
+		}
 	}
 
 	if ctx.DryRun {
@@ -79,5 +390,30 @@ func mirrorChart(ctx *appcontext.AppContext, chart types.Chart) error {
 	} else {
 		log.Info().Str("chart", chart.Name).Str("version", chart.Version).Msg("Chart successfully mirrored")
 	}
+	return outcome
+}
+
+// tagExportedChart records the origin of a chart exported to the OCI image layout of a bundle in the index of
+// the layout, and the images repository its images were rewritten to.
+func tagExportedChart(ctx *appcontext.AppContext, layout *oci.Store, chart types.Chart, archiveDigest string, manifestDesc v1.Descriptor) error {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return err
+	}
+	repoRef, tag, err := TargetReference(ctx, chart)
+	if err != nil {
+		return err
+	}
+	err = bundle.Tag(context.Background(), layout, manifestDesc, repoRef+":"+tag, map[string]string{
+		bundle.AnnotationKind:             bundle.KindChart,
+		bundle.AnnotationName:             chart.Name,
+		bundle.AnnotationSource:           chart.Source,
+		bundle.AnnotationVersion:          chart.Version,
+		bundle.AnnotationSourceDigest:     archiveDigest,
+		bundle.AnnotationImagesRepository: target.ImagesRepository,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to tag chart in the bundle: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,419 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestMirrorHelmCharts_Pipeline(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	inputCharts := filepath.Join("..", "..", "resources", "data_test", "input_charts")
+	for _, ch := range []struct{ name, version string }{{"grafana", "7.0.19"}, {"influxdb", "4.12.5"}, {"influxdb2", "2.1.2"}} {
+		archive, err := os.ReadFile(filepath.Join(inputCharts, ch.name+"-"+ch.version+".tgz"))
+		require.NoError(t, err)
+		source.PushChart(t, "charts/"+ch.name, ch.name, ch.version, archive)
+	}
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: 7.0.19
+  - name: missing
+    source: oci://`+source.Host+`/charts
+    version: 1.0.0
+  - name: influxdb
+    source: oci://`+source.Host+`/charts
+    version: 4.12.5
+  - name: influxdb2
+    source: oci://`+source.Host+`/charts
+    version: 2.1.2
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				ImagesRepository: target.Host + "/mirror/images",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+
+	var mu sync.Mutex
+	scanned := make(map[string]bool)
+	opts := MirrorOptions{
+		Concurrency: 3,
+		ScanImages: func(chartPath string) ([]types.Image, error) {
+			// The chart is scanned from the pulled copy, before it is transformed
+			_, err := os.Stat(filepath.Join(chartPath, "Chart.yaml"))
+			return []types.Image{{Name: filepath.Base(chartPath), Source: "docker.io/" + filepath.Base(chartPath) + ":1.0"}}, err
+		},
+		OnImages: func(chart types.Chart, images []types.Image) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.False(t, scanned[chart.Name], "chart %s scanned twice", chart.Name)
+			scanned[chart.Name] = true
+			assert.Equal(t, chart.Name, images[0].Name)
+		},
+	}
+
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"grafana:7.0.19", "influxdb:4.12.5", "influxdb2:2.1.2"}, successful)
+	assert.Equal(t, []string{"missing:1.0.0"}, failed)
+	assert.Equal(t, map[string]bool{"grafana": true, "influxdb": true, "influxdb2": true}, scanned)
+
+	assert.Equal(t, []string{"7.0.19-mirrored"}, target.Tags("mirror/charts/grafana"))
+	assert.Equal(t, []string{"4.12.5-mirrored"}, target.Tags("mirror/charts/influxdb"))
+	assert.Equal(t, []string{"2.1.2-mirrored"}, target.Tags("mirror/charts/influxdb2"))
+}
+
+func TestMirrorHelmCharts_VersionConstraints(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	archive, err := os.ReadFile(filepath.Join("..", "..", "resources", "data_test", "input_charts", "grafana-7.0.19.tgz"))
+	require.NoError(t, err)
+	source.PushChart(t, "charts/grafana", "grafana", "7.0.19", archive)
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: ~7.0
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: ">=8"
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+
+	var resolved []ResolvedChart
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{
+		OnResolved: func(r []ResolvedChart) { resolved = r },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"grafana:7.0.19"}, successful)
+	assert.Equal(t, []string{"grafana:>=8"}, failed)
+
+	require.Len(t, resolved, 2)
+	assert.Equal(t, []string{"7.0.19"}, resolved[0].Versions)
+	assert.Error(t, resolved[1].Err)
+	assert.Equal(t, []string{"7.0.19-mirrored"}, target.Tags("mirror/charts/grafana"))
+}
+
+func TestMirrorHelmCharts_Locked(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	inputCharts := filepath.Join("..", "..", "resources", "data_test", "input_charts")
+	archives := make(map[string][]byte)
+	for _, ch := range []struct{ name, version string }{{"grafana", "7.0.19"}, {"influxdb", "4.12.5"}} {
+		archive, err := os.ReadFile(filepath.Join(inputCharts, ch.name+"-"+ch.version+".tgz"))
+		require.NoError(t, err)
+		source.PushChart(t, "charts/"+ch.name, ch.name, ch.version, archive)
+		archives[ch.name] = archive
+	}
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: ">=8"
+  - name: influxdb
+    source: oci://`+source.Host+`/charts
+    version: 4.12.5
+  - name: influxdb2
+    source: oci://`+source.Host+`/charts
+    version: 2.1.2
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+
+	// The versions come from the lock instead of the source, which has no grafana >=8
+	locked := map[string][]string{"grafana": {"7.0.19"}, "influxdb": {"4.12.5"}}
+	var mu sync.Mutex
+	pulled := make(map[string]string)
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{
+		ResolveVersions: func(entry types.Chart) ([]string, error) {
+			if versions, ok := locked[entry.Name]; ok {
+				return versions, nil
+			}
+			return nil, errors.New("not locked")
+		},
+		OnPulled: func(chart types.Chart, dgst string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			pulled[chart.Name] = dgst
+			if chart.Name == "influxdb" {
+				return errors.New("digest differs from the lock")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"grafana:7.0.19"}, successful)
+	assert.Equal(t, []string{"influxdb:4.12.5", "influxdb2:2.1.2"}, failed)
+
+	assert.Equal(t, map[string]string{
+		"grafana":  digest.FromBytes(archives["grafana"]).String(),
+		"influxdb": digest.FromBytes(archives["influxdb"]).String(),
+	}, pulled)
+	assert.Equal(t, []string{"7.0.19-mirrored"}, target.Tags("mirror/charts/grafana"))
+	assert.Empty(t, target.Tags("mirror/charts/influxdb"))
+}
+
+func TestMirrorHelmCharts_UpToDatePinnedDigests(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	grafana, err := os.ReadFile(filepath.Join("..", "..", "resources", "data_test", "input_charts", "grafana-7.0.19.tgz"))
+	require.NoError(t, err)
+	source.PushChart(t, "charts/grafana", "grafana", "7.0.19", grafana)
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: 7.0.19
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				ImagesRepository: target.Host + "/mirror/images",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none", PinDigests: true},
+		},
+	}
+
+	// The image of the chart is mirrored with the digest its tag points to at the time of each run
+	image := types.Image{Name: "grafana", Source: "docker.io/grafana/grafana:10.1.5"}
+	mirror := func(imageDigest string) ([]string, []string) {
+		t.Helper()
+		successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{
+			ScanImages: func(string) ([]types.Image, error) { return []types.Image{image}, nil },
+			AwaitImages: func([]types.Image) []types.MirroredImage {
+				return []types.MirroredImage{{Source: image.Source, Target: target.Host + "/mirror/images/grafana:10.1.5", Digest: imageDigest}}
+			},
+		})
+		require.NoError(t, err)
+		return successful, failed
+	}
+	pinned := func() string {
+		t.Helper()
+		dgst, ok := target.Resolve("mirror/charts/grafana", "7.0.19-mirrored")
+		require.True(t, ok)
+		manifestJSON, ok := target.Manifest("mirror/charts/grafana", dgst.String())
+		require.True(t, ok)
+		var manifest v1.Manifest
+		require.NoError(t, json.Unmarshal(manifestJSON, &manifest))
+		return manifest.Annotations[annotationPinnedDigests]
+	}
+
+	first := digest.FromString("first").String()
+	successful, failed := mirror(first)
+	assert.Equal(t, []string{"grafana:7.0.19"}, successful)
+	assert.Empty(t, failed)
+	pinnedFirst := pinned()
+	assert.Equal(t, ImageDigests{"grafana:10.1.5": first}.spec(), pinnedFirst)
+
+	successful, failed = mirror(first)
+	assert.Equal(t, []string{"grafana:7.0.19" + UpToDateSuffix}, successful)
+	assert.Empty(t, failed)
+
+	// The tag of the image moved upstream, the chart is pushed again pinned to the new digest
+	second := digest.FromString("second").String()
+	successful, failed = mirror(second)
+	assert.Equal(t, []string{"grafana:7.0.19"}, successful)
+	assert.Empty(t, failed)
+	assert.Equal(t, ImageDigests{"grafana:10.1.5": second}.spec(), pinned())
+	assert.NotEqual(t, pinnedFirst, pinned())
+}
+
+func TestMirrorHelmCharts_Layout(t *testing.T) {
+	source := registrytest.New(t)
+	archive, err := os.ReadFile(filepath.Join("..", "..", "resources", "data_test", "input_charts", "grafana-7.0.19.tgz"))
+	require.NoError(t, err)
+	source.PushChart(t, "charts/grafana", "grafana", "7.0.19", archive)
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: 7.0.19
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			// The target registry is never contacted, the chart is only transformed and tagged for it
+			Targets: []config.TargetConfig{{
+				Name:             "airgap",
+				ChartsRepository: "registry.example.com/mirror/charts",
+				ImagesRepository: "registry.example.com/mirror/images",
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+	layout, err := oci.New(t.TempDir())
+	require.NoError(t, err)
+
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{Layout: layout})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"grafana:7.0.19"}, successful)
+	assert.Empty(t, failed)
+
+	desc, err := layout.Resolve(context.Background(), "registry.example.com/mirror/charts/grafana:7.0.19-mirrored")
+	require.NoError(t, err)
+	// The annotations of the manifest are kept
+	assert.Equal(t, version.AppName+"/"+version.Version, desc.Annotations["mirrorctl/repackaged-by"])
+	assert.Subset(t, desc.Annotations, map[string]string{
+		bundle.AnnotationKind:             bundle.KindChart,
+		bundle.AnnotationName:             "grafana",
+		bundle.AnnotationSource:           "oci://" + source.Host + "/charts",
+		bundle.AnnotationVersion:          "7.0.19",
+		bundle.AnnotationSourceDigest:     digest.FromBytes(archive).String(),
+		bundle.AnnotationImagesRepository: "registry.example.com/mirror/images",
+	}, desc.Annotations)
+}
+
+func TestMirrorHelmCharts_UpToDate(t *testing.T) {
+	inputCharts := filepath.Join("..", "..", "resources", "data_test", "input_charts")
+	grafana, err := os.ReadFile(filepath.Join(inputCharts, "grafana-7.0.19.tgz"))
+	require.NoError(t, err)
+	influxdb, err := os.ReadFile(filepath.Join(inputCharts, "influxdb-4.12.5.tgz"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		mutated            bool
+		unannotated        bool
+		force              bool
+		notifyTagMutations bool
+		pinDigests         bool
+		expectedSuccessful []string
+		expectedFailed     []string
+	}{
+		{name: "up to date", expectedSuccessful: []string{"grafana:7.0.19" + UpToDateSuffix}},
+		{name: "other transform options", pinDigests: true, notifyTagMutations: true, expectedSuccessful: []string{"grafana:7.0.19"}},
+		{name: "forced", force: true, expectedSuccessful: []string{"grafana:7.0.19"}},
+		{name: "tag mutated", mutated: true, expectedSuccessful: []string{"grafana:7.0.19"}},
+		{name: "tag mutated notified", mutated: true, notifyTagMutations: true, expectedFailed: []string{"grafana:7.0.19"}},
+		{name: "no upstream digest", unannotated: true, notifyTagMutations: true, expectedSuccessful: []string{"grafana:7.0.19"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := registrytest.New(t)
+			target := registrytest.New(t)
+			source.PushChart(t, "charts/grafana", "grafana", "7.0.19", grafana)
+
+			chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+			require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: 7.0.19
+`), 0600))
+
+			appCtx := &appcontext.AppContext{
+				Config: &config.Config{
+					Targets: []config.TargetConfig{{
+						Name:             "local",
+						ChartsRepository: target.Host + "/mirror/charts",
+						ImagesRepository: target.Host + "/mirror/images",
+						TransportConfig:  config.TransportConfig{PlainHTTP: true},
+					}},
+					Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+					Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none", NotifyTagMutations: tt.notifyTagMutations},
+				},
+			}
+
+			switch {
+			case tt.mutated:
+				// Another chart was mirrored with the tag, from another upstream chart
+				desc := target.PushChart(t, "mirror/charts/grafana", "influxdb", "7.0.19-mirrored", influxdb)
+				manifestJSON, ok := target.Manifest("mirror/charts/grafana", desc.Digest.String())
+				require.True(t, ok)
+				var manifest v1.Manifest
+				require.NoError(t, json.Unmarshal(manifestJSON, &manifest))
+				manifest.Annotations = map[string]string{annotationSourceDigest: digest.FromBytes(influxdb).String()}
+				target.PushManifest(t, "mirror/charts/grafana", "7.0.19-mirrored", manifest, nil)
+			case tt.unannotated:
+				// The chart was pushed without its upstream digest, e.g. by an earlier mirrorctl
+				target.PushChart(t, "mirror/charts/grafana", "grafana", "7.0.19-mirrored", grafana)
+			default:
+				successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{})
+				require.NoError(t, err)
+				require.Equal(t, []string{"grafana:7.0.19"}, successful)
+				require.Empty(t, failed)
+			}
+			mirrored, ok := target.Resolve("mirror/charts/grafana", "7.0.19-mirrored")
+			require.True(t, ok)
+
+			appCtx.Config.Options.PinDigests = tt.pinDigests
+			successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{Force: tt.force})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedSuccessful, successful)
+			assert.Equal(t, tt.expectedFailed, failed)
+
+			if len(tt.expectedFailed) > 0 || !tt.mutated && !tt.unannotated && !tt.force && !tt.pinDigests {
+				// The tag was left as it was
+				dgst, ok := target.Resolve("mirror/charts/grafana", "7.0.19-mirrored")
+				require.True(t, ok)
+				assert.Equal(t, mirrored, dgst)
+			}
+		})
+	}
+}
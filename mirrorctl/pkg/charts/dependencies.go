@@ -0,0 +1,216 @@
+package charts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+// Dependency is a dependency declared in the Chart.yaml of a chart, with the chart mirrored for it.
+type Dependency struct {
+	Name       string      // The name of the dependency in Chart.yaml.
+	Repository string      // The upstream repository of the dependency in Chart.yaml.
+	Constraint string      // The version of the dependency in Chart.yaml, a semver constraint or an exact version.
+	Chart      types.Chart // The chart mirrored for the dependency, with its concrete version.
+}
+
+// resolveDependencies resolves the dependencies declared in the Chart.yaml of a pulled chart to the charts to mirror.
+// The version of a dependency is the one of the Chart.lock of the chart, the one the vendored subcharts were built
+// with, or else its version constraint is resolved with the resolve function, e.g. upstream or from a lockfile, to the
+// newest version matching it.
+// Dependencies without a repository, or with a local one (`file://`) or the name of a Helm repository (`@name`,
+// `alias:name`), are not mirrored: the former are vendored, the latter cannot be resolved without the local Helm
+// configuration.
+// It returns the dependencies resolved, in the order of Chart.yaml, the number of registry operations retried, and an
+// error if a dependency cannot be resolved.
+func resolveDependencies(chartPath string, resolve func(ch types.Chart) ([]string, int, error)) ([]Dependency, int, error) {
+	ch, err := loader.LoadDir(chartPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load chart: %w", err)
+	}
+	metadata := ch.Metadata
+
+	var dependencies []Dependency
+	totalRetries := 0
+	for _, dep := range metadata.Dependencies {
+		if !isRemoteRepository(dep.Repository) {
+			if dep.Repository != "" && !strings.HasPrefix(dep.Repository, "file://") {
+				log.Warn().Str("chart", metadata.Name).Str("dependency", dep.Name).Str("repository", dep.Repository).
+					Msg("Dependency repository is the name of a Helm repository, the dependency is not mirrored")
+			}
+			continue
+		}
+
+		depChart := types.Chart{Name: dep.Name, Source: strings.TrimSuffix(dep.Repository, "/"), Version: dep.Version}
+		if locked := lockedDependency(ch.Lock, dep); locked != nil {
+			depChart.Version = locked.Version
+		} else {
+			versions, retries, err := resolve(depChart)
+			totalRetries += retries
+			if err != nil {
+				return nil, totalRetries, fmt.Errorf("failed to resolve dependency %s of chart %s: %w", dep.Name, metadata.Name, err)
+			}
+			depChart.Version = versions[len(versions)-1]
+		}
+		dependencies = append(dependencies, Dependency{Name: dep.Name, Repository: dep.Repository, Constraint: dep.Version, Chart: depChart})
+	}
+	return dependencies, totalRetries, nil
+}
+
+// isRemoteRepository returns true if a dependency repository is the URL of a Helm or an OCI repository.
+func isRemoteRepository(repository string) bool {
+	for _, scheme := range []string{"oci://", "https://", "http://"} {
+		if strings.HasPrefix(repository, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockedDependency returns the entry of a Chart.lock for a dependency of Chart.yaml, or nil if there is none.
+func lockedDependency(lock *chart.Lock, dep *chart.Dependency) *chart.Dependency {
+	if lock == nil {
+		return nil
+	}
+	for _, locked := range lock.Dependencies {
+		if locked.Name == dep.Name && locked.Repository == dep.Repository {
+			return locked
+		}
+	}
+	return nil
+}
+
+// dependencyRepository returns the repository a mirrored dependency is pulled from, `oci://<charts_repository>`,
+// and its version, the version of the mirrored chart.
+func dependencyRepository(ctx *appcontext.AppContext, dep Dependency) (string, string, error) {
+	repoRef, tag, err := TargetReference(ctx, dep.Chart)
+	if err != nil {
+		return "", "", err
+	}
+	return "oci://" + strings.TrimSuffix(repoRef, "/"+dep.Chart.Name), tag, nil
+}
+
+// rewriteDependencies points the dependencies of the Chart.yaml and the Chart.lock of a transformed chart to the
+// charts mirrored for them. The repository and the version of each dependency are edited in place, see
+// valuesDocument, and the digest of the Chart.lock is computed again as Helm does, so that the lock stays in sync.
+// It takes the path of the transformed chart and the dependencies mirrored as input.
+// It returns an error if the files cannot be rewritten.
+func rewriteDependencies(ctx *appcontext.AppContext, chartPath string, dependencies []Dependency) error {
+	chartfilePath := filepath.Join(chartPath, chartutil.ChartfileName)
+	if err := rewriteDependencyList(ctx, chartfilePath, dependencies); err != nil {
+		return fmt.Errorf("failed to rewrite the dependencies of Chart.yaml: %w", err)
+	}
+
+	lockPath := filepath.Join(chartPath, "Chart.lock")
+	if _, err := os.Stat(lockPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := rewriteDependencyList(ctx, lockPath, dependencies); err != nil {
+		return fmt.Errorf("failed to rewrite the dependencies of Chart.lock: %w", err)
+	}
+	ch, err := loader.LoadDir(chartPath)
+	if err != nil {
+		return fmt.Errorf("failed to load chart: %w", err)
+	}
+	if ch.Lock == nil {
+		return nil
+	}
+	lockDigest, err := hashDependencies(ch.Metadata.Dependencies, ch.Lock.Dependencies)
+	if err != nil {
+		return err
+	}
+	return editYAMLFile(lockPath, func(doc *valuesDocument) {
+		if node := mappingValue(resolveAlias(doc.root.Content[0]), "digest"); node != nil {
+			doc.set(node, lockDigest)
+		}
+	})
+}
+
+// rewriteDependencyList points the entries of the `dependencies` list of a Chart.yaml or a Chart.lock file to the
+// charts mirrored for them.
+func rewriteDependencyList(ctx *appcontext.AppContext, path string, dependencies []Dependency) error {
+	var rewriteErr error
+	err := editYAMLFile(path, func(doc *valuesDocument) {
+		list := mappingValue(resolveAlias(doc.root.Content[0]), "dependencies")
+		if list == nil || list.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, entry := range list.Content {
+			entry = resolveAlias(entry)
+			name, repository := mappingValue(entry, "name"), mappingValue(entry, "repository")
+			if name == nil || repository == nil {
+				continue
+			}
+			for _, dep := range dependencies {
+				if dep.Name != name.Value || dep.Repository != repository.Value {
+					continue
+				}
+				mirroredRepository, mirroredVersion, err := dependencyRepository(ctx, dep)
+				if err != nil {
+					rewriteErr = err
+					return
+				}
+				doc.set(repository, mirroredRepository)
+				if version := mappingValue(entry, "version"); version != nil {
+					doc.set(version, mirroredVersion)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return rewriteErr
+}
+
+// editYAMLFile edits a YAML file in place, keeping everything but the values edited, see valuesDocument.
+func editYAMLFile(path string, edit func(doc *valuesDocument)) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc, err := parseValues(content)
+	if err != nil {
+		return err
+	}
+	if doc.root.Kind != yaml.DocumentNode || len(doc.root.Content) == 0 {
+		return nil
+	}
+	edit(doc)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, doc.bytes(), info.Mode())
+}
+
+// hashDependencies computes the digest of a Chart.lock from the dependencies of Chart.yaml and the ones locked,
+// as `helm dependency update` does, so `helm dependency build` finds the lock in sync with Chart.yaml.
+func hashDependencies(req, lock []*chart.Dependency) (string, error) {
+	data, err := json.Marshal([2][]*chart.Dependency{req, lock})
+	if err != nil {
+		return "", err
+	}
+	s, err := provenance.Digest(bytes.NewBuffer(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to compute the digest of Chart.lock: %w", err)
+	}
+	return "sha256:" + s, nil
+}
+
+// dependencyKey identifies a chart mirrored from the charts file or as a dependency, to mirror each chart once.
+func dependencyKey(ch types.Chart) string {
+	return strings.TrimSuffix(ch.Source, "/") + "/" + ch.Name + ":" + ch.Version
+}
@@ -0,0 +1,217 @@
+package charts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// pushTestChart packages a chart with dependencies, vendored in charts/ as `helm package` requires, and a Chart.lock
+// if locked dependencies are given, and pushes it to a registry as `charts/<name>:<version>`.
+func pushTestChart(t *testing.T, registry *registrytest.Server, name, version string, dependencies, locked []*chart.Dependency) {
+	t.Helper()
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version, Dependencies: dependencies},
+	}
+	for _, dep := range dependencies {
+		ch.AddDependency(&chart.Chart{Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: dep.Name, Version: "1.0.0"}})
+	}
+	if locked != nil {
+		digest, err := hashDependencies(dependencies, locked)
+		require.NoError(t, err)
+		ch.Lock = &chart.Lock{Digest: digest, Dependencies: locked}
+	}
+	archivePath, err := chartutil.Save(ch, t.TempDir())
+	require.NoError(t, err)
+	archive, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	registry.PushChart(t, "charts/"+name, name, version, archive)
+}
+
+func TestMirrorHelmCharts_Dependencies(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	sourceRepository := "oci://" + source.Host + "/charts"
+
+	// app locks lib to 1.0.0 although 1.0.1 matches its constraint, web depends on the same lib,
+	// and lib depends back on app
+	pushTestChart(t, source, "app", "1.0.0",
+		[]*chart.Dependency{
+			{Name: "lib", Version: "~1.0", Repository: sourceRepository},
+			{Name: "local", Version: "1.0.0", Repository: "file://../local"},
+		},
+		[]*chart.Dependency{
+			{Name: "lib", Version: "1.0.0", Repository: sourceRepository},
+			{Name: "local", Version: "1.0.0", Repository: "file://../local"},
+		})
+	pushTestChart(t, source, "web", "2.0.0", []*chart.Dependency{{Name: "lib", Version: "1.0.0", Repository: sourceRepository}}, nil)
+	pushTestChart(t, source, "lib", "1.0.0", []*chart.Dependency{{Name: "app", Version: "1.0.0", Repository: sourceRepository}}, nil)
+	pushTestChart(t, source, "lib", "1.0.1", nil, nil)
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: app
+    source: `+sourceRepository+`
+    version: 1.0.0
+  - name: web
+    source: `+sourceRepository+`
+    version: 2.0.0
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				ImagesRepository: target.Host + "/mirror/images",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none", MirrorDependencies: true},
+		},
+	}
+
+	var dependencies []ResolvedChart
+	opts := MirrorOptions{OnDependencies: func(resolved []ResolvedChart) { dependencies = resolved }}
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:1.0.0", "web:2.0.0", "lib:1.0.0"}, successful)
+	assert.Empty(t, failed)
+	assert.Equal(t, []string{"1.0.0-mirrored"}, target.Tags("mirror/charts/lib"))
+	assert.Equal(t, []ResolvedChart{
+		{Entry: types.Chart{Name: "lib", Source: sourceRepository, Version: "~1.0"}, Versions: []string{"1.0.0"}},
+		{Entry: types.Chart{Name: "lib", Source: sourceRepository, Version: "1.0.0"}, Versions: []string{"1.0.0"}},
+		{Entry: types.Chart{Name: "app", Source: sourceRepository, Version: "1.0.0"}, Versions: []string{"1.0.0"}},
+	}, dependencies)
+
+	mirroredRepository := "oci://" + target.Host + "/mirror/charts"
+	tests := []struct {
+		name                 string
+		expectedDependencies []*chart.Dependency
+		expectedLock         []*chart.Dependency
+	}{
+		{
+			name: "app",
+			expectedDependencies: []*chart.Dependency{
+				{Name: "lib", Version: "1.0.0-mirrored", Repository: mirroredRepository},
+				{Name: "local", Version: "1.0.0", Repository: "file://../local"},
+			},
+			expectedLock: []*chart.Dependency{
+				{Name: "lib", Version: "1.0.0-mirrored", Repository: mirroredRepository},
+				{Name: "local", Version: "1.0.0", Repository: "file://../local"},
+			},
+		},
+		{
+			name:                 "lib",
+			expectedDependencies: []*chart.Dependency{{Name: "app", Version: "1.0.0-mirrored", Repository: mirroredRepository}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := registryclient.NewRepository(appCtx, target.Host+"/mirror/charts/"+tt.name)
+			require.NoError(t, err)
+			desc, err := repo.Resolve(context.Background(), "1.0.0-mirrored")
+			require.NoError(t, err)
+			archivePath, err := readChartArchive(repo, desc, filepath.Join(t.TempDir(), tt.name+".tgz"))
+			require.NoError(t, err)
+			ch, err := loader.Load(archivePath)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedDependencies, ch.Metadata.Dependencies)
+			if tt.expectedLock == nil {
+				assert.Nil(t, ch.Lock)
+				return
+			}
+			require.NotNil(t, ch.Lock)
+			assert.Equal(t, tt.expectedLock, ch.Lock.Dependencies)
+			// The lock is kept in sync with Chart.yaml, as `helm dependency build` checks
+			digest, err := hashDependencies(ch.Metadata.Dependencies, ch.Lock.Dependencies)
+			require.NoError(t, err)
+			assert.Equal(t, digest, ch.Lock.Digest)
+		})
+	}
+}
+
+func TestMirrorHelmCharts_DependenciesResolveVersions(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	sourceRepository := "oci://" + source.Host + "/charts"
+
+	// Without a Chart.lock, the constraint of lib is resolved by ResolveVersions rather than to the newest version
+	pushTestChart(t, source, "app", "1.0.0", []*chart.Dependency{{Name: "lib", Version: "~1.0", Repository: sourceRepository}}, nil)
+	pushTestChart(t, source, "lib", "1.0.0", nil, nil)
+	pushTestChart(t, source, "lib", "1.0.1", nil, nil)
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: app
+    source: `+sourceRepository+`
+    version: 1.0.0
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				ImagesRepository: target.Host + "/mirror/images",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none", MirrorDependencies: true},
+		},
+	}
+
+	var entries []types.Chart
+	opts := MirrorOptions{ResolveVersions: func(entry types.Chart) ([]string, error) {
+		entries = append(entries, entry)
+		if entry.Name == "lib" {
+			return []string{"1.0.0"}, nil
+		}
+		return []string{entry.Version}, nil
+	}}
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:1.0.0", "lib:1.0.0"}, successful)
+	assert.Empty(t, failed)
+	assert.Equal(t, []string{"1.0.0-mirrored"}, target.Tags("mirror/charts/lib"))
+	assert.Equal(t, []types.Chart{
+		{Name: "app", Source: sourceRepository, Version: "1.0.0"},
+		{Name: "lib", Source: sourceRepository, Version: "~1.0"},
+	}, entries)
+}
+
+func TestDependencyCycle(t *testing.T) {
+	app := types.Chart{Name: "app", Source: "oci://registry.example.com/charts", Version: "1.0.0"}
+	lib := types.Chart{Name: "lib", Source: "oci://registry.example.com/charts", Version: "1.0.0"}
+	tests := []struct {
+		name     string
+		chain    []types.Chart
+		key      string
+		expected []string
+	}{
+		{name: "no cycle", chain: []types.Chart{app}, key: dependencyKey(lib), expected: nil},
+		{name: "self", chain: []types.Chart{app}, key: dependencyKey(app), expected: []string{"app:1.0.0", "app:1.0.0"}},
+		{name: "parent", chain: []types.Chart{app, lib}, key: dependencyKey(app), expected: []string{"app:1.0.0", "lib:1.0.0", "app:1.0.0"}},
+		{name: "other version", chain: []types.Chart{app}, key: dependencyKey(types.Chart{Name: "app", Source: app.Source + "/", Version: "2.0.0"}), expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, dependencyCycle(tt.chain, tt.key))
+		})
+	}
+}
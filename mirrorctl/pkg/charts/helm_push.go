@@ -3,93 +3,103 @@ package charts
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
-	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog/log"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/file"
-	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
 )
 
-// pushChart pushes a packaged Helm chart to a Google Artifact Registry.
-// It takes an application context, the path to the packaged chart, the chart name, and the chart version as input.
-// It returns an error if the chart could not be pushed.
-func pushChart(ctx *appcontext.AppContext, packagedChartPath string, chartName string, chartVersion string) error {
-	log.Debug().Str("chart_path", packagedChartPath).Msg("Pushing chart to GAR")
+// Annotations of the manifest of a mirrored chart, with the provenance of the upstream chart it was mirrored from,
+// see checkMirroredChart.
+const (
+	annotationRepackagedBy  = "mirrorctl/repackaged-by"
+	annotationSourceDigest  = "mirrorctl/source-digest"
+	annotationTransformSpec = "mirrorctl/transform-spec"
+	annotationPinnedDigests = "mirrorctl/pinned-digests"
+)
+
+// helmConfigMediaType is the media type of the config blob of a Helm chart manifest, the metadata of its Chart.yaml.
+const helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+
+// pushChart pushes a packaged Helm chart to the target registry, or to an OCI image layout if one is given.
+// The config blob of the manifest holds the metadata of the Chart.yaml, as `helm push` does, and the provenance of
+// the chart is recorded in the annotations of the manifest, see chartAnnotations.
+// It takes an application context, the path to the packaged chart, the chart name, the chart version and the OCI
+// image layout, nil to push to the target registry, as input.
+// It returns the descriptor of the chart manifest, empty in dry-run mode, the number of registry operations retried
+// and an error if the chart could not be pushed.
+func pushChart(ctx *appcontext.AppContext, packagedChartPath string, chartName string, chartVersion string, layout *oci.Store) (v1.Descriptor, int, error) {
+	log.Debug().Str("chart_path", packagedChartPath).Msg("Pushing chart to the target registry")
+
+	repoRef, tag, err := TargetReference(ctx, types.Chart{Name: chartName, Version: chartVersion})
+	if err != nil {
+		return v1.Descriptor{}, 0, err
+	}
 
 	chartFilename := filepath.Base(packagedChartPath)
 	imageName := stripArchiveExtension(chartFilename)
 	if imageName == "" {
-		return fmt.Errorf("unable to derive image name from packaged chart filename %q", chartFilename)
+		return v1.Descriptor{}, 0, fmt.Errorf("unable to derive image name from packaged chart filename %q", chartFilename)
 	}
 
-	repoRef := buildRepositoryReference(ctx.Config.GCP.GARRepoCharts, chartName)
-	tag := fmt.Sprintf("%s-%s", chartVersion, ctx.Config.Options.Suffix)
-
 	if ctx.DryRun {
 		log.Info().
 			Str("chart_path", packagedChartPath).
 			Str("repo", repoRef).
 			Str("tag", tag).
-			Msg("Running in dry-run mode: chart push to GAR skipped.")
+			Msg("Running in dry-run mode: chart push to the target registry skipped.")
 		log.Info().
 			Msgf("To push manually, run:\noras push %s %s:application/vnd.cncf.helm.chart.content.v1.tar+gzip --annotation mirrorctl/repackaged-by=%s/%s",
 				repoRef,
 				filepath.Base(packagedChartPath),
 				version.AppName,
 				version.Version)
-		return nil
+		return v1.Descriptor{}, 0, nil
 	}
 
 	log.Debug().Str("repo_ref", repoRef).Msg("Normalized repository reference for ORAS")
 
-	// Create the ORAS remote repository client with the normalized reference.
-	repo, err := remote.NewRepository(repoRef)
+	repo, reference, err := chartDestination(ctx, repoRef, tag, layout)
 	if err != nil {
-		return fmt.Errorf("failed to create remote repository for %q: %w", repoRef, err)
+		return v1.Descriptor{}, 0, err
 	}
 
-	// Authenticate with Google Artifact Registry using gcloud access token
-	cmd := exec.Command("gcloud", "auth", "print-access-token")
-	tokenBytes, err := cmd.Output()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get gcloud access token")
-		return fmt.Errorf("failed to get gcloud access token: %w", err)
+	// retry runs a registry operation with the retry policy and counts its retries
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	totalRetries := 0
+	withRetry := func(operation string, fn func() error) error {
+		retries, err := policy.Do(context.Background(), operation+" "+repoRef, fn)
+		totalRetries += retries
+		return err
 	}
-	token := strings.TrimSpace(string(tokenBytes))
 
-	// Configure the ORAS repository client auth using the gcloud access token.
-	repo.Client = &auth.Client{
-		Client: http.DefaultClient,
-		Cache:  auth.NewCache(),
-		Credential: func(ctx context.Context, s string) (auth.Credential, error) {
-			return auth.Credential{AccessToken: token}, nil
-		},
+	ch, err := loader.Load(packagedChartPath)
+	if err != nil {
+		return v1.Descriptor{}, 0, fmt.Errorf("failed to load packaged chart: %w", err)
 	}
-
-	// TODO add more annotations? change the key to be aligned with the ones in the Chart.yaml?
 	// Annotations attached to the manifest so we can trace origin / repackager
-	annotations := map[string]string{
-		"mirrorctl/repackaged-by": fmt.Sprintf("%s/%s", version.AppName, version.Version),
-	}
+	annotations := chartAnnotations(ch.Metadata)
 	log.Debug().Interface("annotations", annotations).Msg("Setting chart annotations")
 
 	fs, err := file.New(filepath.Dir(packagedChartPath))
 	if err != nil {
-		return fmt.Errorf("failed to create file store: %w", err)
+		return v1.Descriptor{}, 0, fmt.Errorf("failed to create file store: %w", err)
 	}
 	defer fs.Close()
 
@@ -99,36 +109,42 @@ func pushChart(ctx *appcontext.AppContext, packagedChartPath string, chartName s
 		"application/vnd.cncf.helm.chart.content.v1.tar+gzip",
 		packagedChartPath)
 	if err != nil {
-		return fmt.Errorf("failed to add chart file to store: %w", err)
+		return v1.Descriptor{}, 0, fmt.Errorf("failed to add chart file to store: %w", err)
 	}
 
-	// Push the chart blob itself to GAR
-	log.Debug().Str("digest", fileDesc.Digest.String()).Msg("Pushing chart blob to GAR")
-	chartData, err := os.Open(packagedChartPath)
+	// Push the chart blob itself to the target registry
+	// The file is opened again on every attempt so that a retry uploads it from the start
+	log.Debug().Str("digest", fileDesc.Digest.String()).Msg("Pushing chart blob to the target registry")
+	err = withRetry("push chart blob", func() error {
+		chartData, err := os.Open(packagedChartPath)
+		if err != nil {
+			return fmt.Errorf("failed to open chart file for upload: %w", err)
+		}
+		defer chartData.Close()
+		return repo.Push(context.Background(), fileDesc, chartData)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open chart file for upload: %w", err)
-	}
-	defer chartData.Close()
-
-	if err := repo.Push(context.Background(), fileDesc, chartData); err != nil {
-		return fmt.Errorf("failed to push chart blob: %w", err)
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to push chart blob: %w", err)
 	}
 
-	// Create a minimal Helm config blob (Helm requires this)
-	configJSON := []byte(`{"mediaType":"application/vnd.cncf.helm.config.v1+json","annotations":{}}`)
-	hash := sha256.Sum256(configJSON)
-	configDesc := v1.Descriptor{
-		MediaType: "application/vnd.cncf.helm.config.v1+json",
-		Digest:    digest.Digest("sha256:" + hex.EncodeToString(hash[:])),
-		Size:      int64(len(configJSON)),
+	// The Helm config blob is the metadata of the Chart.yaml, read by `helm show chart`
+	configJSON, err := json.Marshal(ch.Metadata)
+	if err != nil {
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to encode Helm config blob: %w", err)
 	}
+	configDesc := content.NewDescriptorFromBytes(helmConfigMediaType, configJSON)
 
 	// Push config blob
-	if err := repo.Push(context.Background(), configDesc, bytes.NewReader(configJSON)); err != nil {
-		return fmt.Errorf("failed to push Helm config blob: %w", err)
+	err = withRetry("push config blob", func() error {
+		return repo.Push(context.Background(), configDesc, bytes.NewReader(configJSON))
+	})
+	if err != nil {
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to push Helm config blob: %w", err)
 	}
 
 	// Pack manifest referencing config + layer
+	// It is packed in memory: the file store would write a manifest with a title annotation to a file of that name
+	manifestStore := memory.New()
 	packOpts := oras.PackManifestOptions{
 		ConfigDescriptor:    &configDesc,
 		Layers:              []v1.Descriptor{fileDesc},
@@ -136,33 +152,199 @@ func pushChart(ctx *appcontext.AppContext, packagedChartPath string, chartName s
 	}
 	manifestDesc, err := oras.PackManifest(
 		context.Background(),
-		fs,
+		manifestStore,
 		oras.PackManifestVersion1_1,
 		"application/vnd.oci.image.manifest.v1+json",
 		packOpts,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to pack manifest: %w", err)
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to pack manifest: %w", err)
 	}
 
 	// Push manifest itself
-	manifestBytes, err := fs.Fetch(context.Background(), manifestDesc)
+	manifestBytes, err := content.FetchAll(context.Background(), manifestStore, manifestDesc)
 	if err != nil {
-		return fmt.Errorf("failed to fetch manifest content from store: %w", err)
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to fetch manifest content from store: %w", err)
 	}
-	if err := repo.Push(context.Background(), manifestDesc, io.Reader(manifestBytes)); err != nil {
-		return fmt.Errorf("failed to push manifest to GAR: %w", err)
+	err = withRetry("push manifest", func() error {
+		return repo.Push(context.Background(), manifestDesc, bytes.NewReader(manifestBytes))
+	})
+	if err != nil {
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to push manifest to the target registry: %w", err)
 	}
 
-	if err := repo.Tag(context.Background(), manifestDesc, tag); err != nil {
-		return fmt.Errorf("failed to tag manifest %q: %w", tag, err)
+	err = withRetry("tag manifest", func() error {
+		return repo.Tag(context.Background(), manifestDesc, reference)
+	})
+	if err != nil {
+		return v1.Descriptor{}, totalRetries, fmt.Errorf("failed to tag manifest %q: %w", reference, err)
 	}
 
 	log.Info().
 		Str("repo", repoRef).
 		Str("tag", tag).
-		Msg("Successfully pushed chart to GAR")
-	return nil
+		Int("retries", totalRetries).
+		Msg("Successfully pushed chart to the target registry")
+	return manifestDesc, totalRetries, nil
+}
+
+// chartAnnotations returns the annotations of the manifest of a mirrored chart, from the metadata of its Chart.yaml:
+// the standard `org.opencontainers.image.*` annotations, with the upstream chart as the base image, and the
+// provenance annotations of mirrorctl, see ProvenanceMetadata.
+// Annotations whose value is unknown, e.g. the upstream digest of a chart transformed by TransformHelmChart, are
+// left out.
+func chartAnnotations(metadata *chart.Metadata) map[string]string {
+	provenance := metadata.Annotations
+	annotations := map[string]string{
+		annotationRepackagedBy: fmt.Sprintf("%s/%s", version.AppName, version.Version),
+		v1.AnnotationTitle:     metadata.Name,
+		v1.AnnotationVersion:   metadata.Version,
+	}
+	set := func(key, value string) {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+	set(v1.AnnotationDescription, metadata.Description)
+	set(v1.AnnotationURL, metadata.Home)
+	set(v1.AnnotationCreated, provenance[provenanceTimestamp])
+	set(v1.AnnotationSource, provenance[provenanceOriginalChartURL])
+	set(annotationSourceDigest, provenance[provenanceOriginalChartDigest])
+	set(v1.AnnotationBaseImageDigest, provenance[provenanceOriginalChartDigest])
+	set(annotationTransformSpec, provenance[provenanceTransformSpec])
+	set(annotationPinnedDigests, provenance[provenancePinnedDigests])
+	if name, ver := provenance[provenanceOriginalChartName], provenance[provenanceOriginalChartVersion]; name != "" && ver != "" {
+		// The upstream chart, e.g. `registry-1.docker.io/bitnamicharts/nginx:15.0.0` or `https://charts.example.com/nginx:1.0.0`
+		source := strings.TrimSuffix(strings.TrimPrefix(provenance[provenanceOriginalChartURL], "oci://"), "/")
+		annotations[v1.AnnotationBaseImageName] = fmt.Sprintf("%s/%s:%s", source, name, ver)
+	}
+	return annotations
+}
+
+// checkMirroredChart looks up the tag a chart is pushed to, in the target registry or in the OCI image layout if one
+// is given, and compares the digest of the upstream chart archive recorded in its manifest with the one of the chart
+// pulled. The chart is up to date if they are the same and it was transformed with the same options, see
+// transformSpec; a chart transformed with other options, e.g. another images repository, is pushed again.
+// With options.pin_digests, the digests of the images mirrored for the chart, if given, must also be the ones pinned
+// in it, see ImageDigests; a chart pinned to other digests, e.g. because an image tag moved, is pushed again.
+// A tag with no upstream digest recorded, e.g. pushed by an earlier mirrorctl, is pushed again. A tag with another
+// upstream digest is a tag mutation: the chart is pushed again, or it fails with options.notify_tag_mutations, as
+// images do.
+// The lookup of the tag is retried, and a tag not found in the target registry is pushed.
+// It returns whether the chart is up to date, the number of registry operations retried, and an error if the tag
+// cannot be looked up or it mutated with options.notify_tag_mutations.
+func checkMirroredChart(ctx *appcontext.AppContext, chart types.Chart, sourceDigest string, digests ImageDigests, layout *oci.Store) (bool, int, error) {
+	repoRef, tag, err := TargetReference(ctx, chart)
+	if err != nil {
+		return false, 0, err
+	}
+	target, reference, err := chartDestination(ctx, repoRef, tag, layout)
+	if err != nil {
+		return false, 0, err
+	}
+
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	var manifestJSON []byte
+	retries, err := policy.Do(context.Background(), "resolve "+repoRef+":"+tag, func() error {
+		desc, err := target.Resolve(context.Background(), reference)
+		if err != nil {
+			return err
+		}
+		manifestJSON, err = content.FetchAll(context.Background(), target, desc)
+		return err
+	})
+	switch {
+	case registryclient.IsNotFound(err):
+		return false, retries, nil
+	case err != nil:
+		return false, retries, fmt.Errorf("failed to look up the chart in the target registry: %w", err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return false, retries, fmt.Errorf("failed to parse the manifest of the chart in the target registry: %w", err)
+	}
+
+	mirroredDigest := manifest.Annotations[annotationSourceDigest]
+	state, err := compareMirroredChart(ctx, manifest, sourceDigest)
+	if err != nil {
+		return false, retries, err
+	}
+	switch state {
+	case chartUpToDate:
+		if ctx.Config.Options.PinDigests && digests != nil && manifest.Annotations[annotationPinnedDigests] != digests.spec() {
+			log.Info().Str("chart", chart.Name).Str("pinned_digests", digests.spec()).
+				Str("target_pinned_digests", manifest.Annotations[annotationPinnedDigests]).
+				Msg("Chart mirrored with other image digests pinned in the target registry, pushing it again")
+			return false, retries, nil
+		}
+		return true, retries, nil
+	case chartOtherOptions:
+		log.Info().Str("chart", chart.Name).Str("target_transform_spec", manifest.Annotations[annotationTransformSpec]).
+			Msg("Chart mirrored with other options in the target registry, pushing it again")
+		return false, retries, nil
+	case chartUnannotated:
+		// Charts pushed by an earlier mirrorctl have no upstream digest, they are pushed again to record it
+		log.Info().Str("chart", chart.Name).Str("repackaged_by", manifest.Annotations[annotationRepackagedBy]).
+			Msg("Chart in the target registry has no upstream digest recorded, pushing it again")
+		return false, retries, nil
+	}
+	if ctx.Config.Options.NotifyTagMutations {
+		log.Warn().
+			Str("chart", chart.Name).
+			Str("source_digest", sourceDigest).
+			Str("target_source_digest", mirroredDigest).
+			Msg("Tag points to a chart mirrored from another upstream chart in the target registry, please manually check")
+		return false, retries, fmt.Errorf("chart %s tag %s points to a chart mirrored from another upstream chart in the target registry, please manually check", chart.Name, tag)
+	}
+	log.Warn().Str("chart", chart.Name).Str("source_digest", sourceDigest).Str("target_source_digest", mirroredDigest).
+		Msg("Tag points to a chart mirrored from another upstream chart in the target registry, pushing it again")
+	return false, retries, nil
+}
+
+// mirroredChartState is how a chart in the target registry compares with the upstream chart mirrored to its tag.
+type mirroredChartState int
+
+const (
+	chartUpToDate     mirroredChartState = iota // Mirrored from the upstream chart with the same options.
+	chartOtherOptions                           // Mirrored from the upstream chart with other options, see transformSpec.
+	chartUnannotated                            // Pushed with no upstream digest recorded, e.g. by an earlier mirrorctl.
+	chartTagMutated                             // Mirrored from another upstream chart.
+)
+
+// compareMirroredChart compares the annotations of the manifest of a chart in the target registry with the digest
+// of the upstream chart archive and the options it would be transformed with.
+// It returns the state of the chart, and an error if the options cannot be read.
+func compareMirroredChart(ctx *appcontext.AppContext, manifest v1.Manifest, sourceDigest string) (mirroredChartState, error) {
+	switch manifest.Annotations[annotationSourceDigest] {
+	case sourceDigest:
+		spec, err := transformSpec(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if manifest.Annotations[annotationTransformSpec] != spec {
+			return chartOtherOptions, nil
+		}
+		return chartUpToDate, nil
+	case "":
+		return chartUnannotated, nil
+	default:
+		return chartTagMutated, nil
+	}
+}
+
+// chartDestination returns where a chart is pushed to and the reference it is tagged with: the OCI image layout if
+// one is given, with the reference of the chart in the target registry, or the repository of the chart in the
+// target registry, with its tag.
+// The repository authenticates with the credential provider configured for the target registry host.
+func chartDestination(ctx *appcontext.AppContext, repoRef, tag string, layout *oci.Store) (oras.Target, string, error) {
+	if layout != nil {
+		return layout, repoRef + ":" + tag, nil
+	}
+	repo, err := registryclient.NewRepository(ctx, repoRef)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create remote repository for %q: %w", repoRef, err)
+	}
+	return repo, tag, nil
 }
 
 // stripArchiveExtension removes the archive extension from a file name.
@@ -188,27 +370,32 @@ func stripArchiveExtension(name string) string {
 	}
 }
 
+// TargetReference returns the repository and the tag a chart is pushed to in the target registry:
+// `<charts_repository>/<name>` and `<version>-<suffix>`.
+// It returns an error if no target registry with a charts repository is configured.
+func TargetReference(ctx *appcontext.AppContext, chart types.Chart) (string, string, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return "", "", err
+	}
+	if target.ChartsRepository == "" {
+		return "", "", fmt.Errorf("target %q has no charts repository", target.Name)
+	}
+	return buildRepositoryReference(target.ChartsRepository, chart.Name), fmt.Sprintf("%s-%s", chart.Version, ctx.Config.Options.Suffix), nil
+}
+
 // buildRepositoryReference builds a repository reference for a given base repository and image name.
-// It takes a base repository and an image name as input.
+// It takes a base repository (the target repository prefix) and an image name as input.
 // It returns a string containing the repository reference.
 func buildRepositoryReference(baseRepo string, imageName string) string {
 	ref := strings.TrimSpace(baseRepo)
+	ref = strings.TrimPrefix(ref, "oci://")
 	ref = strings.TrimPrefix(ref, "https://")
 	ref = strings.TrimPrefix(ref, "http://")
 	ref = strings.TrimPrefix(ref, "/v2/")
-	ref = strings.Replace(ref, "/v2/", "/", 1)
 	ref = strings.ReplaceAll(ref, "/v2/", "/")
+	ref = strings.TrimSuffix(ref, "/")
 
-	// Split into host + path segments
-	parts := strings.Split(ref, "/")
-	// Typical: parts[0] = host, parts[1] = project, parts[2] = repo, optional parts[3:] = image or deeper
-	if len(parts) >= 4 {
-		// Already has an image segment, return as-is
-		return ref
-	}
-	// Append the imageName to ensure we have HOST/PROJECT/REPO/IMAGE
-	if strings.HasSuffix(ref, "/") {
-		return ref + imageName
-	}
+	// The chart is stored in its own repository under the prefix: HOST/PREFIX/CHART
 	return ref + "/" + imageName
 }
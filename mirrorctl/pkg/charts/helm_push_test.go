@@ -0,0 +1,122 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"oras.land/oras-go/v2/content"
+)
+
+func TestBuildRepositoryReference(t *testing.T) {
+	tests := []struct {
+		baseRepo string
+		expected string
+	}{
+		{"europe-southwest1-docker.pkg.dev/project/charts", "europe-southwest1-docker.pkg.dev/project/charts/nginx"},
+		{"oci://harbor.example.com/mirror/charts/", "harbor.example.com/mirror/charts/nginx"},
+		{"https://localhost:5000/v2/charts", "localhost:5000/charts/nginx"},
+		{"registry.example.com", "registry.example.com/nginx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.baseRepo, func(t *testing.T) {
+			assert.Equal(t, tt.expected, buildRepositoryReference(tt.baseRepo, "nginx"))
+		})
+	}
+}
+
+func TestPushChart_GenericTarget(t *testing.T) {
+	registry := registrytest.New(t)
+	chartPath, err := chartutil.Save(&chart.Chart{Metadata: &chart.Metadata{
+		APIVersion:  chart.APIVersionV2,
+		Name:        "nginx",
+		Version:     "1.0.0-mirrored",
+		Description: "NGINX Open Source",
+		Home:        "https://nginx.org",
+		Annotations: map[string]string{
+			provenanceOriginalChartURL:     "oci://registry-1.docker.io/bitnamicharts",
+			provenanceOriginalChartName:    "nginx",
+			provenanceOriginalChartVersion: "1.0.0",
+			provenanceOriginalChartDigest:  "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			provenanceTransformSpec:        "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+			provenanceTimestamp:            "2025-11-14T16:26:31Z",
+		},
+	}}, t.TempDir())
+	require.NoError(t, err)
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: "oci://" + registry.Host + "/mirror/charts",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Options: config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+
+	manifestDesc, retries, err := pushChart(appCtx, chartPath, "nginx", "1.0.0", nil)
+	require.NoError(t, err)
+	assert.Zero(t, retries)
+	assert.Equal(t, []string{"1.0.0-mirrored"}, registry.Tags("mirror/charts/nginx"))
+
+	repo, err := registryclient.NewRepository(appCtx, registry.Host+"/mirror/charts/nginx")
+	require.NoError(t, err)
+	manifestJSON, err := content.FetchAll(context.Background(), repo, manifestDesc)
+	require.NoError(t, err)
+	var manifest v1.Manifest
+	require.NoError(t, json.Unmarshal(manifestJSON, &manifest))
+
+	// The provenance of the Chart.yaml is recorded in the manifest
+	assert.Equal(t, map[string]string{
+		annotationRepackagedBy:       "mirrorctl/dev",
+		annotationSourceDigest:       "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		annotationTransformSpec:      "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+		v1.AnnotationTitle:           "nginx",
+		v1.AnnotationVersion:         "1.0.0-mirrored",
+		v1.AnnotationDescription:     "NGINX Open Source",
+		v1.AnnotationURL:             "https://nginx.org",
+		v1.AnnotationCreated:         "2025-11-14T16:26:31Z",
+		v1.AnnotationSource:          "oci://registry-1.docker.io/bitnamicharts",
+		v1.AnnotationBaseImageName:   "registry-1.docker.io/bitnamicharts/nginx:1.0.0",
+		v1.AnnotationBaseImageDigest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}, manifest.Annotations)
+
+	// The config blob is the metadata of the Chart.yaml, as `helm show chart` reads it
+	assert.Equal(t, helmConfigMediaType, manifest.Config.MediaType)
+	configJSON, err := content.FetchAll(context.Background(), repo, manifest.Config)
+	require.NoError(t, err)
+	var metadata chart.Metadata
+	require.NoError(t, json.Unmarshal(configJSON, &metadata))
+	assert.Equal(t, "nginx", metadata.Name)
+	assert.Equal(t, "1.0.0-mirrored", metadata.Version)
+	assert.Equal(t, "NGINX Open Source", metadata.Description)
+	assert.Equal(t, "1.0.0", metadata.Annotations[provenanceOriginalChartVersion])
+}
+
+func TestChartAnnotations_UnknownProvenance(t *testing.T) {
+	// A chart transformed by TransformHelmChart has no upstream digest nor transform spec
+	annotations := chartAnnotations(&chart.Metadata{
+		Name:    "loki",
+		Version: "5.0.0-poc",
+		Annotations: map[string]string{
+			provenanceOriginalChartURL:     "https://grafana.github.io/helm-charts",
+			provenanceOriginalChartName:    "loki",
+			provenanceOriginalChartVersion: "5.0.0",
+		},
+	})
+
+	assert.Equal(t, "https://grafana.github.io/helm-charts/loki:5.0.0", annotations[v1.AnnotationBaseImageName])
+	for _, key := range []string{annotationSourceDigest, annotationTransformSpec, v1.AnnotationBaseImageDigest, v1.AnnotationDescription, v1.AnnotationCreated} {
+		assert.NotContains(t, annotations, key)
+	}
+}
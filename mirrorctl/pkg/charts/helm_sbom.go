@@ -0,0 +1,70 @@
+package charts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// pushSBOM pushes the SBOM of a chart to the target registry, or to an OCI image layout if one is given, as an OCI artifact whose subject is the chart manifest,
+// so that it is listed by the referrers API, e.g. with `oras discover`. On registries without the referrers API,
+// the artifact is listed in the referrers tag schema.
+// It takes an application context, the chart name, the descriptor of the chart manifest, the SBOM document,
+// its artifact type, such as application/vnd.cyclonedx+json, and the OCI image layout, nil to push to the target
+// registry, as input.
+// It returns the descriptor of the SBOM manifest, the number of registry operations retried
+// and an error if the SBOM could not be pushed.
+func pushSBOM(ctx *appcontext.AppContext, chartName string, subject v1.Descriptor, document []byte, artifactType string, layout *oci.Store) (v1.Descriptor, int, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return v1.Descriptor{}, 0, err
+	}
+	repoRef := buildRepositoryReference(target.ChartsRepository, chartName)
+	repo, _, err := chartDestination(ctx, repoRef, "", layout)
+	if err != nil {
+		return v1.Descriptor{}, 0, err
+	}
+
+	layerDesc := content.NewDescriptorFromBytes(artifactType, document)
+	layerDesc.Annotations = map[string]string{v1.AnnotationTitle: chartName + "-sbom.json"}
+
+	// The SBOM blob, the empty config and the manifest are all pushed again on every attempt
+	var manifestDesc v1.Descriptor
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	retries, err := policy.Do(context.Background(), "push SBOM "+repoRef, func() error {
+		if _, err := oras.PushBytes(context.Background(), repo, artifactType, document); err != nil {
+			return fmt.Errorf("failed to push SBOM blob: %w", err)
+		}
+		var err error
+		manifestDesc, err = oras.PackManifest(context.Background(), repo, oras.PackManifestVersion1_1, artifactType, oras.PackManifestOptions{
+			Subject: &subject,
+			Layers:  []v1.Descriptor{layerDesc},
+			ManifestAnnotations: map[string]string{
+				"mirrorctl/generated-by": fmt.Sprintf("%s/%s", version.AppName, version.Version),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to push SBOM manifest: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return v1.Descriptor{}, retries, err
+	}
+
+	log.Info().
+		Str("repo", repoRef).
+		Str("subject", subject.Digest.String()).
+		Str("digest", manifestDesc.Digest.String()).
+		Str("artifact_type", artifactType).
+		Msg("Successfully attached SBOM to the chart")
+	return manifestDesc, retries, nil
+}
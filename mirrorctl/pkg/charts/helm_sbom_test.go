@@ -0,0 +1,80 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"oras.land/oras-go/v2/content"
+)
+
+func TestPushSBOM(t *testing.T) {
+	tests := []struct {
+		name           string
+		noReferrersAPI bool
+	}{
+		{name: "referrers API"},
+		{name: "referrers tag schema", noReferrersAPI: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := registrytest.New(t)
+			registry.NoReferrersAPI = tt.noReferrersAPI
+			chartPath, err := chartutil.Save(&chart.Chart{
+				Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "nginx", Version: "1.0.0-mirrored"},
+			}, t.TempDir())
+			require.NoError(t, err)
+
+			appCtx := &appcontext.AppContext{
+				Config: &config.Config{
+					Targets: []config.TargetConfig{{
+						Name:             "local",
+						ChartsRepository: "oci://" + registry.Host + "/mirror/charts",
+						TransportConfig:  config.TransportConfig{PlainHTTP: true},
+					}},
+					Options: config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+				},
+			}
+			chartDesc, _, err := pushChart(appCtx, chartPath, "nginx", "1.0.0", nil)
+			require.NoError(t, err)
+
+			document := []byte(`{"bomFormat":"CycloneDX","specVersion":"1.5"}`)
+			sbomDesc, retries, err := pushSBOM(appCtx, "nginx", chartDesc, document, "application/vnd.cyclonedx+json", nil)
+			require.NoError(t, err)
+			assert.Zero(t, retries)
+
+			// The SBOM is found from the chart with the referrers API, or its tag schema fallback
+			repo, err := registryclient.NewRepository(appCtx, registry.Host+"/mirror/charts/nginx")
+			require.NoError(t, err)
+			var referrers []v1.Descriptor
+			require.NoError(t, repo.Referrers(context.Background(), chartDesc, "application/vnd.cyclonedx+json", func(found []v1.Descriptor) error {
+				referrers = append(referrers, found...)
+				return nil
+			}))
+			require.Len(t, referrers, 1)
+			assert.Equal(t, sbomDesc.Digest, referrers[0].Digest)
+
+			manifestContent, err := content.FetchAll(context.Background(), repo, sbomDesc)
+			require.NoError(t, err)
+			var manifest v1.Manifest
+			require.NoError(t, json.Unmarshal(manifestContent, &manifest))
+			assert.Equal(t, "application/vnd.cyclonedx+json", manifest.ArtifactType)
+			assert.Equal(t, chartDesc.Digest, manifest.Subject.Digest)
+			require.Len(t, manifest.Layers, 1)
+			assert.Equal(t, "nginx-sbom.json", manifest.Layers[0].Annotations[v1.AnnotationTitle])
+
+			layer, err := content.FetchAll(context.Background(), repo, manifest.Layers[0])
+			require.NoError(t, err)
+			assert.Equal(t, document, layer)
+		})
+	}
+}
@@ -1,20 +1,24 @@
 package charts
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -22,20 +26,18 @@ var (
 	annotationsRegex = regexp.MustCompile(`(?m)^annotations:\s*`)
 	// versionRegex extracts the version from a Chart.yaml.
 	versionRegex = regexp.MustCompile(`(?m)^version:\s*(.+)`)
-	// globalSectionRegex matches the 'global:' section in a values.yaml.
-	globalSectionRegex = regexp.MustCompile(`^global:\s*`)
-	// imageRegistryRegex matches 'imageRegistry:' under the 'global:' section.
-	imageRegistryRegex = regexp.MustCompile(`^\s+imageRegistry:\s*`) // global.imageRegistry
-	// globalImageSectionRegex matches 'image:' under the 'global:' section.
-	globalImageSectionRegex = regexp.MustCompile(`^\s+image:\s*`) // global.image
-	// registryRegex matches a 'registry:' line within an image section.
-	registryRegex = regexp.MustCompile(`^\s+registry:\s*`) // any *.registry
-	// imageSectionRegex matches an 'image:' section at any indentation level.
-	imageSectionRegex = regexp.MustCompile(`^\s*(?:[a-zA-Z0-9]+Image|image):\s*`) // any image: section or prefixImage: section
-	// anyImageSectionRegex matches any 'image:' section, capturing indentation.
-	// anyImageSectionRegex = regexp.MustCompile(`^(\s*)image:\s*$`)
-	// repoRegex matches 'repo:' or 'repository:' lines.
-	repoRegex = regexp.MustCompile(`^\s+(repo|repository):\s*(.*)`)
+)
+
+// Provenance annotations of the Chart.yaml of a mirrored chart, also recorded in its manifest, see pushChart.
+const (
+	provenanceRepackagedBy         = "repackage.provenance/repackaged-by"
+	provenanceOriginalChartURL     = "repackage.provenance/original-chart-url"
+	provenanceOriginalChartName    = "repackage.provenance/original-chart-name"
+	provenanceOriginalChartVersion = "repackage.provenance/original-chart-version"
+	provenanceOriginalChartDigest  = "repackage.provenance/original-chart-digest"
+	provenanceTransformSpec        = "repackage.provenance/transform-spec"
+	provenancePinnedDigests        = "repackage.provenance/pinned-digests"
+	provenanceTimestamp            = "repackage.provenance/timestamp"
 )
 
 // ProvenanceMetadata holds information about the original chart before it was repackaged.
@@ -44,6 +46,9 @@ type ProvenanceMetadata struct {
 	OriginalChartURL     string
 	OriginalChartName    string
 	OriginalChartVersion string
+	OriginalChartDigest  string // The digest of the upstream chart archive, empty if unknown or for a subchart.
+	TransformSpec        string // The digest of the options the chart was transformed with, see transformSpec.
+	PinnedDigests        string // The digest of the image digests pinned in the chart, empty if none, see ImageDigests.
 	Timestamp            string
 }
 
@@ -58,14 +63,36 @@ func TransformHelmChart(ctx *appcontext.AppContext, chart types.Chart, srcChartP
 	} else {
 		transformedChartPath = path.Join(outputPath[0], fmt.Sprintf("%s-%s", chart.Name, time.Now().Format("20060102150405.1234")))
 	}
+	transformedChartPath, _, err := transformHelmChart(ctx, chart, "", srcChartPath, transformedChartPath, nil, nil)
+	return transformedChartPath, err
+}
+
+// transformHelmChart copies and transforms a Helm chart as TransformHelmChart does, to a given path.
+// The digest of the upstream chart archive, if known, is recorded in the provenance annotations of the root Chart.yaml.
+// If digests are given, the image references of the values.yaml files are also pinned to the digests mirrored.
+// If dependencies are given, the dependencies of the Chart.yaml and the Chart.lock are pointed to the charts mirrored
+// for them, see rewriteDependencies.
+// The image references written literally in the templates are rewritten too, see processTemplate.
+// It returns the path to the transformed chart, the image references of the templates that are computed and
+// could not be rewritten, and an error if the transformation fails.
+func transformHelmChart(ctx *appcontext.AppContext, chart types.Chart, sourceDigest, srcChartPath, transformedChartPath string, digests ImageDigests, dependencies []Dependency) (string, []types.ComputedImage, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return "", nil, err
+	}
+	spec, err := transformSpec(ctx)
+	if err != nil {
+		return "", nil, err
+	}
 
 	// Create output directory
 	if err := os.MkdirAll(transformedChartPath, 0755); err != nil {
 		log.Error().Err(err).Str("path", transformedChartPath).Msg("Failed to create output directory")
-		return "", err
+		return "", nil, err
 	}
+	var computed []types.ComputedImage
 	// TODO use filepath.WalkDir? it's more efficient
-	err := filepath.Walk(srcChartPath, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(srcChartPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -90,29 +117,46 @@ func TransformHelmChart(ctx *appcontext.AppContext, chart types.Chart, srcChartP
 		switch baseName {
 		case "Chart.yaml":
 			// Only process the root Chart.yaml
+			provenance := ProvenanceMetadata{OriginalChartURL: chart.Source, TransformSpec: spec}
 			if filepath.Dir(relPath) == "." {
-				return processChartYAML(path, destPath, ctx.Config.Options.Suffix, chart.Source)
+				provenance.OriginalChartDigest = sourceDigest
+				provenance.PinnedDigests = digests.spec()
+				return processChartYAML(path, destPath, ctx.Config.Options.Suffix, provenance)
 			} else if strings.HasPrefix(filepath.Dir(relPath), "charts/") {
 				log.Debug().Str("destPath", destPath).Str("path", relPath).Msg("Processing DEP charts")
-				return processChartYAML(path, destPath, ctx.Config.Options.Suffix, chart.Source)
+				return processChartYAML(path, destPath, ctx.Config.Options.Suffix, provenance)
 			}
 			return copyFile(path, destPath)
 		case "values.yaml":
-			// Only process the root values.yaml, skip sub-chart values.yaml files
-			if filepath.Dir(relPath) == "." {
-				return processValuesYAML(path, destPath, ctx.Config.GCP.GARRepoContainers)
-			} else if strings.HasPrefix(filepath.Dir(relPath), "charts/") {
+			if filepath.Dir(relPath) != "." && !strings.HasPrefix(filepath.Dir(relPath), "charts/") {
+				return copyFile(path, destPath)
+			}
+			if strings.HasPrefix(filepath.Dir(relPath), "charts/") {
 				log.Debug().Str("destPath", destPath).Str("path", relPath).Msg("Processing DEP values")
-				return processValuesYAML(path, destPath, ctx.Config.GCP.GARRepoContainers)
 			}
-			return copyFile(path, destPath)
+			return processValuesYAML(path, destPath, target.ImagesRepository, digests)
 		default:
+			if helm.IsTemplateFile(relPath) {
+				images, err := processTemplate(path, destPath, target.ImagesRepository)
+				if err != nil {
+					return err
+				}
+				for _, img := range images {
+					computed = append(computed, types.ComputedImage{Chart: chart.Name, File: filepath.ToSlash(relPath), Line: img.Line, Reference: img.Value})
+				}
+				return nil
+			}
 			return copyFile(path, destPath)
 		}
 	})
 	if err != nil {
 		log.Error().Err(err).Str("path", transformedChartPath).Msg("Failed to process chart")
-		return "", err
+		return "", nil, err
+	}
+	if len(dependencies) > 0 {
+		if err := rewriteDependencies(ctx, transformedChartPath, dependencies); err != nil {
+			return "", nil, err
+		}
 	}
 
 	log.Debug().
@@ -120,14 +164,79 @@ func TransformHelmChart(ctx *appcontext.AppContext, chart types.Chart, srcChartP
 		Str("transformed chart path", transformedChartPath).
 		Msg("Helm chart transformed")
 
-	return transformedChartPath, nil
+	return transformedChartPath, computed, nil
+}
+
+// retargetHelmChart copies a Helm chart transformed for an images repository, and points its images to another one:
+// the references to the images repository in the values.yaml files and the templates, the files the transformation
+// rewrites, are replaced. The rest of the chart, its version and provenance annotations included, is copied as it is.
+// It takes the path of the transformed chart, the destination path, and the images repositories the chart was
+// transformed for and is retargeted to as input.
+// It returns an error if the chart cannot be copied.
+func retargetHelmChart(srcChartPath, retargetedChartPath, fromRepository, toRepository string) error {
+	fromRegex := regexp.MustCompile(`(?m)` + regexp.QuoteMeta(strings.TrimSuffix(fromRepository, "/")) + `([/"'\s]|$)`)
+	replacement := strings.ReplaceAll(strings.TrimSuffix(toRepository, "/"), "$", "$$") + "${1}"
+
+	return filepath.Walk(srcChartPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcChartPath, path)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(retargetedChartPath, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(destPath, info.Mode())
+		}
+
+		isValues := filepath.Base(relPath) == "values.yaml" &&
+			(filepath.Dir(relPath) == "." || strings.HasPrefix(filepath.Dir(relPath), "charts/"))
+		if !isValues && !helm.IsTemplateFile(relPath) {
+			return copyFile(path, destPath)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(destPath, []byte(fromRegex.ReplaceAllString(string(content), replacement)), info.Mode())
+	})
+}
+
+// transformSpec returns the digest of the options a chart is transformed with: the version suffix, the repositories
+// of the target, and whether the images are pinned by digest and the dependencies mirrored.
+// A chart mirrored from the same upstream chart with another transform spec is mirrored again, see checkMirroredChart.
+// It returns an error if no target registry is configured.
+func transformSpec(ctx *appcontext.AppContext) (string, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return "", err
+	}
+	spec, err := json.Marshal(struct {
+		Suffix             string `json:"suffix"`
+		ImagesRepository   string `json:"images_repository"`
+		ChartsRepository   string `json:"charts_repository"`
+		PinDigests         bool   `json:"pin_digests"`
+		MirrorDependencies bool   `json:"mirror_dependencies"`
+	}{
+		Suffix:             ctx.Config.Options.Suffix,
+		ImagesRepository:   strings.TrimSuffix(target.ImagesRepository, "/"),
+		ChartsRepository:   strings.TrimSuffix(target.ChartsRepository, "/"),
+		PinDigests:         ctx.Config.Options.PinDigests,
+		MirrorDependencies: ctx.Config.Options.MirrorDependencies,
+	})
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(spec).String(), nil
 }
 
 // processChartYAML processes the Chart.yaml file of a Helm chart.
 // It updates the version of the chart by appending a suffix, and adds provenance annotations.
-// It takes the source path of the Chart.yaml file, the destination path, the version suffix, and the original chart URL as input.
+// It takes the source path of the Chart.yaml file, the destination path, the version suffix, and the provenance of
+// the chart known by the caller, its original URL, digest and transform spec, as input.
 // It returns an error if the processing fails.
-func processChartYAML(srcPath, destPath, versionSuffix, originalChartURL string) error {
+func processChartYAML(srcPath, destPath, versionSuffix string, provenance ProvenanceMetadata) error {
 	content, err := os.ReadFile(srcPath)
 	if err != nil {
 		return fmt.Errorf("failed to read Chart.yaml: %w", err)
@@ -141,14 +250,10 @@ func processChartYAML(srcPath, destPath, versionSuffix, originalChartURL string)
 	modified := replaceVersion(string(content), versionSuffix)
 
 	// Add provenance metadata
-	// TODO Think about getting the original helm chart digest and store it here too
-	provenance := ProvenanceMetadata{
-		RepackagedBy:         fmt.Sprintf("%s %s", version.AppName, version.Version),
-		OriginalChartURL:     originalChartURL,
-		OriginalChartName:    originalName,
-		OriginalChartVersion: originalVersion,
-		Timestamp:            time.Now().UTC().Format(time.RFC3339),
-	}
+	provenance.RepackagedBy = fmt.Sprintf("%s %s", version.AppName, version.Version)
+	provenance.OriginalChartName = originalName
+	provenance.OriginalChartVersion = originalVersion
+	provenance.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	modified = addProvenanceAnnotations(modified, provenance)
 
 	return os.WriteFile(destPath, []byte(modified), 0644)
@@ -231,12 +336,7 @@ func addProvenanceAnnotations(content string, provenance ProvenanceMetadata) str
 			}
 
 			// Add provenance metadata annotations
-			result = append(result, fmt.Sprintf("%s# --- Provenance Metadata ---", indent))
-			result = append(result, fmt.Sprintf("%srepackage.provenance/repackaged-by: \"%s\"", indent, provenance.RepackagedBy))
-			result = append(result, fmt.Sprintf("%srepackage.provenance/original-chart-url: \"%s\"", indent, provenance.OriginalChartURL))
-			result = append(result, fmt.Sprintf("%srepackage.provenance/original-chart-name: \"%s\"", indent, provenance.OriginalChartName))
-			result = append(result, fmt.Sprintf("%srepackage.provenance/original-chart-version: \"%s\"", indent, provenance.OriginalChartVersion))
-			result = append(result, fmt.Sprintf("%srepackage.provenance/timestamp: \"%s\"", indent, provenance.Timestamp))
+			result = append(result, provenanceLines(indent, provenance)...)
 		}
 	}
 
@@ -247,12 +347,7 @@ func addProvenanceAnnotations(content string, provenance ProvenanceMetadata) str
 			newResult := make([]string, 0, len(result)+8)
 			newResult = append(newResult, result[:apiVersionIndex+1]...)
 			newResult = append(newResult, "annotations:")
-			newResult = append(newResult, "  # --- Provenance Metadata ---")
-			newResult = append(newResult, fmt.Sprintf("  repackage.provenance/repackaged-by: \"%s\"", provenance.RepackagedBy))
-			newResult = append(newResult, fmt.Sprintf("  repackage.provenance/original-chart-url: \"%s\"", provenance.OriginalChartURL))
-			newResult = append(newResult, fmt.Sprintf("  repackage.provenance/original-chart-name: \"%s\"", provenance.OriginalChartName))
-			newResult = append(newResult, fmt.Sprintf("  repackage.provenance/original-chart-version: \"%s\"", provenance.OriginalChartVersion))
-			newResult = append(newResult, fmt.Sprintf("  repackage.provenance/timestamp: \"%s\"", provenance.Timestamp))
+			newResult = append(newResult, provenanceLines("  ", provenance)...)
 			newResult = append(newResult, result[apiVersionIndex+1:]...)
 			result = newResult
 		} else {
@@ -263,260 +358,183 @@ func addProvenanceAnnotations(content string, provenance ProvenanceMetadata) str
 	return strings.Join(result, "\n")
 }
 
-// handleGlobalImageDotRegistry handles the `global.image.registry` field in a values.yaml file.
-// It takes a line of the values.yaml file, the registry URL, and a pointer to a boolean as input.
-// It returns the modified line and a boolean indicating whether the line was modified.
-func handleGlobalImageDotRegistry(line string, registryURL string, inImageSection *bool) (string, bool) {
-	if globalImageSectionRegex.MatchString(line) {
-		*inImageSection = true
+// provenanceLines returns the provenance annotations of a Chart.yaml file, indented, with a comment heading them.
+// The digest of the original chart, the transform spec and the pinned digests are only added when they are known.
+func provenanceLines(indent string, provenance ProvenanceMetadata) []string {
+	lines := []string{
+		indent + "# --- Provenance Metadata ---",
+		fmt.Sprintf("%s%s: \"%s\"", indent, provenanceRepackagedBy, provenance.RepackagedBy),
+		fmt.Sprintf("%s%s: \"%s\"", indent, provenanceOriginalChartURL, provenance.OriginalChartURL),
+		fmt.Sprintf("%s%s: \"%s\"", indent, provenanceOriginalChartName, provenance.OriginalChartName),
+		fmt.Sprintf("%s%s: \"%s\"", indent, provenanceOriginalChartVersion, provenance.OriginalChartVersion),
 	}
-
-	if *inImageSection && registryRegex.MatchString(line) {
-		indent := line[:strings.Index(line, "registry")]
-		return fmt.Sprintf("%sregistry: \"%s\"", indent, registryURL), true
+	if provenance.OriginalChartDigest != "" {
+		lines = append(lines, fmt.Sprintf("%s%s: \"%s\"", indent, provenanceOriginalChartDigest, provenance.OriginalChartDigest))
 	}
-
-	// If we are in image section and encounter a line that is not indented as part of image section,
-	// then we are out of image section.
-	trimmed := strings.TrimSpace(line)
-	if *inImageSection && len(line) > 0 && line[0] != ' ' && line[0] != '#' && trimmed != "" {
-		*inImageSection = false
+	if provenance.TransformSpec != "" {
+		lines = append(lines, fmt.Sprintf("%s%s: \"%s\"", indent, provenanceTransformSpec, provenance.TransformSpec))
 	}
-
-	return line, false
-}
-
-// handleGlobalImageRegistry handles the `global.imageRegistry` field in a values.yaml file.
-// It takes a line of the values.yaml file and the registry URL as input.
-// It returns the modified line and a boolean indicating whether the line was modified.
-func handleGlobalImageRegistry(line string, registryURL string) (string, bool) {
-	if imageRegistryRegex.MatchString(line) {
-		indent := line[:strings.Index(line, "imageRegistry")]
-		return fmt.Sprintf("%simageRegistry: \"%s\"", indent, registryURL), true
-	}
-	return line, false
-}
-
-// handleImageRegistry handles the `registry` field within a top-level image section in a values.yaml file.
-// It takes a line of the values.yaml file and the registry URL as input.
-// It returns the modified line and a boolean indicating whether the line was modified.
-func handleImageRegistry(line string, registryURL string) (string, bool) {
-	if registryRegex.MatchString(line) {
-		indent := line[:strings.Index(line, "registry")]
-		return fmt.Sprintf("%sregistry: \"%s\"", indent, registryURL), true
+	if provenance.PinnedDigests != "" {
+		lines = append(lines, fmt.Sprintf("%s%s: \"%s\"", indent, provenancePinnedDigests, provenance.PinnedDigests))
 	}
-	return line, false
-}
-
-// handleImageRepo handles the `repo` and `repository` fields in a values.yaml file.
-// It takes a line of the values.yaml file and the registry URL as input.
-// It returns the modified line and a boolean indicating whether the line was modified.
-func handleImageRepo(line string, registryURL string) (string, bool) {
-	matches := repoRegex.FindStringSubmatch(line)
-	if len(matches) == 3 {
-		key := matches[1]
-		valueStr := strings.TrimSpace(matches[2])
-		currentValue := strings.Trim(valueStr, "\"'")
-		newValue := registryURL + "/" + currentValue
-		indent := line[:strings.Index(line, key)]
-		return fmt.Sprintf("%s%s: \"%s\"", indent, key, newValue), true
-	}
-	return line, false
-}
-
-// hasGlobalRegistry checks if a values.yaml file has a global registry defined.
-// It takes the path to the values.yaml file as input.
-// It returns a boolean indicating whether a global registry is defined and an error if the file cannot be read.
-func hasGlobalRegistry(srcPath string) (bool, error) {
-	srcFile, err := os.Open(srcPath)
-	if err != nil {
-		return false, fmt.Errorf("failed to open values.yaml: %w", err)
-	}
-	defer srcFile.Close()
-
-	scanner := bufio.NewScanner(srcFile)
-	inGlobalSection := false
-	inImageSection := false
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Check if we're entering the global section
-		if globalSectionRegex.MatchString(line) {
-			inGlobalSection = true
-			continue
-		}
-
-		// Check if we're in the global section
-		if inGlobalSection {
-			// Check for global.imageRegistry
-			if imageRegistryRegex.MatchString(line) {
-				return true, nil
-			}
-
-			// Check for global.image.registry
-			if globalImageSectionRegex.MatchString(line) {
-				inImageSection = true
-				continue
-			}
-			if inImageSection && registryRegex.MatchString(line) {
-				return true, nil
-			}
-
-			// Detect if we've left the global section
-			trimmed := strings.TrimSpace(line)
-			if len(line) > 0 && line[0] != ' ' && line[0] != '#' && trimmed != "" {
-				inGlobalSection = false
-				inImageSection = false
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return false, fmt.Errorf("error reading values.yaml: %w", err)
-	}
-
-	return false, nil
+	return append(lines, fmt.Sprintf("%s%s: \"%s\"", indent, provenanceTimestamp, provenance.Timestamp))
 }
 
 // processValuesYAML processes the values.yaml file of a Helm chart.
-// It updates the image registry and repository fields to point to a new registry.
-// It takes the source path of the values.yaml file, the destination path, and the registry URL as input.
+// It updates the image registry and repository fields to point to a new registry, see rewriteRegistries,
+// and pins the images to the digests mirrored if digests are given, see digestPinner.
+// The file is edited in place, so its comments and formatting are kept.
+// It takes the source path of the values.yaml file, the destination path, the registry URL and the digests as input.
 // It returns an error if the processing fails.
-func processValuesYAML(srcPath, destPath, registryURL string) error {
-	// Check if values.yaml contains global.imageRegistry or global.image.registry
-	hasGlobal, err := hasGlobalRegistry(srcPath)
+func processValuesYAML(srcPath, destPath, registryURL string, digests ImageDigests) error {
+	content, err := os.ReadFile(srcPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read values.yaml: %w", err)
 	}
-
-	srcFile, err := os.Open(srcPath)
+	doc, err := parseValues(content)
 	if err != nil {
-		return fmt.Errorf("failed to open values.yaml: %w", err)
+		return err
 	}
-	defer srcFile.Close()
 
-	destFile, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output values.yaml: %w", err)
+	if len(digests) > 0 {
+		pinner := &digestPinner{digests: digests, defaultTag: chartAppVersion(filepath.Dir(srcPath))}
+		pinner.pin(doc)
+		log.Debug().Str("values", srcPath).Int("pinned", pinner.pinned).Msg("Pinned image references by digest")
 	}
-	defer destFile.Close()
-
-	scanner := bufio.NewScanner(srcFile)
-	writer := bufio.NewWriter(destFile)
-	defer writer.Flush()
 
-	// Track if we found the imageRegistry field
-	foundRegistry := false
-	inGlobalSection := false
-	inGlobalImageSection := false // For global.image
-
-	// Track any active image section (not just top-level)
-	type imageSection struct {
-		indentation              int
-		registryHandledInSection bool
+	if !rewriteRegistries(doc, registryURL) {
+		log.Printf("Warning: No global image registry field (global.imageRegistry or global.image.registry) or image repo found in values.yaml")
 	}
-	var currentImageSection *imageSection
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		originalLine := line
-
-		// Determine current indentation level
-		currentIndent := 0
-		for i, char := range line {
-			if char != ' ' {
-				currentIndent = i
-				break
-			}
-		}
-		trimmed := strings.TrimSpace(line)
+	return os.WriteFile(destPath, doc.bytes(), 0644)
+}
 
-		// Check if we're entering the global section
-		if globalSectionRegex.MatchString(line) {
-			inGlobalSection = true
-			writer.WriteString(line + "\n")
-			continue
+// rewriteRegistries points the images of a values.yaml document to a registry.
+// If the document has a global registry, `global.imageRegistry` or `global.image.registry`, it is the only one
+// changed, as the images of the chart are pulled from it. Otherwise, the `registry` field of each image mapping
+// is changed, or the registry is prepended to its repository if it has none.
+// The images written as a single reference are always prefixed with the registry.
+// Each repository is renamed to the name of the image in the registry, see mirroredName, so that
+// `docker.io/bitnami/redis` becomes `<registry>/redis`, where the image is mirrored.
+// It returns true if any image or global registry was found.
+func rewriteRegistries(doc *valuesDocument, registryURL string) bool {
+	globalRegistries, globalImage := findGlobalRegistries(doc.root)
+	found, globalSet := false, false
+	for _, node := range globalRegistries {
+		if !isTemplated(node.Value) && doc.set(node, registryURL) {
+			found, globalSet = true, true
 		}
-
-		// Check if we're leaving the global section
-		if inGlobalSection && len(line) > 0 && line[0] != ' ' && line[0] != '#' && trimmed != "" && !globalSectionRegex.MatchString(line) {
-			// Check if it's not a continuation of global section (like global.image)
-			if currentIndent == 0 {
-				inGlobalSection = false
-				inGlobalImageSection = false
-			}
+	}
+	rename := func(repository *yaml.Node) {
+		if name := mirroredName(repository.Value); name != repository.Value {
+			doc.set(repository, name)
 		}
+	}
 
-		// Check if we're in the global section
-		if inGlobalSection {
-			// Try to handle global.imageRegistry
-			if modifiedLine, replaced := handleGlobalImageRegistry(line, registryURL); replaced {
-				foundRegistry = true
-				writer.WriteString(modifiedLine + "\n")
-				continue
+	forEachImage(doc.root, func(img valuesImage) {
+		switch {
+		case img.scalar != nil:
+			if doc.set(img.scalar, registryURL+"/"+mirroredName(img.scalar.Value)) {
+				found = true
 			}
-
-			// Try to handle global.image.registry
-			if modifiedLine, replaced := handleGlobalImageDotRegistry(line, registryURL, &inGlobalImageSection); replaced {
-				foundRegistry = true
-				writer.WriteString(modifiedLine + "\n")
-				continue
+		case img.mapping == globalImage || len(globalRegistries) > 0:
+			// Pulled from the global registry
+			if globalSet {
+				rename(img.field("repository", "repo"))
 			}
-		}
-
-		// Check if we're entering an image section (anywhere, not just top level)
-		// But skip if we're in the global section
-		if !inGlobalSection && !hasGlobal && imageSectionRegex.MatchString(line) {
-			currentImageSection = &imageSection{
-				indentation:              currentIndent,
-				registryHandledInSection: false,
+		default:
+			repository := img.field("repository", "repo")
+			if registry := img.field("registry"); registry != nil {
+				if !isTemplated(registry.Value) && doc.set(registry, registryURL) {
+					rename(repository)
+					found = true
+				}
+			} else if doc.set(repository, registryURL+"/"+mirroredName(repository.Value)) {
+				found = true
 			}
-			writer.WriteString(line + "\n")
-			continue
 		}
+	})
+	return found
+}
 
-		// Check if we're leaving the current image section
-		// If the line is not indented more than the image section's indentation,
-		// and it's not a comment or empty line, we've left the section
-		if currentImageSection != nil && trimmed != "" && line != "" && line[0] != '#' && currentIndent <= currentImageSection.indentation {
-			currentImageSection = nil // Leave the image section
-		}
+// findGlobalRegistries returns the global registry fields of a values.yaml document,
+// `global.imageRegistry` and `global.image.registry`, and the `global.image` mapping if there is one.
+func findGlobalRegistries(root *yaml.Node) ([]*yaml.Node, *yaml.Node) {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil, nil
+	}
+	global := mappingValue(resolveAlias(root.Content[0]), "global")
+	if global == nil || global.Kind != yaml.MappingNode {
+		return nil, nil
+	}
 
-		// Process the current line if we're inside an image section
-		if currentImageSection != nil && !hasGlobal {
-			// First try to handle registry field within the current image section
-			if !currentImageSection.registryHandledInSection {
-				if modifiedLine, replaced := handleImageRegistry(line, registryURL); replaced {
-					currentImageSection.registryHandledInSection = true
-					foundRegistry = true
-					writer.WriteString(modifiedLine + "\n")
-					continue
-				}
-			}
+	var registries []*yaml.Node
+	if node := mappingValue(global, "imageregistry"); node != nil && node.Kind == yaml.ScalarNode {
+		registries = append(registries, node)
+	}
+	image := mappingValue(global, "image")
+	if image == nil || image.Kind != yaml.MappingNode {
+		return registries, nil
+	}
+	if node := mappingValue(image, "registry"); node != nil && node.Kind == yaml.ScalarNode {
+		registries = append(registries, node)
+	}
+	return registries, image
+}
 
-			// Only handle repo/repository if registry was not handled in this section
-			if !currentImageSection.registryHandledInSection {
-				if modifiedLine, replaced := handleImageRepo(line, registryURL); replaced {
-					foundRegistry = true
-					writer.WriteString(modifiedLine + "\n")
-					continue
-				}
-			}
+// mappingValue returns the value of a key of a mapping node, matching the key case-insensitively,
+// or nil if the node is not a mapping or it has no such key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.ToLower(node.Content[i].Value) == key {
+			return resolveAlias(node.Content[i+1])
 		}
-
-		writer.WriteString(originalLine + "\n")
 	}
+	return nil
+}
+
+// mirroredName returns the name of an image repository or reference in the images repository of the target
+// registry: its last path segment, with its tag and digest, e.g. `redis:7.2` for `docker.io/bitnami/redis:7.2`.
+// The images of a chart are mirrored under that name, see chartscanner, and ImageDigests identifies them by it.
+func mirroredName(reference string) string {
+	return path.Base(reference)
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading values.yaml: %w", err)
+// processTemplate processes a template of a Helm chart.
+// It rewrites the image references written literally in the template, e.g. `image: busybox:1.36` in a test hook,
+// to the registry, as the images written as a single reference in values.yaml are. The rest of the template,
+// its template actions included, is copied as it is.
+// It takes the source path of the template, the destination path, and the registry URL as input.
+// It returns the image references computed by template actions, which cannot be rewritten,
+// and an error if the processing fails.
+func processTemplate(srcPath, destPath, registryURL string) ([]helm.TemplateImage, error) {
+	content, err := os.ReadFile(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, err
 	}
 
-	if !foundRegistry {
-		log.Printf("Warning: No global image registry field (global.imageRegistry or global.image.registry) or image repo found in values.yaml")
+	var computed []helm.TemplateImage
+	images := helm.FindTemplateImages(content)
+	// Replace from the end so the offsets of the previous references are kept
+	for i := len(images) - 1; i >= 0; i-- {
+		img := images[i]
+		if img.Computed {
+			computed = append([]helm.TemplateImage{img}, computed...)
+			continue
+		}
+		rewritten := strconv.Quote(registryURL + "/" + mirroredName(img.Value))
+		log.Debug().Str("template", srcPath).Int("line", img.Line).Str("image", img.Value).Msg("Rewriting image reference of template")
+		content = append(content[:img.Start:img.Start], append([]byte(rewritten), content[img.End:]...)...)
 	}
 
-	return nil
+	return computed, os.WriteFile(destPath, content, info.Mode())
 }
 
 // copyFile copies a file from a source path to a destination path.
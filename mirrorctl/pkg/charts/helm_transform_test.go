@@ -275,11 +275,11 @@ func compareChartYaml(expectedPath, actualPath string) error {
 
 func TestProcessChartYaml(t *testing.T) {
 	tests := []struct {
-		name             string
-		input            string
-		suffix           string
-		originalChartURL string
-		checkResult      func(t *testing.T, output string)
+		name        string
+		input       string
+		suffix      string
+		provenance  ProvenanceMetadata
+		checkResult func(t *testing.T, output string)
 	}{
 		{
 			name: "chart with existing annotations",
@@ -289,13 +289,23 @@ func TestProcessChartYaml(t *testing.T) {
 apiVersion: v2
 version: 1.2.3
 name: test-chart`,
-			suffix:           "build.1",
-			originalChartURL: "https://charts.bitnami.com/bitnami",
+			suffix: "build.1",
+			provenance: ProvenanceMetadata{
+				OriginalChartURL:    "https://charts.bitnami.com/bitnami",
+				OriginalChartDigest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+				TransformSpec:       "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+			},
 			checkResult: func(t *testing.T, output string) {
 				if !strings.Contains(output, "version: 1.2.3-build.1") {
 					t.Errorf("Version was not updated correctly")
 				}
 				checkProvenanceAnnotations(t, output, "test-chart", "1.2.3")
+				if !strings.Contains(output, `  repackage.provenance/original-chart-digest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"`) {
+					t.Errorf("Original chart digest was not added")
+				}
+				if !strings.Contains(output, `  repackage.provenance/transform-spec: "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"`) {
+					t.Errorf("Transform spec was not added")
+				}
 			},
 		},
 		{
@@ -304,8 +314,8 @@ name: test-chart`,
 name: loki
 version: 5.0.0
 description: Loki is a horizontally scalable log aggregation system`,
-			suffix:           "poc",
-			originalChartURL: "https://charts.bitnami.com/bitnami",
+			suffix:     "poc",
+			provenance: ProvenanceMetadata{OriginalChartURL: "https://charts.bitnami.com/bitnami"},
 			checkResult: func(t *testing.T, output string) {
 				if !strings.Contains(output, "version: 5.0.0-poc") {
 					t.Errorf("Version was not updated correctly")
@@ -314,6 +324,10 @@ description: Loki is a horizontally scalable log aggregation system`,
 					t.Errorf("Annotations section was not created")
 				}
 				checkProvenanceAnnotations(t, output, "loki", "5.0.0")
+				// The digest and the transform spec are left out when they are not known
+				if strings.Contains(output, "repackage.provenance/original-chart-digest") || strings.Contains(output, "repackage.provenance/transform-spec") {
+					t.Errorf("Unknown provenance was added")
+				}
 			},
 		},
 	}
@@ -329,7 +343,7 @@ description: Loki is a horizontally scalable log aggregation system`,
 				t.Fatalf("Failed to create test file: %v", err)
 			}
 
-			err = processChartYAML(srcPath, destPath, tt.suffix, tt.originalChartURL)
+			err = processChartYAML(srcPath, destPath, tt.suffix, tt.provenance)
 			if err != nil {
 				t.Fatalf("processChartYaml failed: %v", err)
 			}
@@ -397,7 +411,7 @@ func TestProcessValuesYaml(t *testing.T) {
 			expected: `global:
   image:
     registry: "my-new-loki-registry.com"
-    repository: loki/loki
+    repository: "loki"
     tag: "2.9.0"
   imagePullSecrets: []`,
 		},
@@ -438,7 +452,7 @@ func TestProcessValuesYaml(t *testing.T) {
   # -- Image registry
   registry: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts"
   # -- Image repo
-  repository: grafana/agent-operator
+  repository: "agent-operator"
   tag: v0.44.2`,
 		},
 		{
@@ -456,7 +470,7 @@ func TestProcessValuesYaml(t *testing.T) {
     # -- Test image registry
     registry: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts"
     # -- Test image repo
-    repository: library/busybox
+    repository: "busybox"
     tag: latest`,
 		},
 		{
@@ -475,7 +489,7 @@ mcImage:
   pullPolicy: IfNotPresent`,
 			registryURL: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts",
 			expected: `image:
-  repository: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts/quay.io/minio/minio"
+  repository: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts/minio"
   tag: RELEASE.2022-08-13T21-54-44Z
   pullPolicy: IfNotPresent
 
@@ -483,10 +497,84 @@ imagePullSecrets: []
 # - name: "image-pull-secret"
 
 mcImage:
-  repository: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts/quay.io/minio/mc"
+  repository: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-helm-charts/mc"
   tag: RELEASE.2022-08-11T00-30-48Z
   pullPolicy: IfNotPresent`,
 		},
+		{
+			name: "chart with scalar images",
+			input: `image: docker.io/amazon/aws-cli:2.13.0 # the CLI image
+sidecar:
+  kubectlImage: bitnami/kubectl
+  initImage: "{{ .Values.global.registry }}/busybox:1.36"
+  emptyImage: ""`,
+			registryURL: "registry.example.com/mirror",
+			expected: `image: "registry.example.com/mirror/aws-cli:2.13.0" # the CLI image
+sidecar:
+  kubectlImage: "registry.example.com/mirror/kubectl"
+  initImage: "{{ .Values.global.registry }}/busybox:1.36"
+  emptyImage: ""`,
+		},
+		{
+			name: "chart with flow mappings and image lists",
+			input: `image: {repository: influxdb, tag: 1.8.10-alpine}
+images:
+  - repository: alpine # base image
+    tag: latest
+  - {registry: ghcr.io, repository: org/tool, tag: v1}
+  - name: no-repository`,
+			registryURL: "registry.example.com/mirror",
+			expected: `image: {repository: "registry.example.com/mirror/influxdb", tag: 1.8.10-alpine}
+images:
+  - repository: "registry.example.com/mirror/alpine" # base image
+    tag: latest
+  - {registry: "registry.example.com/mirror", repository: "tool", tag: v1}
+  - name: no-repository`,
+		},
+		{
+			name: "chart with anchors, aliases and multi-line strings",
+			input: `defaults: &defaultImage
+  repository: 'library/nginx'
+  tag: "1.25"
+image: *defaultImage
+proxyImage: *defaultImage
+notes: |
+  image:
+    repository: not/an/image
+script: >-
+  docker pull
+  image: busybox`,
+			registryURL: "registry.example.com/mirror",
+			expected: `defaults: &defaultImage
+  repository: "registry.example.com/mirror/nginx"
+  tag: "1.25"
+image: *defaultImage
+proxyImage: *defaultImage
+notes: |
+  image:
+    repository: not/an/image
+script: >-
+  docker pull
+  image: busybox`,
+		},
+		{
+			name: "chart with global registry and image sections",
+			input: `global:
+  imageRegistry: ""
+  image:
+    repository: global/image
+image:
+  registry: docker.io
+  repository: bitnami/redis`,
+			registryURL: "registry.example.com/mirror",
+			expected: `global:
+  imageRegistry: "registry.example.com/mirror"
+  image:
+    repository: "image"
+image:
+  registry: docker.io
+  repository: "redis"`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -503,7 +591,7 @@ mcImage:
 			}
 
 			// Process the file
-			err = processValuesYAML(srcPath, destPath, tt.registryURL)
+			err = processValuesYAML(srcPath, destPath, tt.registryURL, nil)
 			if err != nil {
 				t.Fatalf("processValuesYaml failed: %v", err)
 			}
@@ -607,3 +695,94 @@ func TestExtractChartName(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessTemplate(t *testing.T) {
+	input := `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+    - name: test
+      image: busybox:1.36 # test hook
+    - name: cli
+      image: "mcr.microsoft.com/azure-cli"
+    - name: app
+      image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"
+`
+	expected := `apiVersion: v1
+kind: Pod
+spec:
+  containers:
+    - name: test
+      image: "registry.example.com/mirror/busybox:1.36" # test hook
+    - name: cli
+      image: "registry.example.com/mirror/azure-cli"
+    - name: app
+      image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"
+`
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "pod.yaml")
+	destPath := filepath.Join(tmpDir, "pod_modified.yaml")
+	if err := os.WriteFile(srcPath, []byte(input), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	computed, err := processTemplate(srcPath, destPath, "registry.example.com/mirror")
+	if err != nil {
+		t.Fatalf("processTemplate failed: %v", err)
+	}
+	modifiedContent, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Failed to read modified file: %v", err)
+	}
+	if string(modifiedContent) != expected {
+		t.Errorf("Expected:\n%s\n\nGot:\n%s", expected, string(modifiedContent))
+	}
+	if len(computed) != 1 || computed[0].Line != 10 || !computed[0].Computed {
+		t.Errorf("Expected the computed reference of line 10, got %+v", computed)
+	}
+}
+
+func TestRetargetHelmChart(t *testing.T) {
+	files := map[string]struct{ input, expected string }{
+		"Chart.yaml": {
+			input:    "name: app\nversion: 1.0.0-poc\ndescription: mirrored from registry.example.com/mirror\n",
+			expected: "name: app\nversion: 1.0.0-poc\ndescription: mirrored from registry.example.com/mirror\n",
+		},
+		"values.yaml": {
+			input:    "image:\n  registry: registry.example.com/mirror\n  repository: registry.example.com/mirror/nginx\nother: registry.example.com/mirror-other/nginx\n",
+			expected: "image:\n  registry: registry.site.local/images\n  repository: registry.site.local/images/nginx\nother: registry.example.com/mirror-other/nginx\n",
+		},
+		"templates/pod.yaml": {
+			input:    "image: \"registry.example.com/mirror/busybox:1.36\"\n",
+			expected: "image: \"registry.site.local/images/busybox:1.36\"\n",
+		},
+		"charts/sub/values.yaml": {
+			input:    "image: registry.example.com/mirror/redis:7\n",
+			expected: "image: registry.site.local/images/redis:7\n",
+		},
+	}
+	srcDir := filepath.Join(t.TempDir(), "app")
+	for name, file := range files {
+		path := filepath.Join(srcDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create test directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(file.input), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	destDir := filepath.Join(t.TempDir(), "app")
+	if err := retargetHelmChart(srcDir, destDir, "registry.example.com/mirror/", "registry.site.local/images"); err != nil {
+		t.Fatalf("retargetHelmChart failed: %v", err)
+	}
+	for name, file := range files {
+		content, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read retargeted file %s: %v", name, err)
+		}
+		if string(content) != file.expected {
+			t.Errorf("%s: Expected:\n%s\n\nGot:\n%s", name, file.expected, string(content))
+		}
+	}
+}
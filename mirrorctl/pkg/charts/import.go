@@ -0,0 +1,240 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+)
+
+// chartContentMediaType is the media type of the archive layer of a Helm chart manifest.
+const chartContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+// ImportCharts pushes the charts of a bundle to the charts repository of the target registry, as
+// `<charts_repository>/<name>:<version>-<suffix>`.
+// A chart exported for the images repository of the target is pushed as it is, with its referrers, and its digest is
+// checked against the index of the bundle. A chart exported for another images repository is retargeted first, see
+// retargetHelmChart, then packaged and pushed again; its archive is checked against the index of the bundle when it
+// is read.
+// A chart whose tag is already in the target registry with the chart of the bundle is skipped, and listed as up to
+// date. A tag that points to another chart is pushed again, or fails with options.notify_tag_mutations, as images do.
+// It takes an application context, the OCI image layout of the bundle and its artifacts as input.
+//
+// ImportCharts Returns:
+//  1. []string: List of charts pushed (Name:Version), in the order of the artifacts.
+//  2. []string: List of charts that failed to be pushed (Name:Version), in the order of the artifacts.
+//  3. error: An error if no target registry with a charts repository is configured.
+func ImportCharts(ctx *appcontext.AppContext, layout oras.ReadOnlyGraphTarget, artifacts []bundle.Artifact) ([]string, []string, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := TargetReference(ctx, types.Chart{}); err != nil {
+		return nil, nil, err
+	}
+
+	var successfulCharts, failedCharts []string
+	for _, a := range artifacts {
+		if a.Kind != bundle.KindChart {
+			continue
+		}
+		upToDate, retries, err := importChart(ctx, layout, a, target.ImagesRepository)
+		chartDetail := fmt.Sprintf("%s:%s%s", a.Name, a.Version, retry.Suffix(retries))
+		if upToDate {
+			chartDetail += UpToDateSuffix
+		}
+		if err != nil {
+			log.Error().Err(err).Str("chart", a.Name).Int("retries", retries).Msg("Failed to import chart")
+			failedCharts = append(failedCharts, chartDetail)
+			continue
+		}
+		successfulCharts = append(successfulCharts, chartDetail)
+	}
+	return successfulCharts, failedCharts, nil
+}
+
+// importChart pushes a chart of a bundle to the target registry, retargeted to an images repository if it was
+// exported for another one.
+// The tag of a chart pushed as it is must point to the chart of the bundle to be up to date, the one of a retargeted
+// chart to a chart mirrored from the same upstream chart with the options of the target, see checkMirroredChart.
+// It returns whether the chart was up to date, the number of registry operations retried and an error if the chart
+// could not be pushed, or its tag points to another chart with options.notify_tag_mutations.
+func importChart(ctx *appcontext.AppContext, layout oras.ReadOnlyGraphTarget, a bundle.Artifact, imagesRepository string) (bool, int, error) {
+	chart := types.Chart{Name: a.Name, Source: a.Source, Version: a.Version}
+	if !sameRepository(a.ImagesRepository, imagesRepository) {
+		// A bundle exported by an earlier mirrorctl has no upstream digest to compare
+		retries := 0
+		if a.SourceDigest != "" {
+			upToDate, checkRetries, err := checkMirroredChart(ctx, chart, a.SourceDigest, nil, nil)
+			retries = checkRetries
+			if err != nil || upToDate {
+				return upToDate, retries, err
+			}
+		}
+		log.Info().Str("chart", a.Name).Str("from", a.ImagesRepository).Str("to", imagesRepository).
+			Msg("Chart exported for another images repository, retargeting it")
+		pushRetries, err := importRetargetedChart(ctx, layout, a, chart, imagesRepository)
+		return false, retries + pushRetries, err
+	}
+
+	repoRef, tag, err := TargetReference(ctx, chart)
+	if err != nil {
+		return false, 0, err
+	}
+	if ctx.DryRun {
+		log.Info().Str("chart", a.Reference).Str("repo", repoRef).Str("tag", tag).
+			Msg("Running in dry-run mode: chart import to the target registry skipped.")
+		return false, 0, nil
+	}
+	repo, err := registryclient.NewRepository(ctx, repoRef)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to create remote repository for %q: %w", repoRef, err)
+	}
+
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	totalRetries := 0
+	withRetry := func(operation string, fn func() error) error {
+		retries, err := policy.Do(context.Background(), operation+" "+repoRef, fn)
+		totalRetries += retries
+		return err
+	}
+
+	var targetDesc v1.Descriptor
+	err = withRetry("resolve", func() (err error) {
+		targetDesc, err = repo.Resolve(context.Background(), tag)
+		return err
+	})
+	switch {
+	case err == nil && targetDesc.Digest == a.Descriptor.Digest:
+		log.Info().Str("chart", a.Name).Str("digest", targetDesc.Digest.String()).Msg("Chart already exists in the target registry, skipping")
+		return true, totalRetries, nil
+	case err == nil && ctx.Config.Options.NotifyTagMutations:
+		return false, totalRetries, fmt.Errorf("chart %s tag %s points to different digest in the target registry, please manually check", a.Name, tag)
+	case err != nil && !registryclient.IsNotFound(err):
+		return false, totalRetries, fmt.Errorf("failed to resolve the target chart: %w", err)
+	}
+
+	// The chart is copied with its referrers, e.g. the SBOM attached to it
+	err = withRetry("copy chart", func() error {
+		_, err := oras.ExtendedCopy(context.Background(), layout, a.Reference, repo, tag, oras.DefaultExtendedCopyOptions)
+		return err
+	})
+	if err != nil {
+		return false, totalRetries, fmt.Errorf("failed to push chart: %w", err)
+	}
+
+	var desc v1.Descriptor
+	err = withRetry("resolve", func() (err error) {
+		desc, err = repo.Resolve(context.Background(), tag)
+		return err
+	})
+	if err != nil {
+		return false, totalRetries, fmt.Errorf("failed to resolve the chart pushed: %w", err)
+	}
+	if desc.Digest != a.Descriptor.Digest {
+		return false, totalRetries, fmt.Errorf("digest %s pushed differs from the digest %s of the bundle", desc.Digest, a.Descriptor.Digest)
+	}
+
+	log.Info().Str("repo", repoRef).Str("tag", tag).Str("digest", desc.Digest.String()).Int("retries", totalRetries).
+		Msg("Successfully imported chart to the target registry")
+	return false, totalRetries, nil
+}
+
+// importRetargetedChart reads the archive of a chart from a bundle, points its images to an images repository,
+// then packages and pushes it.
+// The SBOM attached to the chart in the bundle references the exported chart, so it is not pushed.
+// It returns the number of registry operations retried and an error if the chart could not be pushed.
+func importRetargetedChart(ctx *appcontext.AppContext, layout oras.ReadOnlyGraphTarget, a bundle.Artifact, chart types.Chart, imagesRepository string) (int, error) {
+	tmpDir, err := helm.CreateTempDir(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer helm.RemoveTempDir(ctx, tmpDir)
+
+	archivePath, err := readChartArchive(layout, a.Descriptor, filepath.Join(tmpDir, a.Name+".tgz"))
+	if err != nil {
+		return 0, err
+	}
+	extractedPath := filepath.Join(tmpDir, "bundle")
+	if err := chartutil.ExpandFile(extractedPath, archivePath); err != nil {
+		return 0, fmt.Errorf("failed to untar chart: %w", err)
+	}
+
+	retargetedPath := filepath.Join(tmpDir, a.Name)
+	if err := retargetHelmChart(filepath.Join(extractedPath, a.Name), retargetedPath, a.ImagesRepository, imagesRepository); err != nil {
+		return 0, fmt.Errorf("failed to retarget chart: %w", err)
+	}
+	if err := updateTransformSpec(ctx, retargetedPath); err != nil {
+		return 0, fmt.Errorf("failed to update the transform spec of the chart: %w", err)
+	}
+	pkgChartPath, err := packageHelmChart(retargetedPath)
+	if err != nil {
+		return 0, err
+	}
+	_, retries, err := pushChart(ctx, pkgChartPath, chart.Name, chart.Version, nil)
+	return retries, err
+}
+
+// updateTransformSpec sets the transform spec annotation of the Chart.yaml of a retargeted chart to the one of the
+// target, so that the provenance of the chart pushed names the images repository it now points to. The rest of the
+// provenance annotations, the upstream digest included, are kept.
+func updateTransformSpec(ctx *appcontext.AppContext, chartPath string) error {
+	spec, err := transformSpec(ctx)
+	if err != nil {
+		return err
+	}
+	return editYAMLFile(filepath.Join(chartPath, chartutil.ChartfileName), func(doc *valuesDocument) {
+		annotations := mappingValue(resolveAlias(doc.root.Content[0]), "annotations")
+		if node := mappingValue(annotations, provenanceTransformSpec); node != nil {
+			doc.set(node, spec)
+		}
+	})
+}
+
+// readChartArchive writes the archive layer of a chart manifest of a bundle to a file.
+// The manifest and the archive are checked against their digest as they are read.
+// It returns the path of the file, and an error if the manifest has no chart archive or it cannot be read.
+func readChartArchive(layout oras.ReadOnlyGraphTarget, manifestDesc v1.Descriptor, path string) (string, error) {
+	manifestJSON, err := content.FetchAll(context.Background(), layout, manifestDesc)
+	if err != nil {
+		return "", fmt.Errorf("failed to read chart manifest: %w", err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return "", fmt.Errorf("failed to parse chart manifest: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != chartContentMediaType {
+			continue
+		}
+		archive, err := content.FetchAll(context.Background(), layout, layer)
+		if err != nil {
+			return "", fmt.Errorf("failed to read chart archive: %w", err)
+		}
+		return path, os.WriteFile(path, archive, 0644)
+	}
+	return "", fmt.Errorf("chart manifest %s has no layer %s", manifestDesc.Digest, chartContentMediaType)
+}
+
+// sameRepository returns true if two repository references are the same, ignoring a trailing slash and the scheme.
+func sameRepository(a, b string) bool {
+	normalize := func(repository string) string {
+		repository = strings.TrimPrefix(strings.TrimSpace(repository), "oci://")
+		return strings.TrimSuffix(repository, "/")
+	}
+	return normalize(a) == normalize(b)
+}
@@ -0,0 +1,127 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestImportCharts(t *testing.T) {
+	source := registrytest.New(t)
+	archive, err := os.ReadFile(filepath.Join("..", "..", "resources", "data_test", "input_charts", "grafana-7.0.19.tgz"))
+	require.NoError(t, err)
+	source.PushChart(t, "charts/grafana", "grafana", "7.0.19", archive)
+
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: 7.0.19
+`), 0600))
+
+	dir := t.TempDir()
+	layout, err := oci.New(dir)
+	require.NoError(t, err)
+	exportCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "airgap",
+				ChartsRepository: "registry.example.com/mirror/charts",
+				ImagesRepository: "registry.example.com/mirror/images",
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+	_, failed, err := MirrorHelmCharts(exportCtx, chartsFile, MirrorOptions{Layout: layout})
+	require.NoError(t, err)
+	require.Empty(t, failed)
+
+	store, err := bundle.Open(context.Background(), dir)
+	require.NoError(t, err)
+	artifacts, err := bundle.Artifacts(context.Background(), store)
+	require.NoError(t, err)
+	exported, err := store.Resolve(context.Background(), "registry.example.com/mirror/charts/grafana:7.0.19-mirrored")
+	require.NoError(t, err)
+
+	influxdb, err := os.ReadFile(filepath.Join("..", "..", "resources", "data_test", "input_charts", "influxdb-4.12.5.tgz"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		imagesRepository string
+		sameDigest       bool
+		mutated          bool
+	}{
+		{name: "same images repository", imagesRepository: "registry.example.com/mirror/images", sameDigest: true},
+		{name: "other images repository", imagesRepository: "registry.site.local/images", sameDigest: false},
+		{name: "same images repository tag mutated", imagesRepository: "registry.example.com/mirror/images", mutated: true},
+		{name: "other images repository tag mutated", imagesRepository: "registry.site.local/images", mutated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := registrytest.New(t)
+			importCtx := &appcontext.AppContext{
+				Config: &config.Config{
+					Targets: []config.TargetConfig{{
+						Name:             "site",
+						ChartsRepository: target.Host + "/charts",
+						ImagesRepository: tt.imagesRepository,
+					}},
+					Registries: []config.RegistryConfig{{Host: target.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+					Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none", NotifyTagMutations: true},
+				},
+			}
+
+			if tt.mutated {
+				// Another chart, mirrored from another upstream chart, is already pushed with the tag
+				desc := target.PushChart(t, "charts/grafana", "influxdb", "7.0.19-mirrored", influxdb)
+				manifestJSON, ok := target.Manifest("charts/grafana", desc.Digest.String())
+				require.True(t, ok)
+				var manifest v1.Manifest
+				require.NoError(t, json.Unmarshal(manifestJSON, &manifest))
+				manifest.Annotations = map[string]string{annotationSourceDigest: digest.FromBytes(influxdb).String()}
+				mutated := target.PushManifest(t, "charts/grafana", "7.0.19-mirrored", manifest, nil)
+				successful, failed, err := ImportCharts(importCtx, store, artifacts)
+				require.NoError(t, err)
+				assert.Empty(t, successful)
+				assert.Equal(t, []string{"grafana:7.0.19"}, failed)
+				dgst, ok := target.Resolve("charts/grafana", "7.0.19-mirrored")
+				require.True(t, ok)
+				assert.Equal(t, mutated.Digest, dgst)
+				return
+			}
+
+			successful, failed, err := ImportCharts(importCtx, store, artifacts)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"grafana:7.0.19"}, successful)
+			assert.Empty(t, failed)
+
+			dgst, ok := target.Resolve("charts/grafana", "7.0.19-mirrored")
+			require.True(t, ok)
+			assert.Equal(t, tt.sameDigest, dgst == exported.Digest)
+
+			// Importing the bundle again leaves the chart as it is
+			successful, failed, err = ImportCharts(importCtx, store, artifacts)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"grafana:7.0.19" + UpToDateSuffix}, successful)
+			assert.Empty(t, failed)
+			again, ok := target.Resolve("charts/grafana", "7.0.19-mirrored")
+			require.True(t, ok)
+			assert.Equal(t, dgst, again)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package charts
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+)
+
+// ImageDigests maps the images mirrored for a chart to the digest mirrored.
+// Images are identified by `name:tag`, the last path segment of their repository and their tag,
+// which is also how they are named in the target registry and in the values rewritten, see mirroredName.
+type ImageDigests map[string]string
+
+// NewImageDigests returns the digests of mirrored images, identified by the last path segment of their target.
+// Images without digest, such as the ones of a dry-run, are left out.
+func NewImageDigests(mirrored []types.MirroredImage) ImageDigests {
+	digests := make(ImageDigests, len(mirrored))
+	for _, img := range mirrored {
+		if img.Digest != "" {
+			digests[path.Base(img.Target)] = img.Digest
+		}
+	}
+	return digests
+}
+
+// spec returns the digest of the set of images and digests, recorded in the manifest of the chart they are pinned in,
+// so that a chart whose images were mirrored again with other digests is not up to date. It is empty for no digest.
+func (d ImageDigests) spec() string {
+	if len(d) == 0 {
+		return ""
+	}
+	// The keys of a map are marshalled sorted
+	data, _ := json.Marshal(map[string]string(d))
+	return digest.FromBytes(data).String()
+}
+
+// lookup returns the digest mirrored for an image repository and tag, or an empty string if there is none.
+// An org-qualified repository, e.g. `bitnami/redis`, is looked up by the name it is mirrored and rewritten to.
+func (d ImageDigests) lookup(repository, tag string) string {
+	return d[mirroredName(repository)+":"+tag]
+}
+
+// digestPinner pins the images of a values.yaml document to the digests mirrored.
+type digestPinner struct {
+	digests    ImageDigests
+	defaultTag string // The tag of the images without one, the appVersion of the chart as in the chart scanner.
+	pinned     int
+}
+
+// chartAppVersion returns the appVersion of the Chart.yaml of a chart directory, its version if it has none,
+// or an empty string if it cannot be read.
+func chartAppVersion(chartDir string) string {
+	content, err := os.ReadFile(filepath.Join(chartDir, "Chart.yaml"))
+	if err != nil {
+		return ""
+	}
+	var chart struct {
+		AppVersion string `yaml:"appVersion"`
+		Version    string `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(content, &chart); err != nil {
+		return ""
+	}
+	if chart.AppVersion != "" {
+		return chart.AppVersion
+	}
+	return chart.Version
+}
+
+// pin pins the images of a values.yaml document found by forEachImage.
+func (p *digestPinner) pin(doc *valuesDocument) {
+	forEachImage(doc.root, func(img valuesImage) {
+		if img.scalar != nil {
+			p.pinScalar(doc, img.scalar)
+		} else {
+			p.pinMapping(doc, img)
+		}
+	})
+}
+
+// pinScalar pins an image written as a single reference, e.g. `image: docker.io/library/busybox:1.36`,
+// to `docker.io/library/busybox:1.36@sha256:<hex>`.
+func (p *digestPinner) pinScalar(doc *valuesDocument, node *yaml.Node) {
+	if strings.Contains(node.Value, "@") {
+		return
+	}
+	ref, err := imageref.Parse(node.Value)
+	if err != nil {
+		return
+	}
+	tag := ref.Tag
+	if tag == "" {
+		tag = p.defaultTag
+	}
+	dgst := p.digests.lookup(ref.Repository, tag)
+	if dgst == "" {
+		return
+	}
+	value := node.Value
+	if ref.Tag == "" {
+		value += ":" + tag
+	}
+	if doc.set(node, value+"@"+dgst) {
+		p.pinned++
+	}
+}
+
+// pinMapping pins an image written as a mapping with a repository and a tag. The digest is written in the
+// `digest` field if the mapping has one, as the charts that support it build the reference from it,
+// otherwise the tag becomes `tag@sha256:<hex>`.
+func (p *digestPinner) pinMapping(doc *valuesDocument, img valuesImage) {
+	repository := img.field("repository", "repo")
+	tag := img.field("tag")
+	digestNode := img.field("digest")
+	if digestNode != nil && digestNode.Value != "" && digestNode.Value != "null" {
+		// Already pinned by the chart
+		return
+	}
+
+	tagValue := p.defaultTag
+	if tag != nil && tag.Value != "" && tag.Value != "null" {
+		tagValue = tag.Value
+	}
+	if isTemplated(tagValue) || strings.Contains(tagValue, "@") {
+		return
+	}
+	dgst := p.digests.lookup(repository.Value, tagValue)
+	if dgst == "" {
+		return
+	}
+
+	var ok bool
+	switch {
+	case digestNode != nil:
+		ok = doc.set(digestNode, dgst)
+	case tag != nil:
+		ok = doc.set(tag, tagValue+"@"+dgst)
+	default:
+		ok = doc.insert(img.mapping, repository, "tag", tagValue+"@"+dgst)
+	}
+	if ok {
+		p.pinned++
+	}
+}
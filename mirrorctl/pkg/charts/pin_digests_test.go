@@ -0,0 +1,171 @@
+package charts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	busyboxDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	redisDigest   = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	agentDigest   = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	influxDigest  = "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+)
+
+func TestNewImageDigests(t *testing.T) {
+	digests := NewImageDigests([]types.MirroredImage{
+		{Target: "harbor.example.com/mirror/busybox:1.36", Digest: busyboxDigest},
+		{Target: "harbor.example.com/mirror/redis:7.2"}, // dry-run
+	})
+	assert.Equal(t, ImageDigests{"busybox:1.36": busyboxDigest}, digests)
+	assert.Equal(t, busyboxDigest, digests.lookup("docker.io/library/busybox", "1.36"))
+	assert.Empty(t, digests.lookup("bitnami/redis", "7.2"))
+}
+
+func TestDigestPinner_Pin(t *testing.T) {
+	values := `# Default values
+image: docker.io/library/busybox:1.36 # scalar image
+redis:
+  image:
+    registry: docker.io
+    repository: bitnami/redis
+    tag: "7.2"
+    digest: ""
+agent:
+  image:
+    repository: grafana/agent
+    tag: v0.25.1
+influxdb:
+  image:
+    repository: influxdb
+images:
+  - repository: library/busybox
+    tag: "1.36"
+  - repository: "{{ .Values.custom }}"
+    tag: "1.0"
+unknownImage: quay.io/unknown/app:1.0
+pinnedImage: busybox:1.36@sha256:0000000000000000000000000000000000000000000000000000000000000000
+`
+	digests := ImageDigests{
+		"busybox:1.36":  busyboxDigest,
+		"redis:7.2":     redisDigest,
+		"agent:v0.25.1": agentDigest,
+		"influxdb:1.8":  influxDigest,
+	}
+	doc, err := parseValues([]byte(values))
+	require.NoError(t, err)
+	pinner := &digestPinner{digests: digests, defaultTag: "1.8"}
+	pinner.pin(doc)
+
+	expected := `# Default values
+image: "docker.io/library/busybox:1.36@` + busyboxDigest + `" # scalar image
+redis:
+  image:
+    registry: docker.io
+    repository: bitnami/redis
+    tag: "7.2"
+    digest: "` + redisDigest + `"
+agent:
+  image:
+    repository: grafana/agent
+    tag: "v0.25.1@` + agentDigest + `"
+influxdb:
+  image:
+    repository: influxdb
+    tag: "1.8@` + influxDigest + `"
+images:
+  - repository: library/busybox
+    tag: "1.36@` + busyboxDigest + `"
+  - repository: "{{ .Values.custom }}"
+    tag: "1.0"
+unknownImage: quay.io/unknown/app:1.0
+pinnedImage: busybox:1.36@sha256:0000000000000000000000000000000000000000000000000000000000000000
+`
+	assert.Equal(t, expected, string(doc.bytes()))
+	assert.Equal(t, 5, pinner.pinned)
+}
+
+func TestTransformHelmChart_PinDigests(t *testing.T) {
+	chartDir := filepath.Join(t.TempDir(), "app")
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "charts", "redis"), 0755))
+	files := map[string]string{
+		"Chart.yaml":                   "apiVersion: v2\nname: app\nversion: 1.0.0\nappVersion: \"1.36\"\n",
+		"values.yaml":                  "image:\n  repository: busybox\n",
+		"charts/redis/Chart.yaml":      "apiVersion: v2\nname: redis\nversion: 18.0.0\nappVersion: \"7.2\"\n",
+		"charts/redis/values.yaml":     "image:\n  repository: bitnami/redis\n  digest: \"\"\n",
+		"templates/deployment.yaml":    "image: {{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}\n",
+		"charts/redis/templates/.keep": "",
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "charts", "redis", "templates"), 0755))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(chartDir, name), []byte(content), 0644))
+	}
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: "harbor.example.com/mirror"}},
+			Options: config.OptionsConfig{Suffix: "mirrored"},
+		},
+	}
+	digests := ImageDigests{"busybox:1.36": busyboxDigest, "redis:7.2": redisDigest}
+	dst, _, err := transformHelmChart(appCtx, types.Chart{Name: "app", Version: "1.0.0"}, "", chartDir, chartDir+"-transformed", digests, nil)
+	require.NoError(t, err)
+
+	values, err := os.ReadFile(filepath.Join(dst, "values.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(values), `repository: "harbor.example.com/mirror/busybox"`)
+	assert.Contains(t, string(values), `tag: "1.36@`+busyboxDigest+`"`)
+
+	subchartValues, err := os.ReadFile(filepath.Join(dst, "charts", "redis", "values.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(subchartValues), `digest: "`+redisDigest+`"`)
+
+	template, err := os.ReadFile(filepath.Join(dst, "templates", "deployment.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, files["templates/deployment.yaml"], string(template))
+}
+
+func TestProcessValuesYAML_PinOrgQualifiedRepository(t *testing.T) {
+	values := `image: docker.io/bitnami/redis:7.2
+redis:
+  image:
+    registry: docker.io
+    repository: bitnami/redis
+    tag: "7.2"
+sentinel:
+  image:
+    repository: bitnami/redis
+    tag: "7.2"
+`
+	tmpDir := t.TempDir()
+	srcPath := filepath.Join(tmpDir, "values.yaml")
+	destPath := filepath.Join(tmpDir, "values_modified.yaml")
+	require.NoError(t, os.WriteFile(srcPath, []byte(values), 0644))
+
+	// redis is mirrored to harbor.example.com/mirror/redis, the values must point to that repository
+	digests := NewImageDigests([]types.MirroredImage{{Target: "harbor.example.com/mirror/redis:7.2", Digest: redisDigest}})
+	require.NoError(t, processValuesYAML(srcPath, destPath, "harbor.example.com/mirror", digests))
+
+	expected := `image: "harbor.example.com/mirror/redis:7.2@` + redisDigest + `"
+redis:
+  image:
+    registry: "harbor.example.com/mirror"
+    repository: "redis"
+    tag: "7.2@` + redisDigest + `"
+sentinel:
+  image:
+    repository: "harbor.example.com/mirror/redis"
+    tag: "7.2@` + redisDigest + `"
+`
+	content, err := os.ReadFile(destPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(content))
+}
@@ -0,0 +1,112 @@
+package charts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+// PlanCharts reports the change a mirror run would make to each chart of a list, without pulling anything:
+// the versions are resolved upstream, and each version is looked up in the target registry under the tag it would
+// be pushed with, `<version>-<suffix>`.
+// Mirrored charts are transformed, so their content cannot be compared with upstream: the upstream digest and the
+// options recorded in the manifest of the chart in the target registry are compared instead, as a mirror run does,
+// see checkMirroredChart. A chart mirrored from another upstream chart is a tag mutation, and a chart that would be
+// pushed again, e.g. mirrored with other options, is new.
+// It takes an application context and the list of charts as input.
+// It returns the planned charts, one per version in the order of the input list, and an error if no target
+// registry with a charts repository is configured.
+func PlanCharts(ctx *appcontext.AppContext, chartsList types.ChartsList) ([]types.PlannedArtifact, error) {
+	if _, _, err := TargetReference(ctx, types.Chart{}); err != nil {
+		return nil, err
+	}
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+
+	var planned []types.PlannedArtifact
+	for _, r := range ResolveCharts(ctx, chartsList.Charts) {
+		if r.Err != nil {
+			status := types.PlanError
+			if errors.Is(r.Err, helm.ErrNoVersionMatches) {
+				status = types.PlanMissingUpstream
+			}
+			planned = append(planned, types.PlannedArtifact{
+				Kind: "chart", Name: r.Entry.Name, Source: r.Entry.Source, Version: r.Entry.Version, Status: status, Error: r.Err.Error(),
+			})
+			continue
+		}
+		for _, ch := range r.Charts() {
+			planned = append(planned, planChart(ctx, policy, ch))
+		}
+	}
+	return planned, nil
+}
+
+// planChart looks up the digest of a concrete chart upstream, and the manifest of the chart in the target registry.
+func planChart(ctx *appcontext.AppContext, policy retry.Policy, ch types.Chart) types.PlannedArtifact {
+	// The charts repository of the target was checked by PlanCharts
+	repoRef, tag, _ := TargetReference(ctx, ch)
+	planned := types.PlannedArtifact{Kind: "chart", Name: ch.Name, Source: ch.Source, Version: ch.Version, Target: repoRef + ":" + tag}
+	fail := func(status types.PlanStatus, err error) types.PlannedArtifact {
+		planned.Status = status
+		planned.Error = err.Error()
+		return planned
+	}
+
+	sourceDigest, _, err := helm.ChartDigest(ctx, ch)
+	if errors.Is(err, helm.ErrVersionNotFound) {
+		return fail(types.PlanMissingUpstream, err)
+	} else if err != nil {
+		return fail(types.PlanError, err)
+	}
+	planned.SourceDigest = sourceDigest
+
+	repo, err := registryclient.NewRepository(ctx, repoRef)
+	if err != nil {
+		return fail(types.PlanError, err)
+	}
+	var desc v1.Descriptor
+	var manifestJSON []byte
+	_, err = policy.Do(context.Background(), "resolve "+planned.Target, func() (err error) {
+		desc, err = repo.Resolve(context.Background(), tag)
+		if err != nil {
+			return err
+		}
+		manifestJSON, err = content.FetchAll(context.Background(), repo, desc)
+		return err
+	})
+	switch {
+	case registryclient.IsNotFound(err):
+		planned.Status = types.PlanNew
+		return planned
+	case err != nil:
+		return fail(types.PlanError, err)
+	}
+	planned.TargetDigest = desc.Digest.String()
+
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return fail(types.PlanError, fmt.Errorf("failed to parse the manifest of the chart in the target registry: %w", err))
+	}
+	state, err := compareMirroredChart(ctx, manifest, sourceDigest)
+	if err != nil {
+		return fail(types.PlanError, err)
+	}
+	switch state {
+	case chartUpToDate:
+		planned.Status = types.PlanUpToDate
+	case chartTagMutated:
+		planned.Status = types.PlanTagMutated
+	default:
+		planned.Status = types.PlanNew
+	}
+	return planned
+}
@@ -0,0 +1,128 @@
+package charts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanCharts(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	inputCharts := filepath.Join("..", "..", "resources", "data_test", "input_charts")
+	archives := make(map[string][]byte)
+	for _, ch := range []struct{ name, version string }{{"grafana", "7.0.19"}, {"influxdb", "4.12.5"}, {"influxdb2", "2.1.2"}, {"loki", "5.5.2"}} {
+		archive, err := os.ReadFile(filepath.Join(inputCharts, ch.name+"-"+ch.version+".tgz"))
+		require.NoError(t, err)
+		archives[ch.name] = archive
+		source.PushChart(t, "charts/"+ch.name, ch.name, ch.version, archive)
+	}
+	// loki is also served by a Helm repository, whose index lists the digest of the archive
+	index := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `apiVersion: v1
+entries:
+  loki:
+    - {apiVersion: v2, name: loki, version: 5.5.2, digest: %s, urls: [loki-5.5.2.tgz]}
+`, digest.FromBytes(archives["loki"]).Encoded())
+	}))
+	t.Cleanup(index.Close)
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ChartsRepository: target.Host + "/mirror/charts",
+				ImagesRepository: target.Host + "/mirror/images",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+
+	// grafana and loki were mirrored by a previous run
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: grafana
+    source: oci://`+source.Host+`/charts
+    version: 7.0.19
+  - name: loki
+    source: oci://`+source.Host+`/charts
+    version: 5.5.2
+`), 0600))
+	successful, failed, err := MirrorHelmCharts(appCtx, chartsFile, MirrorOptions{})
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	require.Len(t, successful, 2)
+
+	// influxdb was mirrored from another upstream chart, and influxdb2 without its upstream digest
+	desc := target.PushChart(t, "mirror/charts/influxdb", "influxdb", "4.12.5-mirrored", archives["influxdb"])
+	manifestJSON, ok := target.Manifest("mirror/charts/influxdb", desc.Digest.String())
+	require.True(t, ok)
+	var manifest v1.Manifest
+	require.NoError(t, json.Unmarshal(manifestJSON, &manifest))
+	manifest.Annotations = map[string]string{annotationSourceDigest: digest.FromBytes(archives["grafana"]).String()}
+	target.PushManifest(t, "mirror/charts/influxdb", "4.12.5-mirrored", manifest, nil)
+	target.PushChart(t, "mirror/charts/influxdb2", "influxdb2", "2.1.2-mirrored", archives["influxdb2"])
+
+	planned, err := PlanCharts(appCtx, types.ChartsList{Charts: []types.Chart{
+		{Name: "grafana", Source: "oci://" + source.Host + "/charts", Version: "7.0.19"},
+		{Name: "influxdb", Source: "oci://" + source.Host + "/charts", Version: "~4.12"},
+		{Name: "influxdb2", Source: "oci://" + source.Host + "/charts", Version: "2.1.2"},
+		{Name: "loki", Source: index.URL, Version: "5.5.2"},
+		{Name: "influxdb", Source: "oci://" + source.Host + "/charts", Version: "9.9.9"},
+		{Name: "grafana", Source: "oci://" + source.Host + "/charts", Version: ">=8"},
+		{Name: "loki", Source: index.URL, Version: "5.5.3"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, planned, 7)
+
+	assert.Equal(t, types.PlanUpToDate, planned[0].Status)
+	assert.Equal(t, target.Host+"/mirror/charts/grafana:7.0.19-mirrored", planned[0].Target)
+	assert.Equal(t, digest.FromBytes(archives["grafana"]).String(), planned[0].SourceDigest)
+	assert.NotEmpty(t, planned[0].TargetDigest)
+
+	assert.Equal(t, types.PlanTagMutated, planned[1].Status)
+	assert.Equal(t, "4.12.5", planned[1].Version)
+	assert.Equal(t, target.Host+"/mirror/charts/influxdb:4.12.5-mirrored", planned[1].Target)
+
+	// The chart would be pushed again to record its upstream digest
+	assert.Equal(t, types.PlanNew, planned[2].Status)
+	assert.NotEmpty(t, planned[2].TargetDigest)
+
+	assert.Equal(t, types.PlanUpToDate, planned[3].Status)
+	assert.Equal(t, digest.FromBytes(archives["loki"]).String(), planned[3].SourceDigest)
+
+	assert.Equal(t, types.PlanMissingUpstream, planned[4].Status)
+	assert.Equal(t, types.PlanMissingUpstream, planned[5].Status)
+	assert.Equal(t, ">=8", planned[5].Version)
+	assert.Equal(t, types.PlanMissingUpstream, planned[6].Status)
+
+	// A chart mirrored with other options would be pushed again
+	appCtx.Config.Options.MirrorDependencies = true
+	planned, err = PlanCharts(appCtx, types.ChartsList{Charts: []types.Chart{
+		{Name: "grafana", Source: "oci://" + source.Host + "/charts", Version: "7.0.19"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, planned, 1)
+	assert.Equal(t, types.PlanNew, planned[0].Status)
+}
@@ -0,0 +1,80 @@
+package charts
+
+import (
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+)
+
+// ResolvedChart is a chart entry of the charts file with the concrete versions its version resolved to.
+// Versions holds the version of the entry itself when it is an exact version.
+// Retries is the number of registry operations retried to list the versions upstream.
+// Err is set if the versions of the chart could not be listed upstream or none matches the constraint.
+type ResolvedChart struct {
+	Entry    types.Chart
+	Versions []string
+	Retries  int
+	Err      error
+}
+
+// Charts returns the concrete charts of the entry, one per version resolved.
+func (r ResolvedChart) Charts() []types.Chart {
+	charts := make([]types.Chart, 0, len(r.Versions))
+	for _, v := range r.Versions {
+		charts = append(charts, types.Chart{Name: r.Entry.Name, Source: r.Entry.Source, Version: v})
+	}
+	return charts
+}
+
+// ResolveCharts resolves the version of each chart entry, a semver constraint or `latest`, to concrete versions.
+// It takes an application context and the chart entries as input.
+// It returns the entries resolved, in the order of the input. Entries that cannot be resolved have Err set.
+func ResolveCharts(ctx *appcontext.AppContext, charts []types.Chart) []ResolvedChart {
+	return resolveCharts(charts, func(ch types.Chart) ([]string, int, error) {
+		return helm.ResolveChartVersions(ctx, ch)
+	})
+}
+
+// versionResolver returns the function resolving the version of a chart entry to concrete versions:
+// opts.ResolveVersions if set, or else the versions of the upstream repository.
+func versionResolver(ctx *appcontext.AppContext, opts MirrorOptions) func(ch types.Chart) ([]string, int, error) {
+	if opts.ResolveVersions != nil {
+		return func(ch types.Chart) ([]string, int, error) {
+			versions, err := opts.ResolveVersions(ch)
+			return versions, 0, err
+		}
+	}
+	return func(ch types.Chart) ([]string, int, error) {
+		return helm.ResolveChartVersions(ctx, ch)
+	}
+}
+
+// resolvedDependencies returns the dependencies resolved by the charts mirrored as chart entries: the version
+// constraint of Chart.yaml with the concrete version it resolved to, each once, in the order they were resolved.
+func resolvedDependencies(outcomes []chartOutcome) []ResolvedChart {
+	var resolved []ResolvedChart
+	seen := make(map[string]bool)
+	for _, outcome := range outcomes {
+		for _, dep := range outcome.dependencies {
+			entry := types.Chart{Name: dep.Chart.Name, Source: dep.Chart.Source, Version: dep.Constraint}
+			key := dependencyKey(dep.Chart) + " " + dep.Constraint
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			resolved = append(resolved, ResolvedChart{Entry: entry, Versions: []string{dep.Chart.Version}})
+		}
+	}
+	return resolved
+}
+
+// resolveCharts resolves the version of each chart entry with a resolve function, such as the versions of
+// the upstream repository or the ones of a lockfile, which also returns the number of registry operations retried.
+func resolveCharts(charts []types.Chart, resolve func(ch types.Chart) ([]string, int, error)) []ResolvedChart {
+	resolved := make([]ResolvedChart, 0, len(charts))
+	for _, ch := range charts {
+		versions, retries, err := resolve(ch)
+		resolved = append(resolved, ResolvedChart{Entry: ch, Versions: versions, Retries: retries, Err: err})
+	}
+	return resolved
+}
@@ -0,0 +1,290 @@
+package charts
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// valuesDocument is a values.yaml file parsed as yaml.Node, whose values are edited in the original text.
+// Only the edited values change, so the comments, the formatting, the anchors and everything else are kept
+// as they are. The edited values are written double-quoted.
+type valuesDocument struct {
+	content []byte
+	root    *yaml.Node
+	lines   []int // The offset of the start of each line.
+	edits   []valuesEdit
+	edited  map[*yaml.Node]bool
+}
+
+// valuesEdit replaces a range of the original text with a value node, or inserts a key and a value node.
+type valuesEdit struct {
+	start, end int
+	node       *yaml.Node
+	prefix     string // The text written before the value, for inserted keys.
+}
+
+// parseValues parses the content of a values.yaml file.
+// It returns an error if the content is not valid YAML.
+func parseValues(content []byte) (*valuesDocument, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse values.yaml: %w", err)
+	}
+	lines := []int{0}
+	for i, c := range content {
+		if c == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return &valuesDocument{content: content, root: &root, lines: lines, edited: make(map[*yaml.Node]bool)}, nil
+}
+
+// bytes returns the content of the document with its edits.
+func (d *valuesDocument) bytes() []byte {
+	if len(d.edits) == 0 {
+		return d.content
+	}
+	edits := make([]valuesEdit, len(d.edits))
+	copy(edits, d.edits)
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+
+	result := d.content
+	for _, e := range edits {
+		var buf bytes.Buffer
+		buf.Grow(len(result) + len(e.prefix) + len(e.node.Value) + 2)
+		buf.Write(result[:e.start])
+		buf.WriteString(e.prefix)
+		buf.WriteString(strconv.Quote(e.node.Value))
+		buf.Write(result[e.end:])
+		result = buf.Bytes()
+	}
+	return result
+}
+
+// set changes the value of a scalar node to a string.
+// It returns false if the value cannot be edited in place, such as a block or multi-line scalar.
+func (d *valuesDocument) set(node *yaml.Node, value string) bool {
+	if !d.edited[node] {
+		start, end, ok := d.scalarSpan(node)
+		if !ok {
+			return false
+		}
+		d.edits = append(d.edits, valuesEdit{start: start, end: end, node: node})
+		d.edited[node] = true
+	}
+	node.Kind = yaml.ScalarNode
+	node.Tag = "!!str"
+	node.Style = yaml.DoubleQuotedStyle
+	node.Value = value
+	return true
+}
+
+// insert adds a key with a string value to a mapping, next to the value node after: on the following line
+// for a block mapping, or right after it for a flow mapping.
+// It returns false if the key cannot be inserted, such as after a block or multi-line scalar.
+func (d *valuesDocument) insert(mapping, after *yaml.Node, key, value string) bool {
+	_, end, ok := d.scalarSpan(after)
+	if !ok || len(mapping.Content) == 0 {
+		return false
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Style: yaml.DoubleQuotedStyle, Value: value}
+
+	edit := valuesEdit{start: end, end: end, node: valueNode, prefix: ", " + key + ": "}
+	if mapping.Style&yaml.FlowStyle == 0 {
+		lineEnd := end
+		for lineEnd < len(d.content) && d.content[lineEnd] != '\n' {
+			lineEnd++
+		}
+		if lineEnd > end && d.content[lineEnd-1] == '\r' {
+			lineEnd--
+		}
+		indent := strings.Repeat(" ", mapping.Content[0].Column-1)
+		edit = valuesEdit{start: lineEnd, end: lineEnd, node: valueNode, prefix: "\n" + indent + key + ": "}
+	}
+	d.edits = append(d.edits, edit)
+	d.edited[valueNode] = true
+	mapping.Content = append(mapping.Content, keyNode, valueNode)
+	return true
+}
+
+// scalarSpan returns the range of the original text taken by a scalar node, without its anchor, tag or comment.
+// It returns false for the scalars that are not on a single line, which cannot be found reliably.
+func (d *valuesDocument) scalarSpan(node *yaml.Node) (int, int, bool) {
+	if node.Kind != yaml.ScalarNode || node.Line < 1 || node.Line > len(d.lines) ||
+		node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return 0, 0, false
+	}
+	lineStart := d.lines[node.Line-1]
+	lineEnd := len(d.content)
+	if node.Line < len(d.lines) {
+		lineEnd = d.lines[node.Line] - 1
+	}
+	line := d.content[lineStart:lineEnd]
+
+	// The column is counted in characters
+	start := 0
+	for column := 1; column < node.Column && start < len(line); column++ {
+		_, size := utf8.DecodeRune(line[start:])
+		start += size
+	}
+	// Skip the anchor and the tag the node starts with
+	for start < len(line) && (line[start] == '&' || line[start] == '!') {
+		for start < len(line) && line[start] != ' ' && line[start] != '\t' {
+			start++
+		}
+		for start < len(line) && (line[start] == ' ' || line[start] == '\t') {
+			start++
+		}
+	}
+	if start >= len(line) {
+		return 0, 0, false
+	}
+
+	end := -1
+	switch line[start] {
+	case '"':
+		for i := start + 1; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+			} else if line[i] == '"' {
+				end = i + 1
+				break
+			}
+		}
+	case '\'':
+		for i := start + 1; i < len(line); i++ {
+			if line[i] == '\'' {
+				if i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					continue
+				}
+				end = i + 1
+				break
+			}
+		}
+	default:
+		// A plain scalar ends with the line, a comment, or the next entry of a flow collection
+		text := string(line[start:])
+		if i := strings.Index(text, " #"); i != -1 {
+			text = text[:i]
+		}
+		text = strings.TrimRight(text, " \t\r")
+		if text != node.Value {
+			if i := strings.IndexAny(text, ",]}"); i != -1 {
+				text = strings.TrimRight(text[:i], " \t")
+			}
+		}
+		if text == node.Value {
+			end = start + len(text)
+		}
+	}
+	if end == -1 {
+		return 0, 0, false
+	}
+	return lineStart + start, lineStart + end, true
+}
+
+// valuesImage is an image of a values.yaml document, found as the chart scanner finds them:
+// either a scalar reference such as `image: busybox:1.36`, or a mapping with repository, tag, registry... fields.
+type valuesImage struct {
+	scalar  *yaml.Node
+	mapping *yaml.Node
+}
+
+// field returns the scalar value of a field of an image mapping, matching the key case-insensitively,
+// or nil if the image is not a mapping or it has no such scalar field.
+func (img valuesImage) field(keys ...string) *yaml.Node {
+	if img.mapping == nil {
+		return nil
+	}
+	for i := 0; i+1 < len(img.mapping.Content); i += 2 {
+		key := strings.ToLower(img.mapping.Content[i].Value)
+		for _, k := range keys {
+			if key == k && img.mapping.Content[i+1].Kind == yaml.ScalarNode {
+				return img.mapping.Content[i+1]
+			}
+		}
+	}
+	return nil
+}
+
+// forEachImage calls fn for each image of a values.yaml document: the values of `*image` keys, scalars or
+// mappings, and the mappings of `images` lists. Aliases are followed, and an anchored image is visited once.
+func forEachImage(node *yaml.Node, fn func(img valuesImage)) {
+	visited := make(map[*yaml.Node]bool)
+	images := make(map[*yaml.Node]bool)
+	visit := func(img valuesImage, node *yaml.Node) {
+		if !images[node] {
+			images[node] = true
+			fn(img)
+		}
+	}
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		if node == nil || visited[node] {
+			return
+		}
+		visited[node] = true
+
+		switch node.Kind {
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, child := range node.Content {
+				walk(child)
+			}
+		case yaml.AliasNode:
+			walk(node.Alias)
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := strings.ToLower(node.Content[i].Value)
+				value := resolveAlias(node.Content[i+1])
+				if strings.HasSuffix(key, "image") {
+					switch value.Kind {
+					case yaml.ScalarNode:
+						if isImageValue(value) {
+							visit(valuesImage{scalar: value}, value)
+						}
+					case yaml.MappingNode:
+						if img := (valuesImage{mapping: value}); isImageValue(img.field("repository", "repo")) {
+							visit(img, value)
+						}
+					}
+				} else if key == "images" && value.Kind == yaml.SequenceNode {
+					for _, item := range value.Content {
+						item = resolveAlias(item)
+						if img := (valuesImage{mapping: item}); item.Kind == yaml.MappingNode && isImageValue(img.field("repository", "repo")) {
+							visit(img, item)
+						}
+					}
+				}
+				walk(value)
+			}
+		}
+	}
+	walk(node)
+}
+
+// resolveAlias returns the node an alias points to, or the node itself if it is not an alias.
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// isImageValue returns true if a scalar node holds a value usable in an image reference:
+// neither empty, null nor a Helm template.
+func isImageValue(node *yaml.Node) bool {
+	return node != nil && node.Kind == yaml.ScalarNode && node.Value != "" && node.Value != "null" && !isTemplated(node.Value)
+}
+
+// isTemplated returns true if a value is a Helm template, which cannot be rewritten.
+func isTemplated(value string) bool {
+	return strings.Contains(value, "{{")
+}
@@ -0,0 +1,62 @@
+package charts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValuesDocument_Set(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		ok       bool
+	}{
+		{name: "plain", input: "image: busybox # comment\n", expected: "image: \"new\" # comment\n", ok: true},
+		{name: "double quoted", input: "image: \"busy\\\"box\"\n", expected: "image: \"new\"\n", ok: true},
+		{name: "single quoted", input: "image: 'busy''box' # comment\n", expected: "image: \"new\" # comment\n", ok: true},
+		{name: "anchor and tag", input: "image: &img !!str busybox\n", expected: "image: &img !!str \"new\"\n", ok: true},
+		{name: "flow", input: "image: {repository: busybox, tag: '1'}\n", expected: "image: {repository: \"new\", tag: '1'}\n", ok: true},
+		{name: "unicode", input: "é: x\nimage: busybox\n", expected: "é: x\nimage: \"new\"\n", ok: true},
+		{name: "multi-line plain", input: "image: busy\n  box\n", expected: "image: busy\n  box\n", ok: false},
+		{name: "literal", input: "image: |\n  busybox\n", expected: "image: |\n  busybox\n", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseValues([]byte(tt.input))
+			require.NoError(t, err)
+			value := mappingValue(doc.root.Content[0], "image")
+			if repository := mappingValue(value, "repository"); repository != nil {
+				value = repository
+			}
+			assert.Equal(t, tt.ok, doc.set(value, "new"))
+			assert.Equal(t, tt.expected, string(doc.bytes()))
+		})
+	}
+}
+
+func TestValuesDocument_Insert(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{name: "block", input: "image:\n  repository: busybox # comment\n  pullPolicy: Always\n", expected: "image:\n  repository: busybox # comment\n  tag: \"1.36\"\n  pullPolicy: Always\n"},
+		{name: "sequence item", input: "images:\n  - repository: busybox\n", expected: "images:\n  - repository: busybox\n    tag: \"1.36\"\n"},
+		{name: "flow", input: "image: {repository: busybox, pullPolicy: Always}\n", expected: "image: {repository: busybox, tag: \"1.36\", pullPolicy: Always}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseValues([]byte(tt.input))
+			require.NoError(t, err)
+			var images []valuesImage
+			forEachImage(doc.root, func(img valuesImage) { images = append(images, img) })
+			require.Len(t, images, 1)
+			require.True(t, doc.insert(images[0].mapping, images[0].field("repository"), "tag", "1.36"))
+			assert.Equal(t, tt.expected, string(doc.bytes()))
+			assert.Equal(t, "1.36", images[0].field("tag").Value)
+		})
+	}
+}
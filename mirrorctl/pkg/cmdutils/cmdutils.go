@@ -1,44 +1,77 @@
 package cmdutils
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/charts"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/datastructures"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/images"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/lockfile"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/sbom/chartscanner"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/sbom/sbomformat"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/verify"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-// MirrorImages mirrors a list of container images to a Google Artifact Registry.
+// MirrorImages mirrors a list of container images to the target registry.
 // It takes an application context and a cobra command as input.
-func MirrorImages(ctx *appcontext.AppContext, _ *cobra.Command) error {
+func MirrorImages(ctx *appcontext.AppContext, cmd *cobra.Command) error {
 	imagesFile := viper.GetString("images")
 	if imagesFile == "" {
 		log.Error().Msg("Images file path is required, please provide via --images flag")
 		return errors.New("images file path is required, please provide via --images flag")
 	}
+	lock, err := loadLockfileIfLocked(ctx)
+	if err != nil {
+		return err
+	}
 	if ctx.DryRun {
-		log.Info().Msg("Dry-run: Would mirror images to GAR")
+		log.Info().Msg("Dry-run: Would mirror images to the target registry")
 	}
-	imagesPushed, imagesFailed, err := images.MirrorImagesFromFile(ctx, imagesFile)
+
+	// With --locked, the images of the lockfile are mirrored by digest instead of resolving the tag filters again
+	var resolvedImages []images.ResolvedImage
+	var lockMismatches []string
+	resolve := func(entries []types.Image) []images.ResolvedImage {
+		if lock != nil {
+			resolvedImages, lockMismatches = lockedImages(ctx, lock, entries)
+		} else {
+			resolvedImages = images.ResolveImages(ctx, entries)
+		}
+		return resolvedImages
+	}
+	imagesPushed, imagesFailed, err := images.MirrorImagesFromFile(ctx, imagesFile, resolve)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to mirror images")
 		return fmt.Errorf("failed to mirror images: %w", err)
 	}
 
+	printResolvedImages(resolvedImages)
 	printImagesSummary(imagesPushed, imagesFailed)
 	PrintDryRunMessage(ctx)
-	return nil
+	if lock != nil {
+		return lockMismatchError(lockMismatches)
+	}
+	return writeImagesLockfile(ctx, resolvedImages, imagesPushed)
 }
 
-// MirrorCharts mirrors a list of Helm charts and their associated container images to a Google Artifact Registry.
+// MirrorCharts mirrors a list of Helm charts and their associated container images to the target registry.
 // It takes an application context and a cobra command as input.
 // It returns an error if the mirroring fails.
 func MirrorCharts(ctx *appcontext.AppContext, cmd *cobra.Command) error {
@@ -47,60 +80,188 @@ func MirrorCharts(ctx *appcontext.AppContext, cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
-	if ctx.DryRun {
-		log.Info().Msg("Running in dry-run mode: nothing will be mirrored to GAR")
+	if err := validateDiscovery(ctx); err != nil {
+		return err
 	}
-	successfulCharts, failedCharts, err := charts.MirrorHelmCharts(ctx, chartsFile)
+	lock, err := loadLockfileIfLocked(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to mirror charts: %w", err)
+		return err
+	}
+	if ctx.DryRun {
+		log.Info().Msg("Running in dry-run mode: nothing will be mirrored to the target registry")
 	}
+	opts := charts.MirrorOptions{Concurrency: ctx.Config.Options.ChartConcurrency, Force: viper.GetBool("force")}
 
-	if !viper.GetBool("skip_image_mirroring") {
-		log.Debug().Msg("mirror images to GAR")
-		imageListByChart, err := chartscanner.ExtractImagesFromCharts(ctx, chartsFile)
-		if err != nil {
-			return fmt.Errorf("failed to extract images from charts: %w", err)
+	// The versions resolved are reported and locked once every chart has been mirrored, with the dependencies
+	var resolvedCharts, resolvedDependencies []charts.ResolvedChart
+	opts.OnResolved = func(resolved []charts.ResolvedChart) {
+		resolvedCharts = resolved
+	}
+	opts.OnDependencies = func(resolved []charts.ResolvedChart) {
+		resolvedDependencies = resolved
+	}
+
+	// The digests of the chart archives are locked, or checked against the lockfile with --locked
+	chartDigests := make(map[string]string)
+	var lockMismatches []string
+	var digestsMu sync.Mutex
+	opts.OnPulled = func(chart types.Chart, digest string) error {
+		digestsMu.Lock()
+		defer digestsMu.Unlock()
+		chartDigests[chartKey(chart)] = digest
+		if lock == nil {
+			return nil
+		}
+		lockedDigest := lock.ChartDigest(chart)
+		if lockedDigest == "" {
+			// Its content cannot be checked, it is mirrored by version
+			lockMismatches = append(lockMismatches, fmt.Sprintf("chart %s %s has no digest in the lockfile", chart.Name, chart.Version))
+		} else if lockedDigest != digest {
+			err := fmt.Errorf("digest %s differs from the locked digest %s", digest, lockedDigest)
+			lockMismatches = append(lockMismatches, fmt.Sprintf("chart %s %s: %v", chart.Name, chart.Version, err))
+			return err
 		}
-		log.Info().Interface("images", imageListByChart).Msg("Images extracted from charts")
+		return nil
+	}
+	if lock != nil {
+		// The entries of the charts file and the dependencies without Chart.lock resolve to the versions locked
+		opts.ResolveVersions = func(entry types.Chart) ([]string, error) {
+			lockedCharts, err := lock.LockedCharts(entry)
+			if err != nil {
+				digestsMu.Lock()
+				lockMismatches = append(lockMismatches, err.Error())
+				digestsMu.Unlock()
+				return nil, err
+			}
+			versions := make([]string, 0, len(lockedCharts))
+			for _, c := range lockedCharts {
+				versions = append(versions, c.Version)
+			}
+			return versions, nil
+		}
+	}
+
+	// The image references computed in templates are reported once every chart has been mirrored
+	var computedImages []types.ComputedImage
+	var computedMu sync.Mutex
+	opts.OnComputedImages = func(_ types.Chart, chartImages []types.ComputedImage) {
+		computedMu.Lock()
+		defer computedMu.Unlock()
+		computedImages = append(computedImages, chartImages...)
+	}
+
+	if err := attachChartSBOMs(ctx, &opts); err != nil {
+		return err
+	}
 
-		sortedImages := datastructures.DeduplicateAndSortImages(imageListByChart)
-		var imagesList types.ImagesList
-		imagesList.Images = sortedImages
-		imagesPushed, imagesFailed, err := images.MirrorImages(ctx, imagesList)
+	// Images are mirrored as soon as each chart has been pulled and scanned, while the charts go on through the pipeline
+	var imagesMirrorer *images.Mirrorer
+	if !viper.GetBool("skip_image_mirroring") {
+		log.Debug().Msg("mirror images to the target registry")
+		imagesMirrorer, err = images.NewMirrorer(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to mirror images: %w", err)
 		}
+		submitChartImages(ctx, &opts, imagesMirrorer)
+	} else if ctx.Config.Options.PinDigests {
+		log.Warn().Msg("Image references cannot be pinned by digest when image mirroring is skipped")
+	}
 
-		printImagesSummary(imagesPushed, imagesFailed)
+	// The images mirrored for each chart are locked with it, or pinned to the digests of the lockfile with --locked
+	chartImages := make(map[string][]types.Image)
+	if onImages := opts.OnImages; onImages != nil {
+		opts.OnImages = func(chart types.Chart, imgs []types.Image) {
+			digestsMu.Lock()
+			chartImages[chartKey(chart)] = imgs
+			digestsMu.Unlock()
+			onImages(chart, imgs)
+		}
+	}
+	if scanImages := opts.ScanImages; scanImages != nil && lock != nil {
+		opts.ScanImages = func(chartPath string) ([]types.Image, error) {
+			imgs, err := scanImages(chartPath)
+			if err != nil {
+				return nil, err
+			}
+			pinned, mismatches := lockedChartImages(ctx, lock, imgs)
+			digestsMu.Lock()
+			lockMismatches = append(lockMismatches, mismatches...)
+			digestsMu.Unlock()
+			return pinned, nil
+		}
 	}
 
+	successfulCharts, failedCharts, err := charts.MirrorHelmCharts(ctx, chartsFile, opts)
+	var imagesPushed []types.MirroredImage
+	if imagesMirrorer != nil {
+		// Wait for the images already submitted even if the charts could not be loaded
+		var imagesFailed []types.FailedImage
+		imagesPushed, imagesFailed = imagesMirrorer.Wait()
+		if err == nil {
+			printImagesSummary(imagesPushed, imagesFailed)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mirror charts: %w", err)
+	}
+
+	printResolvedCharts(resolvedCharts)
 	PrintChartsPushed(successfulCharts, failedCharts)
+	printComputedImages(computedImages)
 	PrintDryRunMessage(ctx)
-
-	return nil
+	if lock != nil {
+		return lockMismatchError(lockMismatches)
+	}
+	return writeLockfile(ctx, append(resolvedCharts, resolvedDependencies...), chartDigests, chartImages, imagesPushed)
 }
 
 var ErrMissingRequiredParam = errors.New("missing required parameter")
 
+// ErrLockfileMismatch is returned with `--locked` when the entries or the upstream content differ from the lockfile.
+var ErrLockfileMismatch = errors.New("the upstream content differs from the lockfile")
+
 // ExtractImagesFromHelmCharts extracts the container images from a list of Helm charts.
 // It takes an application context and a cobra command as input.
+// The images are written in the format of the `--format` flag: the native lists of images, or CycloneDX or SPDX
+// documents, one per chart and one combined for the whole charts file.
 // It returns an error if the extraction fails.
 func ExtractImagesFromHelmCharts(ctx *appcontext.AppContext, cmd *cobra.Command) error {
 	chartsFile := viper.GetString("charts")
 	outputDir := viper.GetString("output_dir")
+	format := viper.GetString("format")
 
-	err := validateFlagsExtractImagesFromHelmCharts(chartsFile, outputDir)
+	err := validateFlagsExtractImagesFromHelmCharts(chartsFile, outputDir, format)
 	if err != nil {
 		return err
 	}
+	if err := validateDiscovery(ctx); err != nil {
+		return err
+	}
 
 	log.Debug().Msgf("Listing images for charts in: %s\n", chartsFile)
-	imageListByChart, err := chartscanner.ExtractImagesFromCharts(ctx, chartsFile)
+	sboms, err := chartscanner.ScanCharts(ctx, chartsFile)
 	if err != nil {
 		return fmt.Errorf("failed to extract images from charts: %w", err)
 	}
+	imageListByChart := chartscanner.ImagesByChart(sboms)
 	log.Info().Interface("images", imageListByChart).Msg("Images extracted from charts")
 
+	if format != "" && format != sbomformat.FormatNative {
+		name := sbomformat.CombinedName(chartsFile)
+		if outputDir != "" {
+			if err := sbomformat.WriteFilePerChart(sboms, name, outputDir, format); err != nil {
+				return fmt.Errorf("failed to write SBOM to directory %s: %w", outputDir, err)
+			}
+			return nil
+		}
+		data, err := sbomformat.Encode(format, name, sboms)
+		if err != nil {
+			return fmt.Errorf("failed to encode SBOM: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
 	if outputDir != "" {
 		err := datastructures.WriteImagesToFilePerChart(imageListByChart, outputDir)
 		if err != nil {
@@ -113,14 +274,353 @@ func ExtractImagesFromHelmCharts(ctx *appcontext.AppContext, cmd *cobra.Command)
 	return nil
 }
 
+// Output formats of the `plan` command.
+const (
+	planFormatText = "text"
+	planFormatJSON = "json"
+)
+
+// ErrChangesPending is returned by the `plan` command with `--fail-on-changes` when a mirror run would change
+// the target registry.
+var ErrChangesPending = errors.New("a mirror run would change the target registry")
+
+// planReport is the JSON output of the `plan` command.
+type planReport struct {
+	Pending   int                      `json:"pending"`
+	Summary   map[types.PlanStatus]int `json:"summary"`
+	Artifacts []types.PlannedArtifact  `json:"artifacts"`
+}
+
+// Plan reports what mirroring the images and charts files would change in the target registry, without changing it.
+// It takes an application context and a cobra command as input.
+// The plan is printed in the format of the `--format` flag: a list per status, or a JSON report.
+// It returns an error if the plan cannot be made, or if `--fail-on-changes` is set and a mirror run would change
+// the target registry.
+func Plan(ctx *appcontext.AppContext, cmd *cobra.Command) error {
+	imagesFile := viper.GetString("images")
+	chartsFile := viper.GetString("charts")
+	format := viper.GetString("format")
+	if imagesFile == "" && chartsFile == "" {
+		return fmt.Errorf("%w: %s", ErrMissingRequiredParam, "images or charts file path")
+	}
+	if format != planFormatText && format != planFormatJSON {
+		return fmt.Errorf("unsupported plan format %q, expected %s or %s", format, planFormatText, planFormatJSON)
+	}
+
+	var planned []types.PlannedArtifact
+	if imagesFile != "" {
+		imagesList, err := images.LoadImagesList(imagesFile)
+		if err != nil {
+			return fmt.Errorf("failed to load images: %w", err)
+		}
+		plannedImages, err := images.PlanImages(ctx, *imagesList)
+		if err != nil {
+			return fmt.Errorf("failed to plan images: %w", err)
+		}
+		planned = append(planned, plannedImages...)
+	}
+	if chartsFile != "" {
+		chartsList, err := charts.LoadChartsList(chartsFile)
+		if err != nil {
+			return fmt.Errorf("failed to load charts: %w", err)
+		}
+		plannedCharts, err := charts.PlanCharts(ctx, *chartsList)
+		if err != nil {
+			return fmt.Errorf("failed to plan charts: %w", err)
+		}
+		planned = append(planned, plannedCharts...)
+	}
+
+	report := planReport{Summary: make(map[types.PlanStatus]int), Artifacts: planned}
+	for _, a := range planned {
+		report.Summary[a.Status]++
+		if a.Pending() {
+			report.Pending++
+		}
+	}
+	log.Info().Int("artifacts", len(planned)).Int("pending", report.Pending).Interface("summary", report.Summary).Msg("Plan made")
+
+	if format == planFormatJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal plan: %w", err)
+		}
+		fmt.Println(string(data))
+	} else {
+		printPlan(report)
+	}
+
+	if report.Pending > 0 && viper.GetBool("fail_on_changes") {
+		return fmt.Errorf("%w: %d pending", ErrChangesPending, report.Pending)
+	}
+	return nil
+}
+
+// ErrVerificationFailed is returned by the `verify` command when an artifact is missing from the target registry or
+// differs from what is expected.
+var ErrVerificationFailed = errors.New("the target registry does not match the input files")
+
+// Verify audits the target registry against the images and charts files: every image tag and chart version expected
+// must be in the target registry, the images with the digest of the source or, with `--locked`, of the lockfile, and
+// the images referenced by the mirrored charts must be in the mirror.
+// It takes an application context and a cobra command as input.
+// It prints the checks that passed and failed, and returns an error if the audit cannot be done or a check failed.
+func Verify(ctx *appcontext.AppContext, cmd *cobra.Command) error {
+	imagesFile := viper.GetString("images")
+	chartsFile := viper.GetString("charts")
+	if imagesFile == "" && chartsFile == "" {
+		return fmt.Errorf("%w: %s", ErrMissingRequiredParam, "images or charts file path")
+	}
+	if err := validateDiscovery(ctx); err != nil {
+		return err
+	}
+	lock, err := loadLockfileIfLocked(ctx)
+	if err != nil {
+		return err
+	}
+
+	opts := verify.Options{Lock: lock, Discovery: ctx.Config.Options.Discovery}
+	if imagesFile != "" {
+		if opts.Images, err = images.LoadImagesList(imagesFile); err != nil {
+			return fmt.Errorf("failed to load images: %w", err)
+		}
+	}
+	if chartsFile != "" {
+		if opts.Charts, err = charts.LoadChartsList(chartsFile); err != nil {
+			return fmt.Errorf("failed to load charts: %w", err)
+		}
+	}
+
+	checks, err := verify.Verify(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to verify the target registry: %w", err)
+	}
+
+	var passed, failed []string
+	for _, c := range checks {
+		entry := fmt.Sprintf("%s %s %s", c.Kind, c.Name, c.Reference)
+		if c.Passed {
+			passed = append(passed, entry)
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s (%s)", entry, c.Reason))
+		log.Error().Str("kind", c.Kind).Str("name", c.Name).Str("reference", c.Reference).Msg(c.Reason)
+	}
+	log.Info().Int("passed", len(passed)).Int("failed", len(failed)).Msg("Target registry verified")
+	PrintVerifyReport(passed, failed)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %d of %d checks failed", ErrVerificationFailed, len(failed), len(checks))
+	}
+	return nil
+}
+
+// Export exports the images and charts files to a bundle, an OCI image layout in a directory or a tarball, that can be
+// carried to a site without access to the upstream registries and imported there.
+// The charts are transformed for the target registry, and tagged in the bundle with their reference in it, as are
+// the images of the images file and of the charts.
+// It takes an application context and a cobra command as input.
+// It returns an error if the bundle cannot be written.
+func Export(ctx *appcontext.AppContext, cmd *cobra.Command) error {
+	imagesFile := viper.GetString("images")
+	chartsFile := viper.GetString("charts")
+	output := viper.GetString("output")
+	if imagesFile == "" && chartsFile == "" {
+		return fmt.Errorf("%w: %s", ErrMissingRequiredParam, "images or charts file path")
+	}
+	if output == "" {
+		return fmt.Errorf("%w: %s", ErrMissingRequiredParam, "bundle path")
+	}
+	if err := validateDiscovery(ctx); err != nil {
+		return err
+	}
+	// The SBOM format is checked before anything is exported
+	opts := charts.MirrorOptions{Concurrency: ctx.Config.Options.ChartConcurrency, Force: viper.GetBool("force")}
+	if err := attachChartSBOMs(ctx, &opts); err != nil {
+		return err
+	}
+
+	var imagesList *types.ImagesList
+	if imagesFile != "" {
+		var err error
+		if imagesList, err = images.LoadImagesList(imagesFile); err != nil {
+			return fmt.Errorf("failed to load images: %w", err)
+		}
+	}
+
+	// A dry-run goes through a throwaway layout, so the bundle is neither created nor replaced
+	var writer *bundle.Writer
+	var err error
+	if ctx.DryRun {
+		log.Info().Msg("Running in dry-run mode: nothing will be exported to the bundle")
+		writer, err = bundle.CreateTemp()
+	} else {
+		writer, err = bundle.Create(output)
+	}
+	if err != nil {
+		return err
+	}
+	defer writer.Discard()
+	imagesMirrorer, err := images.NewLayoutMirrorer(ctx, writer.Store)
+	if err != nil {
+		return fmt.Errorf("failed to export images: %w", err)
+	}
+
+	var unresolvedImages []types.FailedImage
+	if imagesList != nil {
+		for _, r := range images.ResolveImages(ctx, imagesList.Images) {
+			if r.Err != nil {
+				log.Error().Err(r.Err).Str("image", r.Entry.Source).Msg("Failed to resolve image tags")
+				unresolvedImages = append(unresolvedImages, types.FailedImage{Image: r.Entry, Error: r.Err.Error()})
+				continue
+			}
+			imagesMirrorer.Submit(r.Images()...)
+		}
+	}
+
+	var successfulCharts, failedCharts []string
+	if chartsFile != "" {
+		opts.Layout = writer.Store
+		if !viper.GetBool("skip_chart_images") {
+			submitChartImages(ctx, &opts, imagesMirrorer)
+		}
+		successfulCharts, failedCharts, err = charts.MirrorHelmCharts(ctx, chartsFile, opts)
+	}
+	// Wait for the images already submitted even if the charts could not be loaded
+	imagesPushed, imagesFailed := imagesMirrorer.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to export charts: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	printImagesSummary(imagesPushed, append(imagesFailed, unresolvedImages...))
+	if chartsFile != "" {
+		PrintChartsPushed(successfulCharts, failedCharts)
+	}
+	PrintDryRunMessage(ctx)
+	log.Info().Str("bundle", output).Int("images", len(imagesPushed)).Int("charts", len(successfulCharts)).Msg("Bundle exported")
+	return nil
+}
+
+// Import pushes the images and charts of a bundle written by Export to the target registry.
+// Charts exported for another images repository than the one of the target are retargeted to it before they are
+// pushed, and the digests pushed are checked against the index of the bundle.
+// It takes an application context and a cobra command as input.
+// It returns an error if the bundle cannot be read.
+func Import(ctx *appcontext.AppContext, cmd *cobra.Command) error {
+	bundlePath := viper.GetString("bundle")
+	if bundlePath == "" {
+		return fmt.Errorf("%w: %s", ErrMissingRequiredParam, "bundle path")
+	}
+	if ctx.DryRun {
+		log.Info().Msg("Running in dry-run mode: nothing will be pushed to the target registry")
+	}
+
+	layout, err := bundle.Open(context.Background(), bundlePath)
+	if err != nil {
+		return err
+	}
+	artifacts, err := bundle.Artifacts(context.Background(), layout)
+	if err != nil {
+		return err
+	}
+	hasImages := slices.ContainsFunc(artifacts, func(a bundle.Artifact) bool { return a.Kind == bundle.KindImage })
+	hasCharts := slices.ContainsFunc(artifacts, func(a bundle.Artifact) bool { return a.Kind == bundle.KindChart })
+	if !hasImages && !hasCharts {
+		return fmt.Errorf("bundle %s has no images nor charts", bundlePath)
+	}
+
+	var imagesPushed []types.MirroredImage
+	var imagesFailed []types.FailedImage
+	if hasImages {
+		if imagesPushed, imagesFailed, err = images.ImportImages(ctx, layout, artifacts); err != nil {
+			return fmt.Errorf("failed to import images: %w", err)
+		}
+	}
+	var successfulCharts, failedCharts []string
+	if hasCharts {
+		if successfulCharts, failedCharts, err = charts.ImportCharts(ctx, layout, artifacts); err != nil {
+			return fmt.Errorf("failed to import charts: %w", err)
+		}
+	}
+
+	printImagesSummary(imagesPushed, imagesFailed)
+	if hasCharts {
+		PrintChartsPushed(successfulCharts, failedCharts)
+	}
+	PrintDryRunMessage(ctx)
+	log.Info().Str("bundle", bundlePath).Int("images", len(imagesPushed)).Int("charts", len(successfulCharts)).Msg("Bundle imported")
+	return nil
+}
+
+// submitChartImages sets the steps of the chart pipeline that submit the images of each chart to a mirrorer as soon as
+// the chart has been scanned and, with options.pin_digests, wait for them before the chart is transformed.
+func submitChartImages(ctx *appcontext.AppContext, opts *charts.MirrorOptions, imagesMirrorer *images.Mirrorer) {
+	discovery := ctx.Config.Options.Discovery
+	opts.ScanImages = func(chartPath string) ([]types.Image, error) {
+		return chartscanner.DiscoverImages(chartPath, discovery)
+	}
+	opts.OnImages = func(chart types.Chart, chartImages []types.Image) {
+		log.Info().Str("chart", chart.Name).Interface("images", chartImages).Msg("Images extracted from chart")
+		imagesMirrorer.Submit(chartImages...)
+	}
+	if ctx.Config.Options.PinDigests {
+		// Each chart waits for its own images before it is transformed
+		opts.AwaitImages = func(chartImages []types.Image) []types.MirroredImage {
+			return imagesMirrorer.Await(chartImages...)
+		}
+	}
+}
+
+// attachChartSBOMs sets the step of the chart pipeline that builds the SBOM attached to each chart, when
+// options.sbom.attach is set. It is called before any image is submitted, so that an unsupported format fails the
+// command before anything is mirrored.
+// It returns an error if the SBOM format is not supported.
+func attachChartSBOMs(ctx *appcontext.AppContext, opts *charts.MirrorOptions) error {
+	if !ctx.Config.Options.SBOM.Attach {
+		return nil
+	}
+	format := ctx.Config.Options.SBOM.Format
+	if format == "" {
+		format = sbomformat.FormatCycloneDXJSON
+	}
+	artifactType := sbomformat.ArtifactType(format)
+	if artifactType == "" {
+		return fmt.Errorf("unsupported SBOM format %q, expected %s or %s", format, sbomformat.FormatCycloneDXJSON, sbomformat.FormatSPDXJSON)
+	}
+	if opts.ScanImages == nil {
+		// The images are still scanned to build the SBOM, without being mirrored
+		discovery := ctx.Config.Options.Discovery
+		opts.ScanImages = func(chartPath string) ([]types.Image, error) {
+			return chartscanner.DiscoverImages(chartPath, discovery)
+		}
+	}
+	opts.SBOM = func(chart types.Chart, chartPath string, chartImages []types.Image) ([]byte, string, error) {
+		sbom, err := chartscanner.ChartSBOM(chart, chartPath, chartImages)
+		if err != nil {
+			return nil, "", err
+		}
+		document, err := sbomformat.Encode(format, sbom.Chart.Name+"-"+sbom.Chart.Version, []types.ChartSBOM{sbom})
+		return document, artifactType, err
+	}
+	return nil
+}
+
 // validateFlagsExtractImagesFromHelmCharts validates the flags for the `extract-images-from-helm-charts` command.
-// It takes the charts file path and the output file path as input.
+// It takes the charts file path, the output file path and the SBOM format as input.
 // It returns an error if the flags are invalid.
-func validateFlagsExtractImagesFromHelmCharts(chartsFile string, outputDir string) error {
+func validateFlagsExtractImagesFromHelmCharts(chartsFile string, outputDir string, format string) error {
 	err := validateChartsFlag(chartsFile)
 	if err != nil {
 		return err
 	}
+	if format != "" {
+		if err := sbomformat.ValidateFormat(format); err != nil {
+			return err
+		}
+	}
 	//if outputDir != "" {
 	//	ext := strings.ToLower(filepath.Ext(outputDir))
 	//	if ext != ".json" && ext != ".yaml" && ext != ".yml" {
@@ -140,19 +640,367 @@ func validateChartsFlag(chartsFile string) error {
 	return nil
 }
 
-func printImagesSummary(imagesPushed map[string]string, imagesFailed []types.FailedImage) {
+// validateDiscovery checks the image discovery mode of the configuration.
+// It returns an error if the discovery mode is invalid.
+func validateDiscovery(ctx *appcontext.AppContext) error {
+	discovery := ctx.Config.Options.Discovery
+	switch discovery.Mode {
+	case "", config.DiscoveryScan, config.DiscoveryRender, config.DiscoveryBoth:
+		return nil
+	default:
+		return fmt.Errorf("invalid discovery mode %q, expected %s, %s or %s",
+			discovery.Mode, config.DiscoveryScan, config.DiscoveryRender, config.DiscoveryBoth)
+	}
+}
+
+// referrersSummary counts the referrers copied with an image by artifact type, e.g. `2 referrers: application/vnd.dev.cosign.artifact.sig.v1+json, application/spdx+json`.
+func referrersSummary(referrers []types.Referrer) string {
+	var artifactTypes []string
+	for _, r := range referrers {
+		if !slices.Contains(artifactTypes, r.ArtifactType) {
+			artifactTypes = append(artifactTypes, r.ArtifactType)
+		}
+	}
+	noun := "referrers"
+	if len(referrers) == 1 {
+		noun = "referrer"
+	}
+	return fmt.Sprintf("%d %s: %s", len(referrers), noun, strings.Join(artifactTypes, ", "))
+}
+
+func printImagesSummary(imagesPushed []types.MirroredImage, imagesFailed []types.FailedImage) {
 	log.Debug().Interface("images pushed", imagesPushed).Msg("Mirroring images")
 	log.Debug().Interface("images failed", imagesFailed).Msg("Failed to mirror images")
 
 	var imagesPushedGar []string
 	for _, img := range imagesPushed {
-		imagesPushedGar = append(imagesPushedGar, img)
+		entry := img.Target
+		if len(img.Platforms) > 0 {
+			entry += fmt.Sprintf(" (%s)", strings.Join(img.Platforms, ", "))
+		}
+		if len(img.Referrers) > 0 {
+			entry += " +" + referrersSummary(img.Referrers)
+		}
+		imagesPushedGar = append(imagesPushedGar, entry+retry.Suffix(img.Retries))
 	}
 	var imagesFailedGar []string
 	for _, img := range imagesFailed {
-		imagesFailedGar = append(imagesFailedGar, fmt.Sprintf("%s (%s)", img.Image.Source, img.Error))
+		imagesFailedGar = append(imagesFailedGar, fmt.Sprintf("%s (%s)%s", img.Image.Source, img.Error, retry.Suffix(img.Retries)))
 	}
 	sort.Strings(imagesPushedGar)
 	sort.Strings(imagesFailedGar)
 	PrintImagesPushed(imagesPushedGar, imagesFailedGar)
 }
+
+// printResolvedCharts prints the chart entries whose version is a semver constraint or `latest`,
+// with the versions they resolved to, e.g. `loki ~5.5 → 5.5.12`.
+func printResolvedCharts(resolvedCharts []charts.ResolvedChart) {
+	var entries []string
+	for _, r := range resolvedCharts {
+		if r.Err != nil || !helm.IsVersionConstraint(r.Entry) {
+			continue
+		}
+		constraint := r.Entry.Version
+		if r.Entry.Latest > 0 {
+			constraint = strings.TrimSpace(fmt.Sprintf("%s latest %d", constraint, r.Entry.Latest))
+		}
+		entries = append(entries, fmt.Sprintf("%s %s → %s%s", r.Entry.Name, constraint, strings.Join(r.Versions, ", "), retry.Suffix(r.Retries)))
+	}
+	PrintResolvedCharts(entries)
+}
+
+// writeLockfile writes the chart versions resolved to the lockfile, with the digests of the chart archives pulled,
+// keeping its images. The entries that could not be resolved are left out.
+// A chart that was not pulled, e.g. because it failed, keeps the entry already locked for it, or else is left out, so
+// `--locked` never mirrors a chart it cannot check.
+// The images of each chart are locked with the digests their sources resolved to when they were mirrored, see
+// imageDigest. A chart whose images were not mirrored keeps the images already locked for it.
+// Nothing is written in dry-run mode.
+func writeLockfile(ctx *appcontext.AppContext, resolvedCharts []charts.ResolvedChart, digests map[string]string, chartImages map[string][]types.Image, imagesPushed []types.MirroredImage) error {
+	if ctx.DryRun {
+		log.Info().Str("file", lockfilePath(ctx)).Msg("Running in dry-run mode: lockfile not written")
+		return nil
+	}
+	imageDigests := make(map[string]string, len(imagesPushed))
+	for _, img := range imagesPushed {
+		imageDigests[img.Source] = img.SourceDigest
+	}
+	return updateLockfile(ctx, func(lock *lockfile.Lockfile) {
+		var locked []lockfile.Chart
+		for _, r := range resolvedCharts {
+			for _, ch := range r.Charts() {
+				c := lockfile.NewChart(r.Entry, ch.Version, digests[chartKey(ch)])
+				if slices.ContainsFunc(locked, func(l lockfile.Chart) bool {
+					return l.Name == c.Name && l.Source == c.Source && l.Version == c.Version && l.Constraint == c.Constraint && l.Latest == c.Latest
+				}) {
+					// A dependency of several charts, or also an entry of the charts file
+					continue
+				}
+				previous, wasLocked := lock.LockedChart(ch)
+				if c.Digest == "" {
+					if !wasLocked || previous.Digest == "" {
+						log.Warn().Str("chart", ch.Name).Str("version", ch.Version).Msg("Chart not pulled, it is not locked")
+						continue
+					}
+					c.Digest = previous.Digest
+				}
+				if imgs, ok := chartImages[chartKey(ch)]; ok {
+					for _, img := range imgs {
+						c.Images = append(c.Images, lockfile.NewImage(img, img, imageDigest(ctx, lock, imageDigests, img.Source)))
+					}
+				} else if wasLocked {
+					c.Images = previous.Images
+				}
+				locked = append(locked, c)
+			}
+		}
+		lock.SetCharts(locked)
+	})
+}
+
+// writeImagesLockfile writes the concrete images resolved from the images file to the lockfile, with the digests
+// their sources resolved to when they were mirrored, keeping its charts.
+// An image that was not mirrored keeps the digest already locked for it, or else its tag is resolved upstream, so a
+// failed image does not lose the digest `--locked` checks. The entries that could not be resolved are left out.
+// Nothing is written in dry-run mode.
+func writeImagesLockfile(ctx *appcontext.AppContext, resolvedImages []images.ResolvedImage, imagesPushed []types.MirroredImage) error {
+	if ctx.DryRun {
+		log.Info().Str("file", lockfilePath(ctx)).Msg("Running in dry-run mode: lockfile not written")
+		return nil
+	}
+	digests := make(map[string]string, len(imagesPushed))
+	for _, img := range imagesPushed {
+		digests[img.Source] = img.SourceDigest
+	}
+	return updateLockfile(ctx, func(lock *lockfile.Lockfile) {
+		var locked []lockfile.Image
+		for _, r := range resolvedImages {
+			if r.Err != nil {
+				continue
+			}
+			for _, img := range r.Images() {
+				locked = append(locked, lockfile.NewImage(r.Entry, img, imageDigest(ctx, lock, digests, img.Source)))
+			}
+		}
+		lock.SetImages(locked)
+	})
+}
+
+// imageDigest returns the digest to lock for a concrete image: the digest its source resolved to when it was
+// mirrored, the one already in the lockfile, or else the digest its tag points to upstream.
+// It returns an empty digest if the tag cannot be resolved, which `--locked` reports as a mismatch.
+func imageDigest(ctx *appcontext.AppContext, lock *lockfile.Lockfile, digests map[string]string, source string) string {
+	if digest := digests[source]; digest != "" {
+		return digest
+	}
+	if digest := lock.ImageDigest(source); digest != "" {
+		return digest
+	}
+	digest, err := images.ResolveDigest(ctx, source)
+	if err != nil {
+		log.Warn().Err(err).Str("image", source).Msg("Failed to resolve the digest of the image, it is locked without digest")
+		return ""
+	}
+	return digest
+}
+
+// chartKey identifies a concrete chart by name, source and version.
+func chartKey(chart types.Chart) string {
+	return chart.Name + " " + chart.Source + " " + chart.Version
+}
+
+// lockfilePath returns the path of the lockfile, options.lockfile or mirrorctl.lock.
+func lockfilePath(ctx *appcontext.AppContext) string {
+	if ctx.Config.Options.Lockfile != "" {
+		return ctx.Config.Options.Lockfile
+	}
+	return lockfile.DefaultPath
+}
+
+// updateLockfile loads the lockfile, updates it and writes it back.
+func updateLockfile(ctx *appcontext.AppContext, update func(lock *lockfile.Lockfile)) error {
+	path := lockfilePath(ctx)
+	lock, err := lockfile.Load(path)
+	if err != nil {
+		return err
+	}
+	update(lock)
+	if err := lock.Write(path); err != nil {
+		return err
+	}
+	log.Info().Str("file", path).Int("charts", len(lock.Charts)).Int("images", len(lock.Images)).Msg("Lockfile written")
+	return nil
+}
+
+// loadLockfileIfLocked loads the lockfile when the `--locked` flag is set, nil otherwise.
+// It returns an error if the lockfile does not exist or cannot be read.
+func loadLockfileIfLocked(ctx *appcontext.AppContext) (*lockfile.Lockfile, error) {
+	if !viper.GetBool("locked") {
+		return nil, nil
+	}
+	path := lockfilePath(ctx)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("--locked requires the lockfile %s: %w", path, err)
+	}
+	log.Info().Str("file", path).Msg("Mirroring the content of the lockfile")
+	return lockfile.Load(path)
+}
+
+// lockedImages resolves the image entries to the images of the lockfile, pinned to their locked digest, and checks
+// that their tags still point to that digest upstream.
+// It returns the entries resolved, in the order of the input, and the differences with the lockfile: the entries
+// that are not in it, the images locked without digest and the tags that moved.
+func lockedImages(ctx *appcontext.AppContext, lock *lockfile.Lockfile, entries []types.Image) ([]images.ResolvedImage, []string) {
+	var mismatches []string
+	resolved := make([]images.ResolvedImage, 0, len(entries))
+	for _, entry := range entries {
+		lockedImgs, err := lock.LockedImages(entry)
+		if err != nil {
+			mismatches = append(mismatches, err.Error())
+			resolved = append(resolved, images.ResolvedImage{Entry: entry, Err: err})
+			continue
+		}
+		r := images.ResolvedImage{Entry: entry}
+		for _, img := range lockedImgs {
+			if entry.Tags != nil {
+				r.Tags = append(r.Tags, strings.TrimPrefix(img.Source, entry.Source+":"))
+			}
+			r.Digests = append(r.Digests, img.Digest)
+			if img.Digest == "" {
+				// Its content cannot be checked, it is mirrored by tag
+				mismatches = append(mismatches, fmt.Sprintf("image %s has no digest in the lockfile", img.Source))
+				continue
+			}
+			current, err := images.ResolveDigest(ctx, img.Source)
+			if err != nil {
+				mismatches = append(mismatches, fmt.Sprintf("image %s: %v", img.Source, err))
+			} else if current != img.Digest {
+				mismatches = append(mismatches, fmt.Sprintf("image %s moved from %s to %s", img.Source, img.Digest, current))
+			}
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved, mismatches
+}
+
+// lockedChartImages pins the images found in a chart to the digests locked for them, and checks that their tags
+// still point to those digests upstream. An image already referenced by digest is kept as is.
+// It returns the images pinned, in the order of the input, and the differences with the lockfile: the images that
+// are not in it, mirrored by tag, and the tags that moved.
+func lockedChartImages(ctx *appcontext.AppContext, lock *lockfile.Lockfile, imgs []types.Image) ([]types.Image, []string) {
+	var mismatches []string
+	pinned := make([]types.Image, 0, len(imgs))
+	for _, img := range imgs {
+		if strings.Contains(img.Source, "@") {
+			pinned = append(pinned, img)
+			continue
+		}
+		lockedDigest := lock.ImageDigest(img.Source)
+		if lockedDigest == "" {
+			mismatches = append(mismatches, fmt.Sprintf("image %s of a chart has no digest in the lockfile", img.Source))
+			pinned = append(pinned, img)
+			continue
+		}
+		current, err := images.ResolveDigest(ctx, img.Source)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("image %s: %v", img.Source, err))
+		} else if current != lockedDigest {
+			mismatches = append(mismatches, fmt.Sprintf("image %s moved from %s to %s", img.Source, lockedDigest, current))
+		}
+		img.Source += "@" + lockedDigest
+		pinned = append(pinned, img)
+	}
+	return pinned, mismatches
+}
+
+// lockMismatchError returns an error listing the differences with the lockfile found with `--locked`, nil if none.
+func lockMismatchError(mismatches []string) error {
+	if len(mismatches) == 0 {
+		return nil
+	}
+	// An image shared by several charts is reported once
+	sort.Strings(mismatches)
+	mismatches = slices.Compact(mismatches)
+	for _, m := range mismatches {
+		log.Error().Msg(m)
+	}
+	return fmt.Errorf("%w: %s", ErrLockfileMismatch, strings.Join(mismatches, "; "))
+}
+
+// printResolvedImages prints the image entries with a tag filter, with the tags they resolved to,
+// e.g. `alpine (semver >=3.20, newest 2) → 3.21.0, 3.22.2`.
+func printResolvedImages(resolvedImages []images.ResolvedImage) {
+	var entries []string
+	for _, r := range resolvedImages {
+		if r.Err != nil || r.Entry.Tags == nil {
+			continue
+		}
+		entries = append(entries, fmt.Sprintf("%s (%s) → %s", r.Entry.Source, tagFilterSummary(*r.Entry.Tags), strings.Join(r.Tags, ", ")))
+	}
+	PrintResolvedImages(entries)
+}
+
+// tagFilterSummary lists the rules of a tag filter, e.g. `include ^3\., newest 2`.
+func tagFilterSummary(filter types.TagFilter) string {
+	var rules []string
+	if filter.Include != "" {
+		rules = append(rules, "include "+filter.Include)
+	}
+	if filter.Exclude != "" {
+		rules = append(rules, "exclude "+filter.Exclude)
+	}
+	if filter.Semver != "" {
+		rules = append(rules, "semver "+filter.Semver)
+	}
+	if filter.Newest > 0 {
+		rules = append(rules, fmt.Sprintf("newest %d", filter.Newest))
+	}
+	if filter.Since != "" {
+		rules = append(rules, "since "+filter.Since)
+	}
+	if len(rules) == 0 {
+		return "all tags"
+	}
+	return strings.Join(rules, ", ")
+}
+
+// printPlan prints the artifacts of a plan grouped by status, the changes first, e.g.
+// `image busybox docker.io/library/busybox:1.36 → <images_repository>/busybox:1.36`, followed by the number of
+// artifacts of each status.
+func printPlan(report planReport) {
+	entries := make(map[types.PlanStatus][]string)
+	for _, a := range report.Artifacts {
+		source := a.Source
+		if a.Version != "" {
+			source += " " + a.Version
+		}
+		entry := fmt.Sprintf("%s %s %s", a.Kind, a.Name, source)
+		if a.Target != "" {
+			entry += " → " + a.Target
+		}
+		if a.Status == types.PlanTagMutated {
+			entry += fmt.Sprintf(" (%s, upstream %s)", a.TargetDigest, a.SourceDigest)
+		}
+		if a.Error != "" {
+			entry += fmt.Sprintf(" (%s)", a.Error)
+		}
+		entries[a.Status] = append(entries[a.Status], entry)
+	}
+
+	statuses := []types.PlanStatus{types.PlanNew, types.PlanTagMutated, types.PlanMissingUpstream, types.PlanError, types.PlanUpToDate}
+	var counts []string
+	for _, status := range statuses {
+		counts = append(counts, fmt.Sprintf("%d %s", report.Summary[status], status))
+	}
+	PrintPlan(entries, statuses, fmt.Sprintf("%s, %d pending", strings.Join(counts, ", "), report.Pending))
+}
+
+// printComputedImages prints the image references of the chart templates that were not rewritten, as `chart: file:line: reference`.
+func printComputedImages(computedImages []types.ComputedImage) {
+	var entries []string
+	for _, img := range computedImages {
+		entries = append(entries, fmt.Sprintf("%s: %s:%d: %s", img.Chart, img.File, img.Line, img.Reference))
+	}
+	sort.Strings(entries)
+	PrintComputedImages(entries)
+}
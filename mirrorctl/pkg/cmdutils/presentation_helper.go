@@ -75,6 +75,100 @@ func PrintImagesPushed(imagesPushed, imagesFailed []string) {
 	}
 }
 
+// PrintResolvedCharts prints the chart entries whose version is a constraint with the concrete versions they resolved to.
+func PrintResolvedCharts(resolvedCharts []string) {
+	if viper.GetBool("quiet") || len(resolvedCharts) == 0 {
+		return
+	}
+	// Handle color disabling if needed
+	color.NoColor = viper.GetBool("no_color")
+
+	cyanBold := color.New(color.FgCyan, color.Bold).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	fmt.Printf("%s: \n %s\n", cyanBold("Chart versions resolved"), cyan(strings.Join(resolvedCharts, "\n ")))
+}
+
+// PrintResolvedImages prints the image entries with a tag filter with the tags they resolved to.
+func PrintResolvedImages(resolvedImages []string) {
+	if viper.GetBool("quiet") || len(resolvedImages) == 0 {
+		return
+	}
+	// Handle color disabling if needed
+	color.NoColor = viper.GetBool("no_color")
+
+	cyanBold := color.New(color.FgCyan, color.Bold).SprintFunc()
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	fmt.Printf("%s: \n %s\n", cyanBold("Image tags resolved"), cyan(strings.Join(resolvedImages, "\n ")))
+}
+
+// PrintPlan prints the artifacts of a plan by status, in the order of the statuses, followed by a summary.
+// The changes are colored by how much attention they need, and the artifacts up to date are faint.
+func PrintPlan(entries map[types.PlanStatus][]string, statuses []types.PlanStatus, summary string) {
+	if viper.GetBool("quiet") {
+		return
+	}
+	// Handle color disabling if needed
+	color.NoColor = viper.GetBool("no_color")
+
+	colors := map[types.PlanStatus]color.Attribute{
+		types.PlanNew:             color.FgGreen,
+		types.PlanTagMutated:      color.FgYellow,
+		types.PlanMissingUpstream: color.FgHiRed,
+		types.PlanError:           color.FgHiRed,
+		types.PlanUpToDate:        color.Faint,
+	}
+	for _, status := range statuses {
+		if len(entries[status]) == 0 {
+			continue
+		}
+		titleColor := color.New(colors[status], color.Bold).SprintFunc()
+		entryColor := color.New(colors[status]).SprintFunc()
+		fmt.Printf("%s: \n %s\n", titleColor(status), entryColor(strings.Join(entries[status], "\n ")))
+	}
+	fmt.Printf("%s %s\n", color.New(color.Bold).Sprint("Plan:"), summary)
+}
+
+// PrintVerifyReport prints the checks of the target registry that passed and failed, followed by the result.
+func PrintVerifyReport(passed, failed []string) {
+	if viper.GetBool("quiet") {
+		return
+	}
+	// Handle color disabling if needed
+	color.NoColor = viper.GetBool("no_color")
+
+	green := color.New(color.FgGreen).SprintFunc()
+	greenBold := color.New(color.FgGreen, color.Bold).SprintFunc()
+	redBold := color.New(color.FgHiRed).Add(color.Bold).SprintFunc()
+	red := color.New(color.FgHiRed).SprintFunc()
+
+	if len(passed) > 0 {
+		fmt.Printf("%s: \n %s\n", greenBold("Passed"), green(strings.Join(passed, "\n ")))
+	}
+	if len(failed) > 0 {
+		fmt.Printf("%s: \n %s\n", redBold("Failed"), red(strings.Join(failed, "\n ")))
+		fmt.Printf("%s %d passed, %d failed\n", redBold("Verification failed:"), len(passed), len(failed))
+		return
+	}
+	fmt.Printf("%s %d passed\n", greenBold("Verification passed:"), len(passed))
+}
+
+// PrintComputedImages prints the image references of chart templates that are computed by template actions
+// and were not rewritten to the target registry.
+func PrintComputedImages(computedImages []string) {
+	if viper.GetBool("quiet") || len(computedImages) == 0 {
+		return
+	}
+	// Handle color disabling if needed
+	color.NoColor = viper.GetBool("no_color")
+
+	yellowBold := color.New(color.FgYellow, color.Bold).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+
+	fmt.Printf("%s: \n %s\n", yellowBold("Image references computed in templates, not rewritten"), yellow(strings.Join(computedImages, "\n ")))
+}
+
 // PrintImageListByChart prints a map of images grouped by chart in a formatted, readable way.
 func PrintImageListByChart(imagesByChart map[string][]types.Image) {
 	if viper.GetBool("quiet") {
@@ -109,6 +203,10 @@ func PrintImageListByChart(imagesByChart map[string][]types.Image) {
 			// Print the Image Source (Value) in green with 4 spaces of indentation
 			// We use %s to ensure the output is a single argument, preventing the
 			// extra space fmt.Println would add.
+			if len(img.DiscoveredBy) > 0 {
+				fmt.Printf("    %s %s\n", green(img.Source), "("+strings.Join(img.DiscoveredBy, ", ")+")")
+				continue
+			}
 			fmt.Printf("    %s\n", green(img.Source))
 		}
 	}
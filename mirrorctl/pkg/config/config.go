@@ -1,6 +1,11 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
@@ -8,8 +13,11 @@ import (
 // Config holds the application configuration.
 // It is loaded from a configuration file or environment variables.
 type Config struct {
-	GCP     GCPConfig     `mapstructure:"gcp"`     // GCP-related configuration.
-	Options OptionsConfig `mapstructure:"options"` // General options.
+	GCP        GCPConfig        `mapstructure:"gcp"`        // GCP-related configuration, a shorthand for a GAR target.
+	Targets    []TargetConfig   `mapstructure:"targets"`    // Registries where charts and images are mirrored to.
+	Target     string           `mapstructure:"target"`     // The name of the target to use when several are configured.
+	Registries []RegistryConfig `mapstructure:"registries"` // Per registry host settings, such as credentials.
+	Options    OptionsConfig    `mapstructure:"options"`    // General options.
 }
 
 // GCPConfig holds GCP-related configuration.
@@ -21,13 +29,224 @@ type GCPConfig struct {
 	GARRepoContainers string `mapstructure:"gar_repo_containers"` // The name of the GAR repository for container images.
 }
 
+// TransportConfig holds the connection settings of a registry.
+type TransportConfig struct {
+	PlainHTTP bool   `mapstructure:"plain_http"` // Use HTTP instead of HTTPS.
+	Insecure  bool   `mapstructure:"insecure"`   // Skip the TLS certificate verification.
+	CAFile    string `mapstructure:"ca_file"`    // PEM bundle with the CA certificates that sign the registry certificate.
+}
+
+// TargetConfig holds a destination registry for the mirrored artifacts.
+// Any OCI registry works: Harbor, Nexus, Artifactory, ECR, ACR, GAR or a plain registry:2.
+// The repositories are prefixes, the chart or image name is appended to them.
+type TargetConfig struct {
+	Name             string `mapstructure:"name"`              // The name used to select the target with --target.
+	ChartsRepository string `mapstructure:"charts_repository"` // Repository prefix for Helm charts, e.g. harbor.example.com/mirror/charts.
+	ImagesRepository string `mapstructure:"images_repository"` // Repository prefix for container images, e.g. harbor.example.com/mirror/images.
+
+	TransportConfig `mapstructure:",squash"`
+}
+
+// RegistryConfig holds the settings of a single registry host.
+// It is used for both source and target registries and selects how mirrorctl authenticates against the host.
+// Secrets can be given literally, read from an environment variable (the *_env fields) or read from a file (the *_file fields).
+// Literal secrets are excluded from JSON so they never end up in the logs.
+type RegistryConfig struct {
+	Host         string `mapstructure:"host"`              // The registry host, e.g. docker.io or europe-southwest1-docker.pkg.dev.
+	Credentials  string `mapstructure:"credentials"`       // The credential provider: docker, static, gcp or none.
+	DockerConfig string `mapstructure:"docker_config"`     // Path to a docker config.json, only used by the docker provider.
+	Username     string `mapstructure:"username"`          // Username for the static provider.
+	UsernameEnv  string `mapstructure:"username_env"`      // Environment variable holding the username for the static provider.
+	Password     string `mapstructure:"password" json:"-"` // Password for the static provider.
+	PasswordEnv  string `mapstructure:"password_env"`      // Environment variable holding the password for the static provider.
+	PasswordFile string `mapstructure:"password_file"`     // File holding the password for the static provider.
+	Token        string `mapstructure:"token" json:"-"`    // Bearer token for the static provider.
+	TokenEnv     string `mapstructure:"token_env"`         // Environment variable holding the bearer token for the static provider.
+	TokenFile    string `mapstructure:"token_file"`        // File holding the bearer token for the static provider.
+
+	MaxConcurrency int    `mapstructure:"max_concurrency"` // Maximum number of images mirrored at the same time from or to this host, 0 means no cap.
+	Verification   string `mapstructure:"verification"`    // Signature verification policy of the images from this host: require, warn or skip.
+
+	TransportConfig `mapstructure:",squash"`
+}
+
+// DefaultConcurrency is the number of images mirrored at the same time when options.concurrency is not set.
+const DefaultConcurrency = 4
+
+// DefaultChartConcurrency is the number of charts mirrored at the same time when options.chart_concurrency is not set.
+const DefaultChartConcurrency = 2
+
 // OptionsConfig holds general options for the application.
 // It contains a suffix to be appended to the version of the mirrored charts,
-// a flag to keep temporary directories, and a flag to notify about tag mutations.
+// a flag to keep temporary directories, a flag to notify about tag mutations,
+// the credential provider used for registries without an explicit entry
+// and the number of images and charts mirrored at the same time.
 type OptionsConfig struct {
-	Suffix             string `mapstructure:"suffix"`               // A suffix to be appended to the version of the mirrored charts.
-	KeepTempDir        bool   `mapstructure:"keep_temp_dir"`        // A flag to keep temporary directories for debugging purposes.
-	NotifyTagMutations bool   `mapstructure:"notify_tag_mutations"` // A flag to notify about tag mutations.
+	Suffix             string   `mapstructure:"suffix"`               // A suffix to be appended to the version of the mirrored charts.
+	KeepTempDir        bool     `mapstructure:"keep_temp_dir"`        // A flag to keep temporary directories for debugging purposes.
+	NotifyTagMutations bool     `mapstructure:"notify_tag_mutations"` // A flag to notify about tag mutations.
+	DefaultCredentials string   `mapstructure:"default_credentials"`  // The credential provider for registries not listed in registries.
+	Concurrency        int      `mapstructure:"concurrency"`          // The number of images mirrored at the same time.
+	ChartConcurrency   int      `mapstructure:"chart_concurrency"`    // The number of charts mirrored at the same time.
+	Platforms          []string `mapstructure:"platforms"`            // Platforms of the images to mirror, e.g. linux/amd64. Empty mirrors the full index.
+	PinDigests         bool     `mapstructure:"pin_digests"`          // Reference the images of the mirrored charts by the digest mirrored.
+	Lockfile           string   `mapstructure:"lockfile"`             // Path of the lockfile with the chart versions and image tags resolved, mirrorctl.lock if not set.
+	MirrorDependencies bool     `mapstructure:"mirror_dependencies"`  // Mirror the dependencies of the charts declared in their Chart.yaml and point the charts to them.
+
+	Retry        RetryConfig        `mapstructure:"retry"`        // How registry operations are retried after transient errors.
+	Referrers    ReferrersConfig    `mapstructure:"referrers"`    // Which referrers of the images, such as signatures and SBOMs, are copied.
+	Verification VerificationConfig `mapstructure:"verification"` // How the signatures of the images are verified before mirroring them.
+	Discovery    DiscoveryConfig    `mapstructure:"discovery"`    // How the images of the charts are found.
+	SBOM         SBOMConfig         `mapstructure:"sbom"`         // Whether the SBOM of the mirrored charts is attached to them.
+}
+
+// SBOMConfig holds whether the SBOM of the images of each mirrored chart is pushed to the target registry,
+// as a referrer of the chart manifest, and its format.
+type SBOMConfig struct {
+	Attach bool   `mapstructure:"attach"` // Push the SBOM of each mirrored chart as a referrer of the chart.
+	Format string `mapstructure:"format"` // The format of the SBOM: cyclonedx-json (default) or spdx-json.
+}
+
+// Image discovery modes of the charts.
+const (
+	DiscoveryScan   = "scan"   // The values and templates of the chart are scanned for image keys.
+	DiscoveryRender = "render" // The chart is rendered and the images of the rendered workloads are collected.
+	DiscoveryBoth   = "both"   // The images found by scanning and rendering the chart are merged.
+)
+
+// DiscoveryConfig holds how the container images of the charts are found.
+// Rendered charts are rendered with their default values, with every `enabled` value set to true,
+// and with each of the values files.
+type DiscoveryConfig struct {
+	Mode        string   `mapstructure:"mode"`         // The discovery mode: scan (default), render or both.
+	ValuesFiles []string `mapstructure:"values_files"` // Paths to values files the charts are also rendered with.
+}
+
+// Signature verification policies, from the most to the least strict.
+const (
+	VerificationRequire = "require" // Images without a valid signature fail to mirror.
+	VerificationWarn    = "warn"    // Images without a valid signature are mirrored with a warning.
+	VerificationSkip    = "skip"    // Signatures are not verified.
+)
+
+// VerificationConfig holds the public keys that sign the images and the default verification policy.
+// The policy can be overridden per registry host in `registries` and per image in images.yaml.
+type VerificationConfig struct {
+	Policy string   `mapstructure:"policy"` // The verification policy: require, warn or skip (default).
+	Keys   []string `mapstructure:"keys"`   // Paths to the PEM public keys that sign the images.
+}
+
+// ReferrersConfig holds which referrers of the mirrored images are copied to the target registry:
+// the artifacts attached to an image with the OCI referrers API or the cosign `sha256-<digest>.sig` tag scheme.
+type ReferrersConfig struct {
+	Enabled       bool     `mapstructure:"enabled"`        // Copy the referrers of the mirrored images.
+	ArtifactTypes []string `mapstructure:"artifact_types"` // Artifact types of the referrers to copy. Empty copies every referrer.
+}
+
+// RetryConfig holds the retry policy of registry operations, such as resolving, copying, pushing and tagging.
+// Unset fields take the defaults of the retry package.
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`    // Attempts per operation, including the first one. 1 disables retries.
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"` // Wait before the first retry, doubled on every retry.
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`     // Upper bound of the wait between two attempts.
+	Jitter         float64       `mapstructure:"jitter"`          // Random fraction, between 0 and 1, added to or removed from each wait.
+	MaxRetryAfter  time.Duration `mapstructure:"max_retry_after"` // Longest Retry-After accepted from a registry, longer ones fail the operation.
+}
+
+// ActiveTarget returns the target registry that charts and images are mirrored to.
+// The target is selected by name when `target` is set, otherwise the only target configured is used.
+// When no targets are configured, the `gcp` section is used as a shorthand for a Google Artifact Registry target.
+// It returns an error if no target can be selected.
+func (c *Config) ActiveTarget() (TargetConfig, error) {
+	if c.Target != "" {
+		for _, t := range c.Targets {
+			if t.Name == c.Target {
+				return t, nil
+			}
+		}
+		if c.Target == "gcp" && len(c.Targets) == 0 {
+			return c.gcpTarget(), nil
+		}
+		return TargetConfig{}, fmt.Errorf("target %q not found in the configuration", c.Target)
+	}
+
+	switch len(c.Targets) {
+	case 0:
+		if c.GCP.GARRepoCharts == "" && c.GCP.GARRepoContainers == "" {
+			return TargetConfig{}, fmt.Errorf("no target registry configured, add a targets or gcp section to the configuration")
+		}
+		return c.gcpTarget(), nil
+	case 1:
+		return c.Targets[0], nil
+	default:
+		names := make([]string, 0, len(c.Targets))
+		for _, t := range c.Targets {
+			names = append(names, t.Name)
+		}
+		return TargetConfig{}, fmt.Errorf("several targets configured (%s), select one with --target", strings.Join(names, ", "))
+	}
+}
+
+// gcpTarget builds a target from the `gcp` section.
+func (c *Config) gcpTarget() TargetConfig {
+	return TargetConfig{
+		Name:             "gcp",
+		ChartsRepository: c.GCP.GARRepoCharts,
+		ImagesRepository: c.GCP.GARRepoContainers,
+	}
+}
+
+// TransportFor returns the connection settings for a registry host.
+// Settings from the `registries` section take precedence over the ones of a target on the same host.
+func (c *Config) TransportFor(host string) TransportConfig {
+	host = imageref.NormalizeHost(host)
+	for _, r := range c.Registries {
+		if imageref.NormalizeHost(r.Host) == host {
+			return r.TransportConfig
+		}
+	}
+	for _, t := range c.Targets {
+		if imageref.NormalizeHost(t.ChartsRepository) == host || imageref.NormalizeHost(t.ImagesRepository) == host {
+			return t.TransportConfig
+		}
+	}
+	return TransportConfig{}
+}
+
+// MaxConcurrencyFor returns the maximum number of images mirrored at the same time from or to a registry host.
+// It returns 0 if the host has no cap.
+func (c *Config) MaxConcurrencyFor(host string) int {
+	host = imageref.NormalizeHost(host)
+	for _, r := range c.Registries {
+		if imageref.NormalizeHost(r.Host) == host {
+			return r.MaxConcurrency
+		}
+	}
+	return 0
+}
+
+// VerificationPolicyFor returns the signature verification policy of the images from a registry host:
+// the one of the host in `registries` if set, options.verification.policy otherwise, and skip by default.
+func (c *Config) VerificationPolicyFor(host string) string {
+	host = imageref.NormalizeHost(host)
+	for _, r := range c.Registries {
+		if imageref.NormalizeHost(r.Host) == host && r.Verification != "" {
+			return r.Verification
+		}
+	}
+	if c.Options.Verification.Policy != "" {
+		return c.Options.Verification.Policy
+	}
+	return VerificationSkip
+}
+
+// ImageConcurrency returns the number of images mirrored at the same time.
+// It defaults to DefaultConcurrency when options.concurrency is not set.
+func (c *Config) ImageConcurrency() int {
+	if c.Options.Concurrency > 0 {
+		return c.Options.Concurrency
+	}
+	return DefaultConcurrency
 }
 
 // LoadConfig loads the application configuration from a configuration file or environment variables.
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActiveTarget(t *testing.T) {
+	harbor := TargetConfig{Name: "harbor", ChartsRepository: "harbor.example.com/mirror/charts", ImagesRepository: "harbor.example.com/mirror/images"}
+	local := TargetConfig{Name: "local", ImagesRepository: "localhost:5000/images", TransportConfig: TransportConfig{PlainHTTP: true}}
+	gcp := GCPConfig{GARRepoCharts: "europe-docker.pkg.dev/project/charts", GARRepoContainers: "europe-docker.pkg.dev/project/containers"}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected TargetConfig
+		wantErr  bool
+	}{
+		{
+			name:     "single target",
+			cfg:      Config{Targets: []TargetConfig{harbor}},
+			expected: harbor,
+		},
+		{
+			name:     "target selected by name",
+			cfg:      Config{Targets: []TargetConfig{harbor, local}, Target: "local"},
+			expected: local,
+		},
+		{
+			name:    "several targets without selection",
+			cfg:     Config{Targets: []TargetConfig{harbor, local}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown target",
+			cfg:     Config{Targets: []TargetConfig{harbor}, Target: "nexus"},
+			wantErr: true,
+		},
+		{
+			name:     "gcp shorthand",
+			cfg:      Config{GCP: gcp},
+			expected: TargetConfig{Name: "gcp", ChartsRepository: gcp.GARRepoCharts, ImagesRepository: gcp.GARRepoContainers},
+		},
+		{
+			name:     "targets take precedence over gcp",
+			cfg:      Config{GCP: gcp, Targets: []TargetConfig{harbor}},
+			expected: harbor,
+		},
+		{
+			name:    "nothing configured",
+			cfg:     Config{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := tt.cfg.ActiveTarget()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, target)
+		})
+	}
+}
+
+func TestTransportFor(t *testing.T) {
+	cfg := Config{
+		Targets: []TargetConfig{{
+			Name:             "local",
+			ImagesRepository: "localhost:5000/images",
+			TransportConfig:  TransportConfig{PlainHTTP: true},
+		}},
+		Registries: []RegistryConfig{{
+			Host:            "harbor.example.com",
+			TransportConfig: TransportConfig{CAFile: "/etc/ssl/harbor.pem"},
+		}},
+	}
+
+	assert.True(t, cfg.TransportFor("localhost:5000").PlainHTTP)
+	assert.Equal(t, "/etc/ssl/harbor.pem", cfg.TransportFor("oci://harbor.example.com/charts").CAFile)
+	assert.Equal(t, TransportConfig{}, cfg.TransportFor("docker.io"))
+}
+
+func TestVerificationPolicyFor(t *testing.T) {
+	cfg := Config{
+		Registries: []RegistryConfig{
+			{Host: "quay.io", Verification: VerificationRequire},
+			{Host: "docker.io", MaxConcurrency: 2},
+		},
+		Options: OptionsConfig{Verification: VerificationConfig{Policy: VerificationWarn}},
+	}
+	assert.Equal(t, VerificationRequire, cfg.VerificationPolicyFor("quay.io"))
+	assert.Equal(t, VerificationWarn, cfg.VerificationPolicyFor("index.docker.io"))
+	assert.Equal(t, VerificationWarn, cfg.VerificationPolicyFor("ghcr.io"))
+	assert.Equal(t, VerificationSkip, (&Config{}).VerificationPolicyFor("ghcr.io"))
+}
@@ -0,0 +1,150 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/transport"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Names of the supported credential providers, as used in the `credentials` field of a registry entry.
+const (
+	ProviderDocker = "docker" // Docker config.json, including credential helpers.
+	ProviderStatic = "static" // Username/password or token given in the config, the environment or a file.
+	ProviderGCP    = "gcp"    // Access token printed by `gcloud auth print-access-token`.
+	ProviderNone   = "none"   // Anonymous access.
+)
+
+// Provider returns the credential to use against a registry host.
+type Provider interface {
+	Credential(ctx context.Context, host string) (auth.Credential, error)
+}
+
+// Store selects the credential provider for each registry host.
+// Hosts listed in the `registries` section of the configuration use their own provider,
+// any other host uses the default provider.
+type Store struct {
+	providers       map[string]Provider
+	defaultProvider Provider
+	gcp             *gcpProvider
+	client          *auth.Client
+}
+
+// NewStore creates a credential store from the application configuration.
+// It returns an error if a registry entry uses an unknown provider.
+func NewStore(cfg *config.Config) (*Store, error) {
+	s := &Store{
+		providers: make(map[string]Provider),
+		gcp:       &gcpProvider{},
+	}
+
+	defaultName := ProviderDocker
+	if cfg != nil && cfg.Options.DefaultCredentials != "" {
+		defaultName = cfg.Options.DefaultCredentials
+	}
+	def, err := s.newProvider(config.RegistryConfig{Credentials: defaultName})
+	if err != nil {
+		return nil, fmt.Errorf("invalid default credentials: %w", err)
+	}
+	s.defaultProvider = def
+
+	s.client = &auth.Client{
+		Client:     transport.NewClient(cfg),
+		Cache:      auth.NewCache(),
+		Credential: s.Credential,
+	}
+	s.client.SetUserAgent(fmt.Sprintf("%s/%s", version.AppName, version.Version))
+
+	if cfg == nil {
+		return s, nil
+	}
+	for _, reg := range cfg.Registries {
+		if reg.Host == "" {
+			return nil, fmt.Errorf("registry entry without host")
+		}
+		p, err := s.newProvider(reg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials for registry %s: %w", reg.Host, err)
+		}
+		s.providers[imageref.NormalizeHost(reg.Host)] = p
+	}
+	return s, nil
+}
+
+// newProvider creates the provider configured by a registry entry.
+func (s *Store) newProvider(reg config.RegistryConfig) (Provider, error) {
+	switch strings.ToLower(reg.Credentials) {
+	case "", ProviderDocker:
+		return &dockerProvider{configPath: reg.DockerConfig}, nil
+	case ProviderStatic:
+		return &staticProvider{cfg: reg}, nil
+	case ProviderGCP:
+		// All the GCP hosts share the same gcloud access token.
+		return s.gcp, nil
+	case ProviderNone:
+		return noneProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown credentials provider %q", reg.Credentials)
+	}
+}
+
+// providerFor returns the provider used for a registry host.
+// Google registries not listed in the configuration keep using gcloud, as mirrorctl always did.
+func (s *Store) providerFor(host string) Provider {
+	host = imageref.NormalizeHost(host)
+	if p, ok := s.providers[host]; ok {
+		return p
+	}
+	if isGoogleRegistry(host) {
+		return s.gcp
+	}
+	return s.defaultProvider
+}
+
+// Credential returns the credential for a registry host.
+// It matches the auth.CredentialFunc signature so it can be plugged into an ORAS auth client.
+func (s *Store) Credential(ctx context.Context, host string) (auth.Credential, error) {
+	p := s.providerFor(host)
+	cred, err := p.Credential(ctx, host)
+	if err != nil {
+		log.Error().Err(err).Str("host", host).Msg("Failed to get registry credentials")
+		return auth.EmptyCredential, err
+	}
+	return cred, nil
+}
+
+// Client returns the ORAS auth client that authenticates every request with the store credentials.
+// The client and its token cache are shared by all the repositories of a run.
+func (s *Store) Client() *auth.Client {
+	return s.client
+}
+
+// BasicAuth returns the username and password to use against a registry host
+// for clients that only support basic authentication, such as Helm HTTP repositories.
+// Access tokens are sent with the `oauth2accesstoken` username, as Google registries expect.
+func (s *Store) BasicAuth(ctx context.Context, host string) (string, string, error) {
+	cred, err := s.Credential(ctx, host)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case cred.Username != "" || cred.Password != "":
+		return cred.Username, cred.Password, nil
+	case cred.AccessToken != "":
+		return "oauth2accesstoken", cred.AccessToken, nil
+	default:
+		return "", "", nil
+	}
+}
+
+// isGoogleRegistry returns true if the host is a Google Artifact Registry or Container Registry host.
+func isGoogleRegistry(host string) bool {
+	host = strings.Split(host, ":")[0]
+	return strings.HasSuffix(host, "-docker.pkg.dev") || host == "gcr.io" || strings.HasSuffix(host, ".gcr.io")
+}
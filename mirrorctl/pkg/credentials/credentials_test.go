@@ -0,0 +1,196 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func TestNewStore_UnknownProvider(t *testing.T) {
+	_, err := NewStore(&config.Config{
+		Registries: []config.RegistryConfig{{Host: "docker.io", Credentials: "vault"}},
+	})
+	assert.Error(t, err)
+
+	_, err = NewStore(&config.Config{Options: config.OptionsConfig{DefaultCredentials: "vault"}})
+	assert.Error(t, err)
+}
+
+func TestNewStore_MissingHost(t *testing.T) {
+	_, err := NewStore(&config.Config{
+		Registries: []config.RegistryConfig{{Credentials: ProviderNone}},
+	})
+	assert.Error(t, err)
+}
+
+func TestStore_ProviderSelection(t *testing.T) {
+	store, err := NewStore(&config.Config{
+		Registries: []config.RegistryConfig{
+			{Host: "docker.io", Credentials: ProviderStatic, Username: "user", Password: "secret"},
+			{Host: "quay.io", Credentials: ProviderNone},
+			{Host: "harbor.example.com:8443", Credentials: ProviderGCP},
+		},
+		Options: config.OptionsConfig{DefaultCredentials: ProviderNone},
+	})
+	require.NoError(t, err)
+
+	assert.IsType(t, &staticProvider{}, store.providerFor("registry-1.docker.io"))
+	assert.IsType(t, &staticProvider{}, store.providerFor("index.docker.io"))
+	assert.IsType(t, noneProvider{}, store.providerFor("quay.io"))
+	assert.IsType(t, &gcpProvider{}, store.providerFor("harbor.example.com:8443"))
+	// Google registries default to gcloud even when they are not listed
+	assert.IsType(t, &gcpProvider{}, store.providerFor("europe-southwest1-docker.pkg.dev"))
+	assert.IsType(t, &gcpProvider{}, store.providerFor("gcr.io"))
+	// Anything else uses the default provider
+	assert.IsType(t, noneProvider{}, store.providerFor("ghcr.io"))
+}
+
+func TestStaticProvider(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0600))
+	t.Setenv("MIRRORCTL_TEST_USER", "env-user")
+	t.Setenv("MIRRORCTL_TEST_PASSWORD", "env-password")
+
+	tests := []struct {
+		name     string
+		cfg      config.RegistryConfig
+		expected auth.Credential
+		wantErr  bool
+	}{
+		{
+			name:     "literal username and password",
+			cfg:      config.RegistryConfig{Username: "user", Password: "secret"},
+			expected: auth.Credential{Username: "user", Password: "secret"},
+		},
+		{
+			name:     "username and password from environment",
+			cfg:      config.RegistryConfig{UsernameEnv: "MIRRORCTL_TEST_USER", PasswordEnv: "MIRRORCTL_TEST_PASSWORD"},
+			expected: auth.Credential{Username: "env-user", Password: "env-password"},
+		},
+		{
+			name:     "token from file",
+			cfg:      config.RegistryConfig{TokenFile: tokenFile},
+			expected: auth.Credential{AccessToken: "file-token"},
+		},
+		{
+			name:    "unset environment variable",
+			cfg:     config.RegistryConfig{UsernameEnv: "MIRRORCTL_TEST_UNSET", PasswordEnv: "MIRRORCTL_TEST_PASSWORD"},
+			wantErr: true,
+		},
+		{
+			name:    "no secret at all",
+			cfg:     config.RegistryConfig{Host: "docker.io"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &staticProvider{cfg: tt.cfg}
+			cred, err := p.Credential(context.Background(), "docker.io")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, cred)
+		})
+	}
+}
+
+func TestDockerProvider(t *testing.T) {
+	// "dXNlcjpzZWNyZXQ=" is base64 for "user:secret"
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(`{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "dXNlcjpzZWNyZXQ="},
+    "registry.example.com": {"auth": "dXNlcjpzZWNyZXQ="}
+  }
+}`), 0600))
+
+	store, err := NewStore(&config.Config{
+		Registries: []config.RegistryConfig{
+			{Host: "docker.io", Credentials: ProviderDocker, DockerConfig: configPath},
+			{Host: "registry.example.com", Credentials: ProviderDocker, DockerConfig: configPath},
+			{Host: "other.example.com", Credentials: ProviderDocker, DockerConfig: configPath},
+		},
+	})
+	require.NoError(t, err)
+
+	expected := auth.Credential{Username: "user", Password: "secret"}
+
+	cred, err := store.Credential(context.Background(), "registry-1.docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, cred)
+
+	cred, err = store.Credential(context.Background(), "registry.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, cred)
+
+	cred, err = store.Credential(context.Background(), "other.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, auth.EmptyCredential, cred)
+}
+
+func TestStore_BasicAuth(t *testing.T) {
+	store, err := NewStore(&config.Config{
+		Registries: []config.RegistryConfig{
+			{Host: "charts.example.com", Credentials: ProviderStatic, Username: "user", Password: "secret"},
+			{Host: "token.example.com", Credentials: ProviderStatic, Token: "abc"},
+		},
+		Options: config.OptionsConfig{DefaultCredentials: ProviderNone},
+	})
+	require.NoError(t, err)
+
+	user, pass, err := store.BasicAuth(context.Background(), "charts.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "secret", pass)
+
+	user, pass, err = store.BasicAuth(context.Background(), "token.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "oauth2accesstoken", user)
+	assert.Equal(t, "abc", pass)
+
+	user, pass, err = store.BasicAuth(context.Background(), "grafana.github.io")
+	assert.NoError(t, err)
+	assert.Empty(t, user)
+	assert.Empty(t, pass)
+}
+
+func TestGCPProvider_RefreshesExpiredToken(t *testing.T) {
+	fetches := 0
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	p := &gcpProvider{
+		fetch: func() (string, error) {
+			fetches++
+			return fmt.Sprintf("token-%d", fetches), nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	cred, err := p.Credential(context.Background(), "gcr.io")
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", cred.AccessToken)
+
+	// The token is reused while it is valid
+	now = now.Add(30 * time.Minute)
+	cred, err = p.Credential(context.Background(), "europe-docker.pkg.dev")
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", cred.AccessToken)
+
+	// and fetched again once it expires
+	now = now.Add(gcpTokenTTL)
+	cred, err = p.Credential(context.Background(), "gcr.io")
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", cred.AccessToken)
+	assert.Equal(t, 2, fetches)
+}
@@ -0,0 +1,149 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	orascreds "oras.land/oras-go/v2/registry/remote/credentials"
+)
+
+// noneProvider gives anonymous access to a registry.
+type noneProvider struct{}
+
+func (noneProvider) Credential(_ context.Context, _ string) (auth.Credential, error) {
+	return auth.EmptyCredential, nil
+}
+
+// staticProvider returns the username/password or token set in a registry entry.
+// Values are resolved on every call so that environment variables and files can be rotated.
+type staticProvider struct {
+	cfg config.RegistryConfig
+}
+
+func (p *staticProvider) Credential(_ context.Context, _ string) (auth.Credential, error) {
+	token, err := resolveSecret(p.cfg.Token, p.cfg.TokenEnv, p.cfg.TokenFile)
+	if err != nil {
+		return auth.EmptyCredential, fmt.Errorf("failed to read token: %w", err)
+	}
+	if token != "" {
+		return auth.Credential{AccessToken: token}, nil
+	}
+
+	username, err := resolveSecret(p.cfg.Username, p.cfg.UsernameEnv, "")
+	if err != nil {
+		return auth.EmptyCredential, fmt.Errorf("failed to read username: %w", err)
+	}
+	password, err := resolveSecret(p.cfg.Password, p.cfg.PasswordEnv, p.cfg.PasswordFile)
+	if err != nil {
+		return auth.EmptyCredential, fmt.Errorf("failed to read password: %w", err)
+	}
+	if username == "" && password == "" {
+		return auth.EmptyCredential, fmt.Errorf("static credentials for %s have neither a token nor a username/password", p.cfg.Host)
+	}
+	return auth.Credential{Username: username, Password: password}, nil
+}
+
+// resolveSecret returns the first non-empty value among a literal, an environment variable and a file.
+// It returns an error if the environment variable or the file are set but cannot be read.
+func resolveSecret(literal, envName, filePath string) (string, error) {
+	if literal != "" {
+		return literal, nil
+	}
+	if envName != "" {
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", envName)
+		}
+		return strings.TrimSpace(value), nil
+	}
+	if filePath != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// dockerProvider reads the credentials stored by `docker login`, including the configured credential helpers.
+// The docker config file is loaded on first use.
+type dockerProvider struct {
+	configPath string
+
+	once  sync.Once
+	store orascreds.Store
+	err   error
+}
+
+func (p *dockerProvider) Credential(ctx context.Context, host string) (auth.Credential, error) {
+	p.once.Do(func() {
+		opts := orascreds.StoreOptions{}
+		if p.configPath != "" {
+			p.store, p.err = orascreds.NewStore(p.configPath, opts)
+		} else {
+			p.store, p.err = orascreds.NewStoreFromDocker(opts)
+		}
+	})
+	if p.err != nil {
+		return auth.EmptyCredential, fmt.Errorf("failed to load docker config: %w", p.err)
+	}
+	return orascreds.Credential(p.store)(ctx, host)
+}
+
+// gcpTokenTTL is how long a gcloud access token is reused before it is fetched again.
+// gcloud tokens are valid for one hour, the margin covers the longest image copies.
+const gcpTokenTTL = 45 * time.Minute
+
+// gcpProvider authenticates with the access token of the active gcloud account.
+// The token is fetched once, shared by every Google registry and fetched again when it expires.
+type gcpProvider struct {
+	mu        sync.Mutex
+	token     string
+	fetchedAt time.Time
+
+	// fetch and now are replaced in tests.
+	fetch func() (string, error)
+	now   func() time.Time
+}
+
+func (p *gcpProvider) Credential(_ context.Context, _ string) (auth.Credential, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	if p.token == "" || now().Sub(p.fetchedAt) >= gcpTokenTTL {
+		fetch := printGcloudAccessToken
+		if p.fetch != nil {
+			fetch = p.fetch
+		}
+		token, err := fetch()
+		if err != nil {
+			return auth.EmptyCredential, err
+		}
+		p.token = token
+		p.fetchedAt = now()
+	}
+	return auth.Credential{AccessToken: p.token}, nil
+}
+
+// printGcloudAccessToken returns the access token of the active gcloud account.
+func printGcloudAccessToken() (string, error) {
+	log.Debug().Msg("Fetching gcloud access token")
+	out, err := exec.Command("gcloud", "auth", "print-access-token").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get gcloud access token: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
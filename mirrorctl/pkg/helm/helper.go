@@ -10,6 +10,7 @@ import (
 )
 
 // CreateTempDir creates a temporary directory for downloading Helm charts.
+// The caller removes it with RemoveTempDir once it is done with it.
 // It takes an application context as input.
 // It returns the path to the temporary directory and an error if the directory cannot be created.
 func CreateTempDir(ctx *appcontext.AppContext) (string, error) {
@@ -19,12 +20,18 @@ func CreateTempDir(ctx *appcontext.AppContext) (string, error) {
 		log.Error().Err(err).Msg("failed to create temporary directory")
 		return "", err
 	}
+	return tmpDir, nil
+}
 
-	// Only remove the temp directory if KeepTempDir is not set
-	if !ctx.Config.Options.KeepTempDir {
-		defer os.RemoveAll(tmpDir)
-	} else {
+// RemoveTempDir removes a temporary directory created by CreateTempDir.
+// The directory is kept for inspection when the keep_temp_dir option is set.
+// It takes an application context and the path to the temporary directory as input.
+func RemoveTempDir(ctx *appcontext.AppContext, tmpDir string) {
+	if ctx.Config.Options.KeepTempDir {
 		log.Debug().Str("temp_dir", tmpDir).Msg("Keeping temporary directory for inspection")
+		return
+	}
+	if err := os.RemoveAll(tmpDir); err != nil {
+		log.Warn().Err(err).Str("temp_dir", tmpDir).Msg("Failed to remove temporary directory")
 	}
-	return tmpDir, err
 }
@@ -1,40 +1,65 @@
 package helm
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog/log"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/registry"
 )
 
 // PullChart pulls a Helm chart from a repository and saves it to a temporary directory.
-// It takes a chart object and the path to the temporary directory as input.
-// It returns the path to the pulled chart and an error if the pull fails.
-func PullChart(ch types.Chart, tmpDir string) (string, error) {
+// It takes an application context, a chart object and the path to the temporary directory as input.
+// It returns the path to the pulled chart, the digest of the chart archive as it was downloaded, the same as the digest
+// listed in the index of a Helm repository or the one of the chart layer of an OCI registry, and an error if the pull fails.
+func PullChart(ctx *appcontext.AppContext, ch types.Chart, tmpDir string) (string, digest.Digest, error) {
 	log.Debug().Str("chart", ch.Name).Str("version", ch.Version).Msg("Pulling chart")
 
-	chartPath, err := downloadChart(ch, tmpDir)
+	archivePath, err := downloadChart(ctx, ch, tmpDir)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open chart archive: %w", err)
+	}
+	defer archive.Close()
+	archiveDigest, err := digest.FromReader(archive)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to compute chart archive digest: %w", err)
+	}
+	if err := chartutil.ExpandFile(tmpDir, archivePath); err != nil {
+		return "", "", fmt.Errorf("failed to untar chart: %w", err)
 	}
 
-	log.Info().Str("chart", ch.Name).Str("version", ch.Version).Str("temporary path", tmpDir).
+	log.Info().Str("chart", ch.Name).Str("version", ch.Version).Str("digest", archiveDigest.String()).Str("temporary path", tmpDir).
 		Msg("Helm chart pulled")
-	return chartPath, nil
+	return filepath.Join(tmpDir, ch.Name), archiveDigest, nil
 }
 
-// downloadChart downloads a Helm chart from a repository.
-// It takes a chart object and the destination directory as input.
-// It returns the path to the downloaded chart and an error if the download fails.
-func downloadChart(chart types.Chart, destDir string) (string, error) {
+// downloadChart downloads the archive of a Helm chart from a repository.
+// It takes an application context, a chart object and the destination directory as input.
+// The repository is accessed with the credential provider configured for its host.
+// It returns the path to the downloaded archive and an error if the download fails.
+func downloadChart(ctx *appcontext.AppContext, chart types.Chart, destDir string) (string, error) {
 	log.Debug().Str("chart", chart.Name).Str("source", chart.Source).Msg("Downloading chart")
 
+	store, err := ctx.Credentials()
+	if err != nil {
+		return "", fmt.Errorf("failed to set up registry credentials: %w", err)
+	}
+
 	settings := cli.New()
 	actionConfig := new(action.Configuration)
 	if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), os.Getenv("HELM_DRIVER"), func(format string, v ...interface{}) {
@@ -47,13 +72,20 @@ func downloadChart(chart types.Chart, destDir string) (string, error) {
 	client.Settings = settings
 	client.Version = chart.Version
 	client.DestDir = destDir
-	client.Untar = true
-	client.UntarDir = destDir
+
+	var transportCfg config.TransportConfig
+	if ctx.Config != nil {
+		transportCfg = ctx.Config.TransportFor(chart.Source)
+	}
 
 	var chartRef string
 	if strings.HasPrefix(chart.Source, "oci://") {
 		// Handle OCI chart
-		regClient, err := registry.NewClient()
+		regOpts := []registry.ClientOption{registry.ClientOptAuthorizer(*store.Client())}
+		if transportCfg.PlainHTTP {
+			regOpts = append(regOpts, registry.ClientOptPlainHTTP())
+		}
+		regClient, err := registry.NewClient(regOpts...)
 		if err != nil {
 			return "", fmt.Errorf("failed to create registry client: %w", err)
 		}
@@ -61,6 +93,14 @@ func downloadChart(chart types.Chart, destDir string) (string, error) {
 		chartRef = fmt.Sprintf("%s/%s", chart.Source, chart.Name)
 	} else {
 		// Handle traditional chart
+		username, password, err := store.BasicAuth(context.Background(), imageref.NormalizeHost(chart.Source))
+		if err != nil {
+			return "", fmt.Errorf("failed to get credentials for %s: %w", chart.Source, err)
+		}
+		client.Username = username
+		client.Password = password
+		client.InsecureSkipTLSverify = transportCfg.Insecure
+		client.CaFile = transportCfg.CAFile
 		client.RepoURL = chart.Source
 		chartRef = chart.Name
 	}
@@ -69,5 +109,10 @@ func downloadChart(chart types.Chart, destDir string) (string, error) {
 		return "", fmt.Errorf("failed to download chart: %w", err)
 	}
 
-	return filepath.Join(destDir, chart.Name), nil
+	// The archive is saved as <name>-<version>.tgz
+	archives, err := filepath.Glob(filepath.Join(destDir, chart.Name+"-*.tgz"))
+	if err != nil || len(archives) == 0 {
+		return "", fmt.Errorf("chart archive of %s not found in %s", chart.Name, destDir)
+	}
+	return archives[0], nil
 }
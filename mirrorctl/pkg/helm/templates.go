@@ -0,0 +1,84 @@
+package helm
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+)
+
+// templateImageRegex matches a line of a template that sets an `image` or `*Image` key, e.g. `- image: busybox:1.36`,
+// capturing the value.
+var templateImageRegex = regexp.MustCompile(`^\s*(?:-\s+)?["']?(?i:[\w.-]*image)["']?\s*:\s+(\S.*)$`)
+
+// TemplateImage is an image reference written in a chart template, on an `image:` line.
+type TemplateImage struct {
+	Line     int    // The line of the reference, starting at 1.
+	Start    int    // The offset of the value in the template, quotes included.
+	End      int    // The offset of the end of the value in the template.
+	Value    string // The reference, unquoted, or the template text that computes it.
+	Computed bool   // True if the reference is built by template actions, e.g. `{{ .Values.image.repository }}:{{ .Values.image.tag }}`.
+}
+
+// IsTemplateFile returns true if a path relative to a chart is a template of the chart or of a subchart:
+// a .yaml, .yml or .tpl file under a templates directory.
+func IsTemplateFile(relPath string) bool {
+	switch filepath.Ext(relPath) {
+	case ".yaml", ".yml", ".tpl":
+	default:
+		return false
+	}
+	for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(relPath)), "/") {
+		if dir == "templates" {
+			return true
+		}
+	}
+	return false
+}
+
+// FindTemplateImages returns the image references of a chart template.
+// Templates are not valid YAML, so the lines that set an `image` key are read as text: the references written
+// literally can be rewritten, while the ones with template actions are computed when the chart is rendered.
+// Values that are not an image reference, such as mappings or block scalars, are ignored.
+func FindTemplateImages(content []byte) []TemplateImage {
+	var images []TemplateImage
+	offset := 0
+	for i, line := range strings.SplitAfter(string(content), "\n") {
+		lineOffset := offset
+		offset += len(line)
+
+		match := templateImageRegex.FindStringSubmatchIndex(strings.TrimRight(line, "\r\n"))
+		if match == nil {
+			continue
+		}
+		start, end := match[2], match[3]
+		value := line[start:end]
+
+		if strings.Contains(value, "{{") {
+			images = append(images, TemplateImage{
+				Line: i + 1, Start: lineOffset + start, End: lineOffset + end,
+				Value: strings.TrimSpace(value), Computed: true,
+			})
+			continue
+		}
+
+		// A literal reference, possibly quoted and followed by a comment
+		if j := strings.Index(value, " #"); j != -1 {
+			value = value[:j]
+		}
+		value = strings.TrimRight(value, " \t")
+		end = start + len(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if value == "" || value == "null" || value == "~" || strings.ContainsAny(value, " \t\"'{}[]&*!|>") {
+			continue
+		}
+		if _, err := imageref.Parse(value); err != nil {
+			continue
+		}
+		images = append(images, TemplateImage{Line: i + 1, Start: lineOffset + start, End: lineOffset + end, Value: value})
+	}
+	return images
+}
@@ -0,0 +1,54 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTemplateFile(t *testing.T) {
+	assert.True(t, IsTemplateFile("templates/deployment.yaml"))
+	assert.True(t, IsTemplateFile("templates/_helpers.tpl"))
+	assert.True(t, IsTemplateFile("charts/redis/templates/tests/test.yml"))
+	assert.False(t, IsTemplateFile("templates/NOTES.txt"))
+	assert.False(t, IsTemplateFile("values.yaml"))
+	assert.False(t, IsTemplateFile("crds/crd.yaml"))
+}
+
+func TestFindTemplateImages(t *testing.T) {
+	content := `spec:
+  containers:
+    - name: test
+      image: busybox:1.36 # test hook
+    - name: app
+      image: "{{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}"
+  initContainers:
+    - image: 'quay.io/curl/curl:8.16.0'
+      imagePullPolicy: IfNotPresent
+{{- define "app.image" -}}
+image: {{ include "common.images.image" . }}
+{{- end }}
+data:
+  helperImage: {{ .Values.helper }}
+  image:
+    repository: not-a-scalar
+  emptyImage: null
+`
+	images := FindTemplateImages([]byte(content))
+	expected := []TemplateImage{
+		{Line: 4, Value: "busybox:1.36"},
+		{Line: 6, Value: `"{{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}"`, Computed: true},
+		{Line: 8, Value: "quay.io/curl/curl:8.16.0"},
+		{Line: 11, Value: `{{ include "common.images.image" . }}`, Computed: true},
+		{Line: 14, Value: "{{ .Values.helper }}", Computed: true},
+	}
+	assert.Len(t, images, len(expected))
+	for i, img := range images {
+		assert.Equal(t, expected[i].Line, img.Line)
+		assert.Equal(t, expected[i].Value, img.Value)
+		assert.Equal(t, expected[i].Computed, img.Computed)
+		// The offsets are the ones of the value, quotes included
+		assert.Equal(t, strings.Trim(content[img.Start:img.End], `'`), img.Value)
+	}
+}
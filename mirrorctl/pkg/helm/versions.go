@@ -0,0 +1,295 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"oras.land/oras-go/v2/content"
+)
+
+// ErrNoVersionMatches is returned when no version of a chart matches the version constraint of its entry.
+var ErrNoVersionMatches = errors.New("no version matches")
+
+// ErrVersionNotFound is returned when a concrete version of a chart is not found upstream.
+var ErrVersionNotFound = errors.New("version not found upstream")
+
+// IsVersionConstraint returns true if the version of a chart entry has to be resolved against the upstream versions:
+// a semver constraint such as `~5.5` or `>=1.2 <2`, or an entry with `latest`. An exact version is pulled as it is.
+func IsVersionConstraint(ch types.Chart) bool {
+	if ch.Latest > 0 {
+		return true
+	}
+	_, err := semver.StrictNewVersion(strings.TrimPrefix(ch.Version, "v"))
+	return err != nil
+}
+
+// ResolveChartVersions resolves the version of a chart entry to the concrete versions to mirror.
+// An exact version is returned as it is. Otherwise the versions of the chart are listed from the index of its
+// Helm repository, or from the tags of its OCI repository, and the ones matching the constraint are selected:
+// the newest one, or the `latest` newest ones. An entry with `latest` and no version selects among all the versions.
+// It takes an application context and the chart entry as input.
+// It returns the versions sorted from the oldest to the newest, the number of registry operations retried, and an
+// error if the versions cannot be listed or none matches.
+func ResolveChartVersions(ctx *appcontext.AppContext, ch types.Chart) ([]string, int, error) {
+	if !IsVersionConstraint(ch) {
+		return []string{ch.Version}, 0, nil
+	}
+
+	versions, retries, err := ListChartVersions(ctx, ch)
+	if err != nil {
+		return nil, retries, err
+	}
+
+	selected, err := SelectVersions(versions, ch.Version, ch.Latest)
+	if err != nil {
+		return nil, retries, fmt.Errorf("failed to resolve the version of chart %s: %w", ch.Name, err)
+	}
+	log.Debug().Str("chart", ch.Name).Str("constraint", ch.Version).Int("latest", ch.Latest).Strs("versions", selected).
+		Msg("Chart versions resolved")
+	return selected, retries, nil
+}
+
+// ListChartVersions lists the versions of a chart upstream, from the index of its Helm repository, or from the tags
+// of its OCI repository.
+// Listing the tags of an OCI repository is retried, the index of a Helm repository is downloaded by the Helm SDK.
+// It returns the versions, the number of registry operations retried, and an error if the versions cannot be listed.
+func ListChartVersions(ctx *appcontext.AppContext, ch types.Chart) ([]string, int, error) {
+	var versions []string
+	var retries int
+	var err error
+	if strings.HasPrefix(ch.Source, "oci://") {
+		versions, retries, err = listOCIChartVersions(ctx, ch)
+	} else {
+		versions, err = listRepoChartVersions(ctx, ch)
+	}
+	if err != nil {
+		return nil, retries, fmt.Errorf("failed to list the versions of chart %s: %w", ch.Name, err)
+	}
+	return versions, retries, nil
+}
+
+// ChartDigest looks up the digest of the archive of a concrete chart upstream without pulling it, the same as the
+// digest of the chart pulled, see PullChart: the digest listed in the index of its Helm repository, or the one of the
+// chart layer of its OCI repository.
+// The lookup of the OCI manifest is retried, the index of a Helm repository is downloaded by the Helm SDK.
+// It returns the digest, the number of registry operations retried, and an error wrapping ErrVersionNotFound if the
+// version is not found upstream, or another error if the digest cannot be looked up.
+func ChartDigest(ctx *appcontext.AppContext, ch types.Chart) (string, int, error) {
+	if strings.HasPrefix(ch.Source, "oci://") {
+		return ociChartDigest(ctx, ch)
+	}
+	index, err := loadRepoIndex(ctx, ch)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, entry := range index.Entries[ch.Name] {
+		if entry.Version != ch.Version {
+			continue
+		}
+		if entry.Digest == "" {
+			return "", 0, fmt.Errorf("chart %s %s has no digest in the index of repository %s", ch.Name, ch.Version, ch.Source)
+		}
+		// The index lists the hex digest of the archive, without its algorithm
+		return "sha256:" + strings.TrimPrefix(entry.Digest, "sha256:"), 0, nil
+	}
+	return "", 0, fmt.Errorf("chart %s %s: %w", ch.Name, ch.Version, ErrVersionNotFound)
+}
+
+// ociChartDigest looks up the digest of the chart layer of a concrete chart stored in an OCI registry.
+// Helm writes the `+` of the versions as `_` in the tags.
+func ociChartDigest(ctx *appcontext.AppContext, ch types.Chart) (string, int, error) {
+	repoRef := strings.TrimPrefix(ch.Source, "oci://") + "/" + ch.Name
+	repository, err := registryclient.NewRepository(ctx, repoRef)
+	if err != nil {
+		return "", 0, err
+	}
+	tag := strings.ReplaceAll(ch.Version, "+", "_")
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	var manifestJSON []byte
+	retries, err := policy.Do(context.Background(), "fetch manifest "+repoRef+":"+tag, func() error {
+		desc, err := repository.Resolve(context.Background(), tag)
+		if err != nil {
+			return err
+		}
+		manifestJSON, err = content.FetchAll(context.Background(), repository, desc)
+		return err
+	})
+	if registryclient.IsNotFound(err) {
+		return "", retries, fmt.Errorf("chart %s %s: %w", ch.Name, ch.Version, ErrVersionNotFound)
+	} else if err != nil {
+		return "", retries, fmt.Errorf("failed to fetch the manifest of chart %s %s: %w", ch.Name, ch.Version, err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return "", retries, fmt.Errorf("failed to parse the manifest of chart %s %s: %w", ch.Name, ch.Version, err)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == registry.ChartLayerMediaType {
+			return layer.Digest.String(), retries, nil
+		}
+	}
+	return "", retries, fmt.Errorf("manifest of chart %s %s has no chart layer", ch.Name, ch.Version)
+}
+
+// SelectVersions selects the versions matching a semver constraint, e.g. `~5.5` or `>=1.2 <2`, or all of them
+// if the constraint is empty: the newest one, or the latest newest ones when latest is set.
+// Versions that are not semver are ignored, and pre-releases only match a constraint with a pre-release.
+// It returns the versions selected, as they are written upstream, sorted from the oldest to the newest,
+// and an error if the constraint is invalid or no version matches.
+func SelectVersions(versions []string, constraint string, latest int) ([]string, error) {
+	var c *semver.Constraints
+	if constraint != "" {
+		var err error
+		if c, err = semver.NewConstraint(constraint); err != nil {
+			return nil, fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+		}
+	}
+
+	type candidate struct {
+		version  *semver.Version
+		original string
+	}
+	var matching []candidate
+	for _, v := range versions {
+		sv, err := semver.NewVersion(v)
+		if err != nil {
+			continue
+		}
+		if c == nil && sv.Prerelease() != "" {
+			continue
+		}
+		if c != nil && !c.Check(sv) {
+			continue
+		}
+		matching = append(matching, candidate{version: sv, original: v})
+	}
+	if len(matching) == 0 {
+		if constraint == "" {
+			return nil, fmt.Errorf("%w, the chart has no released version", ErrNoVersionMatches)
+		}
+		return nil, fmt.Errorf("%w %q", ErrNoVersionMatches, constraint)
+	}
+
+	sort.Slice(matching, func(i, j int) bool { return matching[i].version.LessThan(matching[j].version) })
+	if latest <= 0 {
+		latest = 1
+	}
+	if len(matching) > latest {
+		matching = matching[len(matching)-latest:]
+	}
+	selected := make([]string, 0, len(matching))
+	for _, m := range matching {
+		selected = append(selected, m.original)
+	}
+	return selected, nil
+}
+
+// listOCIChartVersions lists the versions of a chart stored in an OCI registry, from the tags of its repository.
+// Helm writes the `+` of the versions as `_` in the tags, so they are changed back.
+// The tags are listed again from the first page after a transient error, according to the retry policy.
+// It returns the versions, the number of registry operations retried, and an error if the tags cannot be listed.
+func listOCIChartVersions(ctx *appcontext.AppContext, ch types.Chart) ([]string, int, error) {
+	repoRef := strings.TrimPrefix(ch.Source, "oci://") + "/" + ch.Name
+	repository, err := registryclient.NewRepository(ctx, repoRef)
+	if err != nil {
+		return nil, 0, err
+	}
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	var versions []string
+	retries, err := policy.Do(context.Background(), "list tags "+repoRef, func() error {
+		versions = nil
+		return repository.Tags(context.Background(), "", func(tags []string) error {
+			for _, tag := range tags {
+				versions = append(versions, strings.ReplaceAll(tag, "_", "+"))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, retries, fmt.Errorf("failed to list tags: %w", err)
+	}
+	return versions, retries, nil
+}
+
+// listRepoChartVersions lists the versions of a chart of a Helm repository, from the index of the repository.
+func listRepoChartVersions(ctx *appcontext.AppContext, ch types.Chart) ([]string, error) {
+	index, err := loadRepoIndex(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := index.Entries[ch.Name]
+	if !ok {
+		return nil, fmt.Errorf("chart %s not found in repository %s", ch.Name, ch.Source)
+	}
+	versions := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		versions = append(versions, entry.Version)
+	}
+	return versions, nil
+}
+
+// loadRepoIndex downloads and loads the index of the Helm repository of a chart.
+// The repository is accessed with the credential provider configured for its host.
+func loadRepoIndex(ctx *appcontext.AppContext, ch types.Chart) (*repo.IndexFile, error) {
+	store, err := ctx.Credentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up registry credentials: %w", err)
+	}
+	username, password, err := store.BasicAuth(context.Background(), imageref.NormalizeHost(ch.Source))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials for %s: %w", ch.Source, err)
+	}
+	var transportCfg config.TransportConfig
+	if ctx.Config != nil {
+		transportCfg = ctx.Config.TransportFor(ch.Source)
+	}
+
+	settings := cli.New()
+	chartRepo, err := repo.NewChartRepository(&repo.Entry{
+		Name:                  ch.Name,
+		URL:                   ch.Source,
+		Username:              username,
+		Password:              password,
+		CAFile:                transportCfg.CAFile,
+		InsecureSkipTLSverify: transportCfg.Insecure,
+	}, getter.All(settings))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chart repository client: %w", err)
+	}
+	// The index is downloaded to a directory of its own rather than to the Helm cache
+	cacheDir, err := os.MkdirTemp("", version.AppName+"-index-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(cacheDir)
+	chartRepo.CachePath = cacheDir
+
+	indexPath, err := chartRepo.DownloadIndexFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download repository index: %w", err)
+	}
+	index, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load repository index: %w", err)
+	}
+	return index, nil
+}
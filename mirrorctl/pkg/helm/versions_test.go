@@ -0,0 +1,144 @@
+package helm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectVersions(t *testing.T) {
+	versions := []string{"5.4.0", "5.5.0", "v5.5.2", "5.5.10", "5.6.0-rc.1", "5.6.0", "6.0.0", "latest"}
+	tests := []struct {
+		name       string
+		constraint string
+		latest     int
+		expected   []string
+		wantErr    bool
+	}{
+		{name: "tilde range", constraint: "~5.5", expected: []string{"5.5.10"}},
+		{name: "range", constraint: ">=5.4 <6", expected: []string{"5.6.0"}},
+		{name: "latest of a range", constraint: ">=5.4 <6", latest: 3, expected: []string{"v5.5.2", "5.5.10", "5.6.0"}},
+		{name: "latest of all versions", latest: 2, expected: []string{"5.6.0", "6.0.0"}},
+		{name: "more than available", constraint: "~5.5", latest: 10, expected: []string{"5.5.0", "v5.5.2", "5.5.10"}},
+		{name: "pre-release constraint", constraint: ">=5.6.0-0 <6", latest: 2, expected: []string{"5.6.0-rc.1", "5.6.0"}},
+		{name: "no match", constraint: "~7", wantErr: true},
+		{name: "invalid constraint", constraint: "~>five", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := SelectVersions(versions, tt.constraint, tt.latest)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, selected)
+		})
+	}
+}
+
+func TestIsVersionConstraint(t *testing.T) {
+	assert.False(t, IsVersionConstraint(types.Chart{Version: "5.5.2"}))
+	assert.False(t, IsVersionConstraint(types.Chart{Version: "v1.0.0-rc.1+build.2"}))
+	assert.True(t, IsVersionConstraint(types.Chart{Version: "~5.5"}))
+	assert.True(t, IsVersionConstraint(types.Chart{Version: "5.5"}))
+	assert.True(t, IsVersionConstraint(types.Chart{Version: "5.5.2", Latest: 1}))
+	assert.True(t, IsVersionConstraint(types.Chart{}))
+}
+
+func TestResolveChartVersions(t *testing.T) {
+	registry := registrytest.New(t)
+	for _, v := range []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"} {
+		registry.PushChart(t, "charts/nginx", "nginx", v, []byte("chart "+v))
+	}
+	index := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/index.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`apiVersion: v1
+entries:
+  nginx:
+    - {apiVersion: v2, name: nginx, version: 1.0.0, urls: [nginx-1.0.0.tgz]}
+    - {apiVersion: v2, name: nginx, version: 1.2.0, urls: [nginx-1.2.0.tgz]}
+    - {apiVersion: v2, name: nginx, version: 1.1.0, urls: [nginx-1.1.0.tgz]}
+`))
+	}))
+	t.Cleanup(index.Close)
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Registries: []config.RegistryConfig{{Host: registry.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		chart    types.Chart
+		expected []string
+		wantErr  bool
+	}{
+		{name: "exact version", chart: types.Chart{Name: "nginx", Source: "oci://unreachable.invalid", Version: "1.0.0"}, expected: []string{"1.0.0"}},
+		{name: "OCI tags", chart: types.Chart{Name: "nginx", Source: "oci://" + registry.Host + "/charts", Version: "^1.0"}, expected: []string{"1.2.0"}},
+		{name: "OCI tags latest", chart: types.Chart{Name: "nginx", Source: "oci://" + registry.Host + "/charts", Latest: 2}, expected: []string{"1.2.0", "2.0.0"}},
+		{name: "repository index", chart: types.Chart{Name: "nginx", Source: index.URL, Version: "~1", Latest: 2}, expected: []string{"1.1.0", "1.2.0"}},
+		{name: "chart not in index", chart: types.Chart{Name: "redis", Source: index.URL, Version: "~1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, retries, err := ResolveChartVersions(appCtx, tt.chart)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, versions)
+			assert.Zero(t, retries)
+		})
+	}
+}
+
+func TestResolveChartVersions_RetriesTransientErrors(t *testing.T) {
+	registry := registrytest.New(t)
+	for _, v := range []string{"1.0.0", "1.1.0"} {
+		registry.PushChart(t, "charts/nginx", "nginx", v, []byte("chart "+v))
+	}
+
+	// The first tag listing fails with a rate limit
+	var failures atomic.Int32
+	registry.Middleware = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/tags/list") && failures.Add(1) == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Registries: []config.RegistryConfig{{Host: registry.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options: config.OptionsConfig{
+				DefaultCredentials: "none",
+				Retry:              config.RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+
+	versions, retries, err := ResolveChartVersions(appCtx, types.Chart{Name: "nginx", Source: "oci://" + registry.Host + "/charts", Version: "~1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.1.0"}, versions)
+	assert.Equal(t, 1, retries)
+}
@@ -0,0 +1,93 @@
+package imageref
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// tagPattern is the format of a tag, as defined by the distribution specification.
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// Reference is a parsed image reference, such as `registry.example.com:5000/path/name:tag@sha256:<hex>`.
+type Reference struct {
+	Registry   string        // The registry host, docker.io if the reference has none.
+	Repository string        // The repository path, with the library/ prefix of the Docker Hub official images.
+	Tag        string        // The tag, empty if the reference has none.
+	Digest     digest.Digest // The digest, empty if the reference has none.
+}
+
+// Parse parses an image reference with a tag, a digest or both.
+// The first path segment is the registry host if it contains a dot or a port, or is localhost;
+// references without registry host are Docker Hub images, as with `docker pull`.
+// It returns an error if the reference, its tag or its digest is invalid.
+func Parse(ref string) (Reference, error) {
+	var r Reference
+	name := strings.TrimSpace(ref)
+	if i := strings.Index(name, "@"); i != -1 {
+		d, err := digest.Parse(name[i+1:])
+		if err != nil {
+			return Reference{}, fmt.Errorf("invalid digest in image reference %q: %w", ref, err)
+		}
+		r.Digest = d
+		name = name[:i]
+	}
+	// The tag can only be in the last path segment, the registry host may contain a port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		r.Tag = name[i+1:]
+		name = name[:i]
+		if !tagPattern.MatchString(r.Tag) {
+			return Reference{}, fmt.Errorf("invalid tag in image reference %q", ref)
+		}
+	}
+
+	r.Registry = "docker.io"
+	r.Repository = name
+	if host, path, found := strings.Cut(name, "/"); found && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		r.Registry = NormalizeHost(host)
+		r.Repository = path
+	}
+	if r.Repository == "" || strings.HasPrefix(r.Repository, "/") || strings.HasSuffix(r.Repository, "/") {
+		return Reference{}, fmt.Errorf("invalid repository in image reference %q", ref)
+	}
+	if r.Registry == "docker.io" && !strings.Contains(r.Repository, "/") {
+		r.Repository = "library/" + r.Repository
+	}
+	return r, nil
+}
+
+// Name returns the registry host and repository of the reference, without tag nor digest.
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the full reference: registry/repository[:tag][@digest].
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// NormalizeHost turns a registry host, URL or reference into a bare, lower-case registry host.
+// All the Docker Hub aliases are mapped to docker.io so they can be matched against the configuration.
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimPrefix(host, "oci://")
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if idx := strings.Index(host, "/"); idx != -1 {
+		host = host[:idx]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
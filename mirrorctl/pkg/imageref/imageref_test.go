@@ -0,0 +1,56 @@
+package imageref
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	assert.Equal(t, "docker.io", NormalizeHost("registry-1.docker.io"))
+	assert.Equal(t, "docker.io", NormalizeHost("https://index.docker.io/v1/"))
+	assert.Equal(t, "grafana.github.io", NormalizeHost("https://grafana.github.io/helm-charts"))
+	assert.Equal(t, "docker.io", NormalizeHost("oci://registry-1.docker.io/bitnamicharts"))
+	assert.Equal(t, "localhost:5000", NormalizeHost("localhost:5000/library/alpine:3.20"))
+}
+
+func TestParse(t *testing.T) {
+	const dgst = "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+	tests := []struct {
+		ref      string
+		expected Reference
+		wantErr  bool
+	}{
+		{ref: "busybox:1.36", expected: Reference{Registry: "docker.io", Repository: "library/busybox", Tag: "1.36"}},
+		{ref: "bitnami/redis:7.2", expected: Reference{Registry: "docker.io", Repository: "bitnami/redis", Tag: "7.2"}},
+		{ref: "registry-1.docker.io/bitnami/redis", expected: Reference{Registry: "docker.io", Repository: "bitnami/redis"}},
+		{ref: "quay.io/curl/curl:8.16.0", expected: Reference{Registry: "quay.io", Repository: "curl/curl", Tag: "8.16.0"}},
+		{ref: "localhost:5000/app", expected: Reference{Registry: "localhost:5000", Repository: "app"}},
+		{ref: "registry.example.com:5000/team/app:v1", expected: Reference{Registry: "registry.example.com:5000", Repository: "team/app", Tag: "v1"}},
+		{ref: "registry.example.com:5000/team/app@" + dgst, expected: Reference{Registry: "registry.example.com:5000", Repository: "team/app", Digest: dgst}},
+		{ref: "ghcr.io/org/app:v1@" + dgst, expected: Reference{Registry: "ghcr.io", Repository: "org/app", Tag: "v1", Digest: dgst}},
+		{ref: "", wantErr: true},
+		{ref: "ghcr.io/org/app@sha256:abc", wantErr: true},
+		{ref: "ghcr.io/org/app:", wantErr: true},
+		{ref: "ghcr.io/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			ref, err := Parse(tt.ref)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, ref)
+		})
+	}
+}
+
+func TestReference_String(t *testing.T) {
+	ref, err := Parse("localhost:5000/app:v1@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:5000/app", ref.Name())
+	assert.Equal(t, "localhost:5000/app:v1@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b", ref.String())
+}
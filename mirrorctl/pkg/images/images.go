@@ -2,179 +2,328 @@ package images
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
-	"oras.land/oras-go/v2"
-	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
-// MirrorImagesFromFile mirrors a list of container images from a file to a Google Artifact Registry.
-// It takes an application context and the path to the file containing the list of images as input.
+// MirrorImagesFromFile mirrors a list of container images from a file to the target registry.
+// It takes an application context, the path to the file containing the list of images and, optionally,
+// a function that resolves the image entries to concrete images before any image is mirrored, ResolveImages if nil.
+// The entries with a tag filter are mirrored with every tag selected, see ResolveImages.
 //
 // It returns three values:
-//   - A map of strings to strings, where the keys are the source image names and the values are the destination image names.
-//   - A map of strings to strings, where the keys are the source image names and the values are the image digests.
+//   - A list of types.MirroredImage, of the images mirrored with their destination image names.
+//   - A list of types.FailedImage, of the images that failed to mirror, followed by the entries whose tags could not be resolved.
 //   - An error if the mirroring fails.
-func MirrorImagesFromFile(ctx *appcontext.AppContext, imagesFile string) (map[string]string, []types.FailedImage, error) {
+func MirrorImagesFromFile(ctx *appcontext.AppContext, imagesFile string, resolve func(images []types.Image) []ResolvedImage) ([]types.MirroredImage, []types.FailedImage, error) {
+	imagesList, err := LoadImagesList(imagesFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Log the image list in a pretty format
+	log.Info().Interface("images", imagesList).Str("file", imagesFile).Msg("Loaded images from file")
+
+	if resolve == nil {
+		resolve = func(images []types.Image) []ResolvedImage { return ResolveImages(ctx, images) }
+	}
+	resolved := resolve(imagesList.Images)
+	var concrete types.ImagesList
+	var unresolved []types.FailedImage
+	for _, r := range resolved {
+		if r.Err != nil {
+			log.Error().Err(r.Err).Str("image", r.Entry.Source).Msg("Failed to resolve image tags")
+			unresolved = append(unresolved, types.FailedImage{Image: r.Entry, Error: r.Err.Error()})
+			continue
+		}
+		concrete.Images = append(concrete.Images, r.Images()...)
+	}
+
+	mirroredImages, failedImages, err := MirrorImages(ctx, concrete)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mirroredImages, append(failedImages, unresolved...), nil
+}
+
+// LoadImagesList reads a YAML file containing a list of images.
+// It returns an error if the file cannot be read or parsed.
+func LoadImagesList(imagesFile string) (*types.ImagesList, error) {
 	if imagesFile == "" {
-		return nil, nil, fmt.Errorf("images file path is required")
+		return nil, fmt.Errorf("images file path is required")
 	}
 
 	// Read images.yaml
 	data, err := os.ReadFile(imagesFile)
 	if err != nil {
 		log.Error().Err(err).Str("file", imagesFile).Msg("Failed to read images file")
-		return nil, nil, err
+		return nil, err
 	}
 	var imagesList types.ImagesList
 	if err := yaml.Unmarshal(data, &imagesList); err != nil {
 		log.Error().Err(err).Str("file", imagesFile).Msg("Failed to parse images file")
-		return nil, nil, err
+		return nil, err
 	}
-
-	// Log the image list in a pretty format
-	log.Info().Interface("images", imagesList).Str("file", imagesFile).Msg("Loaded images from file")
-	return MirrorImages(ctx, imagesList)
+	return &imagesList, nil
 }
 
-// MirrorImages mirrors a list of container images to a Google Artifact Registry.
+// MirrorImages mirrors a list of container images to the target registry.
 // It takes an application context and a list of images as input.
+// Images are mirrored concurrently, see Mirrorer.
 //
 // It returns three values:
-//   - A map of strings to strings, where the keys are the source image names and the values are the destination image names.
-//   - A list of types.FailedImage, of the images that failed to mirror. Each element of the list is a map with two keys: image and error, where error is the error message.
-//   - An error if the mirroring fails.
-func MirrorImages(ctx *appcontext.AppContext, imagesList types.ImagesList) (map[string]string, []types.FailedImage, error) {
-	// Track failed images with error reasons
-	failedImages := make([]types.FailedImage, 0)
-	mirroredImages := make(map[string]string)
-
-	for _, img := range imagesList.Images {
-		log.Debug().Str("name", img.Name).Str("source", img.Source).Msg("Processing image")
-
-		// Define a helper function to handle failure for cleaner flow
-		handleFailure := func(err error, msg string) {
-			log.Error().Err(err).Str("image", img.Source).Msg(msg)
-			failedImages = append(failedImages, types.FailedImage{
-				Image: img,
-				Error: err.Error(),
-			})
-		}
+//   - A list of types.MirroredImage, of the images mirrored with their destination image names, in the order of the input list.
+//   - A list of types.FailedImage, of the images that failed to mirror, in the order of the input list. Each element of the list is a map with two keys: image and error, where error is the error message.
+//   - An error if the mirroring fails or no target registry is configured.
+func MirrorImages(ctx *appcontext.AppContext, imagesList types.ImagesList) ([]types.MirroredImage, []types.FailedImage, error) {
+	m, err := NewMirrorer(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.Submit(imagesList.Images...)
+	mirroredImages, failedImages := m.Wait()
+	return mirroredImages, failedImages, nil
+}
 
-		tag, err := getImageTag(img)
-		if err != nil {
-			handleFailure(err, "Failed to get image tag")
-			continue
-		}
-		targetRepoPath := fmt.Sprintf("%s/%s:%s", ctx.Config.GCP.GARRepoContainers, img.Name, tag)
+// imageResult holds the outcome of mirroring a single image.
+type imageResult struct {
+	target       string             // The destination image, empty if the source image could not be resolved.
+	failed       *types.FailedImage // The failure, nil if the image was mirrored.
+	retries      int                // The number of registry operations retried.
+	platforms    []string           // The platforms copied, or requested in dry-run mode.
+	referrers    []types.Referrer   // The signatures, attestations and SBOMs copied with the image.
+	sourceDigest digest.Digest      // The digest the source reference resolved to, empty in dry-run mode.
+	desc         v1.Descriptor      // The manifest or index tagged in the target registry, empty in dry-run mode.
+}
 
-		if ctx.DryRun {
-			log.Info().
-				Str("equivalent command", fmt.Sprintf("oras cp %s %s", img.Source, targetRepoPath)).
-				Msg("Dry-run: Would mirror image to GAR")
-			mirroredImages[img.Source] = targetRepoPath
-			continue
-		}
+// mirrorImage mirrors a single container image to the target registry.
+// The signature of the image is verified first according to its verification policy, see verificationPolicy.
+// Only the platforms requested for the image are copied, see planPlatforms.
+// The referrers of the image are copied too when options.referrers is enabled, even if the image was already mirrored,
+// see copyReferrers.
+// It takes the image as input.
+// It returns the outcome of the mirroring.
+func (m *Mirrorer) mirrorImage(img types.Image) imageResult {
+	log.Debug().Str("name", img.Name).Str("source", img.Source).Msg("Processing image")
 
-		// Initialize ORAS source and target registries
-		// Equivalent to: oras cp <source> <target>
-		sourceRepo, err := remote.NewRepository(img.Source)
-		if err != nil {
-			handleFailure(err, "Failed to initialize source repository")
-			continue
+	var result imageResult
+	// Define a helper function to handle failure for cleaner flow
+	handleFailure := func(err error, msg string) imageResult {
+		log.Error().Err(err).Str("image", img.Source).Int("retries", result.retries).Msg(msg)
+		result.failed = &types.FailedImage{
+			Image:   img,
+			Error:   err.Error(),
+			Retries: result.retries,
 		}
+		return result
+	}
+	// retry runs a registry operation with the retry policy and counts its retries
+	withRetry := func(operation string, fn func() error) error {
+		retries, err := m.retry.Do(context.Background(), operation+" "+img.Source, fn)
+		result.retries += retries
+		return err
+	}
 
-		targetRepo, err := remote.NewRepository(targetRepoPath)
-		if err != nil {
-			handleFailure(err, "Failed to initialize target repository")
-			continue
-		}
+	ref, err := imageref.Parse(img.Source)
+	if err != nil {
+		return handleFailure(err, "Invalid image source")
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		return handleFailure(fmt.Errorf("image source must contain a tag or a digest"), "Invalid image source")
+	}
+	targetRepository := fmt.Sprintf("%s/%s", strings.TrimSuffix(m.target.ImagesRepository, "/"), img.Name)
+	targetRef := targetReference(ref.Tag, ref.Digest)
+	targetRepoPath := joinReference(targetRepository, targetRef)
+	platforms := platformsFor(img.Platforms, m.ctx.Config.Options.Platforms)
+	referrersCfg := m.ctx.Config.Options.Referrers
+	policy, err := verificationPolicy(img, ref.Registry, m.ctx.Config)
+	if err != nil {
+		return handleFailure(err, "Invalid signature verification policy")
+	}
 
-		// Authenticate with Google Artifact Registry
-		cmd := exec.Command("gcloud", "auth", "print-access-token")
-		token, err := cmd.Output()
-		if err != nil {
-			handleFailure(err, "Failed to get gcloud access token")
-			continue
+	if m.ctx.DryRun {
+		command := fmt.Sprintf("oras cp %s %s", img.Source, targetRepoPath)
+		if len(platforms) == 1 {
+			command = fmt.Sprintf("oras cp --platform %s %s %s", platforms[0], img.Source, targetRepoPath)
 		}
+		log.Info().
+			Str("equivalent command", command).
+			Strs("platforms", platforms).
+			Bool("referrers", referrersCfg.Enabled).
+			Str("verification", policy).
+			Msg("Dry-run: Would mirror image to the target registry")
+		result.target = targetRepoPath
+		result.platforms = platforms
+		return result
+	}
 
-		targetRepo.Client = &auth.Client{
-			Client: http.DefaultClient,
-			Cache:  auth.NewCache(),
-			Credential: func(ctx context.Context, s string) (auth.Credential, error) {
-				return auth.Credential{
-					AccessToken: strings.TrimSpace(string(token)),
-				}, nil
-			},
-		}
+	// Initialize ORAS source and target registries
+	// Equivalent to: oras cp <source> <target>
+	// Both repositories authenticate with the credential provider configured for their host.
+	sourceRepo, err := registryclient.NewRepository(m.ctx, img.Source)
+	if err != nil {
+		return handleFailure(err, "Failed to initialize source repository")
+	}
 
-		// Check if image already exists in GAR (idempotency)
-		sourceDesc, err := sourceRepo.Resolve(context.Background(), sourceRepo.Reference.Reference)
-		if err != nil {
-			handleFailure(err, "Failed to resolve source image")
-			continue
-		}
+	dest, targetHost, err := m.destination(targetRepository)
+	if err != nil {
+		return handleFailure(err, "Failed to initialize target repository")
+	}
 
-		mirroredImages[img.Source] = targetRepoPath
+	hosts := []string{sourceRepo.Reference.Registry}
+	if targetHost != "" {
+		hosts = append(hosts, targetHost)
+	}
+	release := m.limiter.acquire(hosts...)
+	defer release()
 
-		targetDesc, err := targetRepo.Resolve(context.Background(), targetRepo.Reference.Reference)
-		if err == nil && targetDesc.Digest == sourceDesc.Digest {
-			log.Info().Str("name", img.Name).Str("digest", sourceDesc.Digest.String()).Msg("Image already exists in GAR, skipping")
-			continue
-		} else if err == nil && targetDesc.Digest != sourceDesc.Digest && ctx.Config.Options.NotifyTagMutations {
-			// TODO test this scenario
-			mirrorErr := fmt.Errorf("image %s tag points to different digest in GAR, please manually check", img.Source)
-			log.Warn().
-				Str("name", img.Name).
-				Str("source_digest", sourceDesc.Digest.String()).
-				Str("target_digest", targetDesc.Digest.String()).
-				Msg("Tag points to different digest in GAR, please manually check")
-			handleFailure(mirrorErr, "Tag mutation detected")
-			continue
+	// Check if image already exists in the target registry (idempotency)
+	var sourceDesc v1.Descriptor
+	err = withRetry("resolve", func() (err error) {
+		sourceDesc, err = sourceRepo.Resolve(context.Background(), sourceRepo.Reference.Reference)
+		return err
+	})
+	if err != nil {
+		return handleFailure(err, "Failed to resolve source image")
+	}
+
+	// The signature is checked on the source image, so that nothing unsigned or tampered reaches the target registry
+	if policy != config.VerificationSkip {
+		err = withRetry("verify", func() error {
+			return m.verifier.Verify(context.Background(), sourceRepo, sourceDesc)
+		})
+		if err != nil && policy == config.VerificationRequire {
+			return handleFailure(fmt.Errorf("signature verification failed: %w", err), "Image signature verification failed")
+		} else if err != nil {
+			log.Warn().Err(err).Str("image", img.Source).Msg("Image signature verification failed, mirroring it anyway")
+		} else {
+			log.Info().Str("image", img.Source).Str("digest", sourceDesc.Digest.String()).Msg("Image signature verified")
 		}
+	}
 
-		// Mirror the image
-		// Equivalent to: oras cp <source> <target>
-		_, err = oras.Copy(context.Background(), sourceRepo, sourceRepo.Reference.Reference, targetRepo, targetRepo.Reference.Reference, oras.DefaultCopyOptions)
+	var plan platformPlan
+	err = withRetry("fetch index", func() (err error) {
+		plan, err = planPlatforms(context.Background(), sourceRepo, sourceDesc, platforms)
+		return err
+	})
+	if err != nil {
+		return handleFailure(err, "Failed to select image platforms")
+	}
+
+	// An image referenced only by digest is pushed by digest, which is the one of the trimmed index if platforms were selected
+	targetRef = targetReference(ref.Tag, plan.desc.Digest)
+	targetRepoPath = joinReference(targetRepository, targetRef)
+	result.target = targetRepoPath
+	result.platforms = plan.platforms
+	result.sourceDigest = sourceDesc.Digest
+	result.desc = plan.desc
+
+	// The lookup is retried, but a tag missing from the target registry ends it at once, as it is not transient
+	var targetDesc v1.Descriptor
+	err = withRetry("resolve", func() (err error) {
+		targetDesc, err = dest.Resolve(context.Background(), dest.reference(targetRef))
+		return err
+	})
+	exists := err == nil && targetDesc.Digest == plan.desc.Digest
+	if exists {
+		log.Info().Str("name", img.Name).Str("digest", plan.desc.Digest.String()).Msg("Image already exists in the target registry, skipping")
+	} else if err == nil && targetDesc.Digest != plan.desc.Digest && m.ctx.Config.Options.NotifyTagMutations {
+		// TODO test this scenario
+		mirrorErr := fmt.Errorf("image %s tag points to different digest in the target registry, please manually check", img.Source)
+		log.Warn().
+			Str("name", img.Name).
+			Str("source_digest", plan.desc.Digest.String()).
+			Str("target_digest", targetDesc.Digest.String()).
+			Msg("Tag points to different digest in the target registry, please manually check")
+		return handleFailure(mirrorErr, "Tag mutation detected")
+	}
+
+	// Mirror the image
+	// Equivalent to: oras cp [--platform <platform>] <source> <target>
+	// Blobs already copied by a failed attempt are skipped by the next one.
+	if !exists {
+		err = withRetry("copy", func() error {
+			return copyPlan(context.Background(), sourceRepo, dest, plan, targetRef)
+		})
 		if err != nil {
-			handleFailure(err, "Failed to mirror image")
-			continue
+			return handleFailure(err, "Failed to mirror image")
+		}
+		if m.layout != nil {
+			err = bundle.Tag(context.Background(), m.layout, plan.desc, dest.reference(targetRef), map[string]string{
+				bundle.AnnotationKind:         bundle.KindImage,
+				bundle.AnnotationName:         img.Name,
+				bundle.AnnotationSource:       img.Source,
+				bundle.AnnotationSourceDigest: sourceDesc.Digest.String(),
+			})
+			if err != nil {
+				return handleFailure(err, "Failed to tag image in the bundle")
+			}
 		}
-
-		log.Info().Str("name", img.Name).
-			Str("source", img.Source).
-			Str("target", targetRepoPath).Str("tag", sourceRepo.Reference.Reference).
-			Msg("Successfully mirrored image to GAR.")
 	}
 
-	// Log failed images in JSON format for GitHub Actions
-	if len(failedImages) > 0 {
-		failedJSON, _ := json.Marshal(map[string][]types.FailedImage{"failed_images": failedImages})
-		log.Warn().RawJSON("failed_images", failedJSON).Msg("Some images failed to mirror")
+	// Referrers may have been attached after the image was mirrored, so they are copied even if the image exists
+	// Equivalent to: oras cp --recursive <source> <target>
+	if referrersCfg.Enabled {
+		err = withRetry("copy referrers", func() (err error) {
+			result.referrers, err = copyReferrers(context.Background(), sourceRepo, dest, referrerSubjects(plan), referrersCfg.ArtifactTypes)
+			return err
+		})
+		if err != nil {
+			return handleFailure(err, "Failed to copy image referrers")
+		}
+	}
+	if exists {
+		return result
 	}
 
-	return mirroredImages, failedImages, nil
+	log.Info().Str("name", img.Name).
+		Str("source", img.Source).
+		Str("target", targetRepoPath).Str("digest", plan.desc.Digest.String()).
+		Strs("platforms", result.platforms).
+		Int("referrers", len(result.referrers)).
+		Int("retries", result.retries).
+		Msg("Successfully mirrored image to the target registry.")
+	return result
+}
+
+// destination returns where an image is copied to, the OCI image layout of the mirrorer or a repository of the
+// target registry, and the registry host it is copied to, empty for a layout.
+func (m *Mirrorer) destination(targetRepository string) (destination, string, error) {
+	if m.layout != nil {
+		return destination{Target: m.layout, repository: targetRepository}, "", nil
+	}
+	targetRepo, err := registryclient.NewRepository(m.ctx, targetRepository)
+	if err != nil {
+		return destination{}, "", err
+	}
+	return destination{Target: targetRepo}, targetRepo.Reference.Registry, nil
 }
 
-// getImageTag extracts the tag from an image source string.
-// It takes an image object as input.
-// It returns the image tag and an error if the tag cannot be extracted.
-func getImageTag(img types.Image) (string, error) {
-	if img.Source == "" {
-		return "", fmt.Errorf("image source cannot be empty")
+// targetReference returns the reference of an image in the target repository: the tag of the source image,
+// or the digest mirrored if the source image is only referenced by digest.
+func targetReference(tag string, dgst digest.Digest) string {
+	if tag != "" {
+		return tag
 	}
-	if !strings.Contains(img.Source, ":") {
-		return "", fmt.Errorf("image source must contain a tag")
+	return dgst.String()
+}
+
+// joinReference joins a repository and a tag or digest into an image reference.
+func joinReference(repository, reference string) string {
+	if _, err := digest.Parse(reference); err == nil {
+		return repository + "@" + reference
 	}
-	return strings.Split(img.Source, ":")[1], nil
+	return repository + ":" + reference
 }
@@ -1,23 +1,35 @@
 package images
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2/content/oci"
 )
 
 func TestMirrorImages_NoImagesFile(t *testing.T) {
 	appCtx := &appcontext.AppContext{}
-	_, _, err := MirrorImagesFromFile(appCtx, "")
+	_, _, err := MirrorImagesFromFile(appCtx, "", nil)
 	assert.Error(t, err)
 }
 
 func TestMirrorImages_ImagesFileNotFound(t *testing.T) {
 	appCtx := &appcontext.AppContext{}
-	_, _, err := MirrorImagesFromFile(appCtx, "non-existent-file.yaml")
+	_, _, err := MirrorImagesFromFile(appCtx, "non-existent-file.yaml", nil)
 	assert.Error(t, err)
 }
 
@@ -29,7 +41,7 @@ func TestMirrorImages_InvalidYAML(t *testing.T) {
 	assert.NoError(t, err)
 	file.Close()
 
-	_, _, err = MirrorImagesFromFile(appCtx, file.Name())
+	_, _, err = MirrorImagesFromFile(appCtx, file.Name(), nil)
 	assert.Error(t, err)
 }
 
@@ -53,9 +65,12 @@ images:
 	assert.NoError(t, err)
 	file.Close()
 
-	mirrored, failed, err := MirrorImagesFromFile(appCtx, file.Name())
+	mirrored, failed, err := MirrorImagesFromFile(appCtx, file.Name(), nil)
 	assert.NoError(t, err)
-	assert.Equal(t, "us-central1-docker.pkg.dev/my-project/my-repo/myfolder/myubuntuimage:22.04", mirrored["sourcefolder/ubuntu:22.04"])
+	assert.Equal(t, []types.MirroredImage{{
+		Source: "sourcefolder/ubuntu:22.04",
+		Target: "us-central1-docker.pkg.dev/my-project/my-repo/myfolder/myubuntuimage:22.04",
+	}}, mirrored)
 	assert.Equal(t, 0, len(failed))
 }
 
@@ -79,6 +94,294 @@ images:
 	assert.NoError(t, err)
 	file.Close()
 
-	_, _, err = MirrorImagesFromFile(appCtx, file.Name())
+	_, _, err = MirrorImagesFromFile(appCtx, file.Name(), nil)
 	assert.NoError(t, err) // The function itself doesn't return an error, it logs it
 }
+
+func TestMirrorImages_GenericTarget(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	desc := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ImagesRepository: target.Host + "/mirror/images/",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{
+				Host:            source.Host,
+				TransportConfig: config.TransportConfig{PlainHTTP: true},
+			}},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+
+	sourceRef := source.Host + "/library/busybox:1.36"
+	mirrored, failed, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "busybox", Source: sourceRef}}})
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	assert.Equal(t, []types.MirroredImage{{
+		Source:       sourceRef,
+		Target:       target.Host + "/mirror/images/busybox:1.36",
+		SourceDigest: desc.Digest.String(),
+		Digest:       desc.Digest.String(),
+		Size:         desc.Size,
+		MediaType:    desc.MediaType,
+	}}, mirrored)
+
+	dgst, ok := target.Resolve("mirror/images/busybox", "1.36")
+	require.True(t, ok)
+	assert.Equal(t, desc.Digest, dgst)
+
+	// A second run finds the image already mirrored
+	_, failed, err = MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "busybox", Source: sourceRef}}})
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+}
+
+func TestMirrorImages_DigestSource(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	desc := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+	index := source.PushIndex(t, "library/app", "1.0", "linux/amd64", "linux/arm64", "linux/arm/v7")
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror", TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+
+	mirrored, failed, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{
+		{Name: "busybox", Source: source.Host + "/library/busybox@" + desc.Digest.String()},
+		{Name: "busybox-tagged", Source: source.Host + "/library/busybox:1.36@" + desc.Digest.String()},
+		{Name: "app", Source: source.Host + "/library/app@" + index.Digest.String(), Platforms: []string{"linux/amd64", "linux/arm64"}},
+		{Name: "wrong-digest", Source: source.Host + "/library/busybox:1.36@" + index.Digest.String()},
+	}})
+	require.NoError(t, err)
+	require.Len(t, mirrored, 3)
+
+	// An image referenced only by digest is pushed by digest
+	assert.Equal(t, target.Host+"/mirror/busybox@"+desc.Digest.String(), mirrored[0].Target)
+	assert.Equal(t, desc.Digest.String(), mirrored[0].Digest)
+	_, ok := target.Resolve("mirror/busybox", desc.Digest.String())
+	assert.True(t, ok)
+
+	// A tag and a digest pin the source, and the target is tagged
+	assert.Equal(t, target.Host+"/mirror/busybox-tagged:1.36", mirrored[1].Target)
+	dgst, ok := target.Resolve("mirror/busybox-tagged", "1.36")
+	require.True(t, ok)
+	assert.Equal(t, desc.Digest, dgst)
+
+	// The trimmed index has a digest of its own
+	assert.Equal(t, index.Digest.String(), mirrored[2].SourceDigest)
+	assert.NotEqual(t, mirrored[2].SourceDigest, mirrored[2].Digest)
+	assert.Equal(t, target.Host+"/mirror/app@"+mirrored[2].Digest, mirrored[2].Target)
+	assert.Equal(t, v1.MediaTypeImageIndex, mirrored[2].MediaType)
+
+	// The tag is ignored when a digest is set, and the digest is not in the repository
+	require.Len(t, failed, 1)
+	assert.Equal(t, "wrong-digest", failed[0].Image.Name)
+}
+
+func TestMirrorImages_NoTarget(t *testing.T) {
+	appCtx := &appcontext.AppContext{Config: &config.Config{}}
+	_, _, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "busybox", Source: "busybox:1.36"}}})
+	assert.Error(t, err)
+}
+
+func TestMirrorImages_Concurrent(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	var imagesList types.ImagesList
+	for i := range 12 {
+		name := fmt.Sprintf("app-%02d", i)
+		if i%4 == 0 {
+			// Not pushed to the source registry, so it fails to mirror
+			imagesList.Images = append(imagesList.Images, types.Image{Name: name, Source: source.Host + "/missing/" + name + ":1.0"})
+			continue
+		}
+		source.PushImage(t, "apps/"+name, "1.0", []byte(name))
+		imagesList.Images = append(imagesList.Images, types.Image{Name: name, Source: source.Host + "/apps/" + name + ":1.0"})
+	}
+
+	// Count the manifest pushes running at the same time on the target registry
+	var running, maxRunning atomic.Int32
+	target.Middleware = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror"}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+				{Host: target.Host, MaxConcurrency: 2, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none", Concurrency: 6},
+		},
+	}
+
+	mirrored, failed, err := MirrorImages(appCtx, imagesList)
+	require.NoError(t, err)
+	assert.Len(t, mirrored, 9)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(2))
+
+	// Failures are reported in the order of the input list
+	require.Len(t, failed, 3)
+	for i, f := range failed {
+		assert.Equal(t, imagesList.Images[i*4], f.Image)
+	}
+	for _, img := range imagesList.Images {
+		if strings.Contains(img.Source, "/apps/") {
+			_, ok := target.Resolve("mirror/"+img.Name, "1.0")
+			assert.True(t, ok, img.Name)
+		}
+	}
+}
+
+func TestMirrorImages_RetriesTransientErrors(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+
+	// The first two manifest pushes fail, the first with a rate limit and the second with a server error
+	var failures atomic.Int32
+	target.Middleware = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				switch failures.Add(1) {
+				case 1:
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				case 2:
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror", TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{
+				DefaultCredentials: "none",
+				Retry:              config.RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			},
+		},
+	}
+
+	sourceRef := source.Host + "/library/busybox:1.36"
+	mirrored, failed, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "busybox", Source: sourceRef}}})
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	require.Len(t, mirrored, 1)
+	assert.Equal(t, 2, mirrored[0].Retries)
+	_, ok := target.Resolve("mirror/busybox", "1.36")
+	assert.True(t, ok)
+}
+
+func TestMirrorer_Await(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	busybox := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+	source.PushImage(t, "library/redis", "7.2", []byte("redis layer"))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror", TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+	mirrorer, err := NewMirrorer(appCtx)
+	require.NoError(t, err)
+
+	busyboxImage := types.Image{Name: "busybox", Source: source.Host + "/library/busybox:1.36"}
+	mirrorer.Submit(busyboxImage, types.Image{Name: "redis", Source: source.Host + "/library/redis:7.2"})
+
+	// Awaiting submitted and new images returns the mirrored ones, in order
+	mirrored := mirrorer.Await(
+		types.Image{Name: "missing", Source: source.Host + "/library/missing:1.0"},
+		busyboxImage,
+	)
+	require.Len(t, mirrored, 1)
+	assert.Equal(t, target.Host+"/mirror/busybox:1.36", mirrored[0].Target)
+	assert.Equal(t, busybox.Digest.String(), mirrored[0].Digest)
+
+	mirrored, failed := mirrorer.Wait()
+	assert.Len(t, mirrored, 2)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "missing", failed[0].Image.Name)
+}
+
+func TestNewLayoutMirrorer(t *testing.T) {
+	source := registrytest.New(t)
+	busybox := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			// The target registry is never contacted, the images are only tagged with their reference in it
+			Targets: []config.TargetConfig{{Name: "airgap", ImagesRepository: "registry.example.com/mirror"}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+	layout, err := oci.New(t.TempDir())
+	require.NoError(t, err)
+	mirrorer, err := NewLayoutMirrorer(appCtx, layout)
+	require.NoError(t, err)
+
+	busyboxImage := types.Image{Name: "busybox", Source: source.Host + "/library/busybox:1.36"}
+	mirrorer.Submit(busyboxImage)
+	mirrored, failed := mirrorer.Wait()
+	require.Empty(t, failed)
+	require.Len(t, mirrored, 1)
+	assert.Equal(t, "registry.example.com/mirror/busybox:1.36", mirrored[0].Target)
+
+	desc, err := layout.Resolve(context.Background(), "registry.example.com/mirror/busybox:1.36")
+	require.NoError(t, err)
+	assert.Equal(t, busybox.Digest, desc.Digest)
+	assert.Equal(t, map[string]string{
+		bundle.AnnotationKind:         bundle.KindImage,
+		bundle.AnnotationName:         "busybox",
+		bundle.AnnotationSource:       busyboxImage.Source,
+		bundle.AnnotationSourceDigest: busybox.Digest.String(),
+	}, desc.Annotations)
+
+	// An image already in the layout is skipped
+	mirrorer, err = NewLayoutMirrorer(appCtx, layout)
+	require.NoError(t, err)
+	mirrorer.Submit(busyboxImage)
+	mirrored, failed = mirrorer.Wait()
+	assert.Empty(t, failed)
+	assert.Len(t, mirrored, 1)
+}
@@ -0,0 +1,163 @@
+package images
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2"
+)
+
+// ImportImages pushes the images of a bundle to the images repository of the target registry, whatever the
+// registry the bundle was exported for: each image is tagged as it was exported, under the name of its entry.
+// The referrers of an image in the bundle and the other tags of its repository, such as cosign signatures, are
+// pushed with it. The digest pushed is checked against the index of the bundle.
+// At most options.concurrency images are pushed at the same time.
+// It takes an application context, the OCI image layout of the bundle and its artifacts as input.
+// It returns the images pushed and the images that failed, in the order of the artifacts, and an error if no target
+// registry with an images repository is configured.
+func ImportImages(ctx *appcontext.AppContext, layout oras.ReadOnlyGraphTarget, artifacts []bundle.Artifact) ([]types.MirroredImage, []types.FailedImage, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return nil, nil, err
+	}
+	if target.ImagesRepository == "" {
+		return nil, nil, fmt.Errorf("target %q has no images repository", target.Name)
+	}
+
+	var imgs []bundle.Artifact
+	otherTags := make(map[string][]bundle.Artifact)
+	for _, a := range artifacts {
+		switch a.Kind {
+		case bundle.KindImage:
+			imgs = append(imgs, a)
+		case "":
+			otherTags[a.Repository()] = append(otherTags[a.Repository()], a)
+		}
+	}
+
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	results := make([]types.MirroredImage, len(imgs))
+	errs := make([]error, len(imgs))
+	workers := make(chan struct{}, ctx.Config.ImageConcurrency())
+	var wg sync.WaitGroup
+	for i, a := range imgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			results[i], errs[i] = importImage(ctx, policy, layout, target.ImagesRepository, a, otherTags[a.Repository()])
+		}()
+	}
+	wg.Wait()
+
+	var imported []types.MirroredImage
+	var failed []types.FailedImage
+	for i, a := range imgs {
+		if errs[i] != nil {
+			log.Error().Err(errs[i]).Str("image", a.Reference).Int("retries", results[i].Retries).Msg("Failed to import image")
+			failed = append(failed, types.FailedImage{
+				Image:   types.Image{Name: a.Name, Source: a.Source},
+				Error:   errs[i].Error(),
+				Retries: results[i].Retries,
+			})
+			continue
+		}
+		imported = append(imported, results[i])
+	}
+	return imported, failed, nil
+}
+
+// importImage pushes an image of a bundle, and the other tags of its repository, to the target registry.
+// An image already in the target registry with the digest of the bundle is skipped, and one with another digest
+// fails with options.notify_tag_mutations, as mirrorImage does.
+// It returns the image pushed, with the number of registry operations retried, and an error if the image could not
+// be pushed or the digest pushed differs from the one of the bundle.
+func importImage(ctx *appcontext.AppContext, policy retry.Policy, layout oras.ReadOnlyGraphTarget, imagesRepository string, a bundle.Artifact, otherTags []bundle.Artifact) (types.MirroredImage, error) {
+	targetRepository := fmt.Sprintf("%s/%s", strings.TrimSuffix(imagesRepository, "/"), a.Name)
+	imported := types.MirroredImage{
+		Source:       a.Source,
+		Target:       joinReference(targetRepository, a.Tag()),
+		SourceDigest: a.SourceDigest,
+		Digest:       a.Descriptor.Digest.String(),
+		Size:         a.Descriptor.Size,
+		MediaType:    a.Descriptor.MediaType,
+	}
+	withRetry := func(operation string, fn func() error) error {
+		retries, err := policy.Do(context.Background(), operation+" "+imported.Target, fn)
+		imported.Retries += retries
+		return err
+	}
+
+	if ctx.DryRun {
+		log.Info().Str("image", a.Reference).Str("target", imported.Target).Msg("Dry-run: Would import image to the target registry")
+		return imported, nil
+	}
+
+	targetRepo, err := registryclient.NewRepository(ctx, targetRepository)
+	if err != nil {
+		return imported, err
+	}
+
+	var targetDesc v1.Descriptor
+	err = withRetry("resolve", func() (err error) {
+		targetDesc, err = targetRepo.Resolve(context.Background(), a.Tag())
+		return err
+	})
+	switch {
+	case err == nil && targetDesc.Digest == a.Descriptor.Digest:
+		log.Info().Str("name", a.Name).Str("digest", targetDesc.Digest.String()).Msg("Image already exists in the target registry, skipping")
+		return imported, nil
+	case err == nil && ctx.Config.Options.NotifyTagMutations:
+		return imported, fmt.Errorf("image %s tag points to different digest in the target registry, please manually check", imported.Target)
+	case err != nil && !registryclient.IsNotFound(err):
+		return imported, fmt.Errorf("failed to resolve the target image: %w", err)
+	}
+
+	// The image is copied with its referrers, e.g. the signatures and SBOMs exported with it
+	// Blobs already copied by a failed attempt are skipped by the next one.
+	err = withRetry("copy", func() error {
+		_, err := oras.ExtendedCopy(context.Background(), layout, a.Reference, targetRepo, a.Tag(), oras.DefaultExtendedCopyOptions)
+		return err
+	})
+	if err != nil {
+		return imported, fmt.Errorf("failed to push image: %w", err)
+	}
+	for _, other := range otherTags {
+		err = withRetry("copy "+other.Tag(), func() error {
+			_, err := oras.Copy(context.Background(), layout, other.Reference, targetRepo, other.Tag(), oras.DefaultCopyOptions)
+			return err
+		})
+		if err != nil {
+			return imported, fmt.Errorf("failed to push %s: %w", other.Tag(), err)
+		}
+	}
+
+	err = withRetry("resolve", func() (err error) {
+		targetDesc, err = targetRepo.Resolve(context.Background(), a.Tag())
+		return err
+	})
+	if err != nil {
+		return imported, fmt.Errorf("failed to resolve the image pushed: %w", err)
+	}
+	if targetDesc.Digest != a.Descriptor.Digest {
+		return imported, fmt.Errorf("digest %s pushed differs from the digest %s of the bundle", targetDesc.Digest, a.Descriptor.Digest)
+	}
+
+	log.Info().Str("name", a.Name).
+		Str("bundle", a.Reference).
+		Str("target", imported.Target).
+		Str("digest", imported.Digest).
+		Int("retries", imported.Retries).
+		Msg("Successfully imported image to the target registry")
+	return imported, nil
+}
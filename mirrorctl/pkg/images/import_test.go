@@ -0,0 +1,70 @@
+package images
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/bundle"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestImportImages(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	busybox := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+
+	// The bundle is exported for another registry than the one it is imported to
+	dir := t.TempDir()
+	layout, err := oci.New(dir)
+	require.NoError(t, err)
+	exportCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "airgap", ImagesRepository: "registry.example.com/mirror"}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+	mirrorer, err := NewLayoutMirrorer(exportCtx, layout)
+	require.NoError(t, err)
+	mirrorer.Submit(types.Image{Name: "busybox", Source: source.Host + "/library/busybox:1.36"})
+	_, failed := mirrorer.Wait()
+	require.Empty(t, failed)
+
+	store, err := bundle.Open(context.Background(), dir)
+	require.NoError(t, err)
+	artifacts, err := bundle.Artifacts(context.Background(), store)
+	require.NoError(t, err)
+
+	importCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "site", ImagesRepository: target.Host + "/mirror"}},
+			Registries: []config.RegistryConfig{
+				{Host: target.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+	imported, failed, err := ImportImages(importCtx, store, artifacts)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	require.Len(t, imported, 1)
+	assert.Equal(t, target.Host+"/mirror/busybox:1.36", imported[0].Target)
+	assert.Equal(t, busybox.Digest.String(), imported[0].Digest)
+	dgst, ok := target.Resolve("mirror/busybox", "1.36")
+	require.True(t, ok)
+	assert.Equal(t, busybox.Digest, dgst)
+
+	// An image already in the target registry is skipped
+	imported, failed, err = ImportImages(importCtx, store, artifacts)
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	assert.Len(t, imported, 1)
+}
@@ -0,0 +1,67 @@
+package images
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+)
+
+// hostLimiter caps the number of images mirrored at the same time from or to each registry host.
+// The cap of each host is read from the configuration the first time the host is seen.
+type hostLimiter struct {
+	maxFor func(host string) int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// newHostLimiter creates a limiter that reads the cap of a host with maxFor.
+// A cap lower than 1 means that the host has no cap.
+func newHostLimiter(maxFor func(host string) int) *hostLimiter {
+	return &hostLimiter{
+		maxFor: maxFor,
+		slots:  make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until a slot is free on every host, and returns a function that releases them.
+// Hosts are acquired in a fixed order so that two workers never wait on each other.
+func (l *hostLimiter) acquire(hosts ...string) func() {
+	unique := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		unique[imageref.NormalizeHost(h)] = struct{}{}
+	}
+	ordered := make([]string, 0, len(unique))
+	for h := range unique {
+		ordered = append(ordered, h)
+	}
+	sort.Strings(ordered)
+
+	acquired := make([]chan struct{}, 0, len(ordered))
+	for _, h := range ordered {
+		if slot := l.slotFor(h); slot != nil {
+			slot <- struct{}{}
+			acquired = append(acquired, slot)
+		}
+	}
+	return func() {
+		for _, slot := range acquired {
+			<-slot
+		}
+	}
+}
+
+// slotFor returns the semaphore of a host, or nil if the host has no cap.
+func (l *hostLimiter) slotFor(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot, ok := l.slots[host]
+	if !ok {
+		if max := l.maxFor(host); max > 0 {
+			slot = make(chan struct{}, max)
+		}
+		l.slots[host] = slot
+	}
+	return slot
+}
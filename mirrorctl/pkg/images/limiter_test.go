@@ -0,0 +1,42 @@
+package images
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostLimiter(t *testing.T) {
+	limiter := newHostLimiter(func(host string) int {
+		if host == "docker.io" {
+			return 2
+		}
+		return 0
+	})
+
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// registry-1.docker.io and docker.io share the same cap
+			release := limiter.acquire("registry-1.docker.io", "docker.io", "quay.io")
+			defer release()
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning.Load())
+}
@@ -0,0 +1,213 @@
+package images
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/signature"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// Mirrorer mirrors container images to the target registry as they are submitted.
+// At most options.concurrency images are mirrored at the same time, and the registries listed with a
+// max_concurrency never serve more than that number of images at the same time.
+// It lets callers start mirroring images before the full list of images is known,
+// e.g. as soon as each chart has been scanned.
+// Images are checked against the signature verification policy before they are copied.
+// A Mirrorer created with NewLayoutMirrorer copies the images to an OCI image layout instead.
+type Mirrorer struct {
+	ctx      *appcontext.AppContext
+	target   config.TargetConfig
+	layout   *oci.Store // The OCI image layout the images are copied to, nil to copy them to the target registry.
+	limiter  *hostLimiter
+	retry    retry.Policy
+	verifier *signature.Verifier
+	workers  chan struct{}
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	submitted map[string]int // The index of each submitted image, by name and source.
+	images    []types.Image
+	results   []imageResult
+	done      []chan struct{} // Closed when the image at the same index has been processed.
+}
+
+// NewMirrorer creates a Mirrorer for the active target of the configuration.
+// It takes an application context as input.
+// It returns an error if no target registry with an images repository is configured,
+// or the public keys that verify the signatures cannot be loaded.
+func NewMirrorer(ctx *appcontext.AppContext) (*Mirrorer, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return nil, err
+	}
+	if target.ImagesRepository == "" {
+		return nil, fmt.Errorf("target %q has no images repository", target.Name)
+	}
+	verifier, err := newVerifier(ctx.Config.Options.Verification)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirrorer{
+		ctx:       ctx,
+		target:    target,
+		limiter:   newHostLimiter(ctx.Config.MaxConcurrencyFor),
+		retry:     retry.NewPolicy(ctx.Config.Options.Retry),
+		verifier:  verifier,
+		workers:   make(chan struct{}, ctx.Config.ImageConcurrency()),
+		submitted: make(map[string]int),
+	}, nil
+}
+
+// NewLayoutMirrorer creates a Mirrorer that copies the images to the OCI image layout of a bundle instead of the
+// target registry. Each image is tagged in the layout with the reference it has in the active target of the
+// configuration, see bundle.Tag.
+// It takes an application context and the OCI image layout as input.
+// It returns an error if no target registry with an images repository is configured,
+// or the public keys that verify the signatures cannot be loaded.
+func NewLayoutMirrorer(ctx *appcontext.AppContext, layout *oci.Store) (*Mirrorer, error) {
+	m, err := NewMirrorer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.layout = layout
+	return m, nil
+}
+
+// destination is where images are copied to: a repository of the target registry, where they are tagged with
+// the tag of the source, or an OCI image layout, where they are tagged with their reference in the target registry.
+type destination struct {
+	oras.Target
+	repository string // The repository of the target registry the tags are qualified with, empty if they are not.
+}
+
+// reference returns the reference a tag or digest of an image is tagged with in the destination.
+func (d destination) reference(ref string) string {
+	if d.repository == "" {
+		return ref
+	}
+	return joinReference(d.repository, ref)
+}
+
+// Submit queues images to be mirrored and returns without waiting for them.
+// Images already submitted with the same name and source are ignored.
+// It is safe to call Submit from several goroutines, but not after Wait.
+func (m *Mirrorer) Submit(images ...types.Image) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, img := range images {
+		key := imageKey(img)
+		if _, ok := m.submitted[key]; ok {
+			continue
+		}
+		m.images = append(m.images, img)
+		m.results = append(m.results, imageResult{})
+		m.done = append(m.done, make(chan struct{}))
+		i := len(m.images) - 1
+		m.submitted[key] = i
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.workers <- struct{}{}
+			defer func() { <-m.workers }()
+
+			result := m.mirrorImage(img)
+			m.mu.Lock()
+			m.results[i] = result
+			close(m.done[i])
+			m.mu.Unlock()
+		}()
+	}
+}
+
+// Await blocks until some submitted images have been processed, while the other images keep being mirrored.
+// Images that were not submitted are submitted first.
+// It returns the images among them that were mirrored, in the order of the input list.
+func (m *Mirrorer) Await(images ...types.Image) []types.MirroredImage {
+	m.Submit(images...)
+
+	m.mu.Lock()
+	indexes := make([]int, 0, len(images))
+	for _, img := range images {
+		indexes = append(indexes, m.submitted[imageKey(img)])
+	}
+	m.mu.Unlock()
+
+	mirroredImages := make([]types.MirroredImage, 0, len(indexes))
+	for _, i := range indexes {
+		m.mu.Lock()
+		done := m.done[i]
+		m.mu.Unlock()
+		<-done
+
+		m.mu.Lock()
+		if result := m.results[i]; result.target != "" && result.failed == nil {
+			mirroredImages = append(mirroredImages, m.mirroredImage(i))
+		}
+		m.mu.Unlock()
+	}
+	return mirroredImages
+}
+
+// imageKey identifies an image among the submitted ones: the same source mirrored under the same name.
+func imageKey(img types.Image) string {
+	return img.Name + "=" + img.Source
+}
+
+// Wait blocks until every submitted image has been processed.
+//
+// It returns two values:
+//   - A list of types.MirroredImage, of the images mirrored with their destination image names, in the order they were submitted.
+//   - A list of types.FailedImage, of the images that failed to mirror, in the order they were submitted.
+func (m *Mirrorer) Wait() ([]types.MirroredImage, []types.FailedImage) {
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Track failed images with error reasons
+	failedImages := make([]types.FailedImage, 0)
+	mirroredImages := make([]types.MirroredImage, 0)
+	for i, result := range m.results {
+		if result.target != "" && result.failed == nil {
+			mirroredImages = append(mirroredImages, m.mirroredImage(i))
+		}
+		if result.failed != nil {
+			failedImages = append(failedImages, *result.failed)
+		}
+	}
+
+	// Log failed images in JSON format for GitHub Actions
+	if len(failedImages) > 0 {
+		failedJSON, _ := json.Marshal(map[string][]types.FailedImage{"failed_images": failedImages})
+		log.Warn().RawJSON("failed_images", failedJSON).Msg("Some images failed to mirror")
+	}
+
+	return mirroredImages, failedImages
+}
+
+// mirroredImage returns the outcome of the image at an index, which must have been mirrored.
+// The caller must hold the lock.
+func (m *Mirrorer) mirroredImage(i int) types.MirroredImage {
+	result := m.results[i]
+	return types.MirroredImage{
+		Source:       m.images[i].Source,
+		Target:       result.target,
+		SourceDigest: result.sourceDigest.String(),
+		Digest:       result.desc.Digest.String(),
+		Size:         result.desc.Size,
+		MediaType:    result.desc.MediaType,
+		Platforms:    result.platforms,
+		Retries:      result.retries,
+		Referrers:    result.referrers,
+	}
+}
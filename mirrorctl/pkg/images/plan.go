@@ -0,0 +1,145 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PlanImages reports the change a mirror run would make to each image of a list, without copying anything:
+// the tag filters are resolved, and the digest each source would push, with the platforms selected, is compared
+// with the one of the target reference.
+// At most options.concurrency images are inspected at the same time.
+// It takes an application context and the list of images as input.
+// It returns the planned images, one per concrete image in the order of the input list, and an error if no target
+// registry with an images repository is configured.
+func PlanImages(ctx *appcontext.AppContext, imagesList types.ImagesList) ([]types.PlannedArtifact, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return nil, err
+	}
+	if target.ImagesRepository == "" {
+		return nil, fmt.Errorf("target %q has no images repository", target.Name)
+	}
+
+	var planned []types.PlannedArtifact
+	var concrete []types.Image
+	var indexes []int
+	for _, r := range ResolveImages(ctx, imagesList.Images) {
+		if r.Err != nil {
+			planned = append(planned, unresolvedPlan(r))
+			continue
+		}
+		for _, img := range r.Images() {
+			planned = append(planned, types.PlannedArtifact{})
+			concrete = append(concrete, img)
+			indexes = append(indexes, len(planned)-1)
+		}
+	}
+
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	workers := make(chan struct{}, ctx.Config.ImageConcurrency())
+	var wg sync.WaitGroup
+	for i, img := range concrete {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			planned[indexes[i]] = planImage(ctx, target, policy, img)
+		}()
+	}
+	wg.Wait()
+	return planned, nil
+}
+
+// unresolvedPlan returns the planned image of an entry whose tag filter could not be resolved: missing upstream
+// if the repository does not exist or no tag matches, an error otherwise.
+func unresolvedPlan(r ResolvedImage) types.PlannedArtifact {
+	status := types.PlanError
+	if errors.Is(r.Err, ErrNoTagMatches) || registryclient.IsNotFound(r.Err) {
+		status = types.PlanMissingUpstream
+	}
+	return types.PlannedArtifact{Kind: "image", Name: r.Entry.Name, Source: r.Entry.Source, Status: status, Error: r.Err.Error()}
+}
+
+// planImage inspects the source and the target of a concrete image, the way mirrorImage does before copying it.
+func planImage(ctx *appcontext.AppContext, target config.TargetConfig, policy retry.Policy, img types.Image) types.PlannedArtifact {
+	planned := types.PlannedArtifact{Kind: "image", Name: img.Name, Source: img.Source}
+	fail := func(status types.PlanStatus, err error) types.PlannedArtifact {
+		planned.Status = status
+		planned.Error = err.Error()
+		return planned
+	}
+
+	ref, err := imageref.Parse(img.Source)
+	if err != nil {
+		return fail(types.PlanError, err)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		return fail(types.PlanError, fmt.Errorf("image source must contain a tag or a digest"))
+	}
+	targetRepository := fmt.Sprintf("%s/%s", strings.TrimSuffix(target.ImagesRepository, "/"), img.Name)
+	planned.Target = joinReference(targetRepository, targetReference(ref.Tag, ref.Digest))
+
+	sourceRepo, err := registryclient.NewRepository(ctx, img.Source)
+	if err != nil {
+		return fail(types.PlanError, err)
+	}
+	var sourceDesc v1.Descriptor
+	_, err = policy.Do(context.Background(), "resolve "+img.Source, func() (err error) {
+		sourceDesc, err = sourceRepo.Resolve(context.Background(), sourceRepo.Reference.Reference)
+		return err
+	})
+	if registryclient.IsNotFound(err) {
+		return fail(types.PlanMissingUpstream, err)
+	} else if err != nil {
+		return fail(types.PlanError, err)
+	}
+
+	// The digest pushed is the one of the trimmed index when only some platforms are mirrored
+	var plan platformPlan
+	_, err = policy.Do(context.Background(), "fetch index "+img.Source, func() (err error) {
+		plan, err = planPlatforms(context.Background(), sourceRepo, sourceDesc, platformsFor(img.Platforms, ctx.Config.Options.Platforms))
+		return err
+	})
+	if err != nil {
+		return fail(types.PlanError, err)
+	}
+	targetRef := targetReference(ref.Tag, plan.desc.Digest)
+	planned.Target = joinReference(targetRepository, targetRef)
+	planned.SourceDigest = plan.desc.Digest.String()
+
+	targetRepo, err := registryclient.NewRepository(ctx, targetRepository)
+	if err != nil {
+		return fail(types.PlanError, err)
+	}
+	var targetDesc v1.Descriptor
+	_, err = policy.Do(context.Background(), "resolve "+planned.Target, func() (err error) {
+		targetDesc, err = targetRepo.Resolve(context.Background(), targetRef)
+		return err
+	})
+	switch {
+	case registryclient.IsNotFound(err):
+		planned.Status = types.PlanNew
+	case err != nil:
+		return fail(types.PlanError, err)
+	case targetDesc.Digest == plan.desc.Digest:
+		planned.Status = types.PlanUpToDate
+		planned.TargetDigest = targetDesc.Digest.String()
+	default:
+		planned.Status = types.PlanTagMutated
+		planned.TargetDigest = targetDesc.Digest.String()
+	}
+	return planned
+}
@@ -0,0 +1,74 @@
+package images
+
+import (
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanImages(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	busybox := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+	alpine := source.PushImage(t, "library/alpine", "3.22", []byte("alpine layer"))
+	source.PushImage(t, "library/curl", "8.16.0", []byte("curl layer"))
+
+	// busybox is up to date, and the tag of alpine was moved upstream since it was mirrored
+	target.PushImage(t, "mirror/busybox", "1.36", []byte("busybox layer"))
+	target.PushImage(t, "mirror/alpine", "3.22", []byte("old alpine layer"))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror", TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+
+	planned, err := PlanImages(appCtx, types.ImagesList{Images: []types.Image{
+		{Name: "busybox", Source: source.Host + "/library/busybox:1.36"},
+		{Name: "alpine", Source: source.Host + "/library/alpine:3.22"},
+		{Name: "curl", Source: source.Host + "/library/curl", Tags: &types.TagFilter{Semver: ">=8"}},
+		{Name: "missing", Source: source.Host + "/library/busybox:1.37"},
+		{Name: "no-tag", Source: source.Host + "/library/curl", Tags: &types.TagFilter{Semver: ">=9"}},
+	}})
+	require.NoError(t, err)
+	require.Len(t, planned, 5)
+
+	assert.Equal(t, types.PlannedArtifact{
+		Kind:         "image",
+		Name:         "busybox",
+		Source:       source.Host + "/library/busybox:1.36",
+		Target:       target.Host + "/mirror/busybox:1.36",
+		Status:       types.PlanUpToDate,
+		SourceDigest: busybox.Digest.String(),
+		TargetDigest: busybox.Digest.String(),
+	}, planned[0])
+
+	assert.Equal(t, types.PlanTagMutated, planned[1].Status)
+	assert.Equal(t, alpine.Digest.String(), planned[1].SourceDigest)
+	assert.NotEqual(t, planned[1].SourceDigest, planned[1].TargetDigest)
+
+	assert.Equal(t, types.PlanNew, planned[2].Status)
+	assert.Equal(t, source.Host+"/library/curl:8.16.0", planned[2].Source)
+	assert.Equal(t, target.Host+"/mirror/curl:8.16.0", planned[2].Target)
+
+	assert.Equal(t, types.PlanMissingUpstream, planned[3].Status)
+	assert.NotEmpty(t, planned[3].Error)
+	assert.Equal(t, types.PlanMissingUpstream, planned[4].Status)
+
+	pending := 0
+	for _, a := range planned {
+		if a.Pending() {
+			pending++
+		}
+	}
+	assert.Equal(t, 4, pending)
+}
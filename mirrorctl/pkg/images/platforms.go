@@ -0,0 +1,187 @@
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// AllPlatforms selects every platform of an image, i.e. the full index is mirrored.
+// It lets an image of images.yaml override the platforms set globally in options.platforms.
+const AllPlatforms = "all"
+
+// platformsFor returns the platforms to mirror for an image: the ones of the image if set, the global ones otherwise.
+// An empty list means the full index.
+func platformsFor(imagePlatforms, globalPlatforms []string) []string {
+	platforms := globalPlatforms
+	if len(imagePlatforms) > 0 {
+		platforms = imagePlatforms
+	}
+	if slices.Contains(platforms, AllPlatforms) {
+		return nil
+	}
+	return platforms
+}
+
+// parsePlatform parses a platform such as `linux/amd64` or `linux/arm/v7`.
+// It returns an error if the platform has no operating system or architecture.
+func parsePlatform(platform string) (v1.Platform, error) {
+	parts := strings.Split(strings.TrimSpace(platform), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// platformString formats a platform as os/arch[/variant].
+func platformString(p *v1.Platform) string {
+	if p == nil {
+		return ""
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// matchPlatform returns true if a platform of an index matches a requested platform.
+// A requested platform without variant matches every variant.
+func matchPlatform(got *v1.Platform, want v1.Platform) bool {
+	if got == nil {
+		return false
+	}
+	return got.OS == want.OS && got.Architecture == want.Architecture && (want.Variant == "" || got.Variant == want.Variant)
+}
+
+// platformPlan describes what is copied to the target registry for the platforms requested for an image.
+type platformPlan struct {
+	desc      v1.Descriptor   // The manifest or index tagged in the target registry.
+	platforms []string        // The platforms copied, empty if unknown (single manifest copied as is).
+	index     []byte          // The trimmed index to push, nil if desc is copied from the source registry.
+	manifests []v1.Descriptor // The platform manifests referenced by the index copied, nil if desc is a single manifest.
+}
+
+// planPlatforms decides what to copy for the requested platforms of an image:
+//   - no platform requested: the source manifest or index as is;
+//   - a single platform: the manifest of that platform;
+//   - several platforms: a trimmed index with only the manifests of those platforms,
+//     or the source index as is if it has no other platform.
+//
+// It takes the source repository, the descriptor of the source image and the requested platforms as input.
+// It returns an error if the index cannot be read or none of the requested platforms is in it.
+func planPlatforms(ctx context.Context, repo *remote.Repository, sourceDesc v1.Descriptor, requested []string) (platformPlan, error) {
+	plan := platformPlan{desc: sourceDesc}
+	isIndex := sourceDesc.MediaType == v1.MediaTypeImageIndex || sourceDesc.MediaType == "application/vnd.docker.distribution.manifest.list.v2+json"
+	if !isIndex {
+		if len(requested) > 0 {
+			log.Warn().Str("reference", repo.Reference.String()).Strs("platforms", requested).
+				Msg("Image is not multi-platform, platform selection ignored")
+		}
+		return plan, nil
+	}
+
+	indexJSON, err := content.FetchAll(ctx, repo, sourceDesc)
+	if err != nil {
+		return plan, fmt.Errorf("failed to fetch index: %w", err)
+	}
+	var index v1.Index
+	if err := json.Unmarshal(indexJSON, &index); err != nil {
+		return plan, fmt.Errorf("failed to parse index: %w", err)
+	}
+	plan.manifests = index.Manifests
+
+	if len(requested) == 0 {
+		for _, m := range index.Manifests {
+			if p := platformString(m.Platform); p != "" && p != "unknown/unknown" {
+				plan.platforms = append(plan.platforms, p)
+			}
+		}
+		return plan, nil
+	}
+
+	var selected []v1.Descriptor
+	for _, r := range requested {
+		want, err := parsePlatform(r)
+		if err != nil {
+			return plan, err
+		}
+		found := false
+		for _, m := range index.Manifests {
+			if matchPlatform(m.Platform, want) && !slices.ContainsFunc(selected, func(d v1.Descriptor) bool { return d.Digest == m.Digest }) {
+				selected = append(selected, m)
+				found = true
+			}
+		}
+		if !found {
+			log.Warn().Str("reference", repo.Reference.String()).Str("platform", r).Msg("Platform not found in image index")
+		}
+	}
+	if len(selected) == 0 {
+		return plan, fmt.Errorf("none of the platforms %s found in image index", strings.Join(requested, ", "))
+	}
+	for _, m := range selected {
+		plan.platforms = append(plan.platforms, platformString(m.Platform))
+	}
+
+	if len(requested) == 1 && len(selected) == 1 {
+		plan.desc = selected[0]
+		plan.manifests = nil
+		return plan, nil
+	}
+	if len(selected) == len(index.Manifests) {
+		// Nothing to trim, the source index is copied as is
+		return plan, nil
+	}
+
+	// Keep the order of the source index, so the trimmed index and its digest are the same on every run
+	trimmed := index
+	trimmed.Manifests = nil
+	for _, m := range index.Manifests {
+		if slices.ContainsFunc(selected, func(d v1.Descriptor) bool { return d.Digest == m.Digest }) {
+			trimmed.Manifests = append(trimmed.Manifests, m)
+		}
+	}
+	plan.index, err = json.Marshal(trimmed)
+	if err != nil {
+		return plan, fmt.Errorf("failed to marshal trimmed index: %w", err)
+	}
+	plan.manifests = trimmed.Manifests
+	plan.desc = v1.Descriptor{
+		MediaType: sourceDesc.MediaType,
+		Digest:    digest.FromBytes(plan.index),
+		Size:      int64(len(plan.index)),
+	}
+	return plan, nil
+}
+
+// copyPlan copies to a destination what a platform plan selected, and tags it.
+// It takes the source repository, the destination, the plan and the tag as input.
+// It returns an error if the copy fails.
+func copyPlan(ctx context.Context, sourceRepo *remote.Repository, dest destination, plan platformPlan, tag string) error {
+	if plan.index == nil {
+		_, err := oras.Copy(ctx, sourceRepo, plan.desc.Digest.String(), dest, dest.reference(tag), oras.DefaultCopyOptions)
+		return err
+	}
+
+	for _, m := range plan.manifests {
+		if err := oras.CopyGraph(ctx, sourceRepo, dest, m, oras.DefaultCopyGraphOptions); err != nil {
+			return fmt.Errorf("failed to copy %s manifest: %w", platformString(m.Platform), err)
+		}
+	}
+	_, err := oras.TagBytes(ctx, dest, plan.desc.MediaType, plan.index, dest.reference(tag))
+	return err
+}
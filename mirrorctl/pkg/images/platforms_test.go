@@ -0,0 +1,169 @@
+package images
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := parsePlatform("linux/arm/v7")
+	require.NoError(t, err)
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+	assert.Equal(t, "linux/arm/v7", platformString(&p))
+
+	for _, invalid := range []string{"linux", "/amd64", "linux/arm/v7/extra"} {
+		_, err := parsePlatform(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	assert.True(t, matchPlatform(&v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, arm64))
+	assert.False(t, matchPlatform(&v1.Platform{OS: "linux", Architecture: "amd64"}, arm64))
+	assert.False(t, matchPlatform(nil, arm64))
+	assert.False(t, matchPlatform(&v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+}
+
+func TestPlatformsFor(t *testing.T) {
+	global := []string{"linux/amd64"}
+	assert.Equal(t, global, platformsFor(nil, global))
+	assert.Equal(t, []string{"linux/arm64"}, platformsFor([]string{"linux/arm64"}, global))
+	assert.Nil(t, platformsFor([]string{AllPlatforms}, global))
+	assert.Nil(t, platformsFor(nil, nil))
+}
+
+func TestMirrorImages_Platforms(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushIndex(t, "library/app", "1.0", "linux/amd64", "linux/arm64/v8", "linux/arm/v7")
+
+	sourceRef := source.Host + "/library/app:1.0"
+	newContext := func(platforms []string) *appcontext.AppContext {
+		return &appcontext.AppContext{
+			Config: &config.Config{
+				Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+				Registries: []config.RegistryConfig{
+					{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+				},
+				Options: config.OptionsConfig{DefaultCredentials: "none", Platforms: platforms},
+			},
+		}
+	}
+	targetIndex := func(name string) v1.Index {
+		content, ok := target.Manifest(name, "1.0")
+		require.True(t, ok)
+		var index v1.Index
+		require.NoError(t, json.Unmarshal(content, &index))
+		return index
+	}
+
+	tests := []struct {
+		name      string
+		global    []string
+		image     []string
+		platforms []string
+		check     func(t *testing.T, name string)
+	}{
+		{
+			name:      "full index",
+			platforms: []string{"linux/amd64", "linux/arm64/v8", "linux/arm/v7"},
+			check: func(t *testing.T, name string) {
+				assert.Len(t, targetIndex(name).Manifests, 3)
+			},
+		},
+		{
+			name:      "trimmed index",
+			global:    []string{"linux/amd64", "linux/arm64"},
+			platforms: []string{"linux/amd64", "linux/arm64/v8"},
+			check: func(t *testing.T, name string) {
+				index := targetIndex(name)
+				require.Len(t, index.Manifests, 2)
+				assert.Equal(t, "amd64", index.Manifests[0].Platform.Architecture)
+				assert.Equal(t, "arm64", index.Manifests[1].Platform.Architecture)
+			},
+		},
+		{
+			name:      "single platform",
+			image:     []string{"linux/arm/v7"},
+			global:    []string{"linux/amd64"},
+			platforms: []string{"linux/arm/v7"},
+			check: func(t *testing.T, name string) {
+				content, ok := target.Manifest(name, "1.0")
+				require.True(t, ok)
+				var manifest v1.Manifest
+				require.NoError(t, json.Unmarshal(content, &manifest))
+				assert.Equal(t, v1.MediaTypeImageManifest, manifest.MediaType)
+			},
+		},
+		{
+			name:      "image overrides global platforms",
+			image:     []string{AllPlatforms},
+			global:    []string{"linux/amd64"},
+			platforms: []string{"linux/amd64", "linux/arm64/v8", "linux/arm/v7"},
+			check: func(t *testing.T, name string) {
+				assert.Len(t, targetIndex(name).Manifests, 3)
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "app" + string(rune('a'+i))
+			img := types.Image{Name: name, Source: sourceRef, Platforms: tt.image}
+			appCtx := newContext(tt.global)
+
+			mirrored, failed, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{img}})
+			require.NoError(t, err)
+			require.Empty(t, failed)
+			require.Len(t, mirrored, 1)
+			assert.Equal(t, tt.platforms, mirrored[0].Platforms)
+			tt.check(t, name)
+
+			// A second run finds the same platforms already mirrored
+			mirrored, failed, err = MirrorImages(appCtx, types.ImagesList{Images: []types.Image{img}})
+			require.NoError(t, err)
+			assert.Empty(t, failed)
+			assert.Len(t, mirrored, 1)
+		})
+	}
+}
+
+func TestMirrorImages_PlatformNotFound(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushIndex(t, "library/app", "1.0", "linux/amd64")
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets:    []config.TargetConfig{{Name: "local", ImagesRepository: target.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{DefaultCredentials: "none", Platforms: []string{"linux/s390x"}},
+		},
+	}
+	_, failed, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "app", Source: source.Host + "/library/app:1.0"}}})
+	require.NoError(t, err)
+	assert.Len(t, failed, 1)
+}
+
+func TestMirrorImages_DryRunPlatforms(t *testing.T) {
+	appCtx := &appcontext.AppContext{
+		DryRun: true,
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: "localhost:5000"}},
+			Options: config.OptionsConfig{Platforms: []string{"linux/amd64", "linux/arm64"}},
+		},
+	}
+	mirrored, _, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "app", Source: "docker.io/library/app:1.0"}}})
+	require.NoError(t, err)
+	require.Len(t, mirrored, 1)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, mirrored[0].Platforms)
+}
@@ -0,0 +1,115 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// cosignTags are the tags that cosign uses to attach artifacts to an image when the registry has no referrers API,
+// e.g. sha256-<digest>.sig, with the artifact types that cosign gives to the same artifacts when it attaches them as referrers.
+var cosignTags = []struct {
+	suffix       string
+	artifactType string
+}{
+	{suffix: "sig", artifactType: "application/vnd.dev.cosign.artifact.sig.v1+json"},
+	{suffix: "att", artifactType: "application/vnd.dev.cosign.artifact.att.v1+json"},
+	{suffix: "sbom", artifactType: "application/vnd.dev.cosign.artifact.sbom.v1+json"},
+}
+
+// referrerSubjects returns the manifests of a platform plan whose referrers are copied:
+// the manifest or index tagged in the target registry and the platform manifests of the index.
+// A trimmed index does not exist in the source registry, so it has no referrers, and the ones of
+// the source index do not apply to it.
+func referrerSubjects(plan platformPlan) []v1.Descriptor {
+	var subjects []v1.Descriptor
+	if plan.index == nil {
+		subjects = append(subjects, plan.desc)
+	}
+	return append(subjects, plan.manifests...)
+}
+
+// matchArtifactType returns true if an artifact type is one of the requested ones, or no type is requested.
+func matchArtifactType(artifactType string, requested []string) bool {
+	return len(requested) == 0 || slices.Contains(requested, artifactType)
+}
+
+// copyReferrers copies to a destination the referrers of manifests, found with the OCI referrers API
+// (or its tag schema fallback) and the cosign tag scheme. The referrers of the copied referrers, such as the
+// signature of an SBOM, are copied too.
+// It takes the source repository, the destination, the manifests whose referrers are copied and the artifact types to copy,
+// all of them if empty, as input.
+// It returns the referrers copied and an error if a referrer cannot be listed or copied.
+func copyReferrers(ctx context.Context, sourceRepo *remote.Repository, dest destination, subjects []v1.Descriptor, artifactTypes []string) ([]types.Referrer, error) {
+	var copied []types.Referrer
+	seen := make(map[digest.Digest]bool)
+	var queue []v1.Descriptor
+	enqueue := func(desc v1.Descriptor) {
+		if !seen[desc.Digest] {
+			seen[desc.Digest] = true
+			queue = append(queue, desc)
+		}
+	}
+	for _, subject := range subjects {
+		enqueue(subject)
+	}
+
+	for len(queue) > 0 {
+		subject := queue[0]
+		queue = queue[1:]
+
+		var referrers []v1.Descriptor
+		err := sourceRepo.Referrers(ctx, subject, "", func(page []v1.Descriptor) error {
+			referrers = append(referrers, page...)
+			return nil
+		})
+		if err != nil {
+			return copied, fmt.Errorf("failed to list referrers of %s: %w", subject.Digest, err)
+		}
+		for _, r := range referrers {
+			if seen[r.Digest] || !matchArtifactType(r.ArtifactType, artifactTypes) {
+				continue
+			}
+			// The target repository indexes the referrer by its subject, or updates its referrers tag schema
+			if err := oras.CopyGraph(ctx, sourceRepo, dest, r, oras.DefaultCopyGraphOptions); err != nil {
+				return copied, fmt.Errorf("failed to copy referrer %s: %w", r.Digest, err)
+			}
+			log.Debug().Str("subject", subject.Digest.String()).Str("digest", r.Digest.String()).
+				Str("artifact_type", r.ArtifactType).Msg("Copied referrer")
+			copied = append(copied, types.Referrer{Subject: subject.Digest.String(), Digest: r.Digest.String(), ArtifactType: r.ArtifactType})
+			enqueue(r)
+		}
+
+		for _, cosign := range cosignTags {
+			if !matchArtifactType(cosign.artifactType, artifactTypes) {
+				continue
+			}
+			tag := fmt.Sprintf("%s-%s.%s", subject.Digest.Algorithm(), subject.Digest.Encoded(), cosign.suffix)
+			desc, err := sourceRepo.Resolve(ctx, tag)
+			if errors.Is(err, errdef.ErrNotFound) {
+				continue
+			} else if err != nil {
+				return copied, fmt.Errorf("failed to resolve %s: %w", tag, err)
+			}
+			if seen[desc.Digest] {
+				continue
+			}
+			if _, err := oras.Copy(ctx, sourceRepo, tag, dest, dest.reference(tag), oras.DefaultCopyOptions); err != nil {
+				return copied, fmt.Errorf("failed to copy %s: %w", tag, err)
+			}
+			log.Debug().Str("subject", subject.Digest.String()).Str("tag", tag).Msg("Copied cosign artifact")
+			copied = append(copied, types.Referrer{Subject: subject.Digest.String(), Digest: desc.Digest.String(), ArtifactType: cosign.artifactType, Tag: tag})
+			enqueue(desc)
+		}
+	}
+	return copied, nil
+}
@@ -0,0 +1,132 @@
+package images
+
+import (
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sigArtifactType  = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	sbomArtifactType = "application/spdx+json"
+)
+
+func TestReferrerSubjects(t *testing.T) {
+	image := v1.Descriptor{Digest: "sha256:image"}
+	amd64 := v1.Descriptor{Digest: "sha256:amd64"}
+	arm64 := v1.Descriptor{Digest: "sha256:arm64"}
+
+	assert.Equal(t, []v1.Descriptor{image}, referrerSubjects(platformPlan{desc: image}))
+	assert.Equal(t, []v1.Descriptor{image, amd64, arm64}, referrerSubjects(platformPlan{desc: image, manifests: []v1.Descriptor{amd64, arm64}}))
+	// The referrers of the source index do not apply to a trimmed index
+	assert.Equal(t, []v1.Descriptor{amd64}, referrerSubjects(platformPlan{desc: image, index: []byte("{}"), manifests: []v1.Descriptor{amd64}}))
+}
+
+func TestMirrorImages_Referrers(t *testing.T) {
+	tests := []struct {
+		name           string
+		noReferrersAPI bool
+		artifactTypes  []string
+		referrers      []string
+	}{
+		{name: "referrers API", referrers: []string{"signature", "sbom", "sbom signature", "cosign signature"}},
+		{name: "referrers tag schema", noReferrersAPI: true, referrers: []string{"signature", "sbom", "sbom signature", "cosign signature"}},
+		{name: "artifact types", artifactTypes: []string{sigArtifactType}, referrers: []string{"signature", "cosign signature"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := registrytest.New(t)
+			target := registrytest.New(t)
+			source.NoReferrersAPI = tt.noReferrersAPI
+			target.NoReferrersAPI = tt.noReferrersAPI
+
+			desc := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+			sbom := source.PushArtifact(t, "library/busybox", "", &desc, sbomArtifactType, []byte("sbom"))
+			artifacts := map[string]v1.Descriptor{
+				"signature":        source.PushArtifact(t, "library/busybox", "", &desc, sigArtifactType, []byte("signature")),
+				"sbom":             sbom,
+				"sbom signature":   source.PushArtifact(t, "library/busybox", "", &sbom, sigArtifactType, []byte("sbom signature")),
+				"cosign signature": source.PushArtifact(t, "library/busybox", "sha256-"+desc.Digest.Encoded()+".sig", nil, "", []byte("cosign signature")),
+			}
+
+			appCtx := &appcontext.AppContext{
+				Config: &config.Config{
+					Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror", TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+					Registries: []config.RegistryConfig{
+						{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+					},
+					Options: config.OptionsConfig{
+						DefaultCredentials: "none",
+						Referrers:          config.ReferrersConfig{Enabled: true, ArtifactTypes: tt.artifactTypes},
+					},
+				},
+			}
+
+			sourceRef := source.Host + "/library/busybox:1.36"
+			mirrored, failed, err := MirrorImages(appCtx, types.ImagesList{Images: []types.Image{{Name: "busybox", Source: sourceRef}}})
+			require.NoError(t, err)
+			require.Empty(t, failed)
+			require.Len(t, mirrored, 1)
+
+			var copied []string
+			for _, r := range mirrored[0].Referrers {
+				copied = append(copied, r.Digest)
+			}
+			var expected []string
+			for _, name := range tt.referrers {
+				expected = append(expected, artifacts[name].Digest.String())
+				_, ok := target.Resolve("mirror/busybox", artifacts[name].Digest.String())
+				assert.True(t, ok, "%s not copied", name)
+			}
+			assert.ElementsMatch(t, expected, copied)
+			assert.Contains(t, target.Tags("mirror/busybox"), "sha256-"+desc.Digest.Encoded()+".sig")
+			if tt.noReferrersAPI {
+				// The target registry lists the referrers of the image in the referrers tag schema
+				assert.Contains(t, target.Tags("mirror/busybox"), "sha256-"+desc.Digest.Encoded())
+			}
+		})
+	}
+}
+
+func TestMirrorImages_ReferrersOfExistingImage(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	desc := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/mirror", TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Registries: []config.RegistryConfig{
+				{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+			},
+			Options: config.OptionsConfig{DefaultCredentials: "none", Referrers: config.ReferrersConfig{Enabled: true}},
+		},
+	}
+	images := types.ImagesList{Images: []types.Image{{Name: "busybox", Source: source.Host + "/library/busybox:1.36"}}}
+
+	mirrored, failed, err := MirrorImages(appCtx, images)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	assert.Empty(t, mirrored[0].Referrers)
+
+	// The image is signed after it was mirrored
+	signature := source.PushArtifact(t, "library/busybox", "", &desc, sigArtifactType, []byte("signature"))
+
+	mirrored, failed, err = MirrorImages(appCtx, images)
+	require.NoError(t, err)
+	require.Empty(t, failed)
+	assert.Equal(t, []types.Referrer{{
+		Subject:      desc.Digest.String(),
+		Digest:       signature.Digest.String(),
+		ArtifactType: sigArtifactType,
+	}}, mirrored[0].Referrers)
+	_, ok := target.Resolve("mirror/busybox", signature.Digest.String())
+	assert.True(t, ok)
+}
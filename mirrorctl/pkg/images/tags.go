@@ -0,0 +1,302 @@
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// ErrNoTagMatches is returned when no tag of a repository matches the tag filter of an image entry.
+var ErrNoTagMatches = errors.New("no tag matches the filter")
+
+// ResolvedImage is an image entry of the images file with the concrete tags its tag filter selected.
+// Tags is empty for an entry without tag filter, which is mirrored as it is.
+// Digests, if set, are the digests the concrete images are pinned to, one per image, e.g. the ones of a lockfile.
+// Err is set if the tags of the repository could not be listed or none matches the filter.
+type ResolvedImage struct {
+	Entry   types.Image
+	Tags    []string
+	Digests []string
+	Err     error
+}
+
+// Images returns the concrete images of the entry: the entry itself, or one image per tag selected.
+// The source of each image is pinned to its digest when Digests is set, so the image mirrored is the one of the
+// digest even if its tag moved since.
+func (r ResolvedImage) Images() []types.Image {
+	var images []types.Image
+	if r.Entry.Tags == nil {
+		images = []types.Image{r.Entry}
+	} else {
+		images = make([]types.Image, 0, len(r.Tags))
+		for _, tag := range r.Tags {
+			img := r.Entry
+			img.Source = r.Entry.Source + ":" + tag
+			img.Tags = nil
+			images = append(images, img)
+		}
+	}
+	for i := range images {
+		if i < len(r.Digests) && r.Digests[i] != "" && !strings.Contains(images[i].Source, "@") {
+			images[i].Source += "@" + r.Digests[i]
+		}
+	}
+	return images
+}
+
+// ResolveImages selects the tags of the image entries with a tag filter, by listing the tags of their repository.
+// It takes an application context and the image entries as input.
+// It returns the entries resolved, in the order of the input. Entries that cannot be resolved have Err set.
+func ResolveImages(ctx *appcontext.AppContext, images []types.Image) []ResolvedImage {
+	resolved := make([]ResolvedImage, 0, len(images))
+	for _, img := range images {
+		r := ResolvedImage{Entry: img}
+		if img.Tags != nil {
+			r.Tags, r.Err = resolveImageTags(ctx, img)
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved
+}
+
+// resolveImageTags lists the tags of the repository of an image entry and selects the ones matching its tag filter.
+// Listing the tags, and looking up the creation date of the images with Since, are retried.
+// It returns the tags selected, sorted from the oldest to the newest semver version when the filter compares
+// versions, alphabetically otherwise, and an error if the source is not a repository, the tags cannot be listed
+// or none matches.
+func resolveImageTags(ctx *appcontext.AppContext, img types.Image) ([]string, error) {
+	ref, err := imageref.Parse(img.Source)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Tag != "" || ref.Digest != "" {
+		return nil, fmt.Errorf("image source %q of a tag filter must be a repository without tag nor digest", img.Source)
+	}
+	repo, err := registryclient.NewRepository(ctx, ref.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	var tags []string
+	_, err = policy.Do(context.Background(), "list tags "+ref.Name(), func() error {
+		tags = nil
+		return repo.Tags(context.Background(), "", func(page []string) error {
+			tags = append(tags, page...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the tags of %s: %w", ref.Name(), err)
+	}
+
+	created := func(tag string) (t time.Time, err error) {
+		_, err = policy.Do(context.Background(), "fetch config "+ref.Name()+":"+tag, func() (err error) {
+			t, err = imageCreated(context.Background(), repo, tag)
+			return err
+		})
+		return t, err
+	}
+	selected, err := selectTags(tags, *img.Tags, created)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select the tags of %s: %w", ref.Name(), err)
+	}
+	log.Debug().Str("image", img.Source).Interface("filter", img.Tags).Strs("tags", selected).Msg("Image tags resolved")
+	return selected, nil
+}
+
+// ResolveDigest resolves the source reference of an image to the digest of its manifest, or index, upstream.
+// The lookup is retried, but a tag not found upstream fails at once, see registryclient.IsNotFound.
+// It returns an error if the reference is invalid or cannot be resolved.
+func ResolveDigest(ctx *appcontext.AppContext, source string) (string, error) {
+	ref, err := imageref.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return ref.Digest.String(), nil
+	}
+	if ref.Tag == "" {
+		return "", fmt.Errorf("image source %q must contain a tag or a digest", source)
+	}
+	repo, err := registryclient.NewRepository(ctx, ref.Name())
+	if err != nil {
+		return "", err
+	}
+
+	var desc v1.Descriptor
+	_, err = retry.NewPolicy(ctx.Config.Options.Retry).Do(context.Background(), "resolve "+source, func() (err error) {
+		desc, err = repo.Resolve(context.Background(), ref.Tag)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", source, err)
+	}
+	return desc.Digest.String(), nil
+}
+
+// selectTags selects the tags matching a tag filter, see types.TagFilter.
+// The creation date of the images is only looked up with created when the filter has Since, from the newest tag to
+// the oldest and until Newest tags are found, since it takes a registry request per tag.
+// It returns an error if a rule of the filter is invalid or no tag matches.
+func selectTags(tags []string, filter types.TagFilter, created func(tag string) (time.Time, error)) ([]string, error) {
+	include, err := compileTagPattern(filter.Include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern: %w", err)
+	}
+	exclude, err := compileTagPattern(filter.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+	var constraint *semver.Constraints
+	if filter.Semver != "" {
+		if constraint, err = semver.NewConstraint(filter.Semver); err != nil {
+			return nil, fmt.Errorf("invalid semver constraint %q: %w", filter.Semver, err)
+		}
+	}
+	var since time.Time
+	if filter.Since != "" {
+		if since, err = parseSince(filter.Since); err != nil {
+			return nil, err
+		}
+	}
+
+	// Candidates are ordered from the newest to the oldest, so that Newest keeps the first ones
+	var candidates []string
+	byVersion := constraint != nil || filter.Newest > 0
+	versions := make(map[string]*semver.Version)
+	for _, tag := range tags {
+		if include != nil && !include.MatchString(tag) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(tag) {
+			continue
+		}
+		if byVersion {
+			v, err := semver.NewVersion(tag)
+			if err != nil || (constraint != nil && !constraint.Check(v)) {
+				continue
+			}
+			versions[tag] = v
+		}
+		candidates = append(candidates, tag)
+	}
+	if byVersion {
+		sort.SliceStable(candidates, func(i, j int) bool { return versions[candidates[i]].GreaterThan(versions[candidates[j]]) })
+	} else {
+		sort.Sort(sort.Reverse(sort.StringSlice(candidates)))
+	}
+
+	var selected []string
+	for _, tag := range candidates {
+		if filter.Newest > 0 && len(selected) == filter.Newest {
+			break
+		}
+		if !since.IsZero() {
+			t, err := created(tag)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the creation date of tag %s: %w", tag, err)
+			}
+			if t.Before(since) {
+				continue
+			}
+		}
+		selected = append(selected, tag)
+	}
+	if len(selected) == 0 {
+		return nil, ErrNoTagMatches
+	}
+
+	// From the oldest to the newest
+	for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+		selected[i], selected[j] = selected[j], selected[i]
+	}
+	return selected, nil
+}
+
+// compileTagPattern compiles a regular expression matched against the whole tag, or returns nil if it is empty.
+func compileTagPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// parseSince parses the date of the Since rule of a tag filter, `2025-01-01` or RFC 3339.
+func parseSince(since string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, since); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since date %q, expected YYYY-MM-DD or RFC 3339", since)
+	}
+	return t, nil
+}
+
+// imageCreated returns the creation date of a tagged image, from the `created` field of its config.
+// The config of a multi-platform image is the one of its first platform, all of them are built at the same time.
+// An image without creation date, such as the reproducible builds dated at the epoch, is dated at the zero time.
+func imageCreated(ctx context.Context, repo *remote.Repository, tag string) (time.Time, error) {
+	desc, err := repo.Resolve(ctx, tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+	manifestJSON, err := content.FetchAll(ctx, repo, desc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	// An index and a manifest are told apart by their fields, as some registries serve them with a generic media type
+	var manifest struct {
+		Config    v1.Descriptor   `json:"config"`
+		Manifests []v1.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	for _, m := range manifest.Manifests {
+		if p := platformString(m.Platform); p == "" || p == "unknown/unknown" {
+			// Attestation manifests have no image config
+			continue
+		}
+		if manifestJSON, err = content.FetchAll(ctx, repo, m); err != nil {
+			return time.Time{}, fmt.Errorf("failed to fetch platform manifest: %w", err)
+		}
+		if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+			return time.Time{}, fmt.Errorf("failed to parse platform manifest: %w", err)
+		}
+		break
+	}
+	if manifest.Config.Digest == "" {
+		return time.Time{}, fmt.Errorf("image has no config")
+	}
+
+	configJSON, err := content.FetchAll(ctx, repo, manifest.Config)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	var config v1.Image
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if config.Created == nil {
+		return time.Time{}, nil
+	}
+	return *config.Created, nil
+}
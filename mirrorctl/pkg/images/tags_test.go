@@ -0,0 +1,165 @@
+package images
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectTags(t *testing.T) {
+	tags := []string{"latest", "edge", "3.18", "3.19.4", "3.20.3", "3.20.3-alpine", "3.21.0", "3.22.2", "4.0.0-rc.1"}
+	created := map[string]time.Time{
+		"3.20.3": time.Date(2024, 9, 6, 0, 0, 0, 0, time.UTC),
+		"3.21.0": time.Date(2024, 12, 5, 0, 0, 0, 0, time.UTC),
+		"3.22.2": time.Date(2025, 10, 8, 0, 0, 0, 0, time.UTC),
+	}
+	createdAt := func(tag string) (time.Time, error) {
+		return created[tag], nil
+	}
+
+	tests := []struct {
+		name     string
+		filter   types.TagFilter
+		expected []string
+		wantErr  bool
+	}{
+		{name: "all tags", filter: types.TagFilter{}, expected: []string{"3.18", "3.19.4", "3.20.3", "3.20.3-alpine", "3.21.0", "3.22.2", "4.0.0-rc.1", "edge", "latest"}},
+		{name: "include", filter: types.TagFilter{Include: `3\.2\d\.\d+`}, expected: []string{"3.20.3", "3.21.0", "3.22.2"}},
+		{name: "include and exclude", filter: types.TagFilter{Include: `3\..*`, Exclude: `.*-alpine|3\.18`}, expected: []string{"3.19.4", "3.20.3", "3.21.0", "3.22.2"}},
+		{name: "semver range", filter: types.TagFilter{Semver: ">=3.20 <4"}, expected: []string{"3.20.3", "3.21.0", "3.22.2"}},
+		{name: "newest", filter: types.TagFilter{Newest: 2}, expected: []string{"3.22.2", "4.0.0-rc.1"}},
+		{name: "newest of a range", filter: types.TagFilter{Semver: "~3", Newest: 2}, expected: []string{"3.21.0", "3.22.2"}},
+		{name: "since", filter: types.TagFilter{Semver: "~3", Since: "2024-12-01"}, expected: []string{"3.21.0", "3.22.2"}},
+		{name: "newest since", filter: types.TagFilter{Include: `3\.2\d\.\d+`, Since: "2024-01-01T00:00:00Z", Newest: 1}, expected: []string{"3.22.2"}},
+		{name: "no match", filter: types.TagFilter{Semver: ">=5"}, wantErr: true},
+		{name: "invalid pattern", filter: types.TagFilter{Include: "("}, wantErr: true},
+		{name: "invalid since", filter: types.TagFilter{Since: "last week"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := selectTags(tags, tt.filter, createdAt)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, selected)
+		})
+	}
+}
+
+func TestResolveImages(t *testing.T) {
+	registry := registrytest.New(t)
+	for i, tag := range []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"} {
+		// The config of each image is dated a year after the previous one
+		config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","created":"%d-01-01T00:00:00Z"}`, 2022+i))
+		layer := []byte("layer " + tag)
+		m := v1.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: v1.MediaTypeImageManifest,
+			Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+			Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}},
+		}
+		registry.PushManifest(t, "library/app", tag, m, map[digest.Digest][]byte{m.Config.Digest: config, m.Layers[0].Digest: layer})
+	}
+	registry.PushIndex(t, "library/multi", "1.0.0", "linux/amd64", "linux/arm64")
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Registries: []config.RegistryConfig{{Host: registry.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+
+	entries := []types.Image{
+		{Name: "app", Source: registry.Host + "/library/app", Tags: &types.TagFilter{Semver: "^1", Newest: 2}},
+		{Name: "app-recent", Source: registry.Host + "/library/app", Tags: &types.TagFilter{Since: "2024-01-01"}},
+		{Name: "multi", Source: registry.Host + "/library/multi", Tags: &types.TagFilter{Since: "2000-01-01"}},
+		{Name: "pinned", Source: registry.Host + "/library/app:1.0.0"},
+		{Name: "tagged", Source: registry.Host + "/library/app:1.0.0", Tags: &types.TagFilter{}},
+	}
+	resolved := ResolveImages(appCtx, entries)
+	require.Len(t, resolved, 5)
+
+	assert.Equal(t, []string{"1.1.0", "1.2.0"}, resolved[0].Tags)
+	assert.Equal(t, []types.Image{
+		{Name: "app", Source: registry.Host + "/library/app:1.1.0"},
+		{Name: "app", Source: registry.Host + "/library/app:1.2.0"},
+	}, resolved[0].Images())
+	assert.Equal(t, []string{"1.2.0", "2.0.0"}, resolved[1].Tags)
+	// The images of the test registry have no creation date
+	assert.Error(t, resolved[2].Err)
+	assert.NoError(t, resolved[3].Err)
+	assert.Equal(t, []types.Image{entries[3]}, resolved[3].Images())
+	assert.Error(t, resolved[4].Err)
+}
+
+func TestResolvedImage_Images(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name     string
+		resolved ResolvedImage
+		expected []string
+	}{
+		{name: "entry", resolved: ResolvedImage{Entry: types.Image{Source: "quay.io/curl/curl:8.16.0"}}, expected: []string{"quay.io/curl/curl:8.16.0"}},
+		{name: "pinned entry", resolved: ResolvedImage{Entry: types.Image{Source: "quay.io/curl/curl:8.16.0"}, Digests: []string{digest}}, expected: []string{"quay.io/curl/curl:8.16.0@" + digest}},
+		{name: "entry with digest", resolved: ResolvedImage{Entry: types.Image{Source: "quay.io/curl/curl@" + digest}, Digests: []string{digest}}, expected: []string{"quay.io/curl/curl@" + digest}},
+		{
+			name:     "tags",
+			resolved: ResolvedImage{Entry: types.Image{Source: "docker.io/library/alpine", Tags: &types.TagFilter{}}, Tags: []string{"3.21.0", "3.22.2"}},
+			expected: []string{"docker.io/library/alpine:3.21.0", "docker.io/library/alpine:3.22.2"},
+		},
+		{
+			name:     "pinned tags",
+			resolved: ResolvedImage{Entry: types.Image{Source: "docker.io/library/alpine", Tags: &types.TagFilter{}}, Tags: []string{"3.21.0", "3.22.2"}, Digests: []string{"", digest}},
+			expected: []string{"docker.io/library/alpine:3.21.0", "docker.io/library/alpine:3.22.2@" + digest},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sources []string
+			for _, img := range tt.resolved.Images() {
+				assert.Nil(t, img.Tags)
+				sources = append(sources, img.Source)
+			}
+			assert.Equal(t, tt.expected, sources)
+		})
+	}
+}
+
+func TestResolveDigest(t *testing.T) {
+	registry := registrytest.New(t)
+	desc := registry.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Registries: []config.RegistryConfig{{Host: registry.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{DefaultCredentials: "none"},
+		},
+	}
+
+	dgst, err := ResolveDigest(appCtx, registry.Host+"/library/busybox:1.36")
+	require.NoError(t, err)
+	assert.Equal(t, desc.Digest.String(), dgst)
+
+	pinned := "sha256:" + strings.Repeat("a", 64)
+	dgst, err = ResolveDigest(appCtx, registry.Host+"/library/busybox:1.36@"+pinned)
+	require.NoError(t, err)
+	assert.Equal(t, pinned, dgst)
+
+	_, err = ResolveDigest(appCtx, registry.Host+"/library/busybox:1.37")
+	assert.Error(t, err)
+	_, err = ResolveDigest(appCtx, registry.Host+"/library/busybox")
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package images
+
+import (
+	"fmt"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/signature"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+)
+
+// verificationPolicy returns the signature verification policy of an image: the one of the image if set,
+// the one of its registry host otherwise, see config.Config.VerificationPolicyFor.
+// It returns an error if the policy is not require, warn or skip.
+func verificationPolicy(img types.Image, host string, cfg *config.Config) (string, error) {
+	policy := img.Verification
+	if policy == "" {
+		policy = cfg.VerificationPolicyFor(host)
+	}
+	switch policy {
+	case config.VerificationRequire, config.VerificationWarn, config.VerificationSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid verification policy %q, expected require, warn or skip", policy)
+	}
+}
+
+// newVerifier creates the signature verifier of the public keys listed in options.verification.keys.
+// It returns an error if a key cannot be loaded.
+func newVerifier(cfg config.VerificationConfig) (*signature.Verifier, error) {
+	keys, err := signature.LoadPublicKeys(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewVerifier(keys), nil
+}
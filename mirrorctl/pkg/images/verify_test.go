@@ -0,0 +1,127 @@
+package images
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/signature"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationPolicy(t *testing.T) {
+	cfg := &config.Config{
+		Registries: []config.RegistryConfig{{Host: "quay.io", Verification: config.VerificationRequire}},
+		Options:    config.OptionsConfig{Verification: config.VerificationConfig{Policy: config.VerificationWarn}},
+	}
+
+	tests := []struct {
+		name     string
+		img      types.Image
+		host     string
+		cfg      *config.Config
+		expected string
+		wantErr  bool
+	}{
+		{name: "default", img: types.Image{Source: "docker.io/library/busybox:1.36"}, host: "docker.io", cfg: &config.Config{}, expected: config.VerificationSkip},
+		{name: "global", img: types.Image{Source: "docker.io/library/busybox:1.36"}, host: "docker.io", cfg: cfg, expected: config.VerificationWarn},
+		{name: "registry", img: types.Image{Source: "quay.io/curl/curl:8.16.0"}, host: "quay.io", cfg: cfg, expected: config.VerificationRequire},
+		{name: "image", img: types.Image{Source: "quay.io/curl/curl:8.16.0", Verification: config.VerificationSkip}, host: "quay.io", cfg: cfg, expected: config.VerificationSkip},
+		{name: "invalid", img: types.Image{Source: "quay.io/curl/curl:8.16.0", Verification: "always"}, host: "quay.io", cfg: cfg, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := verificationPolicy(tt.img, tt.host, tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, policy)
+		})
+	}
+}
+
+func TestMirrorImages_Verification(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	signed := source.PushImage(t, "library/signed", "1.0", []byte("signed layer"))
+	payload, err := signature.NewPayload(source.Host+"/library/signed", signed.Digest)
+	require.NoError(t, err)
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+	source.PushSignature(t, "library/signed", signed, payload, base64.StdEncoding.EncodeToString(sig), false)
+	source.PushImage(t, "library/unsigned", "1.0", []byte("unsigned layer"))
+
+	newContext := func(policy string) *appcontext.AppContext {
+		return &appcontext.AppContext{
+			Config: &config.Config{
+				Targets: []config.TargetConfig{{Name: "local", ImagesRepository: target.Host + "/" + policy, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+				Registries: []config.RegistryConfig{
+					{Host: source.Host, Verification: policy, TransportConfig: config.TransportConfig{PlainHTTP: true}},
+				},
+				Options: config.OptionsConfig{
+					DefaultCredentials: "none",
+					Verification:       config.VerificationConfig{Keys: []string{keyFile}},
+				},
+			},
+		}
+	}
+	images := types.ImagesList{Images: []types.Image{
+		{Name: "signed", Source: source.Host + "/library/signed:1.0"},
+		{Name: "unsigned", Source: source.Host + "/library/unsigned:1.0"},
+		{Name: "unsigned-skipped", Source: source.Host + "/library/unsigned:1.0", Verification: config.VerificationSkip},
+	}}
+
+	t.Run("require", func(t *testing.T) {
+		mirrored, failed, err := MirrorImages(newContext(config.VerificationRequire), images)
+		require.NoError(t, err)
+		require.Len(t, mirrored, 2)
+		assert.Equal(t, target.Host+"/require/signed:1.0", mirrored[0].Target)
+		assert.Equal(t, target.Host+"/require/unsigned-skipped:1.0", mirrored[1].Target)
+		require.Len(t, failed, 1)
+		assert.Equal(t, "unsigned", failed[0].Image.Name)
+		assert.Contains(t, failed[0].Error, "signature verification failed: no signature found")
+		_, ok := target.Resolve("require/unsigned", "1.0")
+		assert.False(t, ok)
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		mirrored, failed, err := MirrorImages(newContext(config.VerificationWarn), images)
+		require.NoError(t, err)
+		assert.Len(t, mirrored, 3)
+		assert.Empty(t, failed)
+	})
+}
+
+func TestNewMirrorer_InvalidKey(t *testing.T) {
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{Name: "local", ImagesRepository: "localhost:5000/images"}},
+			Options: config.OptionsConfig{Verification: config.VerificationConfig{Keys: []string{filepath.Join(t.TempDir(), "missing.pub")}}},
+		},
+	}
+	_, err := NewMirrorer(appCtx)
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+// Package lockfile reads and writes the mirrorctl.lock file, the record of the concrete chart versions and image tags
+// a mirror run resolved the entries of the charts and images files to, with the digests of their upstream content.
+// A run with `--locked` mirrors the content of the lockfile instead of resolving the entries again.
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is the path of the lockfile when options.lockfile is not set.
+const DefaultPath = "mirrorctl.lock"
+
+// ErrNotLocked is returned when an entry of the charts or images file has no concrete chart or image in the lockfile.
+var ErrNotLocked = errors.New("not in the lockfile")
+
+// Lockfile holds the charts and the images resolved by mirror runs.
+// The `mirror charts` command writes the charts and the `mirror images` command the images, each keeping the other.
+type Lockfile struct {
+	Charts []Chart `yaml:"charts"`
+	Images []Image `yaml:"images"`
+}
+
+// Chart is a concrete version of a chart entry of the charts file.
+// Constraint and Latest are the version and `latest` of the entry it was resolved from, empty for an exact version.
+// Digest is the digest of the chart archive, empty if the chart was not pulled, e.g. because it failed.
+// Images are the images found in the chart, with the digests their sources resolved to.
+type Chart struct {
+	Name       string  `yaml:"name"`
+	Source     string  `yaml:"source"`
+	Version    string  `yaml:"version"`
+	Digest     string  `yaml:"digest,omitempty"`
+	Constraint string  `yaml:"constraint,omitempty"`
+	Latest     int     `yaml:"latest,omitempty"`
+	Images     []Image `yaml:"images,omitempty"`
+}
+
+// Image is a concrete image of an image entry of the images file.
+// Tags is the tag filter of the entry it was resolved from, nil for an entry with an explicit tag or digest.
+// Digest is the digest the source resolved to, empty if the image was not mirrored, e.g. in dry-run mode.
+type Image struct {
+	Name   string           `yaml:"name"`
+	Source string           `yaml:"source"`
+	Digest string           `yaml:"digest,omitempty"`
+	Tags   *types.TagFilter `yaml:"tags,omitempty"`
+}
+
+// NewChart returns the locked chart of a version resolved from a chart entry, with the digest of its archive.
+func NewChart(entry types.Chart, resolvedVersion, digest string) Chart {
+	locked := Chart{Name: entry.Name, Source: entry.Source, Version: resolvedVersion, Digest: digest, Latest: entry.Latest}
+	if entry.Version != resolvedVersion {
+		locked.Constraint = entry.Version
+	}
+	return locked
+}
+
+// NewImage returns the locked image of a concrete image resolved from an image entry, with the digest of its source.
+// The digest of a source referenced by digest is the one of the reference.
+func NewImage(entry types.Image, resolved types.Image, digest string) Image {
+	if ref, err := imageref.Parse(resolved.Source); err == nil && ref.Digest != "" {
+		digest = ref.Digest.String()
+	}
+	return Image{Name: resolved.Name, Source: resolved.Source, Digest: digest, Tags: entry.Tags}
+}
+
+// Load reads a lockfile. A lockfile that does not exist yet is empty.
+// It returns an error if the file cannot be read or unmarshalled.
+func Load(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Lockfile{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+
+	var lock Lockfile
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lockfile %s: %w", path, err)
+	}
+	return &lock, nil
+}
+
+// LockedCharts returns the concrete charts locked for a chart entry, in the order of the lockfile.
+// It returns ErrNotLocked if the entry was not resolved by the run that wrote the lockfile,
+// e.g. because it was added or changed since.
+func (l *Lockfile) LockedCharts(entry types.Chart) ([]Chart, error) {
+	var locked []Chart
+	for _, c := range l.Charts {
+		if c.Name != entry.Name || c.Source != entry.Source || c.Latest != entry.Latest {
+			continue
+		}
+		if c.Constraint == entry.Version || (c.Constraint == "" && c.Version == entry.Version) {
+			locked = append(locked, c)
+		}
+	}
+	if len(locked) == 0 {
+		return nil, fmt.Errorf("chart %s %s: %w", entry.Name, entry.Version, ErrNotLocked)
+	}
+	return locked, nil
+}
+
+// LockedChart returns the locked chart of a concrete chart, and false if the chart is not in the lockfile.
+func (l *Lockfile) LockedChart(chart types.Chart) (Chart, bool) {
+	for _, c := range l.Charts {
+		if c.Name == chart.Name && c.Source == chart.Source && c.Version == chart.Version {
+			return c, true
+		}
+	}
+	return Chart{}, false
+}
+
+// ChartDigest returns the digest locked for the archive of a concrete chart, empty if the chart or its digest is not
+// in the lockfile.
+func (l *Lockfile) ChartDigest(chart types.Chart) string {
+	c, _ := l.LockedChart(chart)
+	return c.Digest
+}
+
+// ImageDigest returns the digest locked for a concrete image, e.g. `docker.io/library/alpine:3.22.2`, among the
+// images and the images of the charts, empty if the image or its digest is not in the lockfile.
+func (l *Lockfile) ImageDigest(source string) string {
+	for _, img := range l.Images {
+		if img.Source == source {
+			return img.Digest
+		}
+	}
+	for _, c := range l.Charts {
+		for _, img := range c.Images {
+			if img.Source == source && img.Digest != "" {
+				return img.Digest
+			}
+		}
+	}
+	return ""
+}
+
+// LockedImages returns the concrete images locked for an image entry, in the order of the lockfile.
+// It returns ErrNotLocked if the entry was not resolved by the run that wrote the lockfile,
+// e.g. because it was added or changed since.
+func (l *Lockfile) LockedImages(entry types.Image) ([]Image, error) {
+	var locked []Image
+	for _, img := range l.Images {
+		if img.Name != entry.Name || !reflect.DeepEqual(img.Tags, entry.Tags) {
+			continue
+		}
+		if img.Source == entry.Source || (entry.Tags != nil && strings.HasPrefix(img.Source, entry.Source+":")) {
+			locked = append(locked, img)
+		}
+	}
+	if len(locked) == 0 {
+		return nil, fmt.Errorf("image %s %s: %w", entry.Name, entry.Source, ErrNotLocked)
+	}
+	return locked, nil
+}
+
+// SetCharts replaces the charts of the lockfile, sorted by name and source, keeping the order of the versions
+// of each chart.
+func (l *Lockfile) SetCharts(charts []Chart) {
+	l.Charts = append([]Chart(nil), charts...)
+	sort.SliceStable(l.Charts, func(i, j int) bool {
+		if l.Charts[i].Name != l.Charts[j].Name {
+			return l.Charts[i].Name < l.Charts[j].Name
+		}
+		return l.Charts[i].Source < l.Charts[j].Source
+	})
+}
+
+// SetImages replaces the images of the lockfile, sorted by name, keeping the order of the tags of each image.
+func (l *Lockfile) SetImages(images []Image) {
+	l.Images = append([]Image(nil), images...)
+	sort.SliceStable(l.Images, func(i, j int) bool { return l.Images[i].Name < l.Images[j].Name })
+}
+
+// Write writes the lockfile to a path, with a header saying it is generated.
+// It returns an error if the lockfile cannot be marshalled or written.
+func (l *Lockfile) Write(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lockfile: %w", err)
+	}
+	header := fmt.Sprintf("# Generated by %s, do not edit.\n", version.AppName)
+	if err := os.WriteFile(path, append([]byte(header), data...), 0644); err != nil {
+		return fmt.Errorf("failed to write lockfile %s: %w", path, err)
+	}
+	return nil
+}
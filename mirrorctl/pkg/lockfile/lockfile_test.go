@@ -0,0 +1,210 @@
+package lockfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewChart(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    types.Chart
+		version  string
+		digest   string
+		expected Chart
+	}{
+		{
+			name:     "exact version",
+			entry:    types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.2"},
+			version:  "5.5.2",
+			digest:   "sha256:" + strings.Repeat("a", 64),
+			expected: Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.2", Digest: "sha256:" + strings.Repeat("a", 64)},
+		},
+		{
+			name:     "constraint",
+			entry:    types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "~5.5"},
+			version:  "5.5.12",
+			expected: Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.12", Constraint: "~5.5"},
+		},
+		{
+			name:     "latest",
+			entry:    types.Chart{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Latest: 3},
+			version:  "17.3.11",
+			expected: Chart{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Version: "17.3.11", Latest: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NewChart(tt.entry, tt.version, tt.digest))
+		})
+	}
+}
+
+func TestNewImage(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("b", 64)
+	tests := []struct {
+		name     string
+		entry    types.Image
+		resolved types.Image
+		expected Image
+	}{
+		{
+			name:     "tag",
+			entry:    types.Image{Name: "curl", Source: "quay.io/curl/curl:8.16.0"},
+			resolved: types.Image{Name: "curl", Source: "quay.io/curl/curl:8.16.0"},
+			expected: Image{Name: "curl", Source: "quay.io/curl/curl:8.16.0", Digest: "sha256:" + strings.Repeat("a", 64)},
+		},
+		{
+			name:     "digest of the source",
+			entry:    types.Image{Name: "curl", Source: "quay.io/curl/curl@" + digest},
+			resolved: types.Image{Name: "curl", Source: "quay.io/curl/curl@" + digest},
+			expected: Image{Name: "curl", Source: "quay.io/curl/curl@" + digest, Digest: digest},
+		},
+		{
+			name:     "tag filter",
+			entry:    types.Image{Name: "alpine", Source: "docker.io/library/alpine", Tags: &types.TagFilter{Newest: 1}},
+			resolved: types.Image{Name: "alpine", Source: "docker.io/library/alpine:3.22.2"},
+			expected: Image{Name: "alpine", Source: "docker.io/library/alpine:3.22.2", Digest: "sha256:" + strings.Repeat("a", 64), Tags: &types.TagFilter{Newest: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := NewImage(tt.entry, tt.resolved, "sha256:"+strings.Repeat("a", 64))
+			assert.Equal(t, tt.expected, image)
+		})
+	}
+}
+
+func TestLocked(t *testing.T) {
+	lock := &Lockfile{
+		Charts: []Chart{
+			{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.12", Digest: "sha256:loki", Constraint: "~5.5", Images: []Image{
+				{Name: "loki", Source: "docker.io/grafana/loki:2.8.2", Digest: "sha256:lokiimage"},
+			}},
+			{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Version: "17.3.10", Latest: 2},
+			{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Version: "17.3.11", Latest: 2},
+			{Name: "tempo", Source: "https://grafana.github.io/helm-charts", Version: "1.3.1"},
+		},
+		Images: []Image{
+			{Name: "alpine", Source: "docker.io/library/alpine:3.21.0", Tags: &types.TagFilter{Newest: 2}},
+			{Name: "alpine", Source: "docker.io/library/alpine:3.22.2", Tags: &types.TagFilter{Newest: 2}},
+			{Name: "curl", Source: "quay.io/curl/curl:8.16.0", Digest: "sha256:curl"},
+		},
+	}
+
+	chartTests := []struct {
+		name     string
+		entry    types.Chart
+		expected []string
+		wantErr  bool
+	}{
+		{name: "constraint", entry: types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "~5.5"}, expected: []string{"5.5.12"}},
+		{name: "latest", entry: types.Chart{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Latest: 2}, expected: []string{"17.3.10", "17.3.11"}},
+		{name: "exact version", entry: types.Chart{Name: "tempo", Source: "https://grafana.github.io/helm-charts", Version: "1.3.1"}, expected: []string{"1.3.1"}},
+		{name: "constraint changed", entry: types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "~5.6"}, wantErr: true},
+		{name: "latest changed", entry: types.Chart{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Latest: 3}, wantErr: true},
+		{name: "not locked", entry: types.Chart{Name: "mimir", Source: "https://grafana.github.io/helm-charts", Version: "5.0.0"}, wantErr: true},
+	}
+	for _, tt := range chartTests {
+		t.Run("chart "+tt.name, func(t *testing.T) {
+			locked, err := lock.LockedCharts(tt.entry)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrNotLocked)
+				return
+			}
+			require.NoError(t, err)
+			var versions []string
+			for _, c := range locked {
+				versions = append(versions, c.Version)
+			}
+			assert.Equal(t, tt.expected, versions)
+		})
+	}
+
+	imageTests := []struct {
+		name     string
+		entry    types.Image
+		expected []string
+		wantErr  bool
+	}{
+		{name: "tag filter", entry: types.Image{Name: "alpine", Source: "docker.io/library/alpine", Tags: &types.TagFilter{Newest: 2}}, expected: []string{"docker.io/library/alpine:3.21.0", "docker.io/library/alpine:3.22.2"}},
+		{name: "tag", entry: types.Image{Name: "curl", Source: "quay.io/curl/curl:8.16.0"}, expected: []string{"quay.io/curl/curl:8.16.0"}},
+		{name: "tag filter changed", entry: types.Image{Name: "alpine", Source: "docker.io/library/alpine", Tags: &types.TagFilter{Newest: 3}}, wantErr: true},
+		{name: "tag changed", entry: types.Image{Name: "curl", Source: "quay.io/curl/curl:8.17.0"}, wantErr: true},
+	}
+	for _, tt := range imageTests {
+		t.Run("image "+tt.name, func(t *testing.T) {
+			locked, err := lock.LockedImages(tt.entry)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrNotLocked)
+				return
+			}
+			require.NoError(t, err)
+			var sources []string
+			for _, img := range locked {
+				sources = append(sources, img.Source)
+			}
+			assert.Equal(t, tt.expected, sources)
+		})
+	}
+
+	assert.Equal(t, "sha256:loki", lock.ChartDigest(types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.12"}))
+	assert.Empty(t, lock.ChartDigest(types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.13"}))
+	assert.Equal(t, "sha256:curl", lock.ImageDigest("quay.io/curl/curl:8.16.0"))
+	assert.Empty(t, lock.ImageDigest("docker.io/library/alpine:3.22.2"))
+	assert.Empty(t, lock.ImageDigest("quay.io/curl/curl:8.17.0"))
+	assert.Equal(t, "sha256:lokiimage", lock.ImageDigest("docker.io/grafana/loki:2.8.2"))
+
+	locked, ok := lock.LockedChart(types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.12"})
+	require.True(t, ok)
+	assert.Len(t, locked.Images, 1)
+	_, ok = lock.LockedChart(types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.13"})
+	assert.False(t, ok)
+}
+
+func TestWriteLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultPath)
+
+	lock, err := Load(path)
+	require.NoError(t, err)
+	assert.Empty(t, lock.Charts)
+
+	lock.SetCharts([]Chart{
+		{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Version: "17.3.10", Latest: 2},
+		{Name: "redis", Source: "oci://registry-1.docker.io/bitnamicharts", Version: "17.3.11", Latest: 2},
+		{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.12", Digest: "sha256:" + strings.Repeat("a", 64), Constraint: "~5.5"},
+	})
+	lock.SetImages([]Image{
+		{Name: "curl", Source: "quay.io/curl/curl:8.16.0"},
+		{Name: "alpine", Source: "docker.io/library/alpine:3.21.0", Tags: &types.TagFilter{Semver: ">=3.20", Newest: 2}},
+		{Name: "alpine", Source: "docker.io/library/alpine:3.22.2", Tags: &types.TagFilter{Semver: ">=3.20", Newest: 2}},
+	})
+	require.NoError(t, lock.Write(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "# Generated by mirrorctl")
+
+	loaded, err := Load(path)
+	require.NoError(t, err)
+	require.Len(t, loaded.Charts, 3)
+	assert.Equal(t, "loki", loaded.Charts[0].Name)
+	assert.Equal(t, "~5.5", loaded.Charts[0].Constraint)
+	assert.Equal(t, "sha256:"+strings.Repeat("a", 64), loaded.Charts[0].Digest)
+	assert.Equal(t, "17.3.10", loaded.Charts[1].Version)
+	assert.Equal(t, "17.3.11", loaded.Charts[2].Version)
+	require.Len(t, loaded.Images, 3)
+	assert.Equal(t, "docker.io/library/alpine:3.21.0", loaded.Images[0].Source)
+	assert.Equal(t, &types.TagFilter{Semver: ">=3.20", Newest: 2}, loaded.Images[1].Tags)
+	assert.Nil(t, loaded.Images[2].Tags)
+
+	require.NoError(t, os.WriteFile(path, []byte("charts: {"), 0600))
+	_, err = Load(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package registryclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// NewRepository creates an ORAS remote repository for a reference such as `registry/path/name:tag`.
+// The repository authenticates with the credential provider configured for its registry host
+// and uses plain HTTP if the host is configured so.
+// It returns an error if the reference is invalid or the credentials cannot be set up.
+func NewRepository(ctx *appcontext.AppContext, reference string) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(reference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository reference %q: %w", reference, err)
+	}
+
+	store, err := ctx.Credentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up registry credentials: %w", err)
+	}
+	repo.Client = store.Client()
+	if ctx.Config != nil {
+		repo.PlainHTTP = ctx.Config.TransportFor(repo.Reference.Registry).PlainHTTP
+	}
+	return repo, nil
+}
+
+// IsNotFound returns true if a registry operation failed because the repository, tag or manifest does not exist,
+// as opposed to a failure to reach or authenticate with the registry.
+func IsNotFound(err error) bool {
+	if errors.Is(err, errdef.ErrNotFound) {
+		return true
+	}
+	var respErr *errcode.ErrorResponse
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,533 @@
+// Package registrytest provides an in-memory OCI distribution registry for tests.
+// It implements the subset of the distribution API used by ORAS: blobs, manifests, tags and referrers.
+package registrytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifest is a manifest stored in a repository.
+type manifest struct {
+	mediaType string
+	content   []byte
+}
+
+// repository holds the manifests and tags of a single repository.
+type repository struct {
+	manifests map[digest.Digest]manifest
+	tags      map[string]digest.Digest
+}
+
+// Server is an in-memory OCI registry served over plain HTTP.
+type Server struct {
+	// Host is the host:port of the registry, to be used in image references.
+	Host string
+	// URL is the base URL of the registry.
+	URL string
+
+	server *httptest.Server
+
+	mu           sync.Mutex
+	blobs        map[digest.Digest][]byte
+	repositories map[string]*repository
+	uploads      map[string]*bytes.Buffer
+	nextUpload   int
+
+	// Middleware, if set, wraps the registry handler, e.g. to inject failures.
+	Middleware func(http.Handler) http.Handler
+	// NoReferrersAPI, if set, makes the registry behave as one without the referrers API,
+	// so that clients fall back to the referrers tag schema.
+	NoReferrersAPI bool
+}
+
+// New starts a registry that is shut down when the test finishes.
+func New(t testing.TB) *Server {
+	s := &Server{
+		blobs:        make(map[digest.Digest][]byte),
+		repositories: make(map[string]*repository),
+		uploads:      make(map[string]*bytes.Buffer),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var h http.Handler = http.HandlerFunc(s.serve)
+		if s.Middleware != nil {
+			h = s.Middleware(h)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.server.Close)
+
+	s.URL = s.server.URL
+	s.Host = strings.TrimPrefix(s.server.URL, "http://")
+	return s
+}
+
+// Tags returns the sorted tags of a repository.
+func (s *Server) Tags(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo, ok := s.repositories[name]
+	if !ok {
+		return nil
+	}
+	tags := make([]string, 0, len(repo.tags))
+	for tag := range repo.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// serve routes a request to the blob, upload, manifest, tag or referrers handler.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if path == "/v2/" || path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "not found")
+		return
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		name, id, _ := strings.Cut(path, "/blobs/uploads/")
+		s.handleUpload(w, r, name, id)
+	case strings.Contains(path, "/blobs/"):
+		name, ref, _ := strings.Cut(path, "/blobs/")
+		s.handleBlob(w, r, name, ref)
+	case strings.Contains(path, "/manifests/"):
+		name, ref, _ := strings.Cut(path, "/manifests/")
+		s.handleManifest(w, r, name, ref)
+	case strings.HasSuffix(path, "/tags/list"):
+		s.handleTags(w, r, strings.TrimSuffix(path, "/tags/list"))
+	case strings.Contains(path, "/referrers/") && s.NoReferrersAPI:
+		// A registry without the referrers API does not know the endpoint, unlike a missing repository
+		w.WriteHeader(http.StatusNotFound)
+	case strings.Contains(path, "/referrers/"):
+		name, ref, _ := strings.Cut(path, "/referrers/")
+		s.handleReferrers(w, r, name, ref)
+	default:
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "not found")
+	}
+}
+
+func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request, _ string, ref string) {
+	s.mu.Lock()
+	data, ok := s.blobs[digest.Digest(ref)]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Header().Set("Docker-Content-Digest", ref)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, name string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		if mount := r.URL.Query().Get("mount"); mount != "" {
+			if _, ok := s.blobs[digest.Digest(mount)]; ok {
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, mount))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		s.nextUpload++
+		id := fmt.Sprint(s.nextUpload)
+		s.uploads[id] = &bytes.Buffer{}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		buf, ok := s.uploads[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		_, _ = io.Copy(buf, r.Body)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		buf, ok := s.uploads[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		_, _ = io.Copy(buf, r.Body)
+		expected, err := digest.Parse(r.URL.Query().Get("digest"))
+		if err != nil || expected != digest.FromBytes(buf.Bytes()) {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+			return
+		}
+		s.blobs[expected] = buf.Bytes()
+		delete(s.uploads, id)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, expected))
+		w.Header().Set("Docker-Content-Digest", expected.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request, name string, ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	repo := s.repositories[name]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if repo == nil {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository unknown")
+			return
+		}
+		dgst, ok := repo.resolve(ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		m := repo.manifests[dgst]
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(m.content)))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(m.content)
+		}
+	case http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		if repo == nil {
+			repo = &repository{manifests: make(map[digest.Digest]manifest), tags: make(map[string]digest.Digest)}
+			s.repositories[name] = repo
+		}
+		dgst := digest.FromBytes(content)
+		if d, err := digest.Parse(ref); err == nil {
+			if d != dgst {
+				writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+				return
+			}
+		} else {
+			repo.tags[ref] = dgst
+		}
+		repo.manifests[dgst] = manifest{mediaType: r.Header.Get("Content-Type"), content: content}
+
+		var parsed struct {
+			Subject *v1.Descriptor `json:"subject"`
+		}
+		if json.Unmarshal(content, &parsed) == nil && parsed.Subject != nil && !s.NoReferrersAPI {
+			w.Header().Set("OCI-Subject", parsed.Subject.Digest.String())
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if repo == nil {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository unknown")
+			return
+		}
+		dgst, ok := repo.resolve(ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		delete(repo.manifests, dgst)
+		for tag, d := range repo.tags {
+			if d == dgst {
+				delete(repo.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleTags(w http.ResponseWriter, _ *http.Request, name string) {
+	tags := s.Tags(name)
+	if tags == nil {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository unknown")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"name": name, "tags": tags})
+}
+
+func (s *Server) handleReferrers(w http.ResponseWriter, r *http.Request, name string, ref string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	artifactType := r.URL.Query().Get("artifactType")
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	if repo := s.repositories[name]; repo != nil {
+		dgsts := make([]string, 0, len(repo.manifests))
+		for d := range repo.manifests {
+			dgsts = append(dgsts, d.String())
+		}
+		sort.Strings(dgsts)
+		for _, d := range dgsts {
+			m := repo.manifests[digest.Digest(d)]
+			var parsed struct {
+				ArtifactType string            `json:"artifactType"`
+				Config       v1.Descriptor     `json:"config"`
+				Subject      *v1.Descriptor    `json:"subject"`
+				Annotations  map[string]string `json:"annotations"`
+			}
+			if json.Unmarshal(m.content, &parsed) != nil || parsed.Subject == nil || parsed.Subject.Digest.String() != ref {
+				continue
+			}
+			at := parsed.ArtifactType
+			if at == "" {
+				at = parsed.Config.MediaType
+			}
+			if artifactType != "" && at != artifactType {
+				continue
+			}
+			index.Manifests = append(index.Manifests, v1.Descriptor{
+				MediaType:    m.mediaType,
+				Digest:       digest.Digest(d),
+				Size:         int64(len(m.content)),
+				ArtifactType: at,
+				Annotations:  parsed.Annotations,
+			})
+		}
+	}
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	_ = json.NewEncoder(w).Encode(index)
+}
+
+// resolve returns the digest of a manifest referenced by tag or digest.
+func (r *repository) resolve(ref string) (digest.Digest, bool) {
+	if d, err := digest.Parse(ref); err == nil {
+		_, ok := r.manifests[d]
+		return d, ok
+	}
+	d, ok := r.tags[ref]
+	return d, ok
+}
+
+// writeError writes an error in the format of the distribution specification.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+// PushImage stores a minimal single-layer image in a repository and tags it.
+// It returns the descriptor of the image manifest.
+func (s *Server) PushImage(t testing.TB, name, tag string, layer []byte) v1.Descriptor {
+	t.Helper()
+
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	m := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}},
+	}
+	return s.PushManifest(t, name, tag, m, map[digest.Digest][]byte{m.Config.Digest: config, m.Layers[0].Digest: layer})
+}
+
+// PushIndex stores a multi-platform image in a repository and tags it.
+// Each platform, such as linux/amd64 or linux/arm/v7, gets its own single-layer image.
+// It returns the descriptor of the image index.
+func (s *Server) PushIndex(t testing.TB, name, tag string, platforms ...string) v1.Descriptor {
+	t.Helper()
+
+	index := v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: v1.MediaTypeImageIndex}
+	for _, p := range platforms {
+		parts := strings.Split(p, "/")
+		platform := &v1.Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) > 2 {
+			platform.Variant = parts[2]
+		}
+		desc := s.PushImage(t, name, "", []byte(name+" layer for "+p))
+		desc.Platform = platform
+		index.Manifests = append(index.Manifests, desc)
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	desc := v1.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: digest.FromBytes(content), Size: int64(len(content))}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo := s.repositories[name]
+	repo.manifests[desc.Digest] = manifest{mediaType: desc.MediaType, content: content}
+	repo.tags[tag] = desc.Digest
+	return desc
+}
+
+// PushArtifact stores an artifact, such as a signature or an SBOM, in a repository and tags it if tag is not empty.
+// The artifact is attached to subject, if not nil, as the referrers API expects, and added to
+// the referrers tag schema index of the subject if the registry has no referrers API.
+// It returns the descriptor of the artifact manifest.
+func (s *Server) PushArtifact(t testing.TB, name, tag string, subject *v1.Descriptor, artifactType string, payload []byte) v1.Descriptor {
+	t.Helper()
+
+	m := v1.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       v1.DescriptorEmptyJSON,
+		Layers:       []v1.Descriptor{{MediaType: "application/octet-stream", Digest: digest.FromBytes(payload), Size: int64(len(payload))}},
+		Subject:      subject,
+	}
+	desc := s.PushManifest(t, name, tag, m, map[digest.Digest][]byte{m.Config.Digest: v1.DescriptorEmptyJSON.Data, m.Layers[0].Digest: payload})
+	if subject == nil || !s.NoReferrersAPI {
+		return desc
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo := s.repositories[name]
+	schemaTag := subject.Digest.Algorithm().String() + "-" + subject.Digest.Encoded()
+	index := v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: v1.MediaTypeImageIndex}
+	if d, ok := repo.tags[schemaTag]; ok {
+		if err := json.Unmarshal(repo.manifests[d].content, &index); err != nil {
+			t.Fatalf("failed to parse referrers index: %v", err)
+		}
+	}
+	artifact := desc
+	artifact.ArtifactType = artifactType
+	index.Manifests = append(index.Manifests, artifact)
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("failed to marshal referrers index: %v", err)
+	}
+	indexDigest := digest.FromBytes(content)
+	repo.manifests[indexDigest] = manifest{mediaType: v1.MediaTypeImageIndex, content: content}
+	repo.tags[schemaTag] = indexDigest
+	return desc
+}
+
+// PushSignature stores a cosign signature of a manifest: the signed payload as single layer, annotated with its
+// base64 signature. The signature is tagged with the cosign tag scheme (sha256-<digest>.sig), or attached to the
+// manifest with the referrers API if referrer is set.
+// It returns the descriptor of the signature manifest.
+func (s *Server) PushSignature(t testing.TB, name string, subject v1.Descriptor, payload []byte, sig string, referrer bool) v1.Descriptor {
+	t.Helper()
+
+	m := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.DescriptorEmptyJSON,
+		Layers: []v1.Descriptor{{
+			MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+			Digest:      digest.FromBytes(payload),
+			Size:        int64(len(payload)),
+			Annotations: map[string]string{"dev.cosignproject.cosign/signature": sig},
+		}},
+	}
+	tag := subject.Digest.Algorithm().String() + "-" + subject.Digest.Encoded() + ".sig"
+	if referrer {
+		m.ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+		m.Subject = &subject
+		tag = ""
+	}
+	return s.PushManifest(t, name, tag, m, map[digest.Digest][]byte{m.Config.Digest: v1.DescriptorEmptyJSON.Data, m.Layers[0].Digest: payload})
+}
+
+// Manifest returns the content of a manifest referenced by tag or digest in a repository.
+func (s *Server) Manifest(name, ref string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo := s.repositories[name]
+	if repo == nil {
+		return nil, false
+	}
+	d, ok := repo.resolve(ref)
+	if !ok {
+		return nil, false
+	}
+	return repo.manifests[d].content, true
+}
+
+// PushManifest stores the blobs and the manifest in a repository and tags the manifest if tag is not empty.
+// It returns the descriptor of the manifest.
+func (s *Server) PushManifest(t testing.TB, name, tag string, m v1.Manifest, blobs map[digest.Digest][]byte) v1.Descriptor {
+	t.Helper()
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	desc := v1.Descriptor{MediaType: m.MediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for d, b := range blobs {
+		s.blobs[d] = b
+	}
+	repo := s.repositories[name]
+	if repo == nil {
+		repo = &repository{manifests: make(map[digest.Digest]manifest), tags: make(map[string]digest.Digest)}
+		s.repositories[name] = repo
+	}
+	repo.manifests[desc.Digest] = manifest{mediaType: desc.MediaType, content: content}
+	if tag != "" {
+		repo.tags[tag] = desc.Digest
+	}
+	return desc
+}
+
+// Resolve returns the digest of a manifest referenced by tag or digest in a repository.
+func (s *Server) Resolve(name, ref string) (digest.Digest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo := s.repositories[name]
+	if repo == nil {
+		return "", false
+	}
+	return repo.resolve(ref)
+}
+
+// PushChart stores a packaged Helm chart in a repository, tagged with the chart version, as `helm push` does.
+// It returns the descriptor of the chart manifest.
+func (s *Server) PushChart(t testing.TB, name, chartName, chartVersion string, archive []byte) v1.Descriptor {
+	t.Helper()
+
+	config := []byte(fmt.Sprintf(`{"apiVersion":"v2","name":%q,"version":%q}`, chartName, chartVersion))
+	m := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: "application/vnd.cncf.helm.config.v1+json", Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:    []v1.Descriptor{{MediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip", Digest: digest.FromBytes(archive), Size: int64(len(archive))}},
+	}
+	return s.PushManifest(t, name, chartVersion, m, map[digest.Digest][]byte{m.Config.Digest: config, m.Layers[0].Digest: archive})
+}
@@ -0,0 +1,167 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/transport"
+	"github.com/rs/zerolog/log"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// Defaults of the retry policy, used for the fields not set in the configuration.
+const (
+	DefaultMaxAttempts    = 4
+	DefaultInitialBackoff = 2 * time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+	DefaultJitter         = 0.2
+	DefaultMaxRetryAfter  = 5 * time.Minute
+)
+
+// Policy decides how many times and how long apart a registry operation is attempted.
+// Every registry operation of mirrorctl goes through a policy: it is attempted again after a transient error, see
+// IsTransient, with an exponential backoff, or after the delay a rate-limited registry asks for. Any other error,
+// e.g. a manifest or tag not found, ends it at once.
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+	MaxRetryAfter  time.Duration
+}
+
+// NewPolicy creates a retry policy from the configuration, with defaults for the fields that are not set.
+func NewPolicy(cfg config.RetryConfig) Policy {
+	p := Policy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff,
+		MaxBackoff:     cfg.MaxBackoff,
+		Jitter:         cfg.Jitter,
+		MaxRetryAfter:  cfg.MaxRetryAfter,
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = DefaultJitter
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	return p
+}
+
+// sleep waits for a duration or until the context is cancelled. It is replaced in tests.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do runs an operation until it succeeds, fails with an error that is not transient, or runs out of attempts.
+// It takes a context, the name of the operation for the logs and the operation itself as input.
+// It returns the number of retries, i.e. the attempts after the first one, and the error of the last attempt.
+func (p Policy) Do(ctx context.Context, operation string, fn func() error) (int, error) {
+	retries := 0
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if retries > 0 {
+				log.Info().Str("operation", operation).Int("retries", retries).Msg("Registry operation succeeded after retrying")
+			}
+			return retries, nil
+		}
+		if attempt >= p.MaxAttempts || !IsTransient(err) {
+			return retries, err
+		}
+
+		delay := p.backoff(attempt)
+		var rateLimitErr *transport.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			if rateLimitErr.RetryAfter > p.MaxRetryAfter {
+				return retries, err
+			}
+			delay = max(delay, rateLimitErr.RetryAfter)
+		}
+
+		log.Warn().Err(err).Str("operation", operation).Int("attempt", attempt).Dur("delay", delay).Msg("Registry operation failed, retrying")
+		if err := sleep(ctx, delay); err != nil {
+			return retries, err
+		}
+		retries++
+	}
+}
+
+// backoff returns the wait before the retry that follows an attempt: the initial backoff doubled on every
+// attempt, capped by the maximum backoff, with a random jitter so that concurrent workers do not retry together.
+func (p Policy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.MaxBackoff)
+	jitter := (rand.Float64()*2 - 1) * p.Jitter * float64(delay)
+	return delay + time.Duration(jitter)
+}
+
+// IsTransient returns true if an error is worth retrying: rate limiting, server errors, timeouts and dropped connections.
+// Rate limits that the registry reports as exhausted for the current window are not transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var rateLimitErr *transport.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return !rateLimitErr.Exhausted || rateLimitErr.RetryAfter > 0
+	}
+
+	var respErr *errcode.ErrorResponse
+	if errors.As(err, &respErr) {
+		switch respErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// Suffix returns the note appended to an entry of the final summary for its retries, or nothing if there were none.
+func Suffix(retries int) string {
+	switch retries {
+	case 0:
+		return ""
+	case 1:
+		return " [1 retry]"
+	default:
+		return fmt.Sprintf(" [%d retries]", retries)
+	}
+}
@@ -0,0 +1,134 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// recordSleeps replaces sleep with a function that records the waits instead of sleeping.
+func recordSleeps(t *testing.T) *[]time.Duration {
+	var delays []time.Duration
+	original := sleep
+	sleep = func(_ context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	t.Cleanup(func() { sleep = original })
+	return &delays
+}
+
+func TestNewPolicy_Defaults(t *testing.T) {
+	p := NewPolicy(config.RetryConfig{MaxAttempts: 2})
+	assert.Equal(t, 2, p.MaxAttempts)
+	assert.Equal(t, DefaultInitialBackoff, p.InitialBackoff)
+	assert.Equal(t, DefaultMaxBackoff, p.MaxBackoff)
+	assert.Equal(t, DefaultJitter, p.Jitter)
+	assert.Equal(t, DefaultMaxRetryAfter, p.MaxRetryAfter)
+}
+
+func TestDo_RetriesTransientErrors(t *testing.T) {
+	delays := recordSleeps(t)
+	p := Policy{MaxAttempts: 4, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Jitter: 0.01, MaxRetryAfter: time.Minute}
+
+	attempts := 0
+	retries, err := p.Do(context.Background(), "copy", func() error {
+		attempts++
+		if attempts < 4 {
+			return &errcode.ErrorResponse{StatusCode: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, retries)
+	// Exponential backoff capped by the maximum backoff
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for i, d := range *delays {
+		assert.InDelta(t, float64(expected[i]), float64(d), float64(expected[i])*0.011)
+	}
+}
+
+func TestDo_GivesUp(t *testing.T) {
+	recordSleeps(t)
+	p := NewPolicy(config.RetryConfig{MaxAttempts: 3})
+
+	attempts := 0
+	retries, err := p.Do(context.Background(), "copy", func() error {
+		attempts++
+		return &errcode.ErrorResponse{StatusCode: http.StatusTooManyRequests}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, retries)
+
+	// Errors that are not transient are not retried
+	attempts = 0
+	retries, err = p.Do(context.Background(), "resolve", func() error {
+		attempts++
+		return &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	assert.Zero(t, retries)
+}
+
+func TestDo_HonoursRetryAfter(t *testing.T) {
+	delays := recordSleeps(t)
+	p := Policy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute, Jitter: 0.1, MaxRetryAfter: time.Minute}
+
+	attempts := 0
+	_, err := p.Do(context.Background(), "copy", func() error {
+		attempts++
+		if attempts == 1 {
+			return fmt.Errorf("copy failed: %w", &transport.RateLimitError{Host: "docker.io", RetryAfter: 20 * time.Second})
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{20 * time.Second}, *delays)
+
+	// A Retry-After longer than the maximum accepted fails the operation at once
+	attempts = 0
+	_, err = p.Do(context.Background(), "copy", func() error {
+		attempts++
+		return &transport.RateLimitError{Host: "docker.io", RetryAfter: time.Hour}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"server error", &errcode.ErrorResponse{StatusCode: http.StatusBadGateway}, true},
+		{"too many requests", &errcode.ErrorResponse{StatusCode: http.StatusTooManyRequests}, true},
+		{"unauthorized", &errcode.ErrorResponse{StatusCode: http.StatusUnauthorized}, false},
+		{"rate limited", &transport.RateLimitError{Host: "docker.io"}, true},
+		{"quota exhausted", &transport.RateLimitError{Host: "docker.io", Exhausted: true}, false},
+		{"quota exhausted with retry after", &transport.RateLimitError{Host: "docker.io", Exhausted: true, RetryAfter: time.Second}, true},
+		{"cancelled", context.Canceled, false},
+		{"other", errors.New("invalid reference"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsTransient(tt.err))
+		})
+	}
+}
+
+func TestSuffix(t *testing.T) {
+	assert.Equal(t, "", Suffix(0))
+	assert.Equal(t, " [1 retry]", Suffix(1))
+	assert.Equal(t, " [3 retries]", Suffix(3))
+}
@@ -1,11 +1,16 @@
 package chartscanner
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/charts"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
 	"github.com/rs/zerolog/log"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
 )
 
 // ExtractImagesFromCharts extracts the container images from a list of Helm charts.
@@ -15,33 +20,105 @@ import (
 //
 // It also returns an error if the extraction fails.
 func ExtractImagesFromCharts(ctx *appcontext.AppContext, chartsFile string) (map[string][]types.Image, error) {
-	chartsList, err := charts.LoadChartsList(chartsFile)
+	sboms, err := ScanCharts(ctx, chartsFile)
 	if err != nil {
 		return nil, err
 	}
+	return ImagesByChart(sboms), nil
+}
 
+// ImagesByChart returns the images of each chart, keyed by the chart name.
+// Charts with several versions, such as the ones of an entry with `latest`, are keyed by name-version.
+func ImagesByChart(sboms []types.ChartSBOM) map[string][]types.Image {
+	versions := make(map[string]int)
+	for _, sbom := range sboms {
+		versions[sbom.Chart.Name]++
+	}
 	imagesByChart := make(map[string][]types.Image)
+	for _, sbom := range sboms {
+		key := sbom.Chart.Name
+		if versions[key] > 1 {
+			key += "-" + sbom.Chart.Version
+		}
+		imagesByChart[key] = sbom.Images
+	}
+	return imagesByChart
+}
+
+// ScanCharts lists the container images and the subcharts of a list of Helm charts.
+// It takes an application context and the path to the file containing the list of charts as input.
+// The version of each entry, a semver constraint or `latest`, is resolved first, and each version resolved is scanned.
+// The charts that fail to be resolved, pulled or scanned are logged and left out.
+// It returns the SBOM of each chart in the order of the file, with the version pulled,
+// and an error if the list of charts cannot be loaded.
+func ScanCharts(ctx *appcontext.AppContext, chartsFile string) ([]types.ChartSBOM, error) {
+	chartsList, err := charts.LoadChartsList(chartsFile)
+	if err != nil {
+		return nil, err
+	}
 
 	tmpDir, err := helm.CreateTempDir(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer helm.RemoveTempDir(ctx, tmpDir)
 
-	for _, ch := range chartsList.Charts {
-		srcChartPath, err := helm.PullChart(ch, tmpDir)
+	var chartsToScan []types.Chart
+	for _, r := range charts.ResolveCharts(ctx, chartsList.Charts) {
+		if r.Err != nil {
+			log.Error().Err(r.Err).Str("chart", r.Entry.Name).Str("version", r.Entry.Version).Msg("Failed to resolve chart version")
+			continue
+		}
+		chartsToScan = append(chartsToScan, r.Charts()...)
+	}
+
+	var sboms []types.ChartSBOM
+	for _, ch := range chartsToScan {
+		// Each version is pulled to a directory of its own, since they are all untarred as the chart name
+		chartDir, err := os.MkdirTemp(tmpDir, ch.Name+"-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		srcChartPath, _, err := helm.PullChart(ctx, ch, chartDir)
 		if err != nil {
 			log.Error().Err(err).Str("chart", ch.Name).Msg("Failed to pull chart")
 			continue
 		}
 
-		images, err := ScanChart(srcChartPath)
+		images, err := DiscoverImages(srcChartPath, ctx.Config.Options.Discovery)
 		if err != nil {
 			log.Error().Err(err).Str("chart", ch.Name).Msg("Failed to extract images from chart")
 			continue
 		}
 
-		imagesByChart[ch.Name] = images
+		sbom, err := ChartSBOM(ch, srcChartPath, images)
+		if err != nil {
+			log.Error().Err(err).Str("chart", ch.Name).Msg("Failed to read chart")
+			continue
+		}
+		sboms = append(sboms, sbom)
+	}
+
+	return sboms, nil
+}
+
+// ChartSBOM returns the SBOM of a pulled chart, with the version and the subcharts of its Chart.yaml files.
+// It returns an error if the chart cannot be loaded.
+func ChartSBOM(ch types.Chart, chartPath string, images []types.Image) (types.ChartSBOM, error) {
+	chrt, err := loader.Load(chartPath)
+	if err != nil {
+		return types.ChartSBOM{}, fmt.Errorf("failed to load chart: %w", err)
 	}
+	ch.Version = chrt.Metadata.Version
 
-	return imagesByChart, nil
+	sbom := types.ChartSBOM{Chart: ch, Images: images}
+	var addSubcharts func(parent *chart.Chart, parentRef string)
+	addSubcharts = func(parent *chart.Chart, parentRef string) {
+		for _, dep := range parent.Dependencies() {
+			sbom.Subcharts = append(sbom.Subcharts, types.Subchart{Name: dep.Name(), Version: dep.Metadata.Version, Parent: parentRef})
+			addSubcharts(dep, dep.Name()+"@"+dep.Metadata.Version)
+		}
+	}
+	addSubcharts(chrt, ch.Name+"@"+ch.Version)
+	return sbom, nil
 }
@@ -79,3 +79,17 @@ charts:
 
 	assert.Equal(t, expectedImagesByChart, imagesByChart)
 }
+
+func TestChartSBOM(t *testing.T) {
+	images := []types.Image{{Name: "loki", Source: "docker.io/grafana/loki:2.8.2"}}
+	sbom, err := ChartSBOM(types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.x"},
+		"../../../resources/data_test/input_charts/loki", images)
+	assert.NoError(t, err)
+
+	assert.Equal(t, types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.2"}, sbom.Chart)
+	assert.ElementsMatch(t, []types.Subchart{
+		{Name: "grafana-agent-operator", Version: "0.2.3", Parent: "loki@5.5.2"},
+		{Name: "minio", Version: "4.0.12", Parent: "loki@5.5.2"},
+	}, sbom.Subcharts)
+	assert.Equal(t, images, sbom.Images)
+}
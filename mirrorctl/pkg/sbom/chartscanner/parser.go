@@ -2,10 +2,13 @@ package chartscanner
 
 import (
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
 
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
@@ -161,6 +164,34 @@ func parseYAML(filePath string) ([]types.Image, error) {
 	return images, nil
 }
 
+// parseTemplate returns the container images written literally in a chart template, see helm.FindTemplateImages.
+// The images without tag are pulled with the latest tag, as nothing sets a default tag in a template.
+// It takes the path to the template as input.
+// It returns a slice of Image objects and an error if the file cannot be read.
+func parseTemplate(filePath string) ([]types.Image, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []types.Image
+	for _, img := range helm.FindTemplateImages(data) {
+		if img.Computed {
+			continue
+		}
+		ref, err := imageref.Parse(img.Value)
+		if err != nil {
+			continue
+		}
+		source := img.Value
+		if ref.Tag == "" && ref.Digest == "" {
+			source += ":latest"
+		}
+		images = append(images, types.Image{Name: path.Base(ref.Repository), Source: source})
+	}
+	return images, nil
+}
+
 // extractImagesFromNode recursively traverses a YAML node and extracts container image information.
 // It takes a YAML node, a pointer to a slice of images, and the parent key as input.
 func extractImagesFromNode(node *yaml.Node, images *[]types.Image, parentKey string) {
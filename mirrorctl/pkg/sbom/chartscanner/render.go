@@ -0,0 +1,336 @@
+package chartscanner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// Labels of the images, telling how they were found.
+const (
+	discoveredByScan = "scan"
+	renderProfile    = "render:"
+)
+
+// Value profiles the charts are rendered with, besides the values files of the configuration.
+const (
+	profileDefaults   = "defaults"    // The default values of the chart.
+	profileAllEnabled = "all-enabled" // The default values with every `enabled` value set to true.
+)
+
+// podSpecContainerKeys are the keys of the container lists of a PodSpec, found in any workload and in the CRDs
+// that embed a PodSpec or a list of containers.
+var podSpecContainerKeys = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// crdImageFields are the fields of the spec of known custom resources that hold an image reference,
+// by apiVersion group and kind.
+var crdImageFields = map[string][]string{
+	"monitoring.coreos.com/Prometheus":   {"image"},
+	"monitoring.coreos.com/Alertmanager": {"image"},
+	"monitoring.coreos.com/ThanosRuler":  {"image"},
+	"monitoring.grafana.com/GrafanaAgent": {
+		"image",
+		"configReloaderImage",
+	},
+	"logging.banzaicloud.io/Logging": {"image"},
+	"postgresql.cnpg.io/Cluster":     {"imageName"},
+	"mariadb.mmontes.io/MariaDB":     {"image"},
+	"kafka.strimzi.io/Kafka":         {"image"},
+}
+
+// DiscoverImages lists the container images of a chart with a discovery mode of config.DiscoveryConfig:
+// scanning its values and templates with ScanChart, rendering it with RenderChart, or both.
+// When the chart is rendered, each image is labelled with how it was found, e.g. scan and render:defaults.
+// It takes the path to the chart and the discovery configuration as input.
+// It returns the images sorted by source, and an error if the mode is unknown or no image could be discovered.
+func DiscoverImages(chartPath string, cfg config.DiscoveryConfig) ([]types.Image, error) {
+	switch cfg.Mode {
+	case "", config.DiscoveryScan:
+		return ScanChart(chartPath)
+	case config.DiscoveryRender:
+		return RenderChart(chartPath, cfg.ValuesFiles)
+	case config.DiscoveryBoth:
+		scanned, err := ScanChart(chartPath)
+		if err != nil {
+			return nil, err
+		}
+		for i := range scanned {
+			scanned[i].DiscoveredBy = []string{discoveredByScan}
+		}
+		rendered, err := RenderChart(chartPath, cfg.ValuesFiles)
+		if err != nil {
+			// The static scan is still usable
+			log.Warn().Err(err).Str("chart", chartPath).Msg("Failed to render chart, only the scanned images are listed")
+			return scanned, nil
+		}
+		return mergeImages(scanned, rendered), nil
+	default:
+		return nil, fmt.Errorf("invalid discovery mode %q, expected scan, render or both", cfg.Mode)
+	}
+}
+
+// RenderChart renders a chart as `helm template` does and lists the images of the rendered manifests, hooks included:
+// the containers of every PodSpec, and the image fields of known custom resources.
+// The chart is rendered with its default values, with every `enabled` value set to true so that optional
+// components are rendered too, and with each of the values files.
+// A profile that fails to render, e.g. because some values are required, is skipped with a warning.
+// It takes the path to the chart and the paths to the values files as input.
+// It returns the images sorted by source, labelled with the profiles that render them,
+// and an error if the chart cannot be loaded or no profile renders.
+func RenderChart(chartPath string, valuesFiles []string) ([]types.Image, error) {
+	profiles := []string{profileDefaults, profileAllEnabled}
+	profiles = append(profiles, valuesFiles...)
+
+	var images []types.Image
+	var errs []error
+	for _, profile := range profiles {
+		// Rendering drops the disabled dependencies from the chart, so it is loaded for each profile
+		chrt, err := loader.Load(chartPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load chart: %w", err)
+		}
+		vals, err := profileValues(chrt, profile)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests, err := renderManifests(chrt, vals)
+		if err != nil {
+			log.Warn().Err(err).Str("chart", chrt.Name()).Str("profile", profile).Msg("Failed to render chart")
+			errs = append(errs, fmt.Errorf("profile %s: %w", profile, err))
+			continue
+		}
+
+		label := renderProfile + profileLabel(profile)
+		var found []types.Image
+		for _, ref := range findManifestImages(manifests) {
+			found = append(found, renderedImage(ref, label))
+		}
+		log.Debug().Str("chart", chrt.Name()).Str("profile", profile).Int("images", len(found)).Msg("Rendered chart")
+		images = mergeImages(images, found)
+	}
+
+	if len(errs) == len(profiles) {
+		return nil, fmt.Errorf("failed to render chart: %w", errors.Join(errs...))
+	}
+	return images, nil
+}
+
+// profileLabel returns how the images rendered with a profile are labelled: the name of the profile,
+// or the file name of a values file.
+func profileLabel(profile string) string {
+	if profile == profileDefaults || profile == profileAllEnabled {
+		return profile
+	}
+	return filepath.Base(profile)
+}
+
+// profileValues returns the values a chart is rendered with for a profile.
+// It returns an error if a values file cannot be read.
+func profileValues(chrt *chart.Chart, profile string) (map[string]interface{}, error) {
+	switch profile {
+	case profileDefaults:
+		return map[string]interface{}{}, nil
+	case profileAllEnabled:
+		vals, err := chartutil.CoalesceValues(chrt, map[string]interface{}{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the values of the chart: %w", err)
+		}
+		enableAll(vals)
+		return vals, nil
+	default:
+		vals, err := chartutil.ReadValuesFile(profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file %s: %w", profile, err)
+		}
+		return vals, nil
+	}
+}
+
+// enableAll sets every boolean `enabled` value to true, in the values and in all the nested ones.
+func enableAll(vals map[string]interface{}) {
+	for key, value := range vals {
+		switch v := value.(type) {
+		case bool:
+			if key == "enabled" {
+				vals[key] = true
+			}
+		case map[string]interface{}:
+			enableAll(v)
+		case chartutil.Values:
+			enableAll(v)
+		case []interface{}:
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					enableAll(m)
+				}
+			}
+		}
+	}
+}
+
+// renderManifests renders a chart with some values, without a cluster, as `helm template` does.
+// It returns the rendered manifests and the ones of the hooks, and an error if the chart fails to render.
+func renderManifests(chrt *chart.Chart, vals map[string]interface{}) (string, error) {
+	client := action.NewInstall(&action.Configuration{Log: func(format string, v ...interface{}) {
+		log.Trace().Msgf(format, v...)
+	}})
+	client.DryRun = true
+	client.DryRunOption = "client"
+	client.ClientOnly = true
+	client.Replace = true
+	client.ReleaseName = chrt.Name()
+	client.Namespace = "default"
+
+	rel, err := client.Run(chrt, vals)
+	if err != nil {
+		return "", err
+	}
+	var manifests strings.Builder
+	manifests.WriteString(rel.Manifest)
+	for _, hook := range rel.Hooks {
+		manifests.WriteString("\n---\n")
+		manifests.WriteString(hook.Manifest)
+	}
+	return manifests.String(), nil
+}
+
+// findManifestImages returns the image references of rendered manifests, in the order they are found.
+func findManifestImages(manifests string) []string {
+	var refs []string
+	decoder := yaml.NewDecoder(strings.NewReader(manifests))
+	for {
+		var doc map[string]interface{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to parse rendered manifest")
+			break
+		}
+		if doc == nil {
+			continue
+		}
+
+		apiVersion, _ := doc["apiVersion"].(string)
+		kind, _ := doc["kind"].(string)
+		group, _, _ := strings.Cut(apiVersion, "/")
+		if spec, ok := doc["spec"].(map[string]interface{}); ok {
+			for _, field := range crdImageFields[group+"/"+kind] {
+				if ref, ok := spec[field].(string); ok && ref != "" {
+					refs = append(refs, ref)
+				}
+			}
+		}
+		refs = append(refs, findContainerImages(doc)...)
+	}
+	return refs
+}
+
+// findContainerImages returns the images of the containers of every PodSpec found in a rendered object.
+func findContainerImages(value interface{}) []string {
+	var refs []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range podSpecContainerKeys {
+			containers, _ := v[key].([]interface{})
+			for _, c := range containers {
+				if container, ok := c.(map[string]interface{}); ok {
+					if ref, ok := container["image"].(string); ok && ref != "" {
+						refs = append(refs, ref)
+					}
+				}
+			}
+		}
+		// Sorted keys, so the images are found in the same order on every run
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			refs = append(refs, findContainerImages(v[key])...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			refs = append(refs, findContainerImages(item)...)
+		}
+	}
+	return refs
+}
+
+// renderedImage returns the image of a rendered reference. References without tag nor digest are pulled with the
+// latest tag, as the container runtime does.
+func renderedImage(ref, label string) types.Image {
+	name := extractImageName(ref)
+	if r, err := imageref.Parse(ref); err == nil {
+		name = path.Base(r.Repository)
+		if r.Tag == "" && r.Digest == "" {
+			ref += ":latest"
+		}
+	}
+	return types.Image{Name: name, Source: ref, DiscoveredBy: []string{label}}
+}
+
+// mergeImages merges two lists of images, matching the references that name the same image,
+// e.g. busybox:1.36 and docker.io/library/busybox:1.36. The source of the first list is kept,
+// and the labels of both lists are merged.
+// It returns the images sorted by source.
+func mergeImages(images, others []types.Image) []types.Image {
+	merged := make(map[string]*types.Image)
+	var keys []string
+	for _, list := range [][]types.Image{images, others} {
+		for _, img := range list {
+			key := img.Source
+			if r, err := imageref.Parse(img.Source); err == nil {
+				key = r.String()
+			}
+			existing, ok := merged[key]
+			if !ok {
+				img.DiscoveredBy = append([]string(nil), img.DiscoveredBy...)
+				merged[key] = &img
+				keys = append(keys, key)
+				continue
+			}
+			for _, label := range img.DiscoveredBy {
+				if !containsString(existing.DiscoveredBy, label) {
+					existing.DiscoveredBy = append(existing.DiscoveredBy, label)
+				}
+			}
+		}
+	}
+
+	result := make([]types.Image, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *merged[key])
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Compare(result[i].Source, result[j].Source) < 0
+	})
+	return result
+}
+
+// containsString returns true if a list of strings contains a string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package chartscanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderChart(t *testing.T) {
+	chartDir := filepath.Join(t.TempDir(), "app")
+	files := map[string]string{
+		"Chart.yaml":  "apiVersion: v2\nname: app\nversion: 1.0.0\n",
+		"values.yaml": "image: busybox:1.36\nmetrics:\n  enabled: false\n  image: prom/statsd-exporter:v0.26.0\nagent:\n  image: grafana/agent:v0.25.1\n",
+		"templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: "{{ .Values.image }}"
+      containers:
+        - name: app
+          image: "{{ .Values.image }}"
+{{- if .Values.metrics.enabled }}
+        - name: metrics
+          image: {{ .Values.metrics.image }}
+{{- end }}
+`,
+		"templates/cronjob.yaml": `{{- if .Values.backup }}
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  schedule: "0 0 * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: {{ .Values.backup.image }}
+{{- end }}
+`,
+		"templates/hook.yaml": `apiVersion: v1
+kind: Pod
+metadata:
+  name: test
+  annotations:
+    "helm.sh/hook": test
+spec:
+  containers:
+    - name: test
+      image: curlimages/curl
+`,
+		"templates/agent.yaml": `apiVersion: monitoring.grafana.com/v1alpha1
+kind: GrafanaAgent
+metadata:
+  name: agent
+spec:
+  image: {{ .Values.agent.image }}
+`,
+		"backup-values.yaml": "backup:\n  image: postgres:16\n",
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(chartDir, name), []byte(content), 0644))
+	}
+
+	images, err := RenderChart(chartDir, []string{filepath.Join(chartDir, "backup-values.yaml")})
+	require.NoError(t, err)
+
+	all := []string{"render:defaults", "render:all-enabled", "render:backup-values.yaml"}
+	expected := []types.Image{
+		{Name: "busybox", Source: "busybox:1.36", DiscoveredBy: all},
+		{Name: "curl", Source: "curlimages/curl:latest", DiscoveredBy: all},
+		{Name: "agent", Source: "grafana/agent:v0.25.1", DiscoveredBy: all},
+		{Name: "postgres", Source: "postgres:16", DiscoveredBy: []string{"render:backup-values.yaml"}},
+		{Name: "statsd-exporter", Source: "prom/statsd-exporter:v0.26.0", DiscoveredBy: []string{"render:all-enabled"}},
+	}
+	assert.Equal(t, expected, images)
+}
+
+func TestRenderChart_Fails(t *testing.T) {
+	chartDir := filepath.Join(t.TempDir(), "app")
+	require.NoError(t, os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v2\nname: app\nversion: 1.0.0\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(chartDir, "templates", "secret.yaml"), []byte("{{ required \"password is required\" .Values.password }}\n"), 0644))
+
+	_, err := RenderChart(chartDir, nil)
+	assert.ErrorContains(t, err, "password is required")
+}
+
+func TestDiscoverImages(t *testing.T) {
+	chartPath := "../../../resources/data_test/input_charts/loki"
+
+	scanned, err := DiscoverImages(chartPath, config.DiscoveryConfig{})
+	require.NoError(t, err)
+	for _, img := range scanned {
+		assert.Empty(t, img.DiscoveredBy, img.Source)
+	}
+
+	images, err := DiscoverImages(chartPath, config.DiscoveryConfig{Mode: config.DiscoveryBoth})
+	require.NoError(t, err)
+	discoveredBy := make(map[string][]string)
+	for _, img := range images {
+		discoveredBy[img.Source] = img.DiscoveredBy
+	}
+	// Found by both, with the source of the scan
+	assert.Equal(t, []string{"scan", "render:defaults"}, discoveredBy["docker.io/grafana/loki:2.8.2"])
+	assert.Equal(t, []string{"scan", "render:defaults"}, discoveredBy["busybox:latest"])
+	// Only rendered, as the image of the GrafanaAgent resource
+	assert.Equal(t, []string{"render:defaults"}, discoveredBy["docker.io/grafana/agent:v0.25.1"])
+	// Only scanned, as enterprise logs are disabled by default
+	assert.Equal(t, []string{"scan"}, discoveredBy["docker.io/grafana/enterprise-logs:2.8.2"])
+
+	_, err = DiscoverImages(chartPath, config.DiscoveryConfig{Mode: "guess"})
+	assert.ErrorContains(t, err, "invalid discovery mode")
+}
@@ -6,6 +6,7 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
 	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3" // Import yaml.v3
@@ -82,6 +83,24 @@ func ScanChart(chartPath string) ([]types.Image, error) {
 			return nil
 		}
 
+		relPath, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		if helm.IsTemplateFile(relPath) {
+			// Templates are not valid YAML, only the images written literally are found
+			log.Trace().Msgf("Parsing template file: %s", path)
+			images, err := parseTemplate(path)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Failed to parse template file: %s", path)
+				return nil
+			}
+			for _, img := range images {
+				uniqueImages[img.Source] = img
+			}
+			return nil
+		}
+
 		if filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml" {
 			log.Trace().Msgf("Parsing YAML file: %s", path)
 			images, err := parseYAML(path)
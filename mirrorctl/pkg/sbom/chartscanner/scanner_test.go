@@ -42,22 +42,24 @@ func TestScanChart(t *testing.T) {
 				{Name: "nginx-unprivileged", Source: "docker.io/nginxinc/nginx-unprivileged:1.19-alpine"},
 				{Name: "mc", Source: "quay.io/minio/mc:RELEASE.2022-08-11T00-30-48Z"},
 				{Name: "minio", Source: "quay.io/minio/minio:RELEASE.2022-08-13T21-54-44Z"},
+				{Name: "busybox", Source: "busybox:latest"}, // Test hook template of grafana-agent-operator
 			},
 		},
 		{
 			name:      "loki chart (expected)",
 			chartPath: "../../../resources/data_test/expected_charts/loki",
 			expectedImages: []types.Image{
-				{Name: "agent-operator", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/grafana/agent-operator:v0.25.1"},
-				{Name: "kubectl", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/bitnami/kubectl:2.8.2"},
-				{Name: "enterprise-logs-provisioner", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/grafana/enterprise-logs-provisioner:2.8.2"},
-				{Name: "enterprise-logs", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/grafana/enterprise-logs:2.8.2"},
-				{Name: "loki-canary", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/grafana/loki-canary:2.8.2"},
-				{Name: "loki-helm-test", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/grafana/loki-helm-test:2.8.2"},
-				{Name: "loki", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/grafana/loki:2.8.2"},
-				{Name: "nginx-unprivileged", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/nginxinc/nginx-unprivileged:1.19-alpine"},
-				{Name: "mc", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/quay.io/minio/mc:RELEASE.2022-08-11T00-30-48Z"},
-				{Name: "minio", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/quay.io/minio/minio:RELEASE.2022-08-13T21-54-44Z"},
+				{Name: "agent-operator", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/agent-operator:v0.25.1"},
+				{Name: "kubectl", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/kubectl:2.8.2"},
+				{Name: "enterprise-logs-provisioner", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/enterprise-logs-provisioner:2.8.2"},
+				{Name: "enterprise-logs", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/enterprise-logs:2.8.2"},
+				{Name: "loki-canary", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/loki-canary:2.8.2"},
+				{Name: "loki-helm-test", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/loki-helm-test:2.8.2"},
+				{Name: "loki", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/loki:2.8.2"},
+				{Name: "nginx-unprivileged", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/nginx-unprivileged:1.19-alpine"},
+				{Name: "mc", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/mc:RELEASE.2022-08-11T00-30-48Z"},
+				{Name: "minio", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/minio:RELEASE.2022-08-13T21-54-44Z"},
+				{Name: "busybox", Source: "europe-southwest1-docker.pkg.dev/poc-development-123456/test-container-images/busybox:latest"},
 			},
 		},
 	}
@@ -0,0 +1,127 @@
+package sbomformat
+
+import (
+	"encoding/json"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	"github.com/opencontainers/go-digest"
+)
+
+// cdxSpecVersion is the version of the CycloneDX specification of the documents.
+const cdxSpecVersion = "1.5"
+
+// cdxDiscoveredByProperty is the property of the image components that tells how they were found in the charts.
+const cdxDiscoveredByProperty = "mirrorctl:discovered_by"
+
+// cdxHashAlgorithms are the CycloneDX names of the digest algorithms.
+var cdxHashAlgorithms = map[digest.Algorithm]string{
+	digest.SHA256: "SHA-256",
+	digest.SHA384: "SHA-384",
+	digest.SHA512: "SHA-512",
+}
+
+type cdxDocument struct {
+	BOMFormat    string          `json:"bomFormat"`
+	SpecVersion  string          `json:"specVersion"`
+	SerialNumber string          `json:"serialNumber"`
+	Version      int             `json:"version"`
+	Metadata     cdxMetadata     `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type               string                 `json:"type"`
+	BOMRef             string                 `json:"bom-ref,omitempty"`
+	Name               string                 `json:"name"`
+	Version            string                 `json:"version,omitempty"`
+	Hashes             []cdxHash              `json:"hashes,omitempty"`
+	PURL               string                 `json:"purl,omitempty"`
+	ExternalReferences []cdxExternalReference `json:"externalReferences,omitempty"`
+	Properties         []cdxProperty          `json:"properties,omitempty"`
+}
+
+type cdxHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+type cdxExternalReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// encodeCycloneDX encodes the graph of an SBOM as a CycloneDX JSON document.
+// The root of the graph is the component the document describes, and the images are container components.
+func encodeCycloneDX(g *graph) ([]byte, error) {
+	doc := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  cdxSpecVersion,
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: timestamp(),
+			Tools: cdxTools{Components: []cdxComponent{
+				{Type: "application", Name: version.AppName, Version: version.Version},
+			}},
+			Component: cdxComponentOf(g.root),
+		},
+		Components:   make([]cdxComponent, 0, len(g.components)),
+		Dependencies: make([]cdxDependency, 0, len(g.components)+1),
+	}
+	for _, c := range append([]*component{g.root}, g.components...) {
+		if c != g.root {
+			doc.Components = append(doc.Components, cdxComponentOf(c))
+		}
+		// Every component is listed, so that the ones without dependencies are known to have none
+		dependsOn := g.dependsOn[c.ref]
+		if dependsOn == nil {
+			dependsOn = []string{}
+		}
+		doc.Dependencies = append(doc.Dependencies, cdxDependency{Ref: c.ref, DependsOn: dependsOn})
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// cdxComponentOf returns the CycloneDX component of a chart or an image.
+func cdxComponentOf(c *component) cdxComponent {
+	cdx := cdxComponent{Type: "application", BOMRef: c.ref, Name: c.name, Version: c.version}
+	if c.kind != kindImage {
+		if c.source != "" {
+			cdx.ExternalReferences = []cdxExternalReference{{Type: "distribution", URL: c.source}}
+		}
+		return cdx
+	}
+
+	cdx.Type = "container"
+	if c.parsed {
+		cdx.PURL = c.ref
+		if alg, ok := cdxHashAlgorithms[digestAlgorithm(c)]; ok {
+			cdx.Hashes = []cdxHash{{Algorithm: alg, Content: c.image.Digest.Encoded()}}
+		}
+	}
+	for _, label := range c.discoveredBy {
+		cdx.Properties = append(cdx.Properties, cdxProperty{Name: cdxDiscoveredByProperty, Value: label})
+	}
+	return cdx
+}
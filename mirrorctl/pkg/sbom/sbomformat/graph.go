@@ -0,0 +1,174 @@
+package sbomformat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Kinds of the components of an SBOM.
+const (
+	kindCharts = "charts" // The collection of the charts of a charts file.
+	kindChart  = "chart"  // A chart or a subchart.
+	kindImage  = "image"  // A container image.
+)
+
+// spdxIDInvalidChars matches the characters not allowed in an SPDX identifier.
+var spdxIDInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// component is a chart or an image of an SBOM, independent of its format.
+type component struct {
+	kind         string
+	ref          string // The identifier of the component in the document.
+	name         string
+	version      string
+	source       string // The repository of a chart, or the reference of an image.
+	image        imageref.Reference
+	parsed       bool // True if the reference of the image could be parsed.
+	discoveredBy []string
+}
+
+// graph is the components of an SBOM and the dependencies between them, in the order they are added.
+type graph struct {
+	root       *component
+	components []*component
+	index      map[string]*component
+	dependsOn  map[string][]string
+}
+
+// newGraph returns the graph of the charts of an SBOM: each chart depends on its images and on its subcharts,
+// and each subchart on its own subcharts. Images and subcharts shared by several charts are added once.
+// The root of the graph is the chart when there is only one, or else a collection named name that depends
+// on every chart.
+func newGraph(name string, sboms []types.ChartSBOM) *graph {
+	g := &graph{index: make(map[string]*component), dependsOn: make(map[string][]string)}
+	if len(sboms) != 1 {
+		g.root = &component{kind: kindCharts, ref: "charts:" + name, name: name}
+		g.index[g.root.ref] = g.root
+	}
+
+	for _, sbom := range sboms {
+		chart := chartComponent(sbom.Chart.Name, sbom.Chart.Version, sbom.Chart.Source)
+		if g.root == nil {
+			g.root = chart
+		}
+		chart = g.add(chart)
+		g.depend(g.root, chart)
+		for _, sub := range sbom.Subcharts {
+			subchart := g.add(chartComponent(sub.Name, sub.Version, ""))
+			g.depend(g.index["chart:"+sub.Parent], subchart)
+		}
+		for _, img := range sbom.Images {
+			image := g.add(imageComponent(img))
+			for _, label := range img.DiscoveredBy {
+				if !containsString(image.discoveredBy, label) {
+					image.discoveredBy = append(image.discoveredBy, label)
+				}
+			}
+			g.depend(chart, image)
+		}
+	}
+	return g
+}
+
+// add adds a component to the graph, unless it already has one with the same identifier.
+// It returns the component of the graph.
+func (g *graph) add(c *component) *component {
+	if existing, ok := g.index[c.ref]; ok {
+		return existing
+	}
+	g.index[c.ref] = c
+	if c != g.root {
+		g.components = append(g.components, c)
+	}
+	return c
+}
+
+// depend records that a component depends on another one. A dependency of an unknown component is ignored.
+func (g *graph) depend(c, dependency *component) {
+	if c == nil || c == dependency || containsString(g.dependsOn[c.ref], dependency.ref) {
+		return
+	}
+	g.dependsOn[c.ref] = append(g.dependsOn[c.ref], dependency.ref)
+}
+
+// chartComponent returns the component of a chart, identified by its name and version.
+func chartComponent(name, version, source string) *component {
+	return &component{kind: kindChart, ref: "chart:" + name + "@" + version, name: name, version: version, source: source}
+}
+
+// imageComponent returns the component of an image, identified by its package URL, or by its source
+// when the reference cannot be parsed. The name of the component is the repository with its registry,
+// and the version is its tag, or its digest when it has no tag.
+func imageComponent(img types.Image) *component {
+	ref, err := imageref.Parse(img.Source)
+	if err != nil {
+		return &component{kind: kindImage, ref: "image:" + img.Source, name: img.Source, source: img.Source}
+	}
+	version := ref.Tag
+	if version == "" {
+		version = ref.Digest.String()
+	}
+	return &component{
+		kind:    kindImage,
+		ref:     imagePURL(ref),
+		name:    ref.Registry + "/" + ref.Repository,
+		version: version,
+		source:  img.Source,
+		image:   ref,
+		parsed:  true,
+	}
+}
+
+// imagePURL returns the package URL of an image, as defined by the oci type of the purl specification,
+// e.g. pkg:oci/loki@sha256%3A...?repository_url=docker.io/grafana/loki&tag=2.8.2.
+// The version is the digest of the image, and is left out when the reference has none.
+func imagePURL(ref imageref.Reference) string {
+	purl := "pkg:oci/" + strings.ToLower(path.Base(ref.Repository))
+	if ref.Digest != "" {
+		purl += "@" + strings.ReplaceAll(ref.Digest.String(), ":", "%3A")
+	}
+	purl += "?repository_url=" + strings.ReplaceAll(ref.Registry+"/"+ref.Repository, ":", "%3A")
+	if ref.Tag != "" {
+		purl += "&tag=" + ref.Tag
+	}
+	return purl
+}
+
+// digestAlgorithm returns the algorithm of the digest of an image, or an empty one if its reference has no digest.
+func digestAlgorithm(c *component) digest.Algorithm {
+	if c.image.Digest == "" {
+		return ""
+	}
+	return c.image.Digest.Algorithm()
+}
+
+// spdxID returns the SPDX identifier of a component. The identifiers of the images end with a hash of their
+// reference, as the characters replaced in their reference could make two of them equal.
+func spdxID(c *component) string {
+	switch c.kind {
+	case kindImage:
+		sum := sha256.Sum256([]byte(c.ref))
+		return "SPDXRef-Image-" + spdxIDInvalidChars.ReplaceAllString(path.Base(c.name), "-") + "-" + hex.EncodeToString(sum[:6])
+	case kindCharts:
+		return "SPDXRef-Charts-" + spdxIDInvalidChars.ReplaceAllString(c.name, "-")
+	default:
+		return "SPDXRef-Chart-" + spdxIDInvalidChars.ReplaceAllString(c.name+"-"+c.version, "-")
+	}
+}
+
+// containsString returns true if a list of strings contains a string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+// Package sbomformat encodes the container images of Helm charts as standard SBOM documents,
+// in the CycloneDX and SPDX JSON formats.
+package sbomformat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/rs/zerolog/log"
+)
+
+// SBOM formats of the `sbom` commands.
+const (
+	FormatNative        = "native"         // The mirrorctl lists of images, one JSON file per chart.
+	FormatCycloneDXJSON = "cyclonedx-json" // CycloneDX 1.5 JSON documents.
+	FormatSPDXJSON      = "spdx-json"      // SPDX 2.3 JSON documents.
+)
+
+// fileExtensions are the extensions of the files of each standard format.
+var fileExtensions = map[string]string{
+	FormatCycloneDXJSON: ".cdx.json",
+	FormatSPDXJSON:      ".spdx.json",
+}
+
+// artifactTypes are the media types of the documents of each standard format, used as the artifact type
+// of the SBOMs attached to the mirrored charts.
+var artifactTypes = map[string]string{
+	FormatCycloneDXJSON: "application/vnd.cyclonedx+json",
+	FormatSPDXJSON:      "application/spdx+json",
+}
+
+// newUUID and timestamp are the unique identifier and the creation time of the documents, replaced in tests.
+var (
+	newUUID   = uuid.NewString
+	timestamp = func() string { return time.Now().UTC().Format(time.RFC3339) }
+)
+
+// ValidateFormat returns an error if a format is not one of the SBOM formats.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatNative, FormatCycloneDXJSON, FormatSPDXJSON:
+		return nil
+	default:
+		return fmt.Errorf("unsupported SBOM format %q, expected %s, %s or %s", format, FormatNative, FormatCycloneDXJSON, FormatSPDXJSON)
+	}
+}
+
+// Encode encodes the SBOM of some charts as a document of a standard format, named name.
+// A document of a single chart describes the chart: the chart depends on its images and its subcharts,
+// and each subchart on its own subcharts. A document of several charts, such as the one of a whole charts file,
+// describes all of them.
+// Images are identified by their pkg:oci package URL, with their digest when the reference has one.
+// It returns an error if the format is not a standard one.
+func Encode(format, name string, sboms []types.ChartSBOM) ([]byte, error) {
+	g := newGraph(name, sboms)
+	switch format {
+	case FormatCycloneDXJSON:
+		return encodeCycloneDX(g)
+	case FormatSPDXJSON:
+		return encodeSPDX(name, g)
+	default:
+		return nil, fmt.Errorf("unsupported SBOM document format %q, expected %s or %s", format, FormatCycloneDXJSON, FormatSPDXJSON)
+	}
+}
+
+// ArtifactType returns the media type of the documents of a standard format, e.g. application/vnd.cyclonedx+json,
+// or an empty string if the format is not a standard one.
+func ArtifactType(format string) string {
+	return artifactTypes[format]
+}
+
+// CombinedName returns the name of the document of all the charts of a charts file: the name of the file without extension.
+func CombinedName(chartsFile string) string {
+	return strings.TrimSuffix(filepath.Base(chartsFile), filepath.Ext(chartsFile))
+}
+
+// WriteFilePerChart writes a document of a standard format for each chart, named sbom-<chart>-<version>,
+// and a combined document of all the charts, named sbom-<name>, e.g. sbom-loki-5.5.2.cdx.json and
+// sbom-helm-charts.cdx.json.
+// It takes the SBOM of the charts, the name of the combined document, the output directory and the format as input.
+// It returns an error if a document cannot be encoded or written.
+func WriteFilePerChart(sboms []types.ChartSBOM, name, outputDir, format string) error {
+	ext, ok := fileExtensions[format]
+	if !ok {
+		return fmt.Errorf("unsupported SBOM document format %q, expected %s or %s", format, FormatCycloneDXJSON, FormatSPDXJSON)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory %s: %w", outputDir, err)
+	}
+
+	write := func(name string, sboms []types.ChartSBOM) error {
+		data, err := Encode(format, name, sboms)
+		if err != nil {
+			return fmt.Errorf("failed to encode SBOM %s: %w", name, err)
+		}
+		filePath := filepath.Join(outputDir, "sbom-"+name+ext)
+		if err := os.WriteFile(filePath, data, 0644); err != nil {
+			return fmt.Errorf("failed to write file %s: %w", filePath, err)
+		}
+		log.Info().Str("file", filePath).Msg("Successfully wrote SBOM to file")
+		return nil
+	}
+
+	for _, sbom := range sboms {
+		if err := write(sbom.Chart.Name+"-"+sbom.Chart.Version, []types.ChartSBOM{sbom}); err != nil {
+			return err
+		}
+	}
+	return write(name, sboms)
+}
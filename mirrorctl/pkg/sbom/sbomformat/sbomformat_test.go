@@ -0,0 +1,157 @@
+package sbomformat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const lokiDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+var testSBOMs = []types.ChartSBOM{
+	{
+		Chart: types.Chart{Name: "loki", Source: "https://grafana.github.io/helm-charts", Version: "5.5.2"},
+		Subcharts: []types.Subchart{
+			{Name: "minio", Version: "4.0.12", Parent: "loki@5.5.2"},
+			{Name: "grafana-agent-operator", Version: "0.2.15", Parent: "loki@5.5.2"},
+			{Name: "crds", Version: "0.0.0", Parent: "grafana-agent-operator@0.2.15"},
+		},
+		Images: []types.Image{
+			{Name: "busybox", Source: "busybox:latest"},
+			{Name: "loki", Source: "docker.io/grafana/loki:2.8.2@" + lokiDigest, DiscoveredBy: []string{"scan", "render:defaults"}},
+		},
+	},
+	{
+		Chart:  types.Chart{Name: "redis", Source: "https://charts.bitnami.com/bitnami", Version: "17.3.11"},
+		Images: []types.Image{{Name: "busybox", Source: "busybox:latest"}},
+	},
+}
+
+func init() {
+	newUUID = func() string { return "00000000-0000-0000-0000-000000000000" }
+	timestamp = func() string { return "2025-01-01T00:00:00Z" }
+}
+
+func TestImagePURL(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected string
+	}{
+		{ref: "busybox:1.36", expected: "pkg:oci/busybox?repository_url=docker.io/library/busybox&tag=1.36"},
+		{ref: "quay.io/minio/MinIO@" + lokiDigest, expected: "pkg:oci/minio@sha256%3A" + lokiDigest[7:] + "?repository_url=quay.io/minio/MinIO"},
+		{ref: "localhost:5000/app:1.0@" + lokiDigest, expected: "pkg:oci/app@sha256%3A" + lokiDigest[7:] + "?repository_url=localhost%3A5000/app&tag=1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			ref, err := imageref.Parse(tt.ref)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, imagePURL(ref))
+		})
+	}
+}
+
+func TestEncode_CycloneDX(t *testing.T) {
+	data, err := Encode(FormatCycloneDXJSON, "loki-5.5.2", testSBOMs[:1])
+	require.NoError(t, err)
+
+	var doc cdxDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, "CycloneDX", doc.BOMFormat)
+	assert.Equal(t, "1.5", doc.SpecVersion)
+	assert.Equal(t, "urn:uuid:00000000-0000-0000-0000-000000000000", doc.SerialNumber)
+	assert.Equal(t, cdxComponent{
+		Type: "application", BOMRef: "chart:loki@5.5.2", Name: "loki", Version: "5.5.2",
+		ExternalReferences: []cdxExternalReference{{Type: "distribution", URL: "https://grafana.github.io/helm-charts"}},
+	}, doc.Metadata.Component)
+
+	lokiPURL := "pkg:oci/loki@sha256%3A" + lokiDigest[7:] + "?repository_url=docker.io/grafana/loki&tag=2.8.2"
+	busyboxPURL := "pkg:oci/busybox?repository_url=docker.io/library/busybox&tag=latest"
+	require.Len(t, doc.Components, 5)
+	assert.Equal(t, cdxComponent{
+		Type: "container", BOMRef: lokiPURL, Name: "docker.io/grafana/loki", Version: "2.8.2", PURL: lokiPURL,
+		Hashes: []cdxHash{{Algorithm: "SHA-256", Content: lokiDigest[7:]}},
+		Properties: []cdxProperty{
+			{Name: "mirrorctl:discovered_by", Value: "scan"},
+			{Name: "mirrorctl:discovered_by", Value: "render:defaults"},
+		},
+	}, doc.Components[4])
+
+	assert.Equal(t, []cdxDependency{
+		{Ref: "chart:loki@5.5.2", DependsOn: []string{"chart:minio@4.0.12", "chart:grafana-agent-operator@0.2.15", busyboxPURL, lokiPURL}},
+		{Ref: "chart:minio@4.0.12", DependsOn: []string{}},
+		{Ref: "chart:grafana-agent-operator@0.2.15", DependsOn: []string{"chart:crds@0.0.0"}},
+		{Ref: "chart:crds@0.0.0", DependsOn: []string{}},
+		{Ref: busyboxPURL, DependsOn: []string{}},
+		{Ref: lokiPURL, DependsOn: []string{}},
+	}, doc.Dependencies)
+}
+
+func TestEncode_CycloneDXCombined(t *testing.T) {
+	data, err := Encode(FormatCycloneDXJSON, "helm-charts", testSBOMs)
+	require.NoError(t, err)
+
+	var doc cdxDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, "charts:helm-charts", doc.Metadata.Component.BOMRef)
+	// The busybox image of both charts is listed once
+	assert.Len(t, doc.Components, 7)
+	assert.Equal(t, cdxDependency{Ref: "charts:helm-charts", DependsOn: []string{"chart:loki@5.5.2", "chart:redis@17.3.11"}}, doc.Dependencies[0])
+	assert.Equal(t, cdxDependency{Ref: "chart:redis@17.3.11", DependsOn: []string{"pkg:oci/busybox?repository_url=docker.io/library/busybox&tag=latest"}}, doc.Dependencies[len(doc.Dependencies)-1])
+}
+
+func TestEncode_SPDX(t *testing.T) {
+	data, err := Encode(FormatSPDXJSON, "helm-charts", testSBOMs)
+	require.NoError(t, err)
+
+	var doc spdxDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	assert.Equal(t, "https://spdx.org/spdxdocs/helm-charts-00000000-0000-0000-0000-000000000000", doc.DocumentNamespace)
+	require.Len(t, doc.Packages, 7)
+
+	lokiImage := doc.Packages[5]
+	assert.Equal(t, "docker.io/grafana/loki", lokiImage.Name)
+	assert.Equal(t, "CONTAINER", lokiImage.PrimaryPackagePurpose)
+	assert.Equal(t, []spdxChecksum{{Algorithm: "SHA256", Value: lokiDigest[7:]}}, lokiImage.Checksums)
+	assert.Equal(t, "purl", lokiImage.ExternalRefs[0].Type)
+	assert.Regexp(t, `^SPDXRef-Image-loki-[0-9a-f]{12}$`, lokiImage.SPDXID)
+
+	relationships := make(map[spdxRelationship]bool)
+	for _, r := range doc.Relationships {
+		relationships[r] = true
+	}
+	assert.Len(t, doc.Relationships, 8)
+	assert.True(t, relationships[spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Chart-loki-5.5.2"}])
+	assert.True(t, relationships[spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Chart-redis-17.3.11"}])
+	assert.True(t, relationships[spdxRelationship{"SPDXRef-Chart-grafana-agent-operator-0.2.15", "DEPENDS_ON", "SPDXRef-Chart-crds-0.0.0"}])
+	assert.True(t, relationships[spdxRelationship{"SPDXRef-Chart-loki-5.5.2", "DEPENDS_ON", lokiImage.SPDXID}])
+}
+
+func TestWriteFilePerChart(t *testing.T) {
+	outputDir := t.TempDir()
+	require.NoError(t, WriteFilePerChart(testSBOMs, CombinedName("/tmp/helm-charts.yaml"), outputDir, FormatSPDXJSON))
+
+	files, err := filepath.Glob(filepath.Join(outputDir, "*"))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(outputDir, "sbom-loki-5.5.2.spdx.json"),
+		filepath.Join(outputDir, "sbom-redis-17.3.11.spdx.json"),
+		filepath.Join(outputDir, "sbom-helm-charts.spdx.json"),
+	}, files)
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "sbom-redis-17.3.11.spdx.json"))
+	require.NoError(t, err)
+	var doc spdxDocument
+	require.NoError(t, json.Unmarshal(data, &doc))
+	assert.Equal(t, "redis-17.3.11", doc.Name)
+	assert.Len(t, doc.Packages, 2)
+
+	assert.Error(t, WriteFilePerChart(testSBOMs, "helm-charts", outputDir, FormatNative))
+	assert.Error(t, ValidateFormat("cyclonedx-xml"))
+}
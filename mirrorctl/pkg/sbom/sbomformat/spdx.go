@@ -0,0 +1,139 @@
+package sbomformat
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/version"
+	"github.com/opencontainers/go-digest"
+)
+
+// spdxVersion is the version of the SPDX specification of the documents.
+const spdxVersion = "SPDX-2.3"
+
+// spdxNamespacePrefix is the prefix of the unique namespace of the documents.
+const spdxNamespacePrefix = "https://spdx.org/spdxdocs/"
+
+// spdxNoAssertion is the value of the fields whose value is unknown.
+const spdxNoAssertion = "NOASSERTION"
+
+// spdxChecksumAlgorithms are the SPDX names of the digest algorithms.
+var spdxChecksumAlgorithms = map[digest.Algorithm]string{
+	digest.SHA256: "SHA256",
+	digest.SHA384: "SHA384",
+	digest.SHA512: "SHA512",
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+	Comment               string            `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	Category string `json:"referenceCategory"`
+	Type     string `json:"referenceType"`
+	Locator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	Element        string `json:"spdxElementId"`
+	Type           string `json:"relationshipType"`
+	RelatedElement string `json:"relatedSpdxElement"`
+}
+
+// encodeSPDX encodes the graph of an SBOM as an SPDX JSON document named name.
+// The document describes the root chart of the graph, or each chart when the root is a collection of charts,
+// which has no package of its own.
+func encodeSPDX(name string, g *graph) ([]byte, error) {
+	doc := spdxDocument{
+		SPDXVersion:       spdxVersion,
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: spdxNamespacePrefix + spdxIDInvalidChars.ReplaceAllString(name, "-") + "-" + newUUID(),
+		CreationInfo: spdxCreationInfo{
+			Created:  timestamp(),
+			Creators: []string{"Tool: " + version.AppName + "-" + version.Version},
+		},
+		Packages:      make([]spdxPackage, 0, len(g.components)),
+		Relationships: []spdxRelationship{},
+	}
+
+	for _, c := range g.components {
+		doc.Packages = append(doc.Packages, spdxPackageOf(c))
+	}
+	if g.root.kind == kindCharts {
+		for _, ref := range g.dependsOn[g.root.ref] {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{doc.SPDXID, "DESCRIBES", spdxID(g.index[ref])})
+		}
+	} else {
+		doc.Packages = append([]spdxPackage{spdxPackageOf(g.root)}, doc.Packages...)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{doc.SPDXID, "DESCRIBES", spdxID(g.root)})
+	}
+	for _, c := range append([]*component{g.root}, g.components...) {
+		if c.kind == kindCharts {
+			continue
+		}
+		for _, ref := range g.dependsOn[c.ref] {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{spdxID(c), "DEPENDS_ON", spdxID(g.index[ref])})
+		}
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// spdxPackageOf returns the SPDX package of a chart or an image.
+func spdxPackageOf(c *component) spdxPackage {
+	pkg := spdxPackage{
+		Name:                  c.name,
+		SPDXID:                spdxID(c),
+		VersionInfo:           c.version,
+		DownloadLocation:      spdxNoAssertion,
+		PrimaryPackagePurpose: "APPLICATION",
+	}
+	if c.kind != kindImage {
+		if c.source != "" {
+			pkg.DownloadLocation = c.source
+		}
+		return pkg
+	}
+
+	pkg.PrimaryPackagePurpose = "CONTAINER"
+	if c.parsed {
+		pkg.ExternalRefs = []spdxExternalRef{{Category: "PACKAGE-MANAGER", Type: "purl", Locator: c.ref}}
+		if alg, ok := spdxChecksumAlgorithms[digestAlgorithm(c)]; ok {
+			pkg.Checksums = []spdxChecksum{{Algorithm: alg, Value: c.image.Digest.Encoded()}}
+		}
+	}
+	if len(c.discoveredBy) > 0 {
+		pkg.Comment = "Discovered by " + strings.Join(c.discoveredBy, ", ")
+	}
+	return pkg
+}
@@ -0,0 +1,248 @@
+// Package signature verifies the cosign signatures of container images offline, with public keys.
+// Signatures are found with the cosign tag scheme (sha256-<digest>.sig) and the OCI referrers API.
+// No transparency log nor certificate is involved: a signature is valid if one of the keys signed its payload
+// and the payload names the digest of the image.
+// Notation signatures are not verified: an image signed only with Notation is reported with ErrUnsupportedSignature.
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const (
+	// ArtifactType is the artifact type of the cosign signatures attached with the referrers API.
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// PayloadMediaType is the media type of the layers holding the signed payload.
+	PayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// SignatureAnnotation is the annotation of a payload layer holding its base64 signature.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// NotationArtifactType is the artifact type of the Notation signatures attached with the referrers API.
+	NotationArtifactType = "application/vnd.cncf.notary.signature"
+)
+
+// ErrNoSignature is returned when an image has no cosign signature.
+var ErrNoSignature = errors.New("no signature found")
+
+// ErrUnsupportedSignature is returned when an image has no cosign signature but is signed with Notation, whose
+// signatures are not verified.
+var ErrUnsupportedSignature = errors.New("signed with Notation only, Notation signatures are not verified")
+
+// Payload is the simple signing payload signed by cosign.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// NewPayload returns the payload that cosign signs for an image reference and its digest.
+func NewPayload(reference string, dgst digest.Digest) ([]byte, error) {
+	var p Payload
+	p.Critical.Identity.DockerReference = reference
+	p.Critical.Image.DockerManifestDigest = dgst.String()
+	p.Critical.Type = "cosign container image signature"
+	return json.Marshal(p)
+}
+
+// LoadPublicKeys reads PEM public keys, such as the cosign.pub files generated by `cosign generate-key-pair`.
+// It returns an error if a file cannot be read or holds no supported public key.
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+		key, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ParsePublicKey parses a PEM encoded ECDSA, RSA or Ed25519 public key.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// Verifier checks the signatures of images against a set of public keys.
+type Verifier struct {
+	keys []crypto.PublicKey
+}
+
+// NewVerifier creates a verifier that accepts the signatures made by any of the keys.
+func NewVerifier(keys []crypto.PublicKey) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// Verify checks that an image has a valid signature made by one of the keys of the verifier.
+// It takes the repository of the image and the descriptor of its manifest or index as input.
+// It returns ErrNoSignature if the image has no signature, ErrUnsupportedSignature if it only has Notation
+// signatures, and an error if no signature is valid or the signatures cannot be read.
+func (v *Verifier) Verify(ctx context.Context, repo *remote.Repository, subject v1.Descriptor) error {
+	if len(v.keys) == 0 {
+		return fmt.Errorf("no public keys configured to verify signatures")
+	}
+
+	manifests, err := signatureManifests(ctx, repo, subject)
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		notation, err := hasReferrers(ctx, repo, subject, NotationArtifactType)
+		if err != nil {
+			return err
+		}
+		if notation {
+			return fmt.Errorf("%w for %s", ErrUnsupportedSignature, subject.Digest)
+		}
+		return fmt.Errorf("%w for %s", ErrNoSignature, subject.Digest)
+	}
+
+	var reasons []error
+	for _, desc := range manifests {
+		err := v.verifyManifest(ctx, repo, desc, subject.Digest)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err)
+	}
+	return fmt.Errorf("no valid signature for %s: %w", subject.Digest, errors.Join(reasons...))
+}
+
+// signatureManifests returns the manifests of the signatures of an image, attached with the cosign tag scheme
+// or the referrers API.
+func signatureManifests(ctx context.Context, repo *remote.Repository, subject v1.Descriptor) ([]v1.Descriptor, error) {
+	var manifests []v1.Descriptor
+	tag := fmt.Sprintf("%s-%s.sig", subject.Digest.Algorithm(), subject.Digest.Encoded())
+	desc, err := repo.Resolve(ctx, tag)
+	if err == nil {
+		manifests = append(manifests, desc)
+	} else if !errors.Is(err, errdef.ErrNotFound) {
+		return nil, fmt.Errorf("failed to resolve %s: %w", tag, err)
+	}
+
+	err = repo.Referrers(ctx, subject, ArtifactType, func(referrers []v1.Descriptor) error {
+		manifests = append(manifests, referrers...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the signatures of %s: %w", subject.Digest, err)
+	}
+	return manifests, nil
+}
+
+// hasReferrers returns true if an image has referrers of an artifact type, e.g. Notation signatures.
+func hasReferrers(ctx context.Context, repo *remote.Repository, subject v1.Descriptor, artifactType string) (bool, error) {
+	found := false
+	err := repo.Referrers(ctx, subject, artifactType, func(referrers []v1.Descriptor) error {
+		found = found || len(referrers) > 0
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list the referrers of %s: %w", subject.Digest, err)
+	}
+	return found, nil
+}
+
+// verifyManifest checks the payload layers of a signature manifest, and returns nil if one of them is valid.
+func (v *Verifier) verifyManifest(ctx context.Context, repo *remote.Repository, desc v1.Descriptor, dgst digest.Digest) error {
+	manifestJSON, err := content.FetchAll(ctx, repo, desc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature %s: %w", desc.Digest, err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return fmt.Errorf("failed to parse signature %s: %w", desc.Digest, err)
+	}
+
+	err = fmt.Errorf("signature %s has no signed payload", desc.Digest)
+	for _, layer := range manifest.Layers {
+		sig, ok := layer.Annotations[SignatureAnnotation]
+		if layer.MediaType != PayloadMediaType || !ok {
+			continue
+		}
+		payload, fetchErr := content.FetchAll(ctx, repo, layer)
+		if fetchErr != nil {
+			return fmt.Errorf("failed to fetch signature payload %s: %w", layer.Digest, fetchErr)
+		}
+		if err = v.verifyPayload(payload, sig, dgst); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyPayload checks that a payload names the digest of the image and that its base64 signature
+// was made by one of the keys of the verifier.
+func (v *Verifier) verifyPayload(payload []byte, sig string, dgst digest.Digest) error {
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("invalid signature payload: %w", err)
+	}
+	if p.Critical.Image.DockerManifestDigest != dgst.String() {
+		return fmt.Errorf("signature payload is for %s", p.Critical.Image.DockerManifestDigest)
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("invalid base64 signature: %w", err)
+	}
+
+	hash := sha256.Sum256(payload)
+	for _, key := range v.keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, hash[:], rawSig) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], rawSig) == nil {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, rawSig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("signature not made by any of the configured keys")
+}
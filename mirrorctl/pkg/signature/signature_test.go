@@ -0,0 +1,177 @@
+package signature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// sign returns the cosign payload of an image digest and its base64 ECDSA signature.
+func sign(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest) ([]byte, string) {
+	t.Helper()
+	payload, err := NewPayload("example.com/app", dgst)
+	require.NoError(t, err)
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+	return payload, base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestLoadPublicKeys(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	var paths []string
+	for i, key := range []crypto.PublicKey{&ecKey.PublicKey, edKey} {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		require.NoError(t, err)
+		path := filepath.Join(dir, []string{"ec.pub", "ed.pub"}[i])
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+		paths = append(paths, path)
+	}
+
+	keys, err := LoadPublicKeys(paths)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	invalid := filepath.Join(dir, "invalid.pub")
+	require.NoError(t, os.WriteFile(invalid, []byte("not a key"), 0o600))
+	_, err = LoadPublicKeys([]string{invalid})
+	assert.Error(t, err)
+	_, err = LoadPublicKeys([]string{filepath.Join(dir, "missing.pub")})
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		push    func(t *testing.T, s *registrytest.Server, name string) digest.Digest
+		wantErr error
+	}{
+		{
+			name: "cosign tag",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				desc := s.PushImage(t, name, "1.0", []byte("layer"))
+				payload, sig := sign(t, key, desc.Digest)
+				s.PushSignature(t, name, desc, payload, sig, false)
+				return desc.Digest
+			},
+		},
+		{
+			name: "referrer",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				desc := s.PushImage(t, name, "1.0", []byte("layer"))
+				payload, sig := sign(t, key, desc.Digest)
+				s.PushSignature(t, name, desc, payload, sig, true)
+				return desc.Digest
+			},
+		},
+		{
+			name: "one valid signature out of two",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				desc := s.PushImage(t, name, "1.0", []byte("layer"))
+				payload, sig := sign(t, otherKey, desc.Digest)
+				s.PushSignature(t, name, desc, payload, sig, false)
+				payload, sig = sign(t, key, desc.Digest)
+				s.PushSignature(t, name, desc, payload, sig, true)
+				return desc.Digest
+			},
+		},
+		{
+			name: "unsigned",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				return s.PushImage(t, name, "1.0", []byte("layer")).Digest
+			},
+			wantErr: ErrNoSignature,
+		},
+		{
+			name: "notation only",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				desc := s.PushImage(t, name, "1.0", []byte("layer"))
+				s.PushArtifact(t, name, "", &desc, NotationArtifactType, []byte("notation signature envelope"))
+				return desc.Digest
+			},
+			wantErr: ErrUnsupportedSignature,
+		},
+		{
+			name: "signed by another key",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				desc := s.PushImage(t, name, "1.0", []byte("layer"))
+				payload, sig := sign(t, otherKey, desc.Digest)
+				s.PushSignature(t, name, desc, payload, sig, false)
+				return desc.Digest
+			},
+			wantErr: assert.AnError,
+		},
+		{
+			name: "signature of another image",
+			push: func(t *testing.T, s *registrytest.Server, name string) digest.Digest {
+				desc := s.PushImage(t, name, "1.0", []byte("layer"))
+				payload, sig := sign(t, key, digest.FromString("tampered"))
+				s.PushSignature(t, name, desc, payload, sig, false)
+				return desc.Digest
+			},
+			wantErr: assert.AnError,
+		},
+	}
+
+	verifier := NewVerifier([]crypto.PublicKey{&key.PublicKey})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := registrytest.New(t)
+			dgst := tt.push(t, s, "library/app")
+
+			repo, err := remote.NewRepository(s.Host + "/library/app")
+			require.NoError(t, err)
+			repo.PlainHTTP = true
+			desc, err := repo.Resolve(context.Background(), "1.0")
+			require.NoError(t, err)
+			require.Equal(t, dgst, desc.Digest)
+
+			err = verifier.Verify(context.Background(), repo, desc)
+			switch tt.wantErr {
+			case nil:
+				assert.NoError(t, err)
+			case assert.AnError:
+				assert.Error(t, err)
+				assert.NotErrorIs(t, err, ErrNoSignature)
+			default:
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerify_NoKeys(t *testing.T) {
+	s := registrytest.New(t)
+	desc := s.PushImage(t, "library/app", "1.0", []byte("layer"))
+	repo, err := remote.NewRepository(s.Host + "/library/app")
+	require.NoError(t, err)
+	repo.PlainHTTP = true
+
+	assert.ErrorContains(t, NewVerifier(nil).Verify(context.Background(), repo, desc), "no public keys")
+}
@@ -78,7 +78,7 @@ func TestTransformedChartImagesMatchMirroredImages(t *testing.T) {
 
 	var mirroredImagePaths []string
 	for _, img := range imagesPushed {
-		mirroredImagePaths = append(mirroredImagePaths, img)
+		mirroredImagePaths = append(mirroredImagePaths, img.Target)
 	}
 	sort.Strings(mirroredImagePaths)
 
@@ -0,0 +1,142 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RateLimitError is returned for a request that a registry rejected with 429 Too Many Requests.
+type RateLimitError struct {
+	Host       string
+	RetryAfter time.Duration // The wait asked for by the registry in the Retry-After header, 0 if it did not send one.
+	Exhausted  bool          // True if the registry reported a remaining quota of 0 (Docker Hub ratelimit-remaining header).
+}
+
+func (e *RateLimitError) Error() string {
+	msg := fmt.Sprintf("rate limited by %s", e.Host)
+	if e.Exhausted {
+		msg += ", quota exhausted"
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+	return msg
+}
+
+// lowRemainingQuota is the remaining quota under which a warning is logged.
+const lowRemainingQuota = 10
+
+// rateLimitTransport holds back the requests to a host that asked to wait with Retry-After,
+// and turns 429 responses into a RateLimitError so callers can decide whether to retry.
+type rateLimitTransport struct {
+	next http.RoundTripper
+
+	mu        sync.Mutex
+	notBefore map[string]time.Time // Hosts that asked to wait, and until when.
+	remaining map[string]int       // Last ratelimit-remaining reported by each host.
+}
+
+func newRateLimitTransport(next http.RoundTripper) *rateLimitTransport {
+	return &rateLimitTransport{
+		next:      next,
+		notBefore: make(map[string]time.Time),
+		remaining: make(map[string]int),
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.wait(req, host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, hasRemaining := parseRateLimitRemaining(resp.Header.Get("ratelimit-remaining"))
+	if hasRemaining {
+		t.mu.Lock()
+		t.remaining[host] = remaining
+		t.mu.Unlock()
+		if remaining < lowRemainingQuota {
+			log.Warn().Str("host", host).Int("remaining", remaining).Msg("Registry rate limit almost exhausted")
+		}
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	t.mu.Lock()
+	if retryAfter > 0 {
+		t.notBefore[host] = time.Now().Add(retryAfter)
+	}
+	exhausted := hasRemaining && remaining == 0
+	if !hasRemaining {
+		r, known := t.remaining[host]
+		exhausted = known && r == 0
+	}
+	t.mu.Unlock()
+
+	log.Warn().Str("host", host).Dur("retry_after", retryAfter).Bool("exhausted", exhausted).Msg("Rate limited by registry")
+	return nil, &RateLimitError{Host: host, RetryAfter: retryAfter, Exhausted: exhausted}
+}
+
+// wait blocks until the host accepts requests again, or the request is cancelled.
+func (t *rateLimitTransport) wait(req *http.Request, host string) error {
+	t.mu.Lock()
+	until := t.notBefore[host]
+	t.mu.Unlock()
+
+	delay := time.Until(until)
+	if delay <= 0 {
+		return nil
+	}
+	log.Debug().Str("host", host).Dur("delay", delay).Msg("Waiting for the registry rate limit")
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or as an HTTP date.
+// It returns 0 if the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// parseRateLimitRemaining parses a Docker Hub ratelimit-remaining header such as `76;w=21600`.
+// It returns false if the header is missing or invalid.
+func parseRateLimitRemaining(value string) (int, bool) {
+	value, _, _ = strings.Cut(value, ";")
+	remaining, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, false
+	}
+	return remaining, true
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+}
+
+func TestParseRateLimitRemaining(t *testing.T) {
+	remaining, ok := parseRateLimitRemaining("76;w=21600")
+	assert.True(t, ok)
+	assert.Equal(t, 76, remaining)
+	_, ok = parseRateLimitRemaining("")
+	assert.False(t, ok)
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ratelimit-remaining", "0;w=21600")
+		if requests == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newRateLimitTransport(http.DefaultTransport)}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	_, err = client.Get(server.URL)
+	var rateLimitErr *RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr))
+	assert.True(t, rateLimitErr.Exhausted)
+	assert.Zero(t, rateLimitErr.RetryAfter)
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+)
+
+// NewClient creates the HTTP client used to talk to registries.
+// Each registry host gets the TLS settings (insecure, CA bundle) configured for it in the targets or registries sections.
+// Requests to a host that answered 429 with a Retry-After header wait until the registry accepts requests again,
+// and 429 responses are returned as a RateLimitError.
+func NewClient(cfg *config.Config) *http.Client {
+	return &http.Client{
+		Transport: newRateLimitTransport(&hostTransport{
+			cfg:        cfg,
+			transports: make(map[string]http.RoundTripper),
+		}),
+	}
+}
+
+// hostTransport dispatches each request to a transport built for the TLS settings of its host.
+type hostTransport struct {
+	cfg *config.Config
+
+	mu         sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt, err := t.transportFor(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	return rt.RoundTrip(req)
+}
+
+// transportFor returns the transport for a host, creating it on first use.
+func (t *hostTransport) transportFor(host string) (http.RoundTripper, error) {
+	host = imageref.NormalizeHost(host)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rt, ok := t.transports[host]; ok {
+		return rt, nil
+	}
+
+	var settings config.TransportConfig
+	if t.cfg != nil {
+		settings = t.cfg.TransportFor(host)
+	}
+	rt, err := newTransport(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up transport for %s: %w", host, err)
+	}
+	t.transports[host] = rt
+	return rt, nil
+}
+
+// newTransport creates a transport with the TLS settings of a registry.
+// Registries without TLS settings share the default transport.
+func newTransport(settings config.TransportConfig) (http.RoundTripper, error) {
+	if !settings.Insecure && settings.CAFile == "" {
+		return http.DefaultTransport, nil
+	}
+	tlsConfig, err := newTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	return tr, nil
+}
+
+// newTLSConfig builds the TLS configuration for the connection settings of a registry.
+// It returns an error if the CA bundle cannot be read or contains no certificate.
+func newTLSConfig(settings config.TransportConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: settings.Insecure,
+	}
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
@@ -1,11 +1,29 @@
 package types
 
 // Image represents a container image with its name and source.
-// The source is the full image reference, including the registry, repository, and tag.
+// The source is the full image reference, including the registry, repository, and tag or digest (repo@sha256:<hex>).
+// With Tags, the source is a repository without tag, and the tags mirrored are the ones of the repository selected by the filter.
 // The name is the short name of the image.
 type Image struct {
-	Name   string `yaml:"name" json:"name"`
-	Source string `yaml:"source" json:"source"`
+	Name         string     `yaml:"name" json:"name"`
+	Source       string     `yaml:"source" json:"source"`
+	Platforms    []string   `yaml:"platforms,omitempty" json:"platforms,omitempty"`         // Platforms to mirror, e.g. linux/amd64. Overrides options.platforms.
+	Verification string     `yaml:"verification,omitempty" json:"verification,omitempty"`   // Signature verification policy: require, warn or skip. Overrides the one of the registry.
+	DiscoveredBy []string   `yaml:"discovered_by,omitempty" json:"discovered_by,omitempty"` // How the image was found in a chart, e.g. scan or render:defaults.
+	Tags         *TagFilter `yaml:"tags,omitempty" json:"tags,omitempty"`                   // The rules selecting the tags of the repository to mirror.
+}
+
+// TagFilter selects tags of an image repository. All the rules set must match:
+// Include and Exclude are regular expressions matched against the whole tag, Semver is a semver constraint
+// such as `>=3.18 <4`, Newest keeps the newest tags by semver, and Since keeps the tags of images created
+// on or after a date, `2025-01-01` or RFC 3339.
+// Tags that are not semver versions are left out when Semver or Newest is set.
+type TagFilter struct {
+	Include string `yaml:"include,omitempty" json:"include,omitempty"`
+	Exclude string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	Semver  string `yaml:"semver,omitempty" json:"semver,omitempty"`
+	Newest  int    `yaml:"newest,omitempty" json:"newest,omitempty"`
+	Since   string `yaml:"since,omitempty" json:"since,omitempty"`
 }
 
 // ImagesList represents a list of container images.
@@ -14,20 +32,62 @@ type ImagesList struct {
 	Images []Image `yaml:"images" json:"images"`
 }
 
+// MirroredImage represents a container image mirrored to the target registry.
+// SourceDigest is the digest the source reference resolved to. Digest, Size and MediaType describe the manifest
+// or index tagged in the target registry, which differs from the source one when only some platforms are mirrored.
+// They are empty in dry-run mode.
+// Platforms are the platforms copied, empty if the image is not multi-platform.
+// Retries is the number of times a registry operation had to be retried.
+// Referrers are the signatures, attestations and SBOMs copied with the image.
+type MirroredImage struct {
+	Source       string     `yaml:"source" json:"source"`
+	Target       string     `yaml:"target" json:"target"`
+	SourceDigest string     `yaml:"source_digest,omitempty" json:"source_digest,omitempty"`
+	Digest       string     `yaml:"digest,omitempty" json:"digest,omitempty"`
+	Size         int64      `yaml:"size,omitempty" json:"size,omitempty"`
+	MediaType    string     `yaml:"media_type,omitempty" json:"media_type,omitempty"`
+	Platforms    []string   `yaml:"platforms,omitempty" json:"platforms,omitempty"`
+	Retries      int        `yaml:"retries,omitempty" json:"retries,omitempty"`
+	Referrers    []Referrer `yaml:"referrers,omitempty" json:"referrers,omitempty"`
+}
+
+// Referrer represents an artifact attached to an image, such as a signature, an attestation or an SBOM.
+// Subject is the digest of the manifest it is attached to.
+// Tag is set for artifacts attached with the cosign tag scheme, e.g. sha256-<digest>.sig.
+type Referrer struct {
+	Subject      string `yaml:"subject" json:"subject"`
+	Digest       string `yaml:"digest" json:"digest"`
+	ArtifactType string `yaml:"artifact_type" json:"artifact_type"`
+	Tag          string `yaml:"tag,omitempty" json:"tag,omitempty"`
+}
+
 // FailedImage wraps a types.Image with an error reason.
 type FailedImage struct {
-	Image Image  `yaml:"image" json:"image"`
-	Error string `yaml:"error" json:"error"`
+	Image   Image  `yaml:"image" json:"image"`
+	Error   string `yaml:"error" json:"error"`
+	Retries int    `yaml:"retries,omitempty" json:"retries,omitempty"`
+}
+
+// ComputedImage is an image reference of a chart template built by template actions, which cannot be rewritten
+// to the target registry when the chart is mirrored. File is the path of the template within the chart.
+type ComputedImage struct {
+	Chart     string `yaml:"chart" json:"chart"`
+	File      string `yaml:"file" json:"file"`
+	Line      int    `yaml:"line" json:"line"`
+	Reference string `yaml:"reference" json:"reference"`
 }
 
 // Chart represents a Helm chart with its name, source, and version.
 // The source is the URL of the Helm repository.
 // The name is the name of the chart in the repository.
-// The version is the version of the chart to be downloaded.
+// The version is the version of the chart to be downloaded, or a semver constraint such as `~5.5` or `>=1.2 <2`
+// resolved against the versions of the chart upstream.
+// Latest, if set, selects the latest newest versions matching the constraint instead of the newest one.
 type Chart struct {
 	Name    string `yaml:"name"`
 	Source  string `yaml:"source"`
 	Version string `yaml:"version"`
+	Latest  int    `yaml:"latest,omitempty"`
 }
 
 // ChartsList represents a list of Helm charts.
@@ -35,3 +95,50 @@ type Chart struct {
 type ChartsList struct {
 	Charts []Chart `yaml:"charts"`
 }
+
+// ChartSBOM lists the container images of a Helm chart and the subcharts packaged with it.
+// The images are the ones of the chart and of all its subcharts.
+type ChartSBOM struct {
+	Chart     Chart      `yaml:"chart" json:"chart"`
+	Subcharts []Subchart `yaml:"subcharts,omitempty" json:"subcharts,omitempty"`
+	Images    []Image    `yaml:"images" json:"images"`
+}
+
+// Subchart is a chart packaged in the charts/ directory of another chart, or of another subchart.
+// Parent is the name and version of the chart it is packaged in, e.g. loki@5.5.2.
+type Subchart struct {
+	Name    string `yaml:"name" json:"name"`
+	Version string `yaml:"version" json:"version"`
+	Parent  string `yaml:"parent" json:"parent"`
+}
+
+// PlanStatus is the change a mirror run would make to an artifact of the target registry.
+type PlanStatus string
+
+const (
+	PlanNew             PlanStatus = "new"              // Not in the target registry yet, it would be mirrored.
+	PlanUpToDate        PlanStatus = "up-to-date"       // In the target registry with the upstream content, it would be skipped.
+	PlanTagMutated      PlanStatus = "tag-mutated"      // The target tag points to a different digest than upstream.
+	PlanMissingUpstream PlanStatus = "missing-upstream" // Not found upstream, mirroring it would fail.
+	PlanError           PlanStatus = "error"            // The source or the target registry could not be inspected.
+)
+
+// PlannedArtifact is an image or a chart, one per concrete tag or version, with the change a mirror run would make to it.
+// Version is the version of a chart, empty for an image. SourceDigest is the digest of the content that would be pushed, and TargetDigest the one the target reference
+// points to, empty if it does not exist. Error explains the missing-upstream and error statuses.
+type PlannedArtifact struct {
+	Kind         string     `yaml:"kind" json:"kind"` // image or chart
+	Name         string     `yaml:"name" json:"name"`
+	Source       string     `yaml:"source" json:"source"`
+	Version      string     `yaml:"version,omitempty" json:"version,omitempty"`
+	Target       string     `yaml:"target,omitempty" json:"target,omitempty"`
+	Status       PlanStatus `yaml:"status" json:"status"`
+	SourceDigest string     `yaml:"source_digest,omitempty" json:"source_digest,omitempty"`
+	TargetDigest string     `yaml:"target_digest,omitempty" json:"target_digest,omitempty"`
+	Error        string     `yaml:"error,omitempty" json:"error,omitempty"`
+}
+
+// Pending returns true if a mirror run would change the artifact in the target registry, or fail to.
+func (a PlannedArtifact) Pending() bool {
+	return a.Status != PlanUpToDate
+}
@@ -0,0 +1,251 @@
+// Package verify audits a target registry against the charts and images files, after the fact: every image tag and
+// chart version expected is looked up in the target registry, and the images referenced by the mirrored charts must
+// be in the mirror too.
+package verify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/charts"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/helm"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/imageref"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/images"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/lockfile"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registryclient"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/retry"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/sbom/chartscanner"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/rs/zerolog/log"
+)
+
+// Kinds of the checks of a report.
+const (
+	KindImage      = "image"       // An image of the images file.
+	KindChart      = "chart"       // A chart version of the charts file.
+	KindChartImage = "chart image" // An image referenced by the values of a mirrored chart.
+)
+
+// Check is the result of checking an artifact of the target registry.
+// Name is the name of the image or chart, `<chart>@<version>` for the images of a chart, and Reference is
+// the reference looked up in the target registry. Reason says why a check failed.
+type Check struct {
+	Kind      string `yaml:"kind" json:"kind"`
+	Name      string `yaml:"name" json:"name"`
+	Reference string `yaml:"reference" json:"reference"`
+	Passed    bool   `yaml:"passed" json:"passed"`
+	Reason    string `yaml:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// Options are the artifacts a target registry is verified against.
+// Images and Charts are the contents of the images and charts files, nil to skip them.
+// Lock, if set, gives the image digests and chart versions expected instead of resolving the entries upstream.
+// Discovery is how the images of the mirrored charts are found.
+type Options struct {
+	Images    *types.ImagesList
+	Charts    *types.ChartsList
+	Lock      *lockfile.Lockfile
+	Discovery config.DiscoveryConfig
+}
+
+// Verify checks that the target registry has every image and chart expected:
+//   - each image tag is in the target registry with the digest of the source, or of the lockfile, with the platforms
+//     selected as `mirror images` pushes them
+//   - each chart version is in the target registry as `<version>-<suffix>`
+//   - each image the values of a mirrored chart reference is in the images repository of the target registry
+//
+// It takes an application context and the options as input.
+// It returns the checks, images first and then each chart followed by its images, and an error if the target registry
+// is not configured or the charts cannot be pulled to a temporary directory.
+func Verify(ctx *appcontext.AppContext, opts Options) ([]Check, error) {
+	var checks []Check
+	if opts.Images != nil {
+		imageChecks, err := verifyImages(ctx, *opts.Images, opts.Lock)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, imageChecks...)
+	}
+	if opts.Charts != nil {
+		chartChecks, err := verifyCharts(ctx, *opts.Charts, opts.Lock, opts.Discovery)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, chartChecks...)
+	}
+	return checks, nil
+}
+
+// verifyImages checks the images of the images file, or the images of the lockfile pinned to their locked digest.
+func verifyImages(ctx *appcontext.AppContext, imagesList types.ImagesList, lock *lockfile.Lockfile) ([]Check, error) {
+	var checks []Check
+	expected := imagesList
+	if lock != nil {
+		expected = types.ImagesList{}
+		for _, entry := range imagesList.Images {
+			locked, err := lock.LockedImages(entry)
+			if err != nil {
+				checks = append(checks, Check{Kind: KindImage, Name: entry.Name, Reference: entry.Source, Reason: err.Error()})
+				continue
+			}
+			for _, img := range locked {
+				pinned := entry
+				pinned.Source, pinned.Tags = img.Source, nil
+				if img.Digest != "" && !strings.Contains(img.Source, "@") {
+					pinned.Source += "@" + img.Digest
+				}
+				expected.Images = append(expected.Images, pinned)
+			}
+		}
+	}
+
+	planned, err := images.PlanImages(ctx, expected)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range planned {
+		check := Check{Kind: KindImage, Name: p.Name, Reference: p.Target, Passed: p.Status == types.PlanUpToDate}
+		if check.Reference == "" {
+			check.Reference = p.Source
+		}
+		switch p.Status {
+		case types.PlanNew:
+			check.Reason = "not in the target registry"
+		case types.PlanTagMutated:
+			check.Reason = fmt.Sprintf("digest %s, expected %s", p.TargetDigest, p.SourceDigest)
+		case types.PlanMissingUpstream:
+			check.Reason = "source not found upstream, it cannot be compared: " + p.Error
+		case types.PlanError:
+			check.Reason = p.Error
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// verifyCharts checks the chart versions resolved from the charts file, or the ones of the lockfile, and the images
+// referenced by each chart found in the target registry.
+func verifyCharts(ctx *appcontext.AppContext, chartsList types.ChartsList, lock *lockfile.Lockfile, discovery config.DiscoveryConfig) ([]Check, error) {
+	target, err := ctx.Config.ActiveTarget()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := charts.TargetReference(ctx, types.Chart{}); err != nil {
+		return nil, err
+	}
+	tmpDir, err := helm.CreateTempDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer helm.RemoveTempDir(ctx, tmpDir)
+
+	var checks []Check
+	var expected []types.Chart
+	for _, entry := range chartsList.Charts {
+		var versions []string
+		if lock != nil {
+			var locked []lockfile.Chart
+			locked, err = lock.LockedCharts(entry)
+			for _, c := range locked {
+				versions = append(versions, c.Version)
+			}
+		} else {
+			versions, _, err = helm.ResolveChartVersions(ctx, entry)
+		}
+		if err != nil {
+			checks = append(checks, Check{Kind: KindChart, Name: entry.Name, Reference: entry.Source + " " + entry.Version, Reason: err.Error()})
+			continue
+		}
+		expected = append(expected, charts.ResolvedChart{Entry: entry, Versions: versions}.Charts()...)
+	}
+
+	policy := retry.NewPolicy(ctx.Config.Options.Retry)
+	imageChecks := make(map[string]Check)
+	for _, ch := range expected {
+		repoRef, tag, _ := charts.TargetReference(ctx, ch)
+		check := Check{Kind: KindChart, Name: ch.Name, Reference: repoRef + ":" + tag}
+		repo, err := registryclient.NewRepository(ctx, repoRef)
+		if err == nil {
+			_, err = policy.Do(context.Background(), "resolve "+check.Reference, func() error {
+				_, err := repo.Resolve(context.Background(), tag)
+				return err
+			})
+		}
+		switch {
+		case registryclient.IsNotFound(err):
+			check.Reason = "not in the target registry"
+		case err != nil:
+			check.Reason = err.Error()
+		default:
+			check.Passed = true
+		}
+		checks = append(checks, check)
+		if !check.Passed {
+			continue
+		}
+
+		// The mirrored chart is pulled to check the images its values reference
+		chartDir, err := os.MkdirTemp(tmpDir, ch.Name+"-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		mirrored := types.Chart{Name: ch.Name, Source: "oci://" + path.Dir(repoRef), Version: tag}
+		chartPath, _, err := helm.PullChart(ctx, mirrored, chartDir)
+		if err == nil {
+			var chartImages []types.Image
+			chartImages, err = chartscanner.DiscoverImages(chartPath, discovery)
+			for _, img := range chartImages {
+				imgCheck, ok := imageChecks[img.Source]
+				if !ok {
+					imgCheck = verifyChartImage(ctx, target.ImagesRepository, img.Source)
+					imageChecks[img.Source] = imgCheck
+				}
+				imgCheck.Name = ch.Name + "@" + ch.Version
+				checks = append(checks, imgCheck)
+			}
+		}
+		if err != nil {
+			log.Error().Err(err).Str("chart", check.Reference).Msg("Failed to list the images of the mirrored chart")
+			checks = append(checks, Check{Kind: KindChartImage, Name: ch.Name + "@" + ch.Version, Reference: check.Reference, Reason: err.Error()})
+		}
+	}
+	return checks, nil
+}
+
+// verifyChartImage checks that an image referenced by a mirrored chart is in the images repository of the target
+// registry.
+func verifyChartImage(ctx *appcontext.AppContext, imagesRepository, source string) Check {
+	check := Check{Kind: KindChartImage, Reference: source}
+	ref, err := imageref.Parse(source)
+	if err != nil {
+		check.Reason = err.Error()
+		return check
+	}
+	if !strings.HasPrefix(ref.Name()+"/", mirrorPrefix(imagesRepository)) {
+		check.Reason = "not in the images repository of the target registry"
+		return check
+	}
+	if _, err := images.ResolveDigest(ctx, source); registryclient.IsNotFound(err) {
+		check.Reason = "not in the target registry"
+	} else if err != nil {
+		check.Reason = err.Error()
+	} else {
+		check.Passed = true
+	}
+	return check
+}
+
+// mirrorPrefix returns the prefix of the image references of an images repository, with a normalized registry host
+// and a trailing slash, e.g. `registry.example.com/mirror/`.
+func mirrorPrefix(imagesRepository string) string {
+	repository := strings.Trim(imagesRepository, "/")
+	if host, rest, found := strings.Cut(repository, "/"); found {
+		return imageref.NormalizeHost(host) + "/" + rest + "/"
+	}
+	return imageref.NormalizeHost(repository) + "/"
+}
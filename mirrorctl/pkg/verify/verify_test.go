@@ -0,0 +1,194 @@
+package verify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/appcontext"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/charts"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/config"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/images"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/lockfile"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/registrytest"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/sbom/chartscanner"
+	"github.com/jose-oc/mirror-artifacts/mirrorctl/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// packageChart writes a chart with a values.yaml to a directory and packages it.
+// It returns the content of the chart archive.
+func packageChart(t *testing.T, name, version, values string) []byte {
+	t.Helper()
+
+	chartDir := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.MkdirAll(chartDir, 0755))
+	chartYAML := "apiVersion: v2\nname: " + name + "\nversion: " + version + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte(chartYAML), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(chartDir, "values.yaml"), []byte(values), 0600))
+
+	chrt, err := loader.LoadDir(chartDir)
+	require.NoError(t, err)
+	archivePath, err := chartutil.Save(chrt, t.TempDir())
+	require.NoError(t, err)
+	archive, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	return archive
+}
+
+func TestVerify(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	busybox := source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+	source.PushImage(t, "library/alpine", "3.22", []byte("alpine layer"))
+
+	// busybox was mirrored, alpine was not
+	target.PushImage(t, "mirror/images/busybox", "1.36", []byte("busybox layer"))
+	// The mirrored chart references an image of the mirror, one missing from it and one outside of it
+	target.PushChart(t, "mirror/charts/app", "app", "1.0.0-mirrored", packageChart(t, "app", "1.0.0-mirrored", `
+busybox:
+  image: `+target.Host+`/mirror/images/busybox:1.36
+nginx:
+  image: `+target.Host+`/mirror/images/nginx:1.25
+redis:
+  image: docker.io/library/redis:7.2
+`))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ImagesRepository: target.Host + "/mirror/images",
+				ChartsRepository: target.Host + "/mirror/charts",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+	imagesList := &types.ImagesList{Images: []types.Image{
+		{Name: "busybox", Source: source.Host + "/library/busybox:1.36"},
+		{Name: "alpine", Source: source.Host + "/library/alpine:3.22"},
+	}}
+	chartsList := &types.ChartsList{Charts: []types.Chart{
+		{Name: "app", Source: "oci://" + source.Host + "/charts", Version: "1.0.0"},
+		{Name: "missing", Source: "oci://" + source.Host + "/charts", Version: "2.0.0"},
+	}}
+
+	t.Run("upstream", func(t *testing.T) {
+		checks, err := Verify(appCtx, Options{Images: imagesList, Charts: chartsList})
+		require.NoError(t, err)
+
+		expected := []Check{
+			{Kind: KindImage, Name: "busybox", Reference: target.Host + "/mirror/images/busybox:1.36", Passed: true},
+			{Kind: KindImage, Name: "alpine", Reference: target.Host + "/mirror/images/alpine:3.22", Reason: "not in the target registry"},
+			{Kind: KindChart, Name: "app", Reference: target.Host + "/mirror/charts/app:1.0.0-mirrored", Passed: true},
+			{Kind: KindChartImage, Name: "app@1.0.0", Reference: target.Host + "/mirror/images/busybox:1.36", Passed: true},
+			{Kind: KindChartImage, Name: "app@1.0.0", Reference: target.Host + "/mirror/images/nginx:1.25", Reason: "not in the target registry"},
+			{Kind: KindChartImage, Name: "app@1.0.0", Reference: "docker.io/library/redis:7.2", Reason: "not in the images repository of the target registry"},
+			{Kind: KindChart, Name: "missing", Reference: target.Host + "/mirror/charts/missing:2.0.0-mirrored", Reason: "not in the target registry"},
+		}
+		assert.Equal(t, expected, checks)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		lock := &lockfile.Lockfile{
+			Images: []lockfile.Image{{Name: "busybox", Source: source.Host + "/library/busybox:1.36", Digest: busybox.Digest.String()}},
+			Charts: []lockfile.Chart{{Name: "app", Source: "oci://" + source.Host + "/charts", Version: "1.0.0"}},
+		}
+		checks, err := Verify(appCtx, Options{Images: imagesList, Charts: &types.ChartsList{Charts: chartsList.Charts[:1]}, Lock: lock})
+		require.NoError(t, err)
+		require.Len(t, checks, 6)
+
+		// alpine has no entry in the lockfile, it is reported before the images looked up in the target registry
+		assert.Equal(t, "alpine", checks[0].Name)
+		assert.False(t, checks[0].Passed)
+		assert.Contains(t, checks[0].Reason, lockfile.ErrNotLocked.Error())
+		assert.Equal(t, Check{Kind: KindImage, Name: "busybox", Reference: target.Host + "/mirror/images/busybox:1.36", Passed: true}, checks[1])
+		assert.Equal(t, Check{Kind: KindChart, Name: "app", Reference: target.Host + "/mirror/charts/app:1.0.0-mirrored", Passed: true}, checks[2])
+	})
+}
+
+func TestVerify_AfterMirror(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushImage(t, "bitnami/redis", "7.2", []byte("redis layer"))
+	source.PushImage(t, "library/busybox", "1.36", []byte("busybox layer"))
+	// The images of the chart are in org-qualified repositories, written as a mapping and as a single reference
+	source.PushChart(t, "charts/app", "app", "1.0.0", packageChart(t, "app", "1.0.0", `
+redis:
+  image:
+    registry: `+source.Host+`
+    repository: bitnami/redis
+    tag: "7.2"
+busybox:
+  image: `+source.Host+`/library/busybox:1.36
+`))
+	chartsFile := filepath.Join(t.TempDir(), "charts.yaml")
+	require.NoError(t, os.WriteFile(chartsFile, []byte(`
+charts:
+  - name: app
+    source: oci://`+source.Host+`/charts
+    version: 1.0.0
+`), 0600))
+
+	appCtx := &appcontext.AppContext{
+		Config: &config.Config{
+			Targets: []config.TargetConfig{{
+				Name:             "local",
+				ImagesRepository: target.Host + "/mirror/images",
+				ChartsRepository: target.Host + "/mirror/charts",
+				TransportConfig:  config.TransportConfig{PlainHTTP: true},
+			}},
+			Registries: []config.RegistryConfig{{Host: source.Host, TransportConfig: config.TransportConfig{PlainHTTP: true}}},
+			Options:    config.OptionsConfig{Suffix: "mirrored", DefaultCredentials: "none"},
+		},
+	}
+
+	// The chart and its images are mirrored as `mirror charts` does
+	imagesMirrorer, err := images.NewMirrorer(appCtx)
+	require.NoError(t, err)
+	opts := charts.MirrorOptions{
+		ScanImages: func(chartPath string) ([]types.Image, error) {
+			return chartscanner.DiscoverImages(chartPath, config.DiscoveryConfig{})
+		},
+		OnImages: func(_ types.Chart, chartImages []types.Image) { imagesMirrorer.Submit(chartImages...) },
+	}
+	successful, failed, err := charts.MirrorHelmCharts(appCtx, chartsFile, opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app:1.0.0"}, successful)
+	require.Empty(t, failed)
+	_, imagesFailed := imagesMirrorer.Wait()
+	require.Empty(t, imagesFailed)
+
+	checks, err := Verify(appCtx, Options{Charts: &types.ChartsList{Charts: []types.Chart{
+		{Name: "app", Source: "oci://" + source.Host + "/charts", Version: "1.0.0"},
+	}}})
+	require.NoError(t, err)
+	expected := []Check{
+		{Kind: KindChart, Name: "app", Reference: target.Host + "/mirror/charts/app:1.0.0-mirrored", Passed: true},
+		{Kind: KindChartImage, Name: "app@1.0.0", Reference: target.Host + "/mirror/images/redis:7.2", Passed: true},
+		{Kind: KindChartImage, Name: "app@1.0.0", Reference: target.Host + "/mirror/images/busybox:1.36", Passed: true},
+	}
+	assert.ElementsMatch(t, expected, checks)
+}
+
+func TestMirrorPrefix(t *testing.T) {
+	tests := []struct {
+		repository string
+		expected   string
+	}{
+		{repository: "registry.example.com/mirror/images/", expected: "registry.example.com/mirror/images/"},
+		{repository: "localhost:5000/mirror", expected: "localhost:5000/mirror/"},
+		{repository: "index.docker.io/acme", expected: "docker.io/acme/"},
+		{repository: "registry.example.com", expected: "registry.example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repository, func(t *testing.T) {
+			assert.Equal(t, tt.expected, mirrorPrefix(tt.repository))
+		})
+	}
+}